@@ -49,6 +49,7 @@ func handleGetServerConfig(c echo.Context) error {
 	sort.Strings(names)
 	out.Messengers = append(out.Messengers, emailMsgr)
 	out.Messengers = append(out.Messengers, names...)
+	out.Messengers = append(out.Messengers, app.manager.MessengerGroupNames()...)
 
 	app.Lock()
 	out.NeedsRestart = app.needsRestart
@@ -0,0 +1,506 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/knadh/listmonk/internal/manager"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	"github.com/lib/pq"
+)
+
+const (
+	// Interval at which due automation steps are processed.
+	automationInterval = time.Second * 10
+
+	// Number of subscribers whose due steps are processed in one go.
+	automationBatchSize = 1000
+
+	// Duration for which subscribers fetched for processing are claimed so
+	// that other nodes don't process them. If a step's message can't be queued,
+	// it's retried after this.
+	automationClaimDuration = time.Minute * 5
+)
+
+type automationsWrap struct {
+	Results []models.Automation `json:"results"`
+
+	Total   int `json:"total"`
+	PerPage int `json:"per_page"`
+	Page    int `json:"page"`
+}
+
+// automationSub is a subscriber in an automation whose next step is due.
+type automationSub struct {
+	StateID      int64     `db:"state_id"`
+	AutomationID int       `db:"automation_id"`
+	Step         int       `db:"step"`
+	EnteredAt    time.Time `db:"entered_at"`
+
+	models.Subscriber
+}
+
+// handleGetAutomations handles retrieval of automations. A single automation
+// is returned with its steps and their stats.
+func handleGetAutomations(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		pg  = getPagination(c.QueryParams(), 20)
+		out automationsWrap
+
+		id, _  = strconv.Atoi(c.Param("id"))
+		single = false
+	)
+
+	// Fetch one automation.
+	if id > 0 {
+		single = true
+	}
+
+	if err := app.queries.QueryAutomations.Select(&out.Results, id, pg.Offset, pg.Limit); err != nil {
+		app.log.Printf("error fetching automations: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.automations}", "error", pqErrMsg(err)))
+	}
+	if single && len(out.Results) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.automation}"))
+	}
+	if len(out.Results) == 0 {
+		out.Results = []models.Automation{}
+		return c.JSON(http.StatusOK, okResp{out})
+	}
+
+	if single {
+		a := out.Results[0]
+		steps, err := getAutomationSteps(a.ID, true, app)
+		if err != nil {
+			app.log.Printf("error fetching automation steps: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("globals.messages.errorFetching",
+					"name", "{globals.terms.automation}", "error", pqErrMsg(err)))
+		}
+		a.Steps = steps
+
+		return c.JSON(http.StatusOK, okResp{a})
+	}
+
+	// Meta.
+	out.Total = out.Results[0].Total
+	out.Page = pg.Page
+	out.PerPage = pg.PerPage
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// handleCreateAutomation handles automation creation.
+func handleCreateAutomation(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		o   models.Automation
+	)
+
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+
+	if err := validateAutomation(&o, app); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	uu, err := uuid.NewV4()
+	if err != nil {
+		app.log.Printf("error generating UUID: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUUID", "error", err.Error()))
+	}
+
+	var newID int
+	if err := app.queries.CreateAutomation.Get(&newID, uu, o.Name, o.Trigger, o.ListID.Int,
+		o.Attribute, o.Messenger, o.FromEmail, o.Enabled); err != nil {
+		app.log.Printf("error creating automation: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorCreating",
+				"name", "{globals.terms.automation}", "error", pqErrMsg(err)))
+	}
+
+	if err := upsertAutomationSteps(newID, o.Steps, app); err != nil {
+		app.log.Printf("error creating automation steps: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorCreating",
+				"name", "{globals.terms.automation}", "error", pqErrMsg(err)))
+	}
+
+	return handleGetAutomations(copyEchoCtx(c, map[string]string{
+		"id": strconv.Itoa(newID),
+	}))
+}
+
+// handleUpdateAutomation handles automation modification. Steps without
+// IDs are added and existing steps that are not in the request are deleted.
+func handleUpdateAutomation(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		o     models.Automation
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if err := c.Bind(&o); err != nil {
+		return err
+	}
+
+	if err := validateAutomation(&o, app); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	res, err := app.queries.UpdateAutomation.Exec(id, o.Name, o.Trigger, o.ListID.Int,
+		o.Attribute, o.Messenger, o.FromEmail, o.Enabled)
+	if err != nil {
+		app.log.Printf("error updating automation: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{globals.terms.automation}", "error", pqErrMsg(err)))
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.automation}"))
+	}
+
+	if err := upsertAutomationSteps(id, o.Steps, app); err != nil {
+		app.log.Printf("error updating automation steps: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{globals.terms.automation}", "error", pqErrMsg(err)))
+	}
+
+	return handleGetAutomations(c)
+}
+
+// handleDeleteAutomation handles automation deletion.
+func handleDeleteAutomation(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if _, err := app.queries.DeleteAutomation.Exec(id); err != nil {
+		app.log.Printf("error deleting automation: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorDeleting",
+				"name", "{globals.terms.automation}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// validateAutomation validates automation fields and fills in the defaults.
+func validateAutomation(o *models.Automation, app *App) error {
+	if !strHasLen(o.Name, 1, stdInputMaxLen) {
+		return errors.New(app.i18n.T("campaigns.fieldInvalidName"))
+	}
+
+	switch o.Trigger {
+	case models.AutomationTriggerSubscriberInsert,
+		models.AutomationTriggerOptinConfirm,
+		models.AutomationTriggerListAdd,
+		models.AutomationTriggerAttributeChange:
+	default:
+		return errors.New(app.i18n.T("automations.fieldInvalidTrigger"))
+	}
+
+	if o.ListID.Valid && o.ListID.Int < 1 {
+		return errors.New(app.i18n.T("globals.messages.invalidID"))
+	}
+	o.Attribute = strings.TrimSpace(o.Attribute)
+	if o.Trigger != models.AutomationTriggerAttributeChange {
+		o.Attribute = ""
+	}
+
+	if o.Messenger == "" {
+		o.Messenger = emailMsgr
+	}
+	if !app.manager.HasMessenger(o.Messenger) {
+		return errors.New(app.i18n.Ts("campaigns.fieldInvalidMessenger", "name", o.Messenger))
+	}
+
+	if len(o.Steps) == 0 {
+		return errors.New(app.i18n.T("automations.fieldInvalidSteps"))
+	}
+	for i, s := range o.Steps {
+		if !strHasLen(s.Subject, 1, stdInputMaxLen) {
+			return errors.New(app.i18n.T("campaigns.fieldInvalidSubject"))
+		}
+		if s.TemplateID < 0 {
+			return errors.New(app.i18n.T("tx.fieldInvalidTemplate"))
+		}
+
+		if s.Delay == "" {
+			s.Delay = "0s"
+		}
+		if d, err := time.ParseDuration(s.Delay); err != nil || d < 0 {
+			return errors.New(app.i18n.Ts("automations.fieldInvalidDelay", "delay", s.Delay))
+		}
+
+		switch s.Condition {
+		case "":
+			s.Condition = models.AutomationConditionNone
+		case models.AutomationConditionNone,
+			models.AutomationConditionNotOpened,
+			models.AutomationConditionNotClicked:
+		default:
+			return errors.New(app.i18n.T("automations.fieldInvalidCondition"))
+		}
+
+		if s.ContentType == "" {
+			s.ContentType = models.CampaignContentTypeRichtext
+		}
+		o.Steps[i] = s
+	}
+
+	return nil
+}
+
+// getAutomationSteps fetches the steps of an automation, optionally with
+// their stats.
+func getAutomationSteps(id int, withStats bool, app *App) ([]models.AutomationStep, error) {
+	var steps []models.AutomationStep
+	if err := app.queries.GetAutomationSteps.Select(&steps, id); err != nil {
+		return nil, err
+	}
+	if !withStats || len(steps) == 0 {
+		return steps, nil
+	}
+
+	var stats []models.AutomationStep
+	if err := app.queries.GetAutomationStepStats.Select(&stats, id); err != nil {
+		return nil, err
+	}
+	for i, s := range steps {
+		for _, st := range stats {
+			if st.ID == s.ID {
+				steps[i].Queued = st.Queued
+				steps[i].Sent = st.Sent
+				steps[i].Failed = st.Failed
+				steps[i].Skipped = st.Skipped
+				steps[i].Waiting = st.Waiting
+				break
+			}
+		}
+	}
+	return steps, nil
+}
+
+// upsertAutomationSteps replaces the steps of an automation.
+func upsertAutomationSteps(id int, steps []models.AutomationStep, app *App) error {
+	var (
+		ids        = make(pq.Int64Array, 0, len(steps))
+		tplIDs     = make(pq.Int64Array, 0, len(steps))
+		subjects   = make(pq.StringArray, 0, len(steps))
+		bodies     = make(pq.StringArray, 0, len(steps))
+		types      = make(pq.StringArray, 0, len(steps))
+		delays     = make(pq.StringArray, 0, len(steps))
+		conditions = make(pq.StringArray, 0, len(steps))
+	)
+	for _, s := range steps {
+		ids = append(ids, int64(s.ID))
+		tplIDs = append(tplIDs, int64(s.TemplateID))
+		subjects = append(subjects, s.Subject)
+		bodies = append(bodies, s.Body)
+		types = append(types, s.ContentType)
+		delays = append(delays, s.Delay)
+		conditions = append(conditions, s.Condition)
+	}
+
+	_, err := app.queries.UpsertAutomationSteps.Exec(id, ids, tplIDs, subjects, bodies, types, delays, conditions)
+	return err
+}
+
+// runAutomations is a blocking function that periodically exits subscribers
+// who no longer qualify for automations and sends the due steps of the rest.
+func runAutomations(app *App) {
+	t := time.NewTicker(automationInterval)
+	defer t.Stop()
+
+	for range t.C {
+		if _, err := app.queries.ExitAutomationSubscribers.Exec(); err != nil {
+			app.log.Printf("error exiting automation subscribers: %v", err)
+		}
+
+		for {
+			n, err := processAutomations(app)
+			if err != nil {
+				app.log.Printf("error processing automations: %v", err)
+				break
+			}
+			if n < automationBatchSize {
+				break
+			}
+		}
+	}
+}
+
+// processAutomations claims the next batch of subscribers whose automation
+// steps are due and sends them. It returns the number of subscribers claimed.
+func processAutomations(app *App) (int, error) {
+	var subs []automationSub
+	if err := app.queries.NextAutomationSubscribers.Select(&subs,
+		automationBatchSize, automationClaimDuration.Seconds()); err != nil {
+		return 0, err
+	}
+
+	// Automations and their compiled steps are cached for the batch.
+	var (
+		autos = make(map[int]*models.Automation)
+		msgs  = make(map[int]*models.TxMessage)
+	)
+	for _, s := range subs {
+		a, ok := autos[s.AutomationID]
+		if !ok {
+			var out []models.Automation
+			if err := app.queries.QueryAutomations.Select(&out, s.AutomationID, 0, 0); err != nil {
+				return 0, err
+			}
+			if len(out) == 0 {
+				continue
+			}
+			steps, err := getAutomationSteps(s.AutomationID, false, app)
+			if err != nil {
+				return 0, err
+			}
+			a = &out[0]
+			a.Steps = steps
+			autos[s.AutomationID] = a
+		}
+
+		if s.Step >= len(a.Steps) {
+			updateAutomationSub(s, s.Step, time.Now(), models.AutomationSubStatusCompleted, app)
+			continue
+		}
+		step := a.Steps[s.Step]
+
+		// The step isn't due yet, which happens when its delay is changed
+		// after the subscriber has been scheduled for it.
+		if due := s.EnteredAt.Add(stepDelay(step)); due.After(time.Now()) {
+			updateAutomationSub(s, s.Step, due, models.AutomationSubStatusActive, app)
+			continue
+		}
+
+		m, ok := msgs[step.ID]
+		if !ok {
+			m = &models.TxMessage{
+				TemplateID:  step.TemplateID,
+				Subject:     step.Subject,
+				Body:        step.Body,
+				ContentType: step.ContentType,
+				FromEmail:   a.FromEmail,
+				Messenger:   a.Messenger,
+			}
+			if m.FromEmail == "" {
+				m.FromEmail = app.constants.FromEmail
+			}
+			if err := m.Compile(step.TemplateBody, app.manager.GenericTemplateFuncs()); err != nil {
+				app.log.Printf("error compiling automation step (%s #%d): %v", a.Name, step.Position, err)
+				m = nil
+			}
+			msgs[step.ID] = m
+		}
+
+		if err := sendAutomationStep(a, step, m, s, app); err != nil {
+			// Leave the subscriber at the step so that it's retried once the claim expires.
+			app.log.Printf("error sending automation step (%s #%d) (%s): %v", a.Name, step.Position, s.Email, err)
+			continue
+		}
+
+		// Schedule the next step.
+		next := s.Step + 1
+		if next >= len(a.Steps) {
+			updateAutomationSub(s, next, time.Now(), models.AutomationSubStatusCompleted, app)
+		} else {
+			updateAutomationSub(s, next, s.EnteredAt.Add(stepDelay(a.Steps[next])), models.AutomationSubStatusActive, app)
+		}
+	}
+
+	return len(subs), nil
+}
+
+// sendAutomationStep renders and queues the message of an automation step for
+// a subscriber, or records it as skipped if the step's condition doesn't hold.
+// m is the step's compiled message, nil if it couldn't be compiled. Messages
+// that can't be rendered are recorded as failed and not retried. An error is
+// returned only if the message couldn't be recorded or queued.
+func sendAutomationStep(a *models.Automation, step models.AutomationStep, m *models.TxMessage, s automationSub, app *App) error {
+	var msg models.TxMessage
+	if m != nil {
+		msg = *m
+	} else {
+		msg = models.TxMessage{TemplateID: step.TemplateID, Messenger: a.Messenger}
+	}
+	msg.Subscriber = s.Subscriber
+
+	if !automationCondition(step.Condition, s) {
+		_, err := insertTxMessage(msg, step.Subject, step.ID, manager.DeliveryStatusSkipped, app)
+		return err
+	}
+
+	if m == nil {
+		_, err := insertTxMessage(msg, step.Subject, step.ID, manager.DeliveryStatusFailed, app)
+		return err
+	}
+
+	subject, body, err := msg.Render()
+	if err != nil {
+		id, err2 := insertTxMessage(msg, step.Subject, step.ID, manager.DeliveryStatusFailed, app)
+		if err2 != nil {
+			return err2
+		}
+		markTxMessageFailed(id, err, app)
+		return nil
+	}
+
+	id, err := insertTxMessage(msg, subject, step.ID, manager.DeliveryStatusQueued, app)
+	if err != nil {
+		return err
+	}
+	return pushTxMessage(id, msg, subject, body, app)
+}
+
+// automationCondition tells whether the condition of a step holds for a
+// subscriber, that is, they haven't opened or clicked any message since
+// entering the automation.
+func automationCondition(cond string, s automationSub) bool {
+	switch cond {
+	case models.AutomationConditionNotOpened:
+		return !(s.LastEmailOpen.Valid && s.LastEmailOpen.Time.After(s.EnteredAt))
+	case models.AutomationConditionNotClicked:
+		return !(s.LastEmailClicked.Valid && s.LastEmailClicked.Time.After(s.EnteredAt))
+	}
+	return true
+}
+
+// stepDelay returns the delay of an automation step. The delay is validated
+// when the step is saved.
+func stepDelay(s models.AutomationStep) time.Duration {
+	d, _ := time.ParseDuration(s.Delay)
+	return d
+}
+
+// updateAutomationSub updates the progress of a subscriber in an automation.
+func updateAutomationSub(s automationSub, step int, nextAt time.Time, status string, app *App) {
+	if _, err := app.queries.UpdateAutomationSubscriber.Exec(s.StateID, step, nextAt, status); err != nil {
+		app.log.Printf("error updating automation subscriber (%s): %v", s.Email, err)
+	}
+}
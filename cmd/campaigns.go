@@ -18,6 +18,8 @@ import (
 	"time"
 
 	"github.com/gofrs/uuid"
+	"github.com/knadh/listmonk/internal/manager"
+	"github.com/knadh/listmonk/internal/media"
 	"github.com/knadh/listmonk/internal/subimporter"
 	"github.com/knadh/listmonk/models"
 	"github.com/labstack/echo"
@@ -39,6 +41,14 @@ type campaignReq struct {
 	// to the outside world.
 	ListIDs pq.Int64Array `db:"-" json:"lists"`
 
+	// Similarly, this overrides Campaign.ExcludeLists. On updation,
+	// existing exclusion lists are retained if it's not sent.
+	ExcludeListIDs pq.Int64Array `db:"-" json:"exclude_lists"`
+
+	// Similarly, this overrides Campaign.Media with the IDs of the media
+	// to attach. On updation, existing attachments are retained if it's not sent.
+	MediaIDs pq.Int64Array `db:"-" json:"media"`
+
 	// This is only relevant to campaign test requests.
 	SubscriberEmails pq.StringArray `json:"subscribers"`
 
@@ -56,11 +66,21 @@ type campaignContentReq struct {
 type campaignStats struct {
 	ID        int       `db:"id" json:"id"`
 	Status    string    `db:"status" json:"status"`
+	Messenger string    `db:"messenger" json:"messenger"`
 	ToSend    int       `db:"to_send" json:"to_send"`
 	Sent      int       `db:"sent" json:"sent"`
 	Started   null.Time `db:"started_at" json:"started_at"`
 	UpdatedAt null.Time `db:"updated_at" json:"updated_at"`
 	Rate      float64   `json:"rate"`
+
+	// Subscribers skipped for having crossed a frequency cap.
+	Skipped int `db:"skipped" json:"skipped"`
+
+	// Configured rate limit and the current send rate of the campaign's messenger.
+	RateLimit manager.RateStats `json:"rate_limit"`
+
+	// Health of the members if the campaign targets a messenger group.
+	Messengers []manager.MemberHealth `json:"messengers"`
 }
 
 type campsWrap struct {
@@ -139,6 +159,8 @@ func handleGetCampaigns(c echo.Context) error {
 		if noBody {
 			out.Results[i].Body = ""
 		}
+
+		out.Results[i].Variants = []models.CampaignVariant{}
 	}
 
 	// Lazy load stats.
@@ -156,6 +178,14 @@ func handleGetCampaigns(c echo.Context) error {
 	}
 
 	if single {
+		// Load the A/B test variants.
+		if err := app.queries.GetCampaignVariants.Select(&out.Results[0].Variants, id); err != nil {
+			app.log.Printf("error fetching campaign variants: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("globals.messages.errorFetching",
+					"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+		}
+
 		return c.JSON(http.StatusOK, okResp{out.Results[0]})
 	}
 
@@ -302,6 +332,16 @@ func handleCreateCampaign(c echo.Context) error {
 		o.Messenger,
 		o.TemplateID,
 		o.ListIDs,
+		o.ABTestPercent,
+		o.ABTestMetric,
+		o.ABTestWindow,
+		o.OptimizeSendTime,
+		o.ExcludeListIDs,
+		o.Recurrence,
+		o.RecurrenceTZ,
+		o.FeedURL,
+		o.MediaIDs,
+		o.LocalSendTime,
 	); err != nil {
 		if err == sql.ErrNoRows {
 			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.noSubs"))
@@ -313,6 +353,13 @@ func handleCreateCampaign(c echo.Context) error {
 				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
 	}
 
+	if err := upsertCampaignVariants(newID, o.Variants, app); err != nil {
+		app.log.Printf("error creating campaign variants: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorCreating",
+				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
 	// Hand over to the GET handler to return the last insertion.
 	return handleGetCampaigns(copyEchoCtx(c, map[string]string{
 		"id": fmt.Sprintf("%d", newID),
@@ -349,6 +396,15 @@ func handleUpdateCampaign(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.cantUpdate"))
 	}
 
+	// Load the existing A/B test variants so that they're retained
+	// if the request doesn't have any.
+	if err := app.queries.GetCampaignVariants.Select(&cm.Variants, id); err != nil {
+		app.log.Printf("error fetching campaign variants: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
 	// Read the incoming params into the existing campaign fields from the DB.
 	// This allows updating of values that have been sent where as fields
 	// that are not in the request retain the old values.
@@ -375,7 +431,17 @@ func handleUpdateCampaign(c echo.Context) error {
 		pq.StringArray(normalizeTags(o.Tags)),
 		o.Messenger,
 		o.TemplateID,
-		o.ListIDs)
+		o.ListIDs,
+		o.ABTestPercent,
+		o.ABTestMetric,
+		o.ABTestWindow,
+		o.OptimizeSendTime,
+		o.ExcludeListIDs,
+		o.Recurrence,
+		o.RecurrenceTZ,
+		o.FeedURL,
+		o.MediaIDs,
+		o.LocalSendTime)
 	if err != nil {
 		app.log.Printf("error updating campaign: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
@@ -383,6 +449,13 @@ func handleUpdateCampaign(c echo.Context) error {
 				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
 	}
 
+	if err := upsertCampaignVariants(cm.ID, o.Variants, app); err != nil {
+		app.log.Printf("error updating campaign variants: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorUpdating",
+				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
 	return handleGetCampaigns(c)
 }
 
@@ -455,6 +528,9 @@ func handleUpdateCampaignStatus(c echo.Context) error {
 		if cm.Status != models.CampaignStatusPaused && cm.Status != models.CampaignStatusDraft {
 			errMsg = app.i18n.T("campaigns.onlyPausedDraft")
 		}
+		if cm.Recurrence != "" {
+			errMsg = app.i18n.T("campaigns.recurringCantStart")
+		}
 	case models.CampaignStatusPaused:
 		if cm.Status != models.CampaignStatusRunning {
 			errMsg = app.i18n.T("campaigns.onlyActivePause")
@@ -566,11 +642,25 @@ func handleGetRunningCampaignStats(c echo.Context) error {
 				out[i].Rate = rate
 			}
 		}
+
+		if r, ok := app.manager.GetRateStats(c.Messenger); ok {
+			out[i].RateLimit = r
+		}
+		if h, ok := app.manager.GetGroupHealth(c.Messenger); ok {
+			out[i].Messengers = h
+		}
 	}
 
 	return c.JSON(http.StatusOK, okResp{out})
 }
 
+// handleGetPipelineStats returns the time spent by the node in fetching
+// subscribers, rendering messages, and pushing them to messengers.
+func handleGetPipelineStats(c echo.Context) error {
+	app := c.Get("app").(*App)
+	return c.JSON(http.StatusOK, okResp{app.manager.GetPipelineStats()})
+}
+
 // handleTestCampaign handles the sending of a campaign message to
 // arbitrary subscribers for testing.
 func handleTestCampaign(c echo.Context) error {
@@ -766,6 +856,15 @@ func validateCampaignFields(c campaignReq, app *App) (campaignReq, error) {
 		return c, errors.New(app.i18n.T("campaigns.fieldInvalidListIDs"))
 	}
 
+	// A list can't be both included and excluded.
+	for _, ex := range c.ExcludeListIDs {
+		for _, id := range c.ListIDs {
+			if ex == id {
+				return c, errors.New(app.i18n.T("campaigns.fieldInvalidExcludeListIDs"))
+			}
+		}
+	}
+
 	if !app.manager.HasMessenger(c.Messenger) {
 		return c, errors.New(app.i18n.Ts("campaigns.fieldInvalidMessenger", "name", c.Messenger))
 	}
@@ -775,9 +874,133 @@ func validateCampaignFields(c campaignReq, app *App) (campaignReq, error) {
 		return c, errors.New(app.i18n.Ts("campaigns.fieldInvalidBody", "error", err.Error()))
 	}
 
+	// A/B test.
+	if c.ABTestMetric == "" {
+		c.ABTestMetric = models.ABTestMetricViews
+	}
+	if c.ABTestWindow == "" {
+		c.ABTestWindow = "4h"
+	}
+	if c.ABTestPercent == 0 {
+		c.Variants = []models.CampaignVariant{}
+	} else if err := validateABTest(c, app); err != nil {
+		return c, err
+	}
+
+	// Local send time.
+	if c.LocalSendTime != "" {
+		if _, err := time.Parse(manager.LocalSendTimeFormat, c.LocalSendTime); err != nil {
+			return c, errors.New(app.i18n.T("campaigns.fieldInvalidLocalSendTime"))
+		}
+		if c.OptimizeSendTime {
+			return c, errors.New(app.i18n.T("campaigns.fieldInvalidOptimizeSendTime"))
+		}
+	}
+
+	if len(c.MediaIDs) > 0 {
+		if err := validateCampaignMedia(c, app); err != nil {
+			return c, err
+		}
+	}
+
+	// Recurring campaigns are scheduled for their next run.
+	if c.Recurrence != "" {
+		if err := validateRecurrence(&c, app); err != nil {
+			return c, err
+		}
+	} else {
+		c.FeedURL = ""
+	}
+
 	return c, nil
 }
 
+// validateABTest validates the A/B test fields and variants of a campaign.
+func validateABTest(c campaignReq, app *App) error {
+	if c.ABTestPercent < 1 || c.ABTestPercent > 99 {
+		return errors.New(app.i18n.T("campaigns.fieldInvalidABTestPercent"))
+	}
+	if len(c.Variants) < 2 {
+		return errors.New(app.i18n.T("campaigns.fieldInvalidVariants"))
+	}
+	if c.ABTestMetric != models.ABTestMetricViews && c.ABTestMetric != models.ABTestMetricClicks {
+		return errors.New(app.i18n.T("campaigns.fieldInvalidABTestMetric"))
+	}
+	if d, err := time.ParseDuration(c.ABTestWindow); err != nil || d < time.Minute {
+		return errors.New(app.i18n.T("campaigns.fieldInvalidABTestWindow"))
+	}
+
+	for _, v := range c.Variants {
+		if !strHasLen(v.Name, 1, stdInputMaxLen) {
+			return errors.New(app.i18n.T("campaigns.fieldInvalidVariantName"))
+		}
+		if len(v.Subject) > stdInputMaxLen {
+			return errors.New(app.i18n.T("campaigns.fieldInvalidSubject"))
+		}
+
+		vc := c.ApplyVariant(v)
+		vc.TemplateBody = tplTag
+		if err := vc.CompileTemplate(app.manager.TemplateFuncs(vc)); err != nil {
+			return errors.New(app.i18n.Ts("campaigns.fieldInvalidBody", "error", err.Error()))
+		}
+	}
+
+	return nil
+}
+
+// validateCampaignMedia validates the media attached to a campaign. All of
+// them should exist and their total size should be within the limit.
+func validateCampaignMedia(c campaignReq, app *App) error {
+	var med []media.Media
+	if err := app.queries.GetMediaByIDs.Select(&med, c.MediaIDs); err != nil {
+		return errors.New(app.i18n.Ts("globals.messages.errorFetching",
+			"name", "{globals.terms.media}", "error", pqErrMsg(err)))
+	}
+	if len(med) != len(c.MediaIDs) {
+		return errors.New(app.i18n.T("campaigns.fieldInvalidMedia"))
+	}
+
+	var (
+		size int
+		max  = app.constants.AttachmentsMaxSize * 1024 * 1024
+	)
+	for _, m := range med {
+		b, err := app.media.GetBlob(m.Filename)
+		if err != nil {
+			app.log.Printf("error reading attachment %s: %v", m.Filename, err)
+			return errors.New(app.i18n.Ts("media.errorReadingFile", "error", err.Error()))
+		}
+		size += len(b)
+	}
+	if max > 0 && size > max {
+		return errors.New(app.i18n.Ts("campaigns.attachmentsTooLarge",
+			"size", strconv.Itoa(app.constants.AttachmentsMaxSize)))
+	}
+
+	return nil
+}
+
+// upsertCampaignVariants replaces the A/B test variants of a campaign.
+func upsertCampaignVariants(campID int, vars []models.CampaignVariant, app *App) error {
+	var (
+		ids      = make(pq.Int64Array, 0, len(vars))
+		names    = make(pq.StringArray, 0, len(vars))
+		subjects = make(pq.StringArray, 0, len(vars))
+		bodies   = make(pq.StringArray, 0, len(vars))
+		tplIDs   = make(pq.Int64Array, 0, len(vars))
+	)
+	for _, v := range vars {
+		ids = append(ids, int64(v.ID))
+		names = append(names, strings.TrimSpace(v.Name))
+		subjects = append(subjects, v.Subject)
+		bodies = append(bodies, v.Body)
+		tplIDs = append(tplIDs, int64(v.TemplateID))
+	}
+
+	_, err := app.queries.UpsertCampaignVariants.Exec(campID, ids, names, subjects, bodies, tplIDs)
+	return err
+}
+
 // isCampaignalMutable tells if a campaign's in a state where it's
 // properties can be mutated.
 func isCampaignalMutable(status string) bool {
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/knadh/listmonk/internal/manager"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+)
+
+// handleDryRunCampaign starts a dry run of a campaign where its messages are
+// rendered for all its subscribers without being sent. The report is fetched
+// with handleGetCampaignDryRun.
+func handleDryRunCampaign(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	var camp models.Campaign
+	if err := app.queries.GetCampaignForPreview.Get(&camp, id); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.campaign}"))
+		}
+
+		app.log.Printf("error fetching campaign: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.campaign}", "error", pqErrMsg(err)))
+	}
+
+	// Every update to the report is written to the DB so that its progress
+	// can be fetched from any node.
+	err := app.manager.DryRun(&camp, func(r manager.DryRunReport) {
+		b, err := json.Marshal(r)
+		if err != nil {
+			app.log.Printf("error encoding dry run report: %v", err)
+			return
+		}
+		if _, err := app.queries.UpsertCampaignDryRun.Exec(id, types.JSONText(b)); err != nil {
+			app.log.Printf("error recording dry run report of campaign %d: %v", id, err)
+		}
+	})
+	if err == manager.ErrDryRunInProgress {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("campaigns.dryRunInProgress"))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// handleGetCampaignDryRun returns the report of the last dry run of a campaign.
+func handleGetCampaignDryRun(c echo.Context) error {
+	var (
+		app   = c.Get("app").(*App)
+		id, _ = strconv.Atoi(c.Param("id"))
+		out   types.JSONText
+	)
+
+	if id < 1 {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
+	}
+
+	if err := app.queries.GetCampaignDryRun.Get(&out, id); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.notFound", "name", "{campaigns.dryRun}"))
+		}
+
+		app.log.Printf("error fetching dry run report: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{campaigns.dryRun}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
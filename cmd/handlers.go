@@ -166,6 +166,12 @@ func registerHTTPHandlers(e *echo.Echo, app *App) {
 		"campUUID", "subUUID")))
 	e.GET("/campaign/:campUUID/:subUUID/px.png", noIndex(validateUUID(handleRegisterCampaignView,
 		"campUUID", "subUUID")))
+
+	// Public web push subscription endpoints used by /public/static/push.js.
+	e.GET("/push/key", handlePushKey)
+	e.POST("/push/subscribe/:subUUID", handlePushSubscribe)
+	e.POST("/push/unsubscribe", handlePushUnsubscribe)
+
 	// Public health API endpoint.
 	e.GET("/health", handleHealthCheck)
 
@@ -44,8 +44,12 @@ import (
 	"github.com/knadh/listmonk/internal/media/providers/s3"
 	"github.com/knadh/listmonk/internal/messenger"
 	aws_email "github.com/knadh/listmonk/internal/messenger/aws-email"
+	"github.com/knadh/listmonk/internal/messenger/dkim"
 	"github.com/knadh/listmonk/internal/messenger/email"
+	"github.com/knadh/listmonk/internal/messenger/emailapi"
 	"github.com/knadh/listmonk/internal/messenger/postback"
+	"github.com/knadh/listmonk/internal/messenger/sms"
+	"github.com/knadh/listmonk/internal/messenger/webpush"
 	"github.com/knadh/listmonk/internal/subimporter"
 	"github.com/knadh/stuffbin"
 	"github.com/labstack/echo"
@@ -90,6 +94,7 @@ type constants struct {
 	SyncBlacklistSchedulerTime string `koanf:"sync_blacklist_scheduler_time"`
 	SmartListFlag              string `koanf:"smart_list_flag"`
 	EmailSentAllowed           int    `koanf:"allowed"`
+	AttachmentsMaxSize         int    `koanf:"attachments_max_size"`
 	StripeKey                  string `koanf:"stripe_key"`
 	Platform                   []PlatformConfig
 	EmailPlan                  []EmailPlanConfig
@@ -114,28 +119,79 @@ type ProvidersConfig struct {
 }
 
 type ProductProviders struct {
-	Name       string            `json:"name"`
-	Connection []EmailConnection `json:"connection"`
+	Name       string               `json:"name"`
+	Connection []ProviderConnection `json:"connection"`
 }
 
+// ProviderConnection is a connection of a provider's product as it's stored
+// in the settings. It has the fields of the connections of all the messenger
+// kinds so that none of them are lost when the settings are saved. The
+// messengers are loaded from their own connection types.
+type ProviderConnection struct {
+	EmailConnection `json:",squash"`
+	SMSOptions      `json:",squash"`
+	PushOptions     `json:",squash"`
+}
+
+// Connection has the fields that are common to the connections of all
+// the messenger kinds.
+type Connection struct {
+	UUID          string         `json:"uuid" map:"uuid"`
+	Enabled       bool           `json:"enabled" map:"enabled"`
+	Host          string         `json:"host" map:"host"`
+	Username      string         `json:"username" map:"username"`
+	Password      string         `json:"password,omitempty" map:"password"`
+	MaxConns      int            `json:"max_conns" map:"max_conns"`
+	MaxMsgRetries int            `json:"max_msg_retries" map:"max_msg_retries"`
+	WaitTimeout   string         `json:"wait_timeout" map:"wait_timeout"`
+	Tag           string         `json:"tag" map:"tag"`
+	Details       []EmailDetails `json:"details" map:"details"`
+}
+
+// EmailConnection is an SMTP, SES or e-mail API connection.
 type EmailConnection struct {
-	UUID          string              `json:"uuid" map:"uuid"`
-	Enabled       bool                `json:"enabled" map:"enabled"`
-	Host          string              `json:"host" map:"host"`
+	Connection `json:",squash"`
+
 	HelloHostname string              `json:"hello_hostname" map:"hello_hostname"`
 	Port          int                 `json:"port" map:"port"`
 	AuthProtocol  string              `json:"auth_protocol" map:"auth_protocol"`
-	Username      string              `json:"username" map:"username"`
-	Password      string              `json:"password,omitempty" map:"password"`
 	EmailHeaders  []map[string]string `json:"email_headers" map:"email_headers"`
-	MaxConns      int                 `json:"max_conns" map:"max_conns"`
-	MaxMsgRetries int                 `json:"max_msg_retries" map:"max_msg_retries"`
 	IdleTimeout   string              `json:"idle_timeout" map:"idle_timeout"`
-	WaitTimeout   string              `json:"wait_timeout" map:"wait_timeout"`
 	TLSEnabled    bool                `json:"tls_enabled" map:"tls_enabled"`
 	TLSSkipVerify bool                `json:"tls_skip_verify" map:"tls_skip_verify"`
-	Tag           string              `json:"tag" map:"tag"`
-	Details       []EmailDetails      `json:"details" map:"details"`
+	DKIM          dkim.Options        `json:"dkim" map:"dkim"`
+
+	// Batching of messages for the e-mail API providers that support it.
+	BatchSize int    `json:"batch_size" map:"batch_size"`
+	BatchWait string `json:"batch_wait" map:"batch_wait"`
+}
+
+// SMSConnection is a Twilio or HTTP SMS API connection.
+type SMSConnection struct {
+	Connection `json:",squash"`
+	SMSOptions `json:",squash"`
+}
+
+// SMSOptions are the sender, the subscriber attribute with the phone number,
+// and the max number of segments of a message.
+type SMSOptions struct {
+	From           string `json:"from" map:"from"`
+	PhoneAttribute string `json:"phone_attribute" map:"phone_attribute"`
+	MaxSegments    int    `json:"max_segments" map:"max_segments"`
+}
+
+// PushConnection is a web push (VAPID) connection.
+type PushConnection struct {
+	Connection  `json:",squash"`
+	PushOptions `json:",squash"`
+}
+
+// PushOptions are the web push notification defaults and the time for which
+// push services retain the notifications of offline browsers.
+type PushOptions struct {
+	Icon string `json:"icon" map:"icon"`
+	URL  string `json:"url" map:"url"`
+	TTL  string `json:"ttl" map:"ttl"`
 }
 
 type EmailDetails struct {
@@ -163,6 +219,7 @@ func initFlags() {
 	f.Bool("upgrade", false, "upgrade database to the current version")
 	f.Bool("version", false, "current version of the build")
 	f.Bool("new-config", false, "generate sample config file")
+	f.Bool("new-vapid-key", false, "generate and store a VAPID key for the web push connections that don't have one")
 	f.String("static-dir", "", "(optional) path to directory with static files")
 	f.String("i18n-dir", "", "(optional) path to directory with i18n language files")
 	f.Bool("yes", false, "assume 'yes' to prompts, eg: during --install")
@@ -388,11 +445,79 @@ func initCampaignManager(q *Queries, cs *constants, app *App) *manager.Manager {
 		lo.Fatal("app.message_rate should be at least 1")
 	}
 
+	// Unique ID of this instance for leasing campaign subscribers when
+	// multiple instances process campaigns.
+	nodeID := ko.String("app.node_id")
+	if nodeID == "" {
+		host, _ := os.Hostname()
+		nodeID = fmt.Sprintf("%s-%d", host, os.Getpid())
+	}
+
+	// Per-messenger rate limit overrides.
+	var rates []messengerRate
+	for _, item := range ko.Slices("app.messenger_rates") {
+		var r messengerRate
+		if err := item.UnmarshalWithConf("", &r, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+			lo.Fatalf("error reading messenger rate config: %v", err)
+		}
+		rates = append(rates, r)
+	}
+
+	// Frequency caps.
+	var caps []frequencyCap
+	for _, item := range ko.Slices("app.frequency_caps") {
+		var c frequencyCap
+		if err := item.UnmarshalWithConf("", &c, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+			lo.Fatalf("error reading frequency cap config: %v", err)
+		}
+		caps = append(caps, c)
+	}
+
+	// Recipient domain throttles.
+	var throttles []domainThrottle
+	for _, item := range ko.Slices("app.domain_throttles") {
+		var t domainThrottle
+		if err := item.UnmarshalWithConf("", &t, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+			lo.Fatalf("error reading domain throttle config: %v", err)
+		}
+		throttles = append(throttles, t)
+	}
+
+	// Warm-up plans of messengers.
+	var warmups []warmup
+	for _, item := range ko.Slices("app.warmups") {
+		var w warmup
+		if err := item.UnmarshalWithConf("", &w, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+			lo.Fatalf("error reading warm-up config: %v", err)
+		}
+		warmups = append(warmups, w)
+	}
+
+	// Retry backoff durations per error class.
+	backoff := make(map[string]time.Duration)
+	for _, k := range ko.MapKeys("app.retry_backoff") {
+		backoff[k] = ko.Duration("app.retry_backoff." + k)
+	}
+
 	return manager.New(manager.Config{
 		BatchSize:             ko.Int("app.batch_size"),
+		NodeID:                nodeID,
+		LeaseDuration:         ko.Duration("app.lease_duration"),
 		Concurrency:           ko.Int("app.concurrency"),
+		RenderConcurrency:     ko.Int("app.render_concurrency"),
 		MessageRate:           ko.Int("app.message_rate"),
+		MessageBurst:          ko.Int("app.message_burst"),
+		MessengerRates:        makeMessengerRates(rates),
 		MaxSendErrors:         ko.Int("app.max_send_errors"),
+		MaxErrorRate:          ko.Float64("app.max_error_rate"),
+		ErrorRateWindow:       ko.Int("app.error_rate_window"),
+		ErrorRatePerClass:     ko.Bool("app.error_rate_per_class"),
+		RequeueOnError:        ko.Bool("app.requeue_on_error"),
+		MaxAttempts:           ko.Int("app.max_attempts"),
+		RetryBackoff:          backoff,
+		FrequencyCaps:         makeFrequencyCaps(caps),
+		DomainThrottles:       makeDomainThrottles(throttles),
+		Warmups:               makeWarmups(warmups),
 		FromEmail:             cs.FromEmail,
 		IndividualTracking:    ko.Bool("privacy.individual_tracking"),
 		UnsubURL:              cs.UnsubURL,
@@ -404,7 +529,7 @@ func initCampaignManager(q *Queries, cs *constants, app *App) *manager.Manager {
 		SlidingWindow:         ko.Bool("app.message_sliding_window"),
 		SlidingWindowDuration: ko.Duration("app.message_sliding_window_duration"),
 		SlidingWindowRate:     ko.Int("app.message_sliding_window_rate"),
-	}, newManagerDB(q, lo), campNotifCB, app.i18n, lo)
+	}, newManagerDB(q, app.media, lo), campNotifCB, app.i18n, lo)
 
 }
 
@@ -421,30 +546,101 @@ func initProviders(app *App) {
 		case "email_api":
 			for _, product := range item.Slices("product") {
 				productName := product.String("name")
+
+				req := []EmailConnection{}
+				for _, con := range product.Slices("connection") {
+					emailCon := EmailConnection{}
+					if err := con.UnmarshalWithConf("", &emailCon, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+						lo.Fatalf("error reading %s config: %v", productName, err)
+					}
+					req = append(req, emailCon)
+				}
+
+				name := fmt.Sprintf("%v_%v", messengerName, productName)
 				switch productName {
 				case "AWS":
-					req := []EmailConnection{}
-					for _, con := range product.Slices("connection") {
-						emailCon := EmailConnection{}
-						if err := con.UnmarshalWithConf("", &emailCon, koanf.UnmarshalConf{Tag: "json"}); err != nil {
-							lo.Fatalf("error reading SMTP config: %v", err)
-						}
-						req = append(req, emailCon)
-					}
-					name := fmt.Sprintf("%v_%v", messengerName, productName)
+					// Only SES signs messages. The other APIs build and sign
+					// the messages themselves.
+					validateDKIM(productName, product.Slices("connection"))
 					app.messengers[name] = initAWSMessenger(app.manager, name, req)
+				case emailapi.ProviderSendGrid, emailapi.ProviderMailgun, emailapi.ProviderPostmark:
+					app.messengers[name] = initEmailAPIMessenger(name, productName, req)
+				default:
+					lo.Printf("unknown e-mail API product: %s", productName)
 				}
 			}
 		case "email_smtp":
 			for _, product := range item.Slices("product") {
 				productName := product.String("name")
+				validateDKIM(productName, product.Slices("connection"))
+
 				name := fmt.Sprintf("%v_%v", messengerName, productName)
 				app.messengers[name] = initSMTPMessenger(app.manager, name, product.Slices("connection"))
 			}
+		case "sms":
+			for _, product := range item.Slices("product") {
+				productName := product.String("name")
+
+				req := []SMSConnection{}
+				for _, con := range product.Slices("connection") {
+					smsCon := SMSConnection{}
+					if err := con.UnmarshalWithConf("", &smsCon, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+						lo.Fatalf("error reading %s config: %v", productName, err)
+					}
+					req = append(req, smsCon)
+				}
+
+				// The segments of the messages sent on messengers named sms_*
+				// are debited from the SMS credits (smssent.*).
+				name := smsMsgrPrefix + productName
+				app.messengers[name] = initSMSMessenger(name, productName, req)
+			}
+		case "push":
+			for _, product := range item.Slices("product") {
+				productName := product.String("name")
+				if productName != "VAPID" {
+					lo.Printf("unknown push product: %s", productName)
+					continue
+				}
+
+				req := []PushConnection{}
+				for _, con := range product.Slices("connection") {
+					pushCon := PushConnection{}
+					if err := con.UnmarshalWithConf("", &pushCon, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+						lo.Fatalf("error reading %s config: %v", productName, err)
+					}
+					req = append(req, pushCon)
+				}
+
+				name := fmt.Sprintf("%v_%v", messengerName, productName)
+				if m := initWebPushMessenger(name, req, &pushStore{q: app.queries}); m != nil {
+					app.messengers[name] = m
+				}
+			}
 		}
 	}
 }
 
+// validateDKIM validates the DKIM config of the enabled connections of
+// an SMTP or SES product.
+func validateDKIM(product string, conns []*koanf.Koanf) {
+	for _, con := range conns {
+		var c EmailConnection
+		if err := con.UnmarshalWithConf("", &c, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+			lo.Fatalf("error reading %s config: %v", product, err)
+		}
+		if !c.Enabled || !c.DKIM.Enabled {
+			continue
+		}
+
+		if _, err := dkim.New(c.DKIM); err != nil {
+			lo.Fatalf("invalid DKIM config for %s (%s): %v", product, c.Host, err)
+		}
+		lo.Printf("DKIM signing enabled for %s (%s) with %s._domainkey.%s",
+			product, c.Host, c.DKIM.Selector, c.DKIM.Domain)
+	}
+}
+
 func initAWSMessenger(m *manager.Manager, name string, cfg []EmailConnection) messenger.Messenger {
 	var (
 		configs = make([]aws_email.AWSConfig, 0, len(cfg))
@@ -469,6 +665,7 @@ func initAWSMessenger(m *manager.Manager, name string, cfg []EmailConnection) me
 				c.Region = hostPartitions[1]
 			}
 		}
+		c.DKIM = item.DKIM
 		configs = append(configs, c)
 		lo.Printf("loaded email (AWS) messenger: %s@%s",
 			item.Username, item.Host)
@@ -487,6 +684,170 @@ func initAWSMessenger(m *manager.Manager, name string, cfg []EmailConnection) me
 	return msgr
 }
 
+// initEmailAPIMessenger initializes a messenger that sends e-mails over the
+// HTTP API of SendGrid, Mailgun or Postmark. The connection's password is the
+// API key (the server token on Postmark) and the username is the sending
+// domain on Mailgun. The host optionally overrides the API's root URL,
+// eg: api.eu.mailgun.net.
+func initEmailAPIMessenger(name, product string, cfg []EmailConnection) messenger.Messenger {
+	opts := make([]emailapi.Options, 0, len(cfg))
+	for _, item := range cfg {
+		if !item.Enabled {
+			continue
+		}
+
+		o := emailapi.Options{
+			Provider:  product,
+			APIKey:    item.Password,
+			Domain:    item.Username,
+			MaxConns:  item.MaxConns,
+			Retries:   item.MaxMsgRetries,
+			BatchSize: item.BatchSize,
+		}
+		if item.Host != "" {
+			o.RootURL = item.Host
+			if !strings.HasPrefix(o.RootURL, "http://") && !strings.HasPrefix(o.RootURL, "https://") {
+				o.RootURL = "https://" + o.RootURL
+			}
+		}
+		if item.WaitTimeout != "" {
+			d, err := time.ParseDuration(item.WaitTimeout)
+			if err != nil {
+				lo.Fatalf("invalid %s wait_timeout: %v", product, err)
+			}
+			o.Timeout = d
+		}
+		if item.BatchWait != "" {
+			d, err := time.ParseDuration(item.BatchWait)
+			if err != nil {
+				lo.Fatalf("invalid %s batch_wait: %v", product, err)
+			}
+			o.BatchWait = d
+		}
+		if len(item.EmailHeaders) > 0 {
+			o.Headers = make(map[string]string)
+			for _, h := range item.EmailHeaders {
+				for k, v := range h {
+					o.Headers[k] = v
+				}
+			}
+		}
+
+		// The providers sign the messages with the DKIM keys of the
+		// domains that are set up on them.
+		if item.DKIM.Enabled {
+			lo.Printf("DKIM config of %s (%s) is ignored. The provider signs messages.", product, item.Host)
+		}
+
+		opts = append(opts, o)
+		lo.Printf("loaded email (%s API) messenger: %s", product, o.RootURL)
+	}
+
+	if len(opts) == 0 {
+		lo.Fatalf("no %s connections enabled in settings", product)
+	}
+
+	msgr, err := emailapi.New(lo, name, opts...)
+	if err != nil {
+		lo.Fatalf("error loading %s messenger: %v", product, err)
+	}
+
+	return msgr
+}
+
+// initSMSMessenger initializes a messenger that sends campaigns as SMS
+// over Twilio or a generic HTTP API. Only the first enabled connection
+// is used.
+func initSMSMessenger(name, product string, cfg []SMSConnection) messenger.Messenger {
+	for _, item := range cfg {
+		if !item.Enabled {
+			continue
+		}
+
+		o := sms.Options{
+			Provider:    product,
+			RootURL:     item.Host,
+			Username:    item.Username,
+			Password:    item.Password,
+			From:        item.From,
+			PhoneAttrib: item.PhoneAttribute,
+			MaxSegments: item.MaxSegments,
+			MaxConns:    item.MaxConns,
+			Retries:     item.MaxMsgRetries,
+		}
+		if item.WaitTimeout != "" {
+			d, err := time.ParseDuration(item.WaitTimeout)
+			if err != nil {
+				lo.Fatalf("invalid %s wait_timeout: %v", product, err)
+			}
+			o.Timeout = d
+		}
+
+		msgr, err := sms.New(lo, name, o)
+		if err != nil {
+			lo.Fatalf("error loading %s messenger: %v", product, err)
+		}
+
+		lo.Printf("loaded SMS (%s) messenger: %s", product, name)
+		return msgr
+	}
+
+	lo.Fatalf("no %s connections enabled in settings", product)
+	return nil
+}
+
+// initWebPushMessenger initializes the web push notification messenger.
+// The connection's username is the VAPID subject (mailto: or https: contact)
+// and the password is the base64url VAPID private key. Only the first enabled
+// connection is used. If it has no key, the messenger is skipped and nil
+// is returned.
+func initWebPushMessenger(name string, cfg []PushConnection, store webpush.Store) messenger.Messenger {
+	for _, item := range cfg {
+		if !item.Enabled {
+			continue
+		}
+
+		o := webpush.Options{
+			Subject:    item.Username,
+			PrivateKey: item.Password,
+			Icon:       item.Icon,
+			URL:        item.URL,
+			MaxConns:   item.MaxConns,
+			Retries:    item.MaxMsgRetries,
+		}
+		if item.TTL != "" {
+			d, err := time.ParseDuration(item.TTL)
+			if err != nil {
+				lo.Fatalf("invalid web push ttl: %v", err)
+			}
+			o.TTL = d
+		}
+		if item.WaitTimeout != "" {
+			d, err := time.ParseDuration(item.WaitTimeout)
+			if err != nil {
+				lo.Fatalf("invalid web push wait_timeout: %v", err)
+			}
+			o.Timeout = d
+		}
+
+		if o.PrivateKey == "" {
+			lo.Printf("no VAPID private key set for web push. Run --new-vapid-key to generate one. Skipping web push messenger")
+			return nil
+		}
+
+		msgr, err := webpush.New(lo, name, o, store)
+		if err != nil {
+			lo.Fatalf("error loading web push messenger: %v", err)
+		}
+
+		lo.Printf("loaded web push messenger: %s", name)
+		return msgr
+	}
+
+	lo.Fatalf("no web push connections enabled in settings")
+	return nil
+}
+
 func initStripe(q *Queries, cs *constants) {
 	var value string
 	if len(cs.StripeKey) == 0 {
@@ -622,6 +983,13 @@ func initPostbackMessengers(m *manager.Manager) []messenger.Messenger {
 			lo.Fatalf("error reading Postback config: %v", err)
 		}
 
+		// A batch only fills up with as many messages as are pushed
+		// concurrently. Larger batches would wait for batch_wait every time.
+		if c := ko.Int("app.concurrency"); c > 0 && o.BatchSize > c {
+			lo.Printf("batch_size of Postback messenger %s is more than app.concurrency. Using %d", name, c)
+			o.BatchSize = c
+		}
+
 		// Initialize the Messenger.
 		p, err := postback.New(o)
 		if err != nil {
@@ -635,6 +1003,43 @@ func initPostbackMessengers(m *manager.Manager) []messenger.Messenger {
 	return out
 }
 
+// initMessengerGroups loads all the enabled messenger groups into the
+// campaign manager. It should be called after the messengers are loaded.
+func initMessengerGroups(m *manager.Manager) {
+	for _, item := range ko.Slices("app.messenger_groups") {
+		if !item.Bool("enabled") {
+			continue
+		}
+
+		var g messengerGroup
+		if err := item.UnmarshalWithConf("", &g, koanf.UnmarshalConf{Tag: "json"}); err != nil {
+			lo.Fatalf("error reading messenger group config: %v", err)
+		}
+
+		var probe time.Duration
+		if g.ProbeInterval != "" {
+			d, err := time.ParseDuration(g.ProbeInterval)
+			if err != nil {
+				lo.Printf("error parsing probe interval of messenger group %s: %v", g.Name, err)
+			}
+			probe = d
+		}
+
+		if err := m.AddMessengerGroup(manager.MessengerGroup{
+			Name:          g.Name,
+			Members:       g.Messengers,
+			MaxErrorRate:  g.MaxErrorRate,
+			ErrorWindow:   g.ErrorWindow,
+			ProbeInterval: probe,
+		}); err != nil {
+			lo.Printf("error loading messenger group %s: %v", g.Name, err)
+			continue
+		}
+
+		lo.Printf("loaded messenger group: %s", g.Name)
+	}
+}
+
 // initMediaStore initializes Upload manager with a custom backend.
 func initMediaStore() media.Store {
 	switch provider := ko.String("upload.provider"); provider {
@@ -898,7 +1303,8 @@ func runSmartEmailList(q *Queries, prefixEmail string) {
 		smartEmailName,
 		"private",
 		"single",
-		pq.StringArray(normalizeTags([]string{}))); err != nil {
+		pq.StringArray(normalizeTags([]string{})),
+		""); err != nil {
 		lo.Println("error create new list ", smartEmailName, " [runSmartEmailList]: ", err)
 		return
 	}
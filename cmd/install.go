@@ -62,6 +62,7 @@ func install(lastVer string, db *sqlx.DB, fs stuffbin.FileSystem, prompt bool) {
 		models.ListTypePrivate,
 		models.ListOptinSingle,
 		pq.StringArray{"test"},
+		"",
 	); err != nil {
 		lo.Fatalf("Error creating list: %v", err)
 	}
@@ -71,6 +72,7 @@ func install(lastVer string, db *sqlx.DB, fs stuffbin.FileSystem, prompt bool) {
 		models.ListTypePublic,
 		models.ListOptinDouble,
 		pq.StringArray{"test"},
+		"",
 	); err != nil {
 		lo.Fatalf("Error creating list: %v", err)
 	}
@@ -129,6 +131,16 @@ func install(lastVer string, db *sqlx.DB, fs stuffbin.FileSystem, prompt bool) {
 		emailMsgr,
 		1,
 		pq.Int64Array{1},
+		0,
+		models.ABTestMetricViews,
+		"4h",
+		false,
+		pq.Int64Array{},
+		"",
+		"UTC",
+		"",
+		pq.Int64Array{},
+		"",
 	); err != nil {
 		lo.Fatalf("error creating sample campaign: %v", err)
 	}
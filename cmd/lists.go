@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"net/http"
 	"strconv"
+	"time"
 
 	"github.com/gofrs/uuid"
 	"github.com/knadh/listmonk/models"
@@ -107,6 +108,9 @@ func handleCreateList(c echo.Context) error {
 	if !strHasLen(o.Name, 1, stdInputMaxLen) {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("lists.invalidName"))
 	}
+	if _, err := time.LoadLocation(o.Timezone); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("lists.invalidTimezone", "name", o.Timezone))
+	}
 
 	uu, err := uuid.NewV4()
 	if err != nil {
@@ -123,7 +127,8 @@ func handleCreateList(c echo.Context) error {
 		o.Name,
 		o.Type,
 		o.Optin,
-		pq.StringArray(normalizeTags(o.Tags))); err != nil {
+		pq.StringArray(normalizeTags(o.Tags)),
+		o.Timezone); err != nil {
 		app.log.Printf("error creating list: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorCreating",
@@ -147,14 +152,23 @@ func handleUpdateList(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidID"))
 	}
 
-	// Incoming params.
-	var o models.List
+	// Incoming params. The timezone is left unchanged if it's absent.
+	var o struct {
+		models.List
+		Timezone *string `json:"timezone"`
+	}
 	if err := c.Bind(&o); err != nil {
 		return err
 	}
 
+	if o.Timezone != nil {
+		if _, err := time.LoadLocation(*o.Timezone); err != nil {
+			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.Ts("lists.invalidTimezone", "name", *o.Timezone))
+		}
+	}
+
 	res, err := app.queries.UpdateList.Exec(id,
-		o.Name, o.Type, o.Optin, pq.StringArray(normalizeTags(o.Tags)))
+		o.Name, o.Type, o.Optin, pq.StringArray(normalizeTags(o.Tags)), o.Timezone)
 	if err != nil {
 		app.log.Printf("error updating list: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
@@ -28,6 +28,9 @@ import (
 const (
 	emailMsgr    = "smtp_email"
 	awsEmailMsgr = "email"
+
+	// Prefix of the names of the SMS messengers (sms_{provider}).
+	smsMsgrPrefix = "sms_"
 )
 
 // App contains the "global" components that are
@@ -135,6 +138,14 @@ func init() {
 	// Load the SQL queries from the filesystem.
 	_, queries := initQueries(queryFilePath, db, fs, true)
 
+	// Generate a web push key.
+	if ko.Bool("new-vapid-key") {
+		if err := newVAPIDKey(queries); err != nil {
+			lo.Fatal(err)
+		}
+		os.Exit(0)
+	}
+
 	// Load settings from DB.
 	initSettings(queries.GetSettings)
 }
@@ -177,6 +188,7 @@ func main() {
 	for _, m := range app.messengers {
 		app.manager.AddMessenger(m)
 	}
+	initMessengerGroups(app.manager)
 
 	// Init config to sync block list across platforms
 	// InitPlatform(app.queries, app.constants)
@@ -191,6 +203,12 @@ func main() {
 	go SchedulerSyncBlacklistSubscribers(app.queries, app.constants)
 	go SchedulerDeleteTblEvents(app.queries)
 
+	// Start the automation worker that sends the due steps of automations.
+	go runAutomations(app)
+
+	// Start the scheduler that clones the due runs of recurring campaigns.
+	go runRecurringCampaigns(app)
+
 	// Start the campaign workers. The campaign batches (fetch from DB, push out
 	// messages) get processed at the specified interval.
 	go app.manager.Run(time.Second * 5)
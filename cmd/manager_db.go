@@ -1,22 +1,34 @@
 package main
 
 import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
 	"github.com/gofrs/uuid"
+	"github.com/jmoiron/sqlx/types"
+	"github.com/knadh/listmonk/internal/manager"
+	"github.com/knadh/listmonk/internal/media"
+	"github.com/knadh/listmonk/internal/messenger"
 	"github.com/knadh/listmonk/models"
 	"github.com/lib/pq"
-	"log"
 )
 
 // runnerDB implements runner.DataSource over the primary
 // database.
 type runnerDB struct {
 	queries *Queries
+	media   media.Store
 	logger  *log.Logger
 }
 
-func newManagerDB(q *Queries, l *log.Logger) *runnerDB {
+func newManagerDB(q *Queries, m media.Store, l *log.Logger) *runnerDB {
 	return &runnerDB{
 		queries: q,
+		media:   m,
 		logger:  l,
 	}
 }
@@ -28,16 +40,152 @@ func (r *runnerDB) NextCampaigns(excludeIDs []int64) ([]*models.Campaign, error)
 	return out, err
 }
 
-// NextSubscribers retrieves a subset of subscribers of a given campaign.
-// Since batches are processed sequentially, the retrieval is ordered by ID,
-// and every batch takes the last ID of the last batch and fetches the next
-// batch above that.
-func (r *runnerDB) NextSubscribers(campID, limit int) ([]models.Subscriber, error) {
+// NextSubscribers retrieves the subscribers of a given campaign in the
+// range of subscriber IDs (fromID, toID] ordered by ID. Subscribers who
+// have crossed a frequency cap are skipped.
+func (r *runnerDB) NextSubscribers(campID, fromID, toID int, caps []manager.FrequencyCap) ([]models.Subscriber, error) {
+	b, err := makeCapRecords(caps)
+	if err != nil {
+		return nil, err
+	}
+
+	var out []models.Subscriber
+	err = r.queries.NextCampaignSubscribers.Select(&out, campID, fromID, toID, b, false)
+	return out, err
+}
+
+// DryRunSubscribers returns the subscribers of a campaign in the given range
+// of subscriber IDs for a dry run. Unlike NextSubscribers, subscribers who have
+// crossed a frequency cap aren't recorded as skipped.
+func (r *runnerDB) DryRunSubscribers(campID, fromID, toID int, caps []manager.FrequencyCap) ([]models.Subscriber, error) {
+	b, err := makeCapRecords(caps)
+	if err != nil {
+		return nil, err
+	}
+
 	var out []models.Subscriber
-	//defer func(begin time.Time) {
-	//	r.logger.Printf(" NextSubscribers campID: %s , took: %v, totalCamp: %v", campID, time.Since(begin), len(out))
-	//}(time.Now())
-	err := r.queries.NextCampaignSubscribers.Select(&out, campID)
+	err = r.queries.NextCampaignSubscribers.Select(&out, campID, fromID, toID, b, true)
+	return out, err
+}
+
+// CountCampaignRecipients returns the total number of subscribers of a
+// campaign and the max subscriber ID across its lists.
+func (r *runnerDB) CountCampaignRecipients(campID int) (int, int, error) {
+	var out struct {
+		ToSend int `db:"to_send"`
+		MaxID  int `db:"max_subscriber_id"`
+	}
+	err := r.queries.CountCampaignRecipients.Get(&out, campID)
+	return out.ToSend, out.MaxID, err
+}
+
+// makeCapRecords flattens frequency caps into a JSON array of one record per
+// list for the next-campaign-subscribers query. list_id 0 is a global cap.
+func makeCapRecords(caps []manager.FrequencyCap) (types.JSONText, error) {
+	type capRec struct {
+		ListID int     `json:"list_id"`
+		Max    int     `json:"max"`
+		Period float64 `json:"period"`
+	}
+	recs := []capRec{}
+	for _, c := range caps {
+		if len(c.ListIDs) == 0 {
+			recs = append(recs, capRec{Max: c.Max, Period: c.Period.Seconds()})
+			continue
+		}
+		for _, id := range c.ListIDs {
+			recs = append(recs, capRec{ListID: id, Max: c.Max, Period: c.Period.Seconds()})
+		}
+	}
+	b, err := json.Marshal(recs)
+	if err != nil {
+		return nil, err
+	}
+	return types.JSONText(b), nil
+}
+
+// NextLease leases the next range of subscribers of a campaign to the node.
+// Expired leases of other nodes are taken over first. It returns nil if there
+// are no ranges to be leased at the moment.
+func (r *runnerDB) NextLease(campID, limit int, node string, ttl time.Duration) (*manager.Lease, error) {
+	var out manager.Lease
+	err := r.queries.ReclaimCampaignLease.Get(&out, campID, node, ttl.Seconds())
+	if err == nil {
+		return &out, nil
+	} else if err != sql.ErrNoRows {
+		return nil, err
+	}
+
+	if err := r.queries.CreateCampaignLease.Get(&out, campID, node, ttl.Seconds(), limit); err != nil {
+		if err == sql.ErrNoRows {
+			return nil, nil
+		}
+		return nil, err
+	}
+	return &out, nil
+}
+
+// RenewLease extends a lease held by the node and records its progress.
+func (r *runnerDB) RenewLease(l manager.Lease, node string, ttl time.Duration) error {
+	_, err := r.queries.RenewCampaignLease.Exec(l.ID, node, ttl.Seconds(), l.LastID, l.Sent)
+	return err
+}
+
+// CompleteLease removes a processed lease and updates the campaign's sent count.
+func (r *runnerDB) CompleteLease(l manager.Lease, node string) error {
+	if _, err := r.queries.CompleteCampaignLease.Exec(l.ID, node, l.Sent); err != nil {
+		r.logger.Printf("error completing campaign lease: %v", err)
+		return err
+	}
+	return nil
+}
+
+// AddCampaignSent adds messages sent outside of leases (deferred messages that
+// have become due) to the campaign's sent count.
+func (r *runnerDB) AddCampaignSent(campID, n int) error {
+	_, err := r.queries.AddCampaignSent.Exec(campID, n)
+	return err
+}
+
+// FinishCampaign marks a campaign as finished if all its subscribers
+// have been processed by all the nodes.
+func (r *runnerDB) FinishCampaign(campID int) (bool, error) {
+	res, err := r.queries.FinishCampaign.Exec(campID)
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// EndABTest ends the test phase of an A/B test campaign if its variants
+// have been sent to the test group. The winner is picked after the window.
+func (r *runnerDB) EndABTest(campID int, window time.Duration) (bool, error) {
+	res, err := r.queries.EndCampaignABTest.Exec(campID, window.Seconds())
+	if err != nil {
+		return false, err
+	}
+	n, _ := res.RowsAffected()
+	return n > 0, nil
+}
+
+// PickABWinner picks the winning variant of an A/B test campaign whose test
+// window has passed and returns its ID. It returns 0 if there's nothing to pick.
+func (r *runnerDB) PickABWinner(campID int) (int, error) {
+	var id int
+	if err := r.queries.PickCampaignABWinner.Get(&id, campID); err != nil {
+		if err == sql.ErrNoRows {
+			return 0, nil
+		}
+		return 0, err
+	}
+	return id, nil
+}
+
+// GetCampaignVariants fetches the A/B test variants of a campaign.
+func (r *runnerDB) GetCampaignVariants(campID int) ([]models.CampaignVariant, error) {
+	var out []models.CampaignVariant
+	err := r.queries.GetCampaignVariants.Select(&out, campID)
 	return out, err
 }
 
@@ -54,6 +202,165 @@ func (r *runnerDB) UpdateCampaignStatus(campID int, status string) error {
 	return err
 }
 
+// PauseCampaign pauses a campaign recording the reason for it.
+func (r *runnerDB) PauseCampaign(campID int, reason string) error {
+	_, err := r.queries.PauseCampaign.Exec(campID, reason)
+	return err
+}
+
+// RecordDeliveries records the delivery attempts of campaign messages.
+func (r *runnerDB) RecordDeliveries(ds []manager.Delivery) error {
+	var (
+		campIDs = make(pq.Int64Array, 0, len(ds))
+		subIDs  = make(pq.Int64Array, 0, len(ds))
+		status  = make(pq.StringArray, 0, len(ds))
+		msgrs   = make(pq.StringArray, 0, len(ds))
+		msgIDs  = make(pq.StringArray, 0, len(ds))
+		errs    = make(pq.StringArray, 0, len(ds))
+		retries = make(pq.Float64Array, 0, len(ds))
+		varIDs  = make(pq.Int64Array, 0, len(ds))
+	)
+	// Credits used by the sent messages. The messengers of the SMS providers
+	// are named sms_* and are debited from the SMS credits.
+	var emails, segments int
+	for _, d := range ds {
+		if d.Status == manager.DeliveryStatusSent {
+			if strings.HasPrefix(d.Messenger, smsMsgrPrefix) {
+				segments += d.Credits
+			} else {
+				emails += d.Credits
+			}
+		}
+
+		campIDs = append(campIDs, int64(d.CampaignID))
+		subIDs = append(subIDs, int64(d.SubscriberID))
+		status = append(status, d.Status)
+		msgrs = append(msgrs, d.Messenger)
+		msgIDs = append(msgIDs, d.MessageID)
+		errs = append(errs, d.Error)
+		retries = append(retries, d.RetryAfter.Seconds())
+		varIDs = append(varIDs, int64(d.VariantID))
+	}
+
+	if _, err := r.queries.RecordCampaignDeliveries.Exec(campIDs, subIDs, status, msgrs, msgIDs, errs, retries, varIDs); err != nil {
+		return err
+	}
+
+	if emails > 0 || segments > 0 {
+		if _, err := r.queries.UpdateSettingCreditBalances.Exec(emails, segments); err != nil {
+			r.logger.Printf("error updating sent counts: %v", err)
+			return err
+		}
+	}
+	return nil
+}
+
+// RecordTxDelivery records the outcome of the delivery of a transactional message.
+func (r *runnerDB) RecordTxDelivery(id, status, messageID, errMsg string) error {
+	_, err := r.queries.UpdateTxMessage.Exec(id, status, messageID, errMsg)
+	return err
+}
+
+// NextRetries claims the failed messages of a campaign that are due to be
+// retried for the given duration and returns their subscribers. Subscribers
+// who are no longer eligible for the campaign are skipped.
+func (r *runnerDB) NextRetries(campID, limit int, ttl time.Duration, caps []manager.FrequencyCap) ([]manager.Retry, error) {
+	b, err := makeCapRecords(caps)
+	if err != nil {
+		return nil, err
+	}
+
+	var res []struct {
+		models.Subscriber
+		Attempts int `db:"attempts"`
+	}
+	if err := r.queries.NextCampaignRetries.Select(&res, campID, limit, ttl.Seconds(), b); err != nil {
+		return nil, err
+	}
+
+	out := make([]manager.Retry, 0, len(res))
+	for _, s := range res {
+		out = append(out, manager.Retry{Subscriber: s.Subscriber, Attempts: s.Attempts})
+	}
+	return out, nil
+}
+
+// GetSendHours returns the hours of the day (UTC) at which the given subscribers
+// have historically engaged the most with campaigns, keyed by subscriber ID.
+func (r *runnerDB) GetSendHours(subIDs []int) (map[int]int, error) {
+	var res []struct {
+		SubscriberID int `db:"subscriber_id"`
+		Hour         int `db:"hour"`
+	}
+	if err := r.queries.GetSubscriberSendHours.Select(&res, pq.Array(subIDs)); err != nil {
+		return nil, err
+	}
+
+	out := make(map[int]int, len(res))
+	for _, h := range res {
+		out[h.SubscriberID] = h.Hour
+	}
+	return out, nil
+}
+
+// GetMedianSendHour returns the median hour of engagement of the subscribers
+// of a campaign's lists or -1 if there's none.
+func (r *runnerDB) GetMedianSendHour(campID int) (int, error) {
+	var out int
+	err := r.queries.GetCampaignMedianSendHour.Get(&out, campID)
+	return out, err
+}
+
+// GetListTimezones returns the default timezones of the given subscribers from
+// the lists of a campaign that they're subscribed to, keyed by subscriber ID.
+func (r *runnerDB) GetListTimezones(campID int, subIDs []int) (map[int]string, error) {
+	var res []struct {
+		SubscriberID int    `db:"subscriber_id"`
+		Timezone     string `db:"timezone"`
+	}
+	if err := r.queries.GetSubscriberListTimezones.Select(&res, campID, pq.Array(subIDs)); err != nil {
+		return nil, err
+	}
+
+	out := make(map[int]string, len(res))
+	for _, t := range res {
+		out[t.SubscriberID] = t.Timezone
+	}
+	return out, nil
+}
+
+// GetMessengerSent returns the number of campaign messages sent (or queued)
+// by a messenger since the given time.
+func (r *runnerDB) GetMessengerSent(messenger string, since time.Time) (int, error) {
+	var out int
+	err := r.queries.GetMessengerSent.Get(&out, messenger, since)
+	return out, err
+}
+
+// GetCampaignAttachments fetches the media attached to a campaign from the
+// media store.
+func (r *runnerDB) GetCampaignAttachments(campID int) ([]messenger.Attachment, error) {
+	var med []media.Media
+	if err := r.queries.GetCampaignMedia.Select(&med, campID); err != nil {
+		return nil, err
+	}
+
+	out := make([]messenger.Attachment, 0, len(med))
+	for _, m := range med {
+		b, err := r.media.GetBlob(m.Filename)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching attachment %s: %v", m.Filename, err)
+		}
+
+		out = append(out, messenger.Attachment{
+			Name:    m.Filename,
+			Header:  messenger.MakeAttachmentHeader(m.Filename, "base64"),
+			Content: b,
+		})
+	}
+	return out, nil
+}
+
 // CreateLink registers a URL with a UUID for tracking clicks and returns the UUID.
 func (r *runnerDB) CreateLink(url string) (string, error) {
 	// Create a new UUID for the URL. If the URL already exists in the DB
@@ -76,20 +383,3 @@ func (r *runnerDB) UpdateLastEmailSent(email string) error {
 	_, err := r.queries.UpdateLastEmailSent.Exec(email)
 	return err
 }
-
-func (r *runnerDB) UpdateSentCampaign(campID, limit, lastSubsId int) error {
-	//defer func(begin time.Time) {
-	//	r.logger.Printf(" UpdateSentCampaign campID: %s, limit: %s, lastSubsId: %s, took: %v", campID, limit, lastSubsId, time.Since(begin))
-	//}(time.Now())
-	_, err := r.queries.UpdateSendCampaignCounts.Exec(campID, limit, lastSubsId)
-	if err != nil {
-		r.logger.Printf(" Error UpdateSendCampaignCounts: ", err)
-		return err
-	}
-	_, err = r.queries.UpdateSettingCampaignCounts.Exec(limit)
-	if err != nil {
-		r.logger.Printf(" Error UpdateSettingCampaignCounts: ", err)
-		return err
-	}
-	return err
-}
@@ -18,10 +18,14 @@ const (
 	thumbnailSize = 90
 )
 
-// validMimes is the list of image types allowed to be uploaded.
+// validMimes is the list of file types allowed to be uploaded. Documents
+// and calendar invites are for attaching to campaigns.
 var (
-	validMimes = []string{"image/jpg", "image/jpeg", "image/png", "image/gif"}
-	validExts  = []string{".jpg", ".jpeg", ".png", ".gif"}
+	validMimes = []string{"image/jpg", "image/jpeg", "image/png", "image/gif", "application/pdf", "text/calendar"}
+	validExts  = []string{".jpg", ".jpeg", ".png", ".gif", ".pdf", ".ics"}
+
+	// imageExts is the list of file types that get thumbnails.
+	imageExts = []string{".jpg", ".jpeg", ".png", ".gif"}
 )
 
 // handleUploadMedia handles media file uploads.
@@ -79,22 +83,24 @@ func handleUploadMedia(c echo.Context) error {
 		}
 	}()
 
-	// Create thumbnail from file.
-	thumbFile, err := createThumbnail(file)
-	if err != nil {
-		cleanUp = true
-		app.log.Printf("error resizing image: %v", err)
-		return echo.NewHTTPError(http.StatusInternalServerError,
-			app.i18n.Ts("media.errorResizing", "error", err.Error()))
-	}
+	// Create and upload a thumbnail if it's an image.
+	thumbfName := ""
+	if inArray(ext, imageExts) {
+		thumbFile, err := createThumbnail(file)
+		if err != nil {
+			cleanUp = true
+			app.log.Printf("error resizing image: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("media.errorResizing", "error", err.Error()))
+		}
 
-	// Upload thumbnail.
-	thumbfName, err := app.media.Put(thumbPrefix+fName, typ, thumbFile)
-	if err != nil {
-		cleanUp = true
-		app.log.Printf("error saving thumbnail: %v", err)
-		return echo.NewHTTPError(http.StatusInternalServerError,
-			app.i18n.Ts("media.errorSavingThumbnail", "error", err.Error()))
+		thumbfName, err = app.media.Put(thumbPrefix+fName, typ, thumbFile)
+		if err != nil {
+			cleanUp = true
+			app.log.Printf("error saving thumbnail: %v", err)
+			return echo.NewHTTPError(http.StatusInternalServerError,
+				app.i18n.Ts("media.errorSavingThumbnail", "error", err.Error()))
+		}
 	}
 
 	uu, err := uuid.NewV4()
@@ -130,7 +136,9 @@ func handleGetMedia(c echo.Context) error {
 
 	for i := 0; i < len(out); i++ {
 		out[i].URL = app.media.Get(out[i].Filename)
-		out[i].ThumbURL = app.media.Get(out[i].Thumb)
+		if out[i].Thumb != "" {
+			out[i].ThumbURL = app.media.Get(out[i].Thumb)
+		}
 	}
 
 	return c.JSON(http.StatusOK, okResp{out})
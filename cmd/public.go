@@ -489,7 +489,7 @@ func handleSelfExportSubscriberData(c echo.Context) error {
 				Header:  messenger.MakeAttachmentHeader(fname, "base64"),
 			},
 		},
-	}, app.manager.Cfg.Concurrency); err != nil {
+	}); err != nil {
 		app.log.Printf("error e-mailing subscriber profile: %s", err)
 		return c.Render(http.StatusInternalServerError, tplMessage,
 			makeMsgTpl(app.i18n.T("public.errorTitle"), "",
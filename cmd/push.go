@@ -0,0 +1,176 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+
+	"github.com/jmoiron/sqlx/types"
+	"github.com/knadh/listmonk/internal/messenger/webpush"
+	"github.com/labstack/echo"
+)
+
+// webPushMsgr is the name of the web push messenger (messenger "push" with
+// the product "VAPID" in the providers settings).
+const webPushMsgr = "push_VAPID"
+
+// maxPushSubscriptions is the max number of browsers a subscriber can
+// subscribe on. The least recently subscribed ones are removed beyond that.
+const maxPushSubscriptions = 10
+
+// pushSubReq is a browser's PushSubscription.toJSON().
+type pushSubReq struct {
+	Endpoint string `json:"endpoint"`
+	Keys     struct {
+		P256dh string `json:"p256dh"`
+		Auth   string `json:"auth"`
+	} `json:"keys"`
+}
+
+// pushStore is the webpush.Store of the subscribers' push subscriptions in the DB.
+type pushStore struct {
+	q *Queries
+}
+
+// GetSubscriptions returns the push subscriptions of a subscriber.
+func (s *pushStore) GetSubscriptions(subID int) ([]webpush.Subscription, error) {
+	var out []webpush.Subscription
+	if err := s.q.GetPushSubscriptions.Select(&out, subID); err != nil {
+		return nil, err
+	}
+	return out, nil
+}
+
+// DeleteSubscription deletes an expired push subscription.
+func (s *pushStore) DeleteSubscription(endpoint string) error {
+	_, err := s.q.DeletePushSubscription.Exec(endpoint)
+	return err
+}
+
+// handlePushKey returns the VAPID public key that browsers subscribe with.
+func handlePushKey(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	wp, ok := app.messengers[webPushMsgr].(*webpush.WebPush)
+	if !ok {
+		return echo.NewHTTPError(http.StatusNotFound, app.i18n.T("public.pushNotEnabled"))
+	}
+
+	return c.JSON(http.StatusOK, okResp{struct {
+		PublicKey string `json:"public_key"`
+	}{wp.PublicKey()}})
+}
+
+// handlePushSubscribe records the push subscription of a subscriber's browser.
+func handlePushSubscribe(c echo.Context) error {
+	var (
+		app     = c.Get("app").(*App)
+		subUUID = c.Param("subUUID")
+		req     pushSubReq
+	)
+
+	if _, ok := app.messengers[webPushMsgr]; !ok {
+		return echo.NewHTTPError(http.StatusNotFound, app.i18n.T("public.pushNotEnabled"))
+	}
+	if !reUUID.MatchString(subUUID) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidUUID"))
+	}
+
+	if err := c.Bind(&req); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("public.invalidPushSubscription"))
+	}
+	if !webpush.ValidEndpoint(req.Endpoint) || req.Keys.P256dh == "" || req.Keys.Auth == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("public.invalidPushSubscription"))
+	}
+
+	var exists bool
+	if err := app.queries.SubscriberExists.Get(&exists, 0, subUUID); err != nil {
+		app.log.Printf("error checking subscriber existence: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, app.i18n.T("public.errorProcessingRequest"))
+	}
+	if !exists {
+		return echo.NewHTTPError(http.StatusNotFound, app.i18n.T("public.subNotFound"))
+	}
+
+	if _, err := app.queries.UpsertPushSubscription.Exec(subUUID, req.Endpoint,
+		req.Keys.P256dh, req.Keys.Auth, c.Request().UserAgent(), maxPushSubscriptions); err != nil {
+		app.log.Printf("error recording push subscription: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, app.i18n.T("public.errorProcessingRequest"))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// handlePushUnsubscribe deletes the push subscription of a browser.
+func handlePushUnsubscribe(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		req pushSubReq
+	)
+
+	if err := c.Bind(&req); err != nil || req.Endpoint == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("public.invalidPushSubscription"))
+	}
+
+	if _, err := app.queries.DeletePushSubscription.Exec(req.Endpoint); err != nil {
+		app.log.Printf("error deleting push subscription: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError, app.i18n.T("public.errorProcessingRequest"))
+	}
+
+	return c.JSON(http.StatusOK, okResp{true})
+}
+
+// newVAPIDKey generates a VAPID key pair and stores the private key in the
+// web push (VAPID) connections of the providers settings that don't have one.
+// Only the public key is printed.
+func newVAPIDKey(q *Queries) error {
+	var b types.JSONText
+	if err := q.GetSettings.Get(&b); err != nil {
+		return fmt.Errorf("error reading settings from DB: %s", pqErrMsg(err))
+	}
+
+	var set struct {
+		Providers []ProvidersConfig `json:"providers"`
+	}
+	if err := json.Unmarshal(b, &set); err != nil {
+		return fmt.Errorf("error unmarshalling settings from DB: %v", err)
+	}
+
+	priv, pub, err := webpush.GenerateKeys()
+	if err != nil {
+		return fmt.Errorf("error generating VAPID keys: %v", err)
+	}
+
+	n := 0
+	for i, p := range set.Providers {
+		if p.Messenger != "push" {
+			continue
+		}
+		for j, pr := range p.Product {
+			if pr.Name != "VAPID" {
+				continue
+			}
+			for k, c := range pr.Connection {
+				if c.Password == "" {
+					set.Providers[i].Product[j].Connection[k].Password = priv
+					n++
+				}
+			}
+		}
+	}
+	if n == 0 {
+		return errors.New("no web push (VAPID) connections without a key in the providers settings")
+	}
+
+	out, err := json.Marshal(set)
+	if err != nil {
+		return fmt.Errorf("error encoding settings: %v", err)
+	}
+	if _, err := q.UpdateSettings.Exec(out); err != nil {
+		return fmt.Errorf("error updating settings: %s", pqErrMsg(err))
+	}
+
+	lo.Printf("stored a new VAPID key in %d web push connection(s). The public key is %s", n, pub)
+	return nil
+}
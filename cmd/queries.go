@@ -66,26 +66,53 @@ type Queries struct {
 	GetCampaign                 *sqlx.Stmt `query:"get-campaign"`
 	GetCampaignForPreview       *sqlx.Stmt `query:"get-campaign-for-preview"`
 	GetCampaignStats            *sqlx.Stmt `query:"get-campaign-stats"`
+	GetCampaignVariants         *sqlx.Stmt `query:"get-campaign-variants"`
+	UpsertCampaignVariants      *sqlx.Stmt `query:"upsert-campaign-variants"`
 	GetCampaignStatus           *sqlx.Stmt `query:"get-campaign-status"`
 	NextCampaigns               *sqlx.Stmt `query:"next-campaigns"`
 	NextCampaignSubscribers     *sqlx.Stmt `query:"next-campaign-subscribers"`
+	CountCampaignRecipients     *sqlx.Stmt `query:"count-campaign-recipients"`
+	UpsertCampaignDryRun        *sqlx.Stmt `query:"upsert-campaign-dry-run"`
+	GetCampaignDryRun           *sqlx.Stmt `query:"get-campaign-dry-run"`
+	UpsertPushSubscription      *sqlx.Stmt `query:"upsert-push-subscription"`
+	GetPushSubscriptions        *sqlx.Stmt `query:"get-push-subscriptions"`
+	DeletePushSubscription      *sqlx.Stmt `query:"delete-push-subscription"`
+	ReclaimCampaignLease        *sqlx.Stmt `query:"reclaim-campaign-lease"`
+	CreateCampaignLease         *sqlx.Stmt `query:"create-campaign-lease"`
+	RenewCampaignLease          *sqlx.Stmt `query:"renew-campaign-lease"`
+	CompleteCampaignLease       *sqlx.Stmt `query:"complete-campaign-lease"`
+	AddCampaignSent             *sqlx.Stmt `query:"add-campaign-sent"`
+	FinishCampaign              *sqlx.Stmt `query:"finish-campaign"`
+	EndCampaignABTest           *sqlx.Stmt `query:"end-campaign-ab-test"`
+	PickCampaignABWinner        *sqlx.Stmt `query:"pick-campaign-ab-winner"`
+	RecordCampaignDeliveries    *sqlx.Stmt `query:"record-campaign-deliveries"`
+	NextCampaignRetries         *sqlx.Stmt `query:"next-campaign-retries"`
+	GetSubscriberSendHours      *sqlx.Stmt `query:"get-subscriber-send-hours"`
+	GetCampaignMedianSendHour   *sqlx.Stmt `query:"get-campaign-median-send-hour"`
+	GetSubscriberListTimezones  *sqlx.Stmt `query:"get-subscriber-list-timezones"`
+	GetMessengerSent            *sqlx.Stmt `query:"get-messenger-sent"`
 	GetOneCampaignSubscriber    *sqlx.Stmt `query:"get-one-campaign-subscriber"`
 	UpdateCampaign              *sqlx.Stmt `query:"update-campaign"`
 	UpdateCampaignStatus        *sqlx.Stmt `query:"update-campaign-status"`
+	PauseCampaign               *sqlx.Stmt `query:"pause-campaign"`
 	UpdateCampaignCounts        *sqlx.Stmt `query:"update-campaign-counts"`
+	GetDueRecurringCampaigns    *sqlx.Stmt `query:"get-due-recurring-campaigns"`
+	ClaimRecurringCampaignRun   *sqlx.Stmt `query:"claim-recurring-campaign-run"`
+	CreateRecurringCampaignRun  *sqlx.Stmt `query:"create-recurring-campaign-run"`
 	RegisterCampaignView        *sqlx.Stmt `query:"register-campaign-view"`
 	DeleteCampaign              *sqlx.Stmt `query:"delete-campaign"`
 	UpdateLastEmailSent         *sqlx.Stmt `query:"update-last-email-sent"`
 	UpdateLastEmailOpen         *sqlx.Stmt `query:"update-last-email-open"`
 	UpdateLastEmailClicked      *sqlx.Stmt `query:"update-last-email-clicked"`
-	UpdateSendCampaignCounts    *sqlx.Stmt `query:"update-send-campaign-counts"`
-	UpdateSettingCampaignCounts *sqlx.Stmt `query:"update-setting-campaign-counts"`
+	UpdateSettingCreditBalances *sqlx.Stmt `query:"update-setting-credit-balances"`
 	DeleteEventsScheduler       *sqlx.Stmt `query:"delete-events-scheduler"`
 	ValidateStartCampaign       *sqlx.Stmt `query:"validate-start-campaign-by-max-email"`
 
-	InsertMedia *sqlx.Stmt `query:"insert-media"`
-	GetMedia    *sqlx.Stmt `query:"get-media"`
-	DeleteMedia *sqlx.Stmt `query:"delete-media"`
+	InsertMedia      *sqlx.Stmt `query:"insert-media"`
+	GetMedia         *sqlx.Stmt `query:"get-media"`
+	DeleteMedia      *sqlx.Stmt `query:"delete-media"`
+	GetMediaByIDs    *sqlx.Stmt `query:"get-media-by-ids"`
+	GetCampaignMedia *sqlx.Stmt `query:"get-campaign-media"`
 
 	CreateTemplate     *sqlx.Stmt `query:"create-template"`
 	GetTemplates       *sqlx.Stmt `query:"get-templates"`
@@ -93,6 +120,21 @@ type Queries struct {
 	SetDefaultTemplate *sqlx.Stmt `query:"set-default-template"`
 	DeleteTemplate     *sqlx.Stmt `query:"delete-template"`
 
+	InsertTxMessage *sqlx.Stmt `query:"insert-tx-message"`
+	GetTxMessage    *sqlx.Stmt `query:"get-tx-message"`
+	UpdateTxMessage *sqlx.Stmt `query:"update-tx-message"`
+
+	QueryAutomations           *sqlx.Stmt `query:"query-automations"`
+	GetAutomationSteps         *sqlx.Stmt `query:"get-automation-steps"`
+	GetAutomationStepStats     *sqlx.Stmt `query:"get-automation-step-stats"`
+	CreateAutomation           *sqlx.Stmt `query:"create-automation"`
+	UpdateAutomation           *sqlx.Stmt `query:"update-automation"`
+	UpsertAutomationSteps      *sqlx.Stmt `query:"upsert-automation-steps"`
+	DeleteAutomation           *sqlx.Stmt `query:"delete-automation"`
+	ExitAutomationSubscribers  *sqlx.Stmt `query:"exit-automation-subscribers"`
+	NextAutomationSubscribers  *sqlx.Stmt `query:"next-automation-subscribers"`
+	UpdateAutomationSubscriber *sqlx.Stmt `query:"update-automation-subscriber"`
+
 	CreateLink        *sqlx.Stmt `query:"create-link"`
 	RegisterLinkClick *sqlx.Stmt `query:"register-link-click"`
 
@@ -0,0 +1,197 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/url"
+	"time"
+
+	"github.com/gofrs/uuid"
+	"github.com/knadh/listmonk/internal/cron"
+	"github.com/knadh/listmonk/internal/feed"
+	"github.com/knadh/listmonk/models"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+const (
+	// Interval at which recurring campaigns are checked for due runs.
+	recurringInterval = time.Second * 30
+
+	// Timeout for fetching the feed of a recurring campaign.
+	feedTimeout = time.Second * 30
+)
+
+// validateRecurrence validates the recurrence of a campaign and schedules
+// the campaign (send_at) for its next run.
+func validateRecurrence(c *campaignReq, app *App) error {
+	if c.Type == models.CampaignTypeOptin {
+		return errors.New(app.i18n.T("campaigns.fieldInvalidRecurrenceOptin"))
+	}
+
+	sch, err := cron.Parse(c.Recurrence)
+	if err != nil {
+		return errors.New(app.i18n.Ts("campaigns.fieldInvalidRecurrence", "error", err.Error()))
+	}
+
+	if c.RecurrenceTZ == "" {
+		c.RecurrenceTZ = "UTC"
+	}
+	loc, err := time.LoadLocation(c.RecurrenceTZ)
+	if err != nil {
+		return errors.New(app.i18n.Ts("campaigns.fieldInvalidRecurrenceTZ", "name", c.RecurrenceTZ))
+	}
+
+	if c.FeedURL != "" {
+		u, err := url.Parse(c.FeedURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			return errors.New(app.i18n.T("campaigns.fieldInvalidFeedURL"))
+		}
+	}
+
+	c.SendAt = null.TimeFrom(sch.Next(time.Now().In(loc)))
+	c.SendLater = true
+	return nil
+}
+
+// runRecurringCampaigns is a blocking function that periodically clones
+// recurring campaigns whose runs are due into child campaigns.
+func runRecurringCampaigns(app *App) {
+	t := time.NewTicker(recurringInterval)
+	defer t.Stop()
+
+	for range t.C {
+		var camps []models.Campaign
+		if err := app.queries.GetDueRecurringCampaigns.Select(&camps); err != nil {
+			app.log.Printf("error fetching recurring campaigns: %v", err)
+			continue
+		}
+
+		for _, c := range camps {
+			if err := runRecurringCampaign(c, app); err != nil {
+				app.log.Printf("error running recurring campaign (%s): %v", c.Name, err)
+			}
+		}
+	}
+}
+
+// runRecurringCampaign claims the due run of a recurring campaign and clones
+// it into a child campaign that's sent right away. If the campaign has a feed,
+// the items published since the last run are rendered into the child and the
+// run is skipped if there are none or if the feed can't be fetched.
+func runRecurringCampaign(c models.Campaign, app *App) error {
+	sch, err := cron.Parse(c.Recurrence)
+	if err != nil {
+		return err
+	}
+	loc, err := time.LoadLocation(c.RecurrenceTZ)
+	if err != nil {
+		return err
+	}
+
+	// The feed is fetched before the run is claimed so that the claimed row
+	// isn't locked for as long as a slow feed takes to respond. If the feed
+	// can't be fetched, the run is skipped instead of being retried at every
+	// interval.
+	var (
+		now    = time.Now().In(loc)
+		items  = models.FeedItems{}
+		lastAt null.Time
+	)
+	if c.FeedURL != "" {
+		all, err := feed.Fetch(c.FeedURL, feedTimeout)
+		if err != nil {
+			res, cErr := app.queries.ClaimRecurringCampaignRun.Exec(c.ID, c.SendAt.Time, sch.Next(now))
+			if cErr != nil {
+				return fmt.Errorf("error scheduling next run: %v", cErr)
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				return nil
+			}
+			return fmt.Errorf("error fetching feed: %v. Skipping run", err)
+		}
+
+		// Items are sorted latest first. Items without dates are only
+		// included on the first run.
+		for _, it := range all {
+			if c.FeedLastItemAt.Valid && !it.PublishedAt.After(c.FeedLastItemAt.Time) {
+				continue
+			}
+			items = append(items, it)
+			if !it.PublishedAt.IsZero() && !lastAt.Valid {
+				lastAt = null.TimeFrom(it.PublishedAt)
+			}
+		}
+
+		// Undated items are never new after this run.
+		if !lastAt.Valid {
+			lastAt = null.TimeFrom(time.Now())
+		}
+	}
+
+	// The run is claimed and its child campaign is created in a transaction
+	// so that the run isn't lost if anything in between fails. The claimed
+	// row stays locked until then and other nodes find it already claimed.
+	tx, err := app.db.Beginx()
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %v", err)
+	}
+	defer tx.Rollback()
+
+	// Claim the run by scheduling the next one. If another node has
+	// already claimed it, there's nothing to do.
+	res, err := tx.Stmtx(app.queries.ClaimRecurringCampaignRun).Exec(c.ID, c.SendAt.Time, sch.Next(now))
+	if err != nil {
+		return fmt.Errorf("error scheduling next run: %v", err)
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		return nil
+	}
+
+	// Skip the run if the sending limit has been reached.
+	var meta models.CampaignMeta
+	if err := app.queries.ValidateStartCampaign.Get(&meta, c.ID); err != nil {
+		return fmt.Errorf("error checking sending limit: %v", err)
+	}
+	if meta.EmailAllowed < (meta.ToSend + meta.TotalSent) {
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error scheduling next run: %v", err)
+		}
+		return errors.New("sending limit reached. Skipping run")
+	}
+
+	if c.FeedURL != "" && len(items) == 0 {
+		app.log.Printf("no new feed items for recurring campaign (%s). Skipping run", c.Name)
+		if err := tx.Commit(); err != nil {
+			return fmt.Errorf("error scheduling next run: %v", err)
+		}
+		return nil
+	}
+
+	uu, err := uuid.NewV4()
+	if err != nil {
+		return fmt.Errorf("error generating UUID: %v", err)
+	}
+
+	var (
+		id   int
+		name = fmt.Sprintf("%s (%s)", c.Name, now.Format("2006-01-02 15:04"))
+	)
+	if err := tx.Stmtx(app.queries.CreateRecurringCampaignRun).Get(&id, c.ID, uu, name, items, lastAt); err != nil {
+		// The campaign has no lists. Discard the child and skip the run.
+		if err == sql.ErrNoRows {
+			tx.Rollback()
+			if _, err := app.queries.ClaimRecurringCampaignRun.Exec(c.ID, c.SendAt.Time, sch.Next(now)); err != nil {
+				return fmt.Errorf("error scheduling next run: %v", err)
+			}
+			return errors.New("campaign has no lists. Skipping run")
+		}
+		return fmt.Errorf("error creating campaign run: %v", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("error creating campaign run: %v", err)
+	}
+
+	app.log.Printf("created run (%s) of recurring campaign (%s) with %d feed items", name, c.Name, len(items))
+	return nil
+}
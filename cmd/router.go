@@ -66,6 +66,7 @@ func setupRouter(server *echo.Echo, db *sqlx.DB, lo *log.Logger) {
 	v1.PUT("/api/settings", handleUpdateSettings)
 	v1.POST("/api/admin/reload", handleReloadApp)
 	v1.GET("/api/logs", handleGetLogs)
+	v1.GET("/api/warmups", handleGetWarmups)
 
 	v1.GET("/api/subscribers/:id", handleGetSubscriber)
 	v1.GET("/api/subscribers/:id/export", handleExportSubscriberData)
@@ -104,11 +105,14 @@ func setupRouter(server *echo.Echo, db *sqlx.DB, lo *log.Logger) {
 
 	v1.GET("/api/campaigns", handleGetCampaigns)
 	v1.GET("/api/campaigns/running/stats", handleGetRunningCampaignStats)
+	v1.GET("/api/campaigns/running/pipeline", handleGetPipelineStats)
 	v1.GET("/api/campaigns/:id", handleGetCampaigns)
 	v1.GET("/api/campaigns/:id/preview", handlePreviewCampaign)
 	v1.POST("/api/campaigns/:id/preview", handlePreviewCampaign)
 	v1.POST("/api/campaigns/:id/text", handlePreviewCampaign)
 	v1.POST("/api/campaigns/:id/test", handleTestCampaign)
+	v1.GET("/api/campaigns/:id/dry-run", handleGetCampaignDryRun)
+	v1.POST("/api/campaigns/:id/dry-run", handleDryRunCampaign)
 	v1.POST("/api/automation/sendemail", handleSendTestEmailCampaign)
 	v1.POST("/api/campaigns", handleCreateCampaign)
 	v1.PUT("/api/campaigns/:id", handleUpdateCampaign)
@@ -128,4 +132,13 @@ func setupRouter(server *echo.Echo, db *sqlx.DB, lo *log.Logger) {
 	v1.PUT("/api/templates/:id", handleUpdateTemplate)
 	v1.PUT("/api/templates/:id/default", handleTemplateSetDefault)
 	v1.DELETE("/api/templates/:id", handleDeleteTemplate)
+
+	v1.POST("/api/tx", handleSendTxMessage)
+	v1.GET("/api/tx/:id", handleGetTxMessage)
+
+	v1.GET("/api/automations", handleGetAutomations)
+	v1.GET("/api/automations/:id", handleGetAutomations)
+	v1.POST("/api/automations", handleCreateAutomation)
+	v1.PUT("/api/automations/:id", handleUpdateAutomation)
+	v1.DELETE("/api/automations/:id", handleDeleteAutomation)
 }
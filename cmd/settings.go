@@ -4,6 +4,7 @@ import (
 	"context"
 	"encoding/json"
 	"net/http"
+	"path"
 	"regexp"
 	"strings"
 	"syscall"
@@ -11,6 +12,8 @@ import (
 
 	"github.com/gofrs/uuid"
 	"github.com/jmoiron/sqlx/types"
+	"github.com/knadh/listmonk/internal/manager"
+	"github.com/knadh/listmonk/internal/messenger/dkim"
 	"github.com/labstack/echo"
 	"github.com/machinebox/graphql"
 )
@@ -29,6 +32,30 @@ type settings struct {
 	AppConcurrency   int `json:"app.concurrency"`
 	AppMaxSendErrors int `json:"app.max_send_errors"`
 	AppMessageRate   int `json:"app.message_rate"`
+	AppMessageBurst  int `json:"app.message_burst"`
+
+	// Number of workers rendering campaign messages. 0 uses the number of CPUs.
+	AppRenderConcurrency int `json:"app.render_concurrency"`
+
+	AppMessengerRates  []messengerRate  `json:"app.messenger_rates"`
+	AppMessengerGroups []messengerGroup `json:"app.messenger_groups"`
+
+	AppMaxErrorRate      float64 `json:"app.max_error_rate"`
+	AppErrorRateWindow   int     `json:"app.error_rate_window"`
+	AppErrorRatePerClass bool    `json:"app.error_rate_per_class"`
+
+	AppRequeueOnError bool              `json:"app.requeue_on_error"`
+	AppMaxAttempts    int               `json:"app.max_attempts"`
+	AppRetryBackoff   map[string]string `json:"app.retry_backoff"`
+
+	AppFrequencyCaps []frequencyCap `json:"app.frequency_caps"`
+
+	AppDomainThrottles []domainThrottle `json:"app.domain_throttles"`
+
+	AppWarmups []warmup `json:"app.warmups"`
+
+	// Max total size (MB) of the attachments of a campaign.
+	AppAttachmentsMaxSize int `json:"app.attachments_max_size"`
 
 	AppMessageSlidingWindow         bool   `json:"app.message_sliding_window"`
 	AppMessageSlidingWindowDuration string `json:"app.message_sliding_window_duration"`
@@ -83,9 +110,58 @@ type settings struct {
 		MaxConns      int    `json:"max_conns"`
 		Timeout       string `json:"timeout"`
 		MaxMsgRetries int    `json:"max_msg_retries"`
+		HMACSecret    string `json:"hmac_secret,omitempty"`
+		BatchSize     int    `json:"batch_size"`
+		BatchWait     string `json:"batch_wait"`
 	} `json:"messengers"`
 }
 
+// messengerRate overrides the default message rate for a messenger.
+type messengerRate struct {
+	Messenger string `json:"messenger"`
+	Rate      int    `json:"rate"`
+	Burst     int    `json:"burst"`
+}
+
+// messengerGroup is a set of messengers that campaigns can target by the
+// group's name. See manager.MessengerGroup.
+type messengerGroup struct {
+	Enabled       bool                  `json:"enabled"`
+	Name          string                `json:"name"`
+	Messengers    []manager.GroupMember `json:"messengers"`
+	MaxErrorRate  float64               `json:"max_error_rate"`
+	ErrorWindow   int                   `json:"error_window"`
+	ProbeInterval string                `json:"probe_interval"`
+}
+
+// frequencyCap is the maximum number of campaign messages a subscriber can
+// be sent within a period, across all lists or only for the given lists.
+type frequencyCap struct {
+	Lists  []int  `json:"lists"`
+	Max    int    `json:"max"`
+	Period string `json:"period"`
+}
+
+// domainThrottle limits the messages per minute and the concurrency of
+// campaign messages to a group of recipient domains. Domain is either a
+// mailbox provider class (eg: SMART-GMAIL) or a domain glob (eg: *.yahoo.com).
+type domainThrottle struct {
+	Domain      string `json:"domain"`
+	Rate        int    `json:"rate"`
+	Concurrency int    `json:"concurrency"`
+}
+
+// warmup is a warm-up plan of a messenger with a daily cap for every day
+// starting from StartDate (YYYY-MM-DD). See manager.Warmup.
+type warmup struct {
+	Enabled           bool   `json:"enabled"`
+	Messenger         string `json:"messenger"`
+	StartDate         string `json:"start_date"`
+	DailyCaps         []int  `json:"daily_caps"`
+	EngagedOnlyDays   int    `json:"engaged_only_days"`
+	EngagedWithinDays int    `json:"engaged_within_days"`
+}
+
 type Proxy struct {
 	Url    string       `json:"url"`
 	Header []ListHeader `json:"header"`
@@ -118,6 +194,9 @@ var (
 	reAlphaNum = regexp.MustCompile(`[^a-z0-9\-]`)
 )
 
+// Date format of the start dates of warm-up plans.
+const warmupDateFormat = "2006-01-02"
+
 // handleGetSettings returns settings from the DB.
 func handleGetSettings(c echo.Context) error {
 	app := c.Get("app").(*App)
@@ -127,12 +206,20 @@ func handleGetSettings(c echo.Context) error {
 		return err
 	}
 
-	// Empty out passwords.
+	// Empty out passwords and DKIM keys.
 	for i := 0; i < len(s.SMTP); i++ {
 		s.SMTP[i].Password = ""
 	}
+	for i := range s.Providers {
+		for j := range s.Providers[i].Product {
+			for k := range s.Providers[i].Product[j].Connection {
+				s.Providers[i].Product[j].Connection[k].DKIM.PrivateKey = ""
+			}
+		}
+	}
 	for i := 0; i < len(s.Messengers); i++ {
 		s.Messengers[i].Password = ""
+		s.Messengers[i].HMACSecret = ""
 	}
 	s.UploadS3AwsSecretAccessKey = ""
 
@@ -183,6 +270,18 @@ func handleUpdateSettings(c echo.Context) error {
 						}
 					}
 				}
+
+				// Similarly, the DKIM private key is only sent when it's changed.
+				dk := &set.Providers[i].Product[j].Connection[k].DKIM
+				if dk.PrivateKey == "" {
+					dk.PrivateKey = providerDKIMKey(cur.Providers, v.UUID)
+				}
+				if v.Enabled && dk.Enabled {
+					if _, err := dkim.New(*dk); err != nil {
+						return echo.NewHTTPError(http.StatusBadRequest,
+							app.i18n.Ts("settings.invalidDKIM", "name", v.Host, "error", err.Error()))
+					}
+				}
 			}
 		}
 	}
@@ -230,6 +329,13 @@ func handleUpdateSettings(c echo.Context) error {
 				}
 			}
 		}
+		if m.HMACSecret == "" {
+			for _, c := range cur.Messengers {
+				if m.UUID == c.UUID {
+					set.Messengers[i].HMACSecret = c.HMACSecret
+				}
+			}
+		}
 
 		name := reAlphaNum.ReplaceAllString(strings.ToLower(m.Name), "")
 		if _, ok := names[name]; ok {
@@ -240,10 +346,96 @@ func handleUpdateSettings(c echo.Context) error {
 			return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("settings.invalidMessengerName"))
 		}
 
+		if m.BatchSize < 0 {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("settings.invalidMessengerBatch", "name", name))
+		}
+		if m.BatchWait != "" {
+			if d, err := time.ParseDuration(m.BatchWait); err != nil || d <= 0 {
+				return echo.NewHTTPError(http.StatusBadRequest,
+					app.i18n.Ts("settings.invalidMessengerBatch", "name", name))
+			}
+		}
+
 		set.Messengers[i].Name = name
 		names[name] = true
 	}
 
+	// Validate messenger groups. Their names share the namespace of messengers
+	// and their members should be loaded messengers (not groups).
+	for i, g := range set.AppMessengerGroups {
+		name := reAlphaNum.ReplaceAllString(strings.ToLower(strings.TrimSpace(g.Name)), "")
+		_, isMsgr := app.messengers[name]
+		ok := name != "" && !names[name] && !isMsgr && len(g.Messengers) > 0
+
+		if g.ProbeInterval != "" {
+			if d, err := time.ParseDuration(g.ProbeInterval); err != nil || d <= 0 {
+				ok = false
+			}
+		}
+		for _, m := range g.Messengers {
+			if _, has := app.messengers[m.Messenger]; !has || m.Weight < 0 {
+				ok = false
+			}
+		}
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("settings.invalidMessengerGroup", "name", g.Name))
+		}
+
+		set.AppMessengerGroups[i].Name = name
+		names[name] = true
+	}
+
+	// Validate frequency caps.
+	for _, fc := range set.AppFrequencyCaps {
+		if d, err := time.ParseDuration(fc.Period); err != nil || d <= 0 || fc.Max < 1 {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("settings.invalidFrequencyCap", "period", fc.Period))
+		}
+	}
+
+	// Validate domain throttles.
+	for i, t := range set.AppDomainThrottles {
+		// Mailbox provider classes are upper case (SMART-GMAIL) and domains lower case.
+		d := strings.TrimSpace(t.Domain)
+		if strings.HasPrefix(strings.ToUpper(d), "SMART-") {
+			d = strings.ToUpper(d)
+		} else {
+			d = strings.ToLower(d)
+		}
+		if _, err := path.Match(d, ""); d == "" || err != nil ||
+			t.Rate < 0 || t.Concurrency < 0 || (t.Rate == 0 && t.Concurrency == 0) {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("settings.invalidDomainThrottle", "name", t.Domain))
+		}
+		set.AppDomainThrottles[i].Domain = d
+	}
+
+	// Validate warm-up plans. A messenger can only have one.
+	warmups := map[string]bool{}
+	for _, w := range set.AppWarmups {
+		_, isMsgr := app.messengers[w.Messenger]
+		_, err := time.Parse(warmupDateFormat, w.StartDate)
+		ok := isMsgr && !warmups[w.Messenger] && err == nil && len(w.DailyCaps) > 0 &&
+			w.EngagedOnlyDays >= 0 && w.EngagedWithinDays >= 0
+		for _, n := range w.DailyCaps {
+			if n < 1 {
+				ok = false
+			}
+		}
+		if !ok {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("settings.invalidWarmup", "name", w.Messenger))
+		}
+		warmups[w.Messenger] = true
+	}
+
+	// Retain the attachment size cap if it's not sent.
+	if set.AppAttachmentsMaxSize < 1 {
+		set.AppAttachmentsMaxSize = cur.AppAttachmentsMaxSize
+	}
+
 	// S3 password?
 	if set.UploadS3AwsSecretAccessKey == "" {
 		set.UploadS3AwsSecretAccessKey = cur.UploadS3AwsSecretAccessKey
@@ -263,6 +455,11 @@ func handleUpdateSettings(c echo.Context) error {
 				"name", "{globals.terms.settings}", "error", pqErrMsg(err)))
 	}
 
+	// Rate limits are applied to the running campaign manager right away
+	// as they don't require a reload.
+	app.manager.SetRateLimits(set.AppMessageRate, set.AppMessageBurst,
+		makeMessengerRates(set.AppMessengerRates))
+
 	// If there are any active campaigns, don't do an auto reload and
 	// warn the user on the frontend.
 	if app.manager.HasRunningCampaigns() {
@@ -290,6 +487,102 @@ func handleGetLogs(c echo.Context) error {
 	return c.JSON(http.StatusOK, okResp{app.bufLog.Lines()})
 }
 
+// handleGetWarmups returns the progress of the warm-up plans of messengers.
+func handleGetWarmups(c echo.Context) error {
+	app := c.Get("app").(*App)
+
+	out, err := app.manager.GetWarmupProgress()
+	if err != nil {
+		app.log.Printf("error fetching warm-up progress: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{settings.warmups}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// makeMessengerRates returns a map of messenger names to their rate limits
+// from the list of per-messenger overrides in the settings.
+func makeMessengerRates(rates []messengerRate) map[string]manager.RateLimit {
+	out := make(map[string]manager.RateLimit, len(rates))
+	for _, r := range rates {
+		if r.Messenger == "" || r.Rate < 1 {
+			continue
+		}
+		out[r.Messenger] = manager.RateLimit{Rate: r.Rate, Burst: r.Burst}
+	}
+	return out
+}
+
+// makeDomainThrottles returns the campaign manager's recipient domain
+// throttles from the list of throttles in the settings.
+func makeDomainThrottles(throttles []domainThrottle) []manager.DomainThrottle {
+	out := make([]manager.DomainThrottle, 0, len(throttles))
+	for _, t := range throttles {
+		out = append(out, manager.DomainThrottle{
+			Pattern:     t.Domain,
+			Rate:        t.Rate,
+			Concurrency: t.Concurrency,
+		})
+	}
+	return out
+}
+
+// makeWarmups returns the campaign manager's warm-up plans from the list of
+// enabled plans in the settings. Invalid plans are ignored.
+func makeWarmups(warmups []warmup) []manager.Warmup {
+	out := make([]manager.Warmup, 0, len(warmups))
+	for _, w := range warmups {
+		start, err := time.Parse(warmupDateFormat, w.StartDate)
+		if !w.Enabled || err != nil || len(w.DailyCaps) == 0 {
+			continue
+		}
+
+		// Subscribers who have opened a message in the last 30 days are engaged by default.
+		if w.EngagedWithinDays < 1 {
+			w.EngagedWithinDays = 30
+		}
+		out = append(out, manager.Warmup{
+			Messenger:       w.Messenger,
+			StartDate:       start,
+			DailyCaps:       w.DailyCaps,
+			EngagedOnlyDays: w.EngagedOnlyDays,
+			EngagedWithin:   time.Hour * 24 * time.Duration(w.EngagedWithinDays),
+		})
+	}
+	return out
+}
+
+// makeFrequencyCaps returns the campaign manager's frequency caps from the
+// list of caps in the settings. Invalid caps are ignored.
+func makeFrequencyCaps(caps []frequencyCap) []manager.FrequencyCap {
+	out := make([]manager.FrequencyCap, 0, len(caps))
+	for _, c := range caps {
+		d, err := time.ParseDuration(c.Period)
+		if err != nil || d <= 0 || c.Max < 1 {
+			continue
+		}
+		out = append(out, manager.FrequencyCap{ListIDs: c.Lists, Max: c.Max, Period: d})
+	}
+	return out
+}
+
+// providerDKIMKey returns the DKIM private key of a provider connection
+// by its UUID.
+func providerDKIMKey(providers []ProvidersConfig, uuid string) string {
+	for _, p := range providers {
+		for _, pr := range p.Product {
+			for _, c := range pr.Connection {
+				if c.UUID == uuid {
+					return c.DKIM.PrivateKey
+				}
+			}
+		}
+	}
+	return ""
+}
+
 func getSettings(app *App) (settings, error) {
 	var (
 		b   types.JSONText
@@ -1129,7 +1129,8 @@ func handleQueryFilterSubscribers(c echo.Context) error {
 		listName,
 		"private",
 		"single",
-		pq.StringArray(normalizeTags([]string{}))); err != nil {
+		pq.StringArray(normalizeTags([]string{})),
+		""); err != nil {
 		app.log.Printf("error creating list: %v", err)
 		return echo.NewHTTPError(http.StatusInternalServerError,
 			app.i18n.Ts("globals.messages.errorCreating",
@@ -1415,7 +1416,8 @@ func handleQuerySmartFilterSubscribers(c echo.Context) error {
 			listName,
 			"private",
 			"single",
-			pq.StringArray(normalizeTags([]string{}))); err != nil {
+			pq.StringArray(normalizeTags([]string{})),
+			""); err != nil {
 			app.log.Printf("error creating list: %v", err)
 			return echo.NewHTTPError(http.StatusInternalServerError,
 				app.i18n.Ts("globals.messages.errorCreating",
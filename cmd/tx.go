@@ -0,0 +1,221 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/gofrs/uuid"
+	"github.com/knadh/listmonk/internal/manager"
+	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/models"
+	"github.com/labstack/echo"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+// txMessageStatus represents the delivery record of a transactional message.
+type txMessageStatus struct {
+	UUID         string    `db:"uuid" json:"message_id"`
+	SubscriberID null.Int  `db:"subscriber_id" json:"subscriber_id"`
+	TemplateID   null.Int  `db:"template_id" json:"template_id"`
+	Email        string    `db:"email" json:"email"`
+	Subject      string    `db:"subject" json:"subject"`
+	Status       string    `db:"status" json:"status"`
+	Messenger    string    `db:"messenger" json:"messenger"`
+	MessageID    string    `db:"message_id" json:"provider_message_id"`
+	Error        string    `db:"error" json:"error"`
+	CreatedAt    null.Time `db:"created_at" json:"created_at"`
+	UpdatedAt    null.Time `db:"updated_at" json:"updated_at"`
+}
+
+// handleSendTxMessage renders a stored template with arbitrary data for a
+// single subscriber and pushes the message to the manager's queue. It returns
+// the ID of the message whose delivery can be looked up.
+func handleSendTxMessage(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		m   models.TxMessage
+	)
+
+	if err := c.Bind(&m); err != nil {
+		return err
+	}
+
+	if err := validateTxMessage(&m, app); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, err.Error())
+	}
+
+	// Get the subscriber.
+	sub, err := getSubscriber(m.SubscriberID, m.SubscriberUUID, strings.ToLower(m.SubscriberEmail), app)
+	if err != nil {
+		return err
+	}
+	m.Subscriber = sub
+
+	// Get the template.
+	var tpls []models.Template
+	if err := app.queries.GetTemplates.Select(&tpls, m.TemplateID, false); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.templates}", "error", pqErrMsg(err)))
+	}
+	if len(tpls) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.template}"))
+	}
+
+	// Compile and render the message.
+	if err := m.Compile(tpls[0].Body, app.manager.GenericTemplateFuncs()); err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("templates.errorCompiling", "error", err.Error()))
+	}
+	subject, body, err := m.Render()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest,
+			app.i18n.Ts("templates.errorRendering", "error", err.Error()))
+	}
+
+	// Record the message so that its delivery can be tracked.
+	id, err := insertTxMessage(m, subject, 0, manager.DeliveryStatusQueued, app)
+	if err != nil {
+		app.log.Printf("error recording transactional message: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorCreating",
+				"name", "{globals.terms.txMessage}", "error", pqErrMsg(err)))
+	}
+
+	if err := pushTxMessage(id, m, subject, body, app); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("tx.errorSending", "error", err.Error()))
+	}
+
+	return c.JSON(http.StatusOK, okResp{struct {
+		MessageID string `json:"message_id"`
+	}{id}})
+}
+
+// handleGetTxMessage returns the delivery record of a transactional message.
+func handleGetTxMessage(c echo.Context) error {
+	var (
+		app = c.Get("app").(*App)
+		id  = c.Param("id")
+	)
+
+	if !reUUID.MatchString(id) {
+		return echo.NewHTTPError(http.StatusBadRequest, app.i18n.T("globals.messages.invalidUUID"))
+	}
+
+	var out txMessageStatus
+	if err := app.queries.GetTxMessage.Get(&out, id); err != nil {
+		if err == sql.ErrNoRows {
+			return echo.NewHTTPError(http.StatusBadRequest,
+				app.i18n.Ts("globals.messages.notFound", "name", "{globals.terms.txMessage}"))
+		}
+
+		app.log.Printf("error fetching transactional message: %v", err)
+		return echo.NewHTTPError(http.StatusInternalServerError,
+			app.i18n.Ts("globals.messages.errorFetching",
+				"name", "{globals.terms.txMessage}", "error", pqErrMsg(err)))
+	}
+
+	return c.JSON(http.StatusOK, okResp{out})
+}
+
+// validateTxMessage validates transactional message fields and fills
+// in the defaults.
+func validateTxMessage(m *models.TxMessage, app *App) error {
+	if m.SubscriberID < 1 && m.SubscriberUUID == "" && m.SubscriberEmail == "" {
+		return errors.New(app.i18n.T("tx.fieldInvalidSubscriber"))
+	}
+	if m.SubscriberUUID != "" && !reUUID.MatchString(m.SubscriberUUID) {
+		return errors.New(app.i18n.T("globals.messages.invalidUUID"))
+	}
+	if m.TemplateID < 1 {
+		return errors.New(app.i18n.T("tx.fieldInvalidTemplate"))
+	}
+	if !strHasLen(m.Subject, 1, stdInputMaxLen) {
+		return errors.New(app.i18n.T("campaigns.fieldInvalidSubject"))
+	}
+
+	if m.FromEmail == "" {
+		m.FromEmail = app.constants.FromEmail
+	}
+	if m.ContentType == "" {
+		m.ContentType = models.CampaignContentTypeHTML
+	}
+	if m.Messenger == "" {
+		m.Messenger = emailMsgr
+	}
+	if !app.manager.HasMessenger(m.Messenger) {
+		return errors.New(app.i18n.Ts("campaigns.fieldInvalidMessenger", "name", m.Messenger))
+	}
+
+	for _, a := range m.Attachments {
+		if a.Name == "" || len(a.Content) == 0 {
+			return errors.New(app.i18n.T("tx.fieldInvalidAttachment"))
+		}
+	}
+
+	return nil
+}
+
+// insertTxMessage records a transactional message with the given delivery
+// status and returns its ID. stepID is the automation step that the message
+// belongs to, if any.
+func insertTxMessage(m models.TxMessage, subject string, stepID int, status string, app *App) (string, error) {
+	uu, err := uuid.NewV4()
+	if err != nil {
+		return "", err
+	}
+	id := uu.String()
+
+	if _, err := app.queries.InsertTxMessage.Exec(id, m.Subscriber.ID, m.TemplateID,
+		m.Subscriber.Email, subject, m.Messenger, stepID, status); err != nil {
+		return "", err
+	}
+	return id, nil
+}
+
+// pushTxMessage pushes a rendered transactional message that has been recorded
+// to the manager's queue. If it can't be queued, the message is marked as failed.
+func pushTxMessage(id string, m models.TxMessage, subject string, body []byte, app *App) error {
+	msg := manager.Message{
+		Subscriber: m.Subscriber,
+		Messenger:  m.Messenger,
+		ID:         id,
+	}
+	msg.From = m.FromEmail
+	msg.To = []string{m.Subscriber.Email}
+	msg.Subject = subject
+	msg.ContentType = m.ContentType
+	msg.Body = body
+
+	if len(m.Headers) > 0 {
+		msg.Headers = make(textproto.MIMEHeader, len(m.Headers))
+		for k, v := range m.Headers {
+			msg.Headers.Set(k, v)
+		}
+	}
+	for _, a := range m.Attachments {
+		msg.Attachments = append(msg.Attachments, messenger.Attachment{
+			Name:    a.Name,
+			Header:  messenger.MakeAttachmentHeader(a.Name, "base64"),
+			Content: a.Content,
+		})
+	}
+
+	if err := app.manager.PushMessage(msg); err != nil {
+		markTxMessageFailed(id, err, app)
+		return err
+	}
+	return nil
+}
+
+// markTxMessageFailed marks a recorded transactional message as failed.
+func markTxMessageFailed(id string, err error, app *App) {
+	if _, err := app.queries.UpdateTxMessage.Exec(id, manager.DeliveryStatusFailed, "", err.Error()); err != nil {
+		app.log.Printf("error recording transactional message failure: %v", err)
+	}
+}
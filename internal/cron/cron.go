@@ -0,0 +1,249 @@
+// Package cron parses standard 5 field cron expressions (minute, hour,
+// day of month, month, day of week) and computes their next occurrences.
+package cron
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Schedule is a parsed cron expression. Every field is a bitset of the
+// values that match.
+type Schedule struct {
+	minute, hour, dom, month, dow uint64
+
+	// If either of the day fields is *, both have to match (which one
+	// does trivially). Otherwise, a day matches if either of them does.
+	domStar, dowStar bool
+}
+
+type bounds struct {
+	min, max int
+	names    map[string]int
+}
+
+var (
+	minutes = bounds{0, 59, nil}
+	hours   = bounds{0, 23, nil}
+	doms    = bounds{1, 31, nil}
+	months  = bounds{1, 12, map[string]int{
+		"jan": 1, "feb": 2, "mar": 3, "apr": 4, "may": 5, "jun": 6,
+		"jul": 7, "aug": 8, "sep": 9, "oct": 10, "nov": 11, "dec": 12,
+	}}
+	dows = bounds{0, 7, map[string]int{
+		"sun": 0, "mon": 1, "tue": 2, "wed": 3, "thu": 4, "fri": 5, "sat": 6,
+	}}
+
+	descriptors = map[string]string{
+		"@yearly":   "0 0 1 1 *",
+		"@annually": "0 0 1 1 *",
+		"@monthly":  "0 0 1 * *",
+		"@weekly":   "0 0 * * 0",
+		"@daily":    "0 0 * * *",
+		"@hourly":   "0 * * * *",
+	}
+)
+
+// allHours is the hour bitset of a schedule that runs every hour.
+const allHours = 1<<24 - 1
+
+// Max number of years to look ahead for an occurrence. Expressions such
+// as Feb 30 never occur.
+const maxLookAhead = 5
+
+// Parse parses a cron expression, eg: "0 9 * * mon" (every Monday at 09:00).
+// The @yearly, @monthly, @weekly, @daily, and @hourly descriptors are
+// also accepted.
+func Parse(expr string) (*Schedule, error) {
+	expr = strings.TrimSpace(strings.ToLower(expr))
+	if d, ok := descriptors[expr]; ok {
+		expr = d
+	}
+
+	f := strings.Fields(expr)
+	if len(f) != 5 {
+		return nil, fmt.Errorf("expected 5 fields, got %d", len(f))
+	}
+
+	var (
+		s   Schedule
+		err error
+	)
+	if s.minute, err = parseField(f[0], minutes); err != nil {
+		return nil, fmt.Errorf("invalid minute: %v", err)
+	}
+	if s.hour, err = parseField(f[1], hours); err != nil {
+		return nil, fmt.Errorf("invalid hour: %v", err)
+	}
+	if s.dom, err = parseField(f[2], doms); err != nil {
+		return nil, fmt.Errorf("invalid day of month: %v", err)
+	}
+	if s.month, err = parseField(f[3], months); err != nil {
+		return nil, fmt.Errorf("invalid month: %v", err)
+	}
+
+	if s.dow, err = parseField(f[4], dows); err != nil {
+		return nil, fmt.Errorf("invalid day of week: %v", err)
+	}
+	// 7 is also Sunday.
+	if has(s.dow, 7) {
+		s.dow |= 1
+	}
+	s.domStar = f[2] == "*" || f[2] == "?"
+	s.dowStar = f[4] == "*" || f[4] == "?"
+
+	if _, ok := s.next(time.Date(2000, 1, 1, 0, 0, 0, 0, time.UTC), 30); !ok {
+		return nil, errors.New("the schedule never occurs")
+	}
+	return &s, nil
+}
+
+// Next returns the first occurrence of the schedule after t in t's location.
+// It returns the zero time if there's none within the next few years.
+func (s *Schedule) Next(t time.Time) time.Time {
+	n, _ := s.next(t, maxLookAhead)
+	return n
+}
+
+func (s *Schedule) next(t time.Time, years int) (time.Time, bool) {
+	var (
+		loc   = t.Location()
+		limit = t.Year() + years
+	)
+
+	// Start at the next whole minute.
+	t = t.Truncate(time.Minute).Add(time.Minute)
+
+	for t.Year() <= limit {
+		if !has(s.month, int(t.Month())) {
+			t = date(t.Year(), t.Month()+1, 1, 0, loc)
+			continue
+		}
+		if !s.dayMatches(t) {
+			t = date(t.Year(), t.Month(), t.Day()+1, 0, loc)
+			continue
+		}
+		if !has(s.hour, t.Hour()) {
+			t = date(t.Year(), t.Month(), t.Day(), t.Hour()+1, loc)
+			continue
+		}
+		if !has(s.minute, t.Minute()) {
+			t = t.Add(time.Minute)
+			continue
+		}
+
+		// A time of the day that's repeated when DST ends only occurs
+		// once, unless the schedule runs every hour.
+		if s.hour != allHours && repeated(t) {
+			t = t.Add(time.Minute)
+			continue
+		}
+		return t, true
+	}
+
+	return time.Time{}, false
+}
+
+// date returns the start of an hour on a date in a location. An hour that's
+// skipped when DST starts is moved forward by the change as time.Date may
+// normalize it to an hour before the change, which would never advance.
+func date(year int, month time.Month, day, hour int, loc *time.Location) time.Time {
+	var (
+		t    = time.Date(year, month, day, hour, 0, 0, 0, loc)
+		want = time.Date(year, month, day, hour, 0, 0, 0, time.UTC)
+	)
+	if t.Day() == want.Day() && t.Hour() == want.Hour() {
+		return t
+	}
+
+	_, before := t.Zone()
+	_, after := t.Add(time.Hour * 3).Zone()
+	return t.Add(time.Duration(after-before) * time.Second)
+}
+
+// repeated checks whether the wall clock time of t occurred an hour before,
+// ie: t is in the hour that's repeated when DST ends.
+func repeated(t time.Time) bool {
+	p := t.Add(-time.Hour)
+	return p.Hour() == t.Hour() && p.Minute() == t.Minute()
+}
+
+func (s *Schedule) dayMatches(t time.Time) bool {
+	var (
+		dom = has(s.dom, t.Day())
+		dow = has(s.dow, int(t.Weekday()))
+	)
+	if s.domStar || s.dowStar {
+		return dom && dow
+	}
+	return dom || dow
+}
+
+// parseField parses a comma separated list of values, ranges (a-b),
+// and steps (*/n, a-b/n, a/n) into a bitset.
+func parseField(field string, b bounds) (uint64, error) {
+	var out uint64
+	for _, p := range strings.Split(field, ",") {
+		step := 1
+		if i := strings.Index(p, "/"); i >= 0 {
+			n, err := strconv.Atoi(p[i+1:])
+			if err != nil || n < 1 {
+				return 0, fmt.Errorf("invalid step in %s", p)
+			}
+			step = n
+			p = p[:i]
+		}
+
+		var lo, hi int
+		switch {
+		case p == "*" || p == "?":
+			lo, hi = b.min, b.max
+		case strings.Contains(p, "-"):
+			r := strings.SplitN(p, "-", 2)
+			var err error
+			if lo, err = parseValue(r[0], b); err != nil {
+				return 0, err
+			}
+			if hi, err = parseValue(r[1], b); err != nil {
+				return 0, err
+			}
+		default:
+			v, err := parseValue(p, b)
+			if err != nil {
+				return 0, err
+			}
+			lo, hi = v, v
+
+			// a/n is a/n until the max.
+			if step > 1 {
+				hi = b.max
+			}
+		}
+
+		if lo > hi {
+			return 0, fmt.Errorf("invalid range %s", p)
+		}
+		for v := lo; v <= hi; v += step {
+			out |= 1 << uint(v)
+		}
+	}
+	return out, nil
+}
+
+func parseValue(s string, b bounds) (int, error) {
+	if v, ok := b.names[s]; ok {
+		return v, nil
+	}
+	v, err := strconv.Atoi(s)
+	if err != nil || v < b.min || v > b.max {
+		return 0, fmt.Errorf("invalid value %s", s)
+	}
+	return v, nil
+}
+
+func has(set uint64, v int) bool {
+	return set&(1<<uint(v)) != 0
+}
@@ -0,0 +1,190 @@
+package cron
+
+import (
+	"testing"
+	"time"
+)
+
+func TestParse(t *testing.T) {
+	cases := []struct {
+		expr    string
+		wantErr bool
+	}{
+		{"* * * * *", false},
+		{"0 9 * * mon", false},
+		{"0 9 * * MON-FRI", false},
+		{"*/15 0-6,18-23 1,15 jan-jun,dec 0,7", false},
+		{"0 0 29 2 *", false},
+		{"0 12 ? * sun", false},
+		{"10/20 * * * *", false},
+		{"  @daily  ", false},
+		{"@yearly", false},
+		{"@weekly", false},
+
+		{"", true},
+		{"* * * *", true},
+		{"* * * * * *", true},
+		{"60 * * * *", true},
+		{"* 24 * * *", true},
+		{"* * 0 * *", true},
+		{"* * 32 * *", true},
+		{"* * * 0 *", true},
+		{"* * * 13 *", true},
+		{"* * * * 8", true},
+		{"* * * * funday", true},
+		{"*/0 * * * *", true},
+		{"*/x * * * *", true},
+		{"5-1 * * * *", true},
+		{"1-2-3 * * * *", true},
+		{"a * * * *", true},
+		{"@every 5m", true},
+
+		// Valid fields that never occur together.
+		{"0 0 30 2 *", true},
+		{"0 0 31 4,6,9,11 *", true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.expr, func(t *testing.T) {
+			_, err := Parse(c.expr)
+			if (err != nil) != c.wantErr {
+				t.Errorf("Parse(%q) err = %v, want error: %v", c.expr, err, c.wantErr)
+			}
+		})
+	}
+}
+
+func TestNext(t *testing.T) {
+	cases := []struct {
+		name string
+		expr string
+		loc  string
+		from string
+		want string
+	}{
+		{"every minute", "* * * * *", "UTC", "2021-01-01T00:00:00Z", "2021-01-01T00:01:00Z"},
+		{"seconds truncated", "* * * * *", "UTC", "2021-01-01T00:00:30Z", "2021-01-01T00:01:00Z"},
+		{"weekday", "0 9 * * mon", "UTC", "2021-01-01T00:00:00Z", "2021-01-04T09:00:00Z"},
+		{"sunday as 7", "0 0 * * 7", "UTC", "2021-01-01T00:00:00Z", "2021-01-03T00:00:00Z"},
+		{"next month", "30 2 1 * *", "UTC", "2021-01-01T03:00:00Z", "2021-02-01T02:30:00Z"},
+		{"skips short months", "0 0 31 * *", "UTC", "2021-01-31T01:00:00Z", "2021-03-31T00:00:00Z"},
+		{"leap day", "0 0 29 2 *", "UTC", "2021-01-01T00:00:00Z", "2024-02-29T00:00:00Z"},
+		{"step", "*/15 * * * *", "UTC", "2021-01-01T00:07:00Z", "2021-01-01T00:15:00Z"},
+		{"range step", "5-10/2 * * * *", "UTC", "2021-01-01T00:06:00Z", "2021-01-01T00:07:00Z"},
+		{"value step", "10/20 * * * *", "UTC", "2021-01-01T00:31:00Z", "2021-01-01T00:50:00Z"},
+		{"month and weekday names", "0 9 * may-jul mon-fri", "UTC", "2021-01-01T00:00:00Z", "2021-05-03T09:00:00Z"},
+		{"yearly", "@yearly", "UTC", "2021-01-01T00:00:00Z", "2022-01-01T00:00:00Z"},
+		{"hourly", "@hourly", "UTC", "2021-01-01T00:00:00Z", "2021-01-01T01:00:00Z"},
+		{"year end", "0 0 1 1 *", "UTC", "2021-12-31T23:59:00Z", "2022-01-01T00:00:00Z"},
+
+		// If both day fields are restricted, either of them matches.
+		// 2021-01-01 is a Friday.
+		{"dom or dow, dom", "0 12 1-7 * mon", "UTC", "2021-01-01T00:00:00Z", "2021-01-01T12:00:00Z"},
+		{"dom or dow, dow", "0 12 1-7 * mon", "UTC", "2021-01-07T13:00:00Z", "2021-01-11T12:00:00Z"},
+		{"dom or dow, first", "0 12 13 * fri", "UTC", "2021-01-01T13:00:00Z", "2021-01-08T12:00:00Z"},
+
+		// If either is *, both have to match.
+		{"dow only", "0 12 * * fri", "UTC", "2021-01-01T13:00:00Z", "2021-01-08T12:00:00Z"},
+		{"dom only", "0 12 13 * *", "UTC", "2021-01-01T13:00:00Z", "2021-01-13T12:00:00Z"},
+		{"dom with ?", "0 12 13 * ?", "UTC", "2021-01-01T13:00:00Z", "2021-01-13T12:00:00Z"},
+		{"dom or dow, friday the 6th", "0 0 13 * fri", "UTC", "2021-08-01T00:00:00Z", "2021-08-06T00:00:00Z"},
+
+		// Times are in the location of the start time.
+		{"location", "0 9 * * *", "Asia/Kolkata", "2021-01-01T04:00:00Z", "2021-01-02T03:30:00Z"},
+		{"location day", "0 9 * * sat", "America/New_York", "2021-01-02T02:00:00Z", "2021-01-02T14:00:00Z"},
+
+		// DST starts in New York on 2021-03-14 at 02:00 (EST to EDT).
+		{"after dst starts", "0 3 * * *", "America/New_York", "2021-03-14T04:00:00Z", "2021-03-14T07:00:00Z"},
+		{"wall clock across dst", "0 9 * * *", "America/New_York", "2021-03-13T15:00:00Z", "2021-03-14T13:00:00Z"},
+		{"hourly across dst", "0 * * * *", "America/New_York", "2021-03-14T06:30:00Z", "2021-03-14T07:00:00Z"},
+		{"skipped time", "30 2 * * *", "America/New_York", "2021-03-14T04:00:00Z", "2021-03-15T06:30:00Z"},
+
+		// DST ends in New York on 2021-11-07 at 02:00 (EDT to EST) and
+		// 01:00-01:59 is repeated.
+		{"repeated time, first", "30 1 * * *", "America/New_York", "2021-11-07T04:00:00Z", "2021-11-07T05:30:00Z"},
+		{"repeated time, once", "30 1 * * *", "America/New_York", "2021-11-07T05:30:00Z", "2021-11-08T06:30:00Z"},
+		{"repeated hour, hourly", "0 * * * *", "America/New_York", "2021-11-07T05:00:00Z", "2021-11-07T06:00:00Z"},
+		{"after dst ends", "0 9 * * *", "America/New_York", "2021-11-06T14:00:00Z", "2021-11-07T14:00:00Z"},
+
+		// Midnight was skipped in São Paulo on 2018-11-04.
+		{"skipped midnight", "0 0 * * *", "America/Sao_Paulo", "2018-11-03T15:00:00Z", "2018-11-05T02:00:00Z"},
+		{"day after skipped midnight", "0 12 * * *", "America/Sao_Paulo", "2018-11-03T16:00:00Z", "2018-11-04T14:00:00Z"},
+		{"month with skipped midnight", "0 12 4 11 *", "America/Sao_Paulo", "2018-10-10T12:00:00Z", "2018-11-04T14:00:00Z"},
+
+		// Occurrences beyond the look ahead.
+		{"beyond look ahead", "0 0 29 2 *", "UTC", "2097-03-01T00:00:00Z", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			loc, err := time.LoadLocation(c.loc)
+			if err != nil {
+				t.Skipf("timezone data unavailable: %v", err)
+			}
+			s, err := Parse(c.expr)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			from, _ := time.Parse(time.RFC3339, c.from)
+			got := nextOrFail(t, s, from.In(loc))
+
+			if c.want == "" {
+				if !got.IsZero() {
+					t.Errorf("Next(%s) = %s, want none", c.from, got.UTC())
+				}
+				return
+			}
+
+			want, _ := time.Parse(time.RFC3339, c.want)
+			if !got.Equal(want) {
+				t.Errorf("Next(%s) = %s (%s), want %s", c.from, got.UTC(), got, c.want)
+			}
+			if got.Location() != loc {
+				t.Errorf("location = %s, want %s", got.Location(), loc)
+			}
+		})
+	}
+}
+
+func TestNextSequence(t *testing.T) {
+	loc, err := time.LoadLocation("America/New_York")
+	if err != nil {
+		t.Skipf("timezone data unavailable: %v", err)
+	}
+
+	// Every occurrence of an hourly schedule around both DST changes
+	// is an hour apart.
+	s, _ := Parse("0 * * * *")
+	for _, from := range []time.Time{
+		time.Date(2021, 3, 13, 20, 0, 0, 0, loc),
+		time.Date(2021, 11, 6, 20, 0, 0, 0, loc),
+	} {
+		prev := from
+		for i := 0; i < 12; i++ {
+			n := nextOrFail(t, s, prev)
+			if d := n.Sub(prev); d != time.Hour {
+				t.Fatalf("Next(%s) = %s, %v later", prev, n, d)
+			}
+			prev = n
+		}
+	}
+}
+
+// nextOrFail calls s.Next and fails if it doesn't return.
+func nextOrFail(t *testing.T, s *Schedule, from time.Time) time.Time {
+	t.Helper()
+
+	out := make(chan time.Time, 1)
+	go func() {
+		out <- s.Next(from)
+	}()
+
+	select {
+	case n := <-out:
+		return n
+	case <-time.After(time.Second * 5):
+		t.Fatalf("Next(%s) didn't return", from)
+	}
+	return time.Time{}
+}
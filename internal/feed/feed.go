@@ -0,0 +1,205 @@
+// Package feed fetches and parses RSS 2.0 and Atom feeds into
+// campaign feed items.
+package feed
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// Max size of a feed that's read.
+const maxFeedSize = 10 * 1024 * 1024
+
+// Date formats seen in the wild in RSS pubDate and Atom published/updated.
+var dateFormats = []string{
+	time.RFC1123Z,
+	time.RFC1123,
+	time.RFC3339,
+	time.RFC3339Nano,
+	time.RFC822Z,
+	time.RFC822,
+	"Mon, 2 Jan 2006 15:04:05 -0700",
+	"Mon, 2 Jan 2006 15:04:05 MST",
+	"2 Jan 2006 15:04:05 -0700",
+	"2006-01-02T15:04:05",
+	"2006-01-02",
+}
+
+// Offsets of the timezone names allowed in RFC 822 dates. time.Parse only
+// knows the offsets of the names of the local timezone and takes the rest
+// to be UTC.
+var rfc822Zones = map[string]string{
+	"UT":  "+0000",
+	"GMT": "+0000",
+	"Z":   "+0000",
+	"EST": "-0500",
+	"EDT": "-0400",
+	"CST": "-0600",
+	"CDT": "-0500",
+	"MST": "-0700",
+	"MDT": "-0600",
+	"PST": "-0800",
+	"PDT": "-0700",
+}
+
+type rss struct {
+	Channel struct {
+		Items []struct {
+			Title       string `xml:"title"`
+			Link        string `xml:"link"`
+			GUID        string `xml:"guid"`
+			Description string `xml:"description"`
+			Content     string `xml:"http://purl.org/rss/1.0/modules/content/ encoded"`
+			Author      string `xml:"author"`
+			Creator     string `xml:"http://purl.org/dc/elements/1.1/ creator"`
+			PubDate     string `xml:"pubDate"`
+			Date        string `xml:"http://purl.org/dc/elements/1.1/ date"`
+		} `xml:"item"`
+	} `xml:"channel"`
+}
+
+type atom struct {
+	Entries []struct {
+		Title string `xml:"title"`
+		ID    string `xml:"id"`
+		Links []struct {
+			Href string `xml:"href,attr"`
+			Rel  string `xml:"rel,attr"`
+		} `xml:"link"`
+		Summary   string `xml:"summary"`
+		Content   string `xml:"content"`
+		Author    string `xml:"author>name"`
+		Published string `xml:"published"`
+		Updated   string `xml:"updated"`
+	} `xml:"entry"`
+}
+
+// Fetch fetches a feed from a URL and parses it.
+func Fetch(url string, timeout time.Duration) ([]models.FeedItem, error) {
+	c := http.Client{Timeout: timeout}
+	resp, err := c.Get(url)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("error fetching feed: %s", resp.Status)
+	}
+
+	return Parse(io.LimitReader(resp.Body, maxFeedSize))
+}
+
+// Parse parses an RSS or Atom feed. The items are sorted by their
+// publication date, latest first.
+func Parse(r io.Reader) ([]models.FeedItem, error) {
+	b, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	// Find the root element to tell RSS from Atom.
+	var root string
+	dec := xml.NewDecoder(bytes.NewReader(b))
+	for {
+		t, err := dec.Token()
+		if err != nil {
+			return nil, fmt.Errorf("error parsing feed: %v", err)
+		}
+		if el, ok := t.(xml.StartElement); ok {
+			root = el.Name.Local
+			break
+		}
+	}
+
+	var out []models.FeedItem
+	switch root {
+	case "rss":
+		var f rss
+		if err := xml.Unmarshal(b, &f); err != nil {
+			return nil, fmt.Errorf("error parsing RSS feed: %v", err)
+		}
+		for _, i := range f.Channel.Items {
+			it := models.FeedItem{
+				ID:          first(i.GUID, i.Link),
+				Title:       strings.TrimSpace(i.Title),
+				URL:         strings.TrimSpace(i.Link),
+				Description: strings.TrimSpace(i.Description),
+				Content:     strings.TrimSpace(first(i.Content, i.Description)),
+				Author:      strings.TrimSpace(first(i.Author, i.Creator)),
+			}
+			it.PublishedAt = parseDate(first(i.PubDate, i.Date))
+			out = append(out, it)
+		}
+
+	case "feed":
+		var f atom
+		if err := xml.Unmarshal(b, &f); err != nil {
+			return nil, fmt.Errorf("error parsing Atom feed: %v", err)
+		}
+		for _, e := range f.Entries {
+			it := models.FeedItem{
+				ID:          e.ID,
+				Title:       strings.TrimSpace(e.Title),
+				Description: strings.TrimSpace(e.Summary),
+				Content:     strings.TrimSpace(first(e.Content, e.Summary)),
+				Author:      strings.TrimSpace(e.Author),
+			}
+			for _, l := range e.Links {
+				if l.Rel == "" || l.Rel == "alternate" {
+					it.URL = l.Href
+					break
+				}
+			}
+			it.PublishedAt = parseDate(first(e.Published, e.Updated))
+			out = append(out, it)
+		}
+
+	default:
+		return nil, errors.New("unknown feed format")
+	}
+
+	sort.SliceStable(out, func(i, j int) bool {
+		return out[i].PublishedAt.After(out[j].PublishedAt)
+	})
+	return out, nil
+}
+
+// parseDate parses a feed date. It returns the zero time if the date
+// can't be parsed.
+func parseDate(s string) time.Time {
+	s = strings.TrimSpace(s)
+
+	// Replace an RFC 822 timezone name with its offset.
+	if i := strings.LastIndexByte(s, ' '); i > 0 {
+		if off, ok := rfc822Zones[strings.ToUpper(s[i+1:])]; ok {
+			s = s[:i+1] + off
+		}
+	}
+
+	for _, f := range dateFormats {
+		if t, err := time.Parse(f, s); err == nil {
+			return t
+		}
+	}
+	return time.Time{}
+}
+
+func first(s ...string) string {
+	for _, v := range s {
+		if strings.TrimSpace(v) != "" {
+			return v
+		}
+	}
+	return ""
+}
@@ -0,0 +1,229 @@
+package feed
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseDate(t *testing.T) {
+	cases := []struct {
+		in   string
+		want string
+	}{
+		// RSS (RFC 822 and variants).
+		{"Tue, 10 Jun 2003 04:00:00 +0000", "2003-06-10T04:00:00Z"},
+		{"Tue, 10 Jun 2003 09:30:00 +0530", "2003-06-10T04:00:00Z"},
+		{"Tue, 10 Jun 2003 04:00:00 GMT", "2003-06-10T04:00:00Z"},
+		{"Tue, 10 Jun 2003 04:00:00 UT", "2003-06-10T04:00:00Z"},
+		{"Tue, 10 Jun 2003 00:00:00 EDT", "2003-06-10T04:00:00Z"},
+		{"Tue, 10 Jun 2003 23:00:00 est", "2003-06-11T04:00:00Z"},
+		{"Mon, 09 Jun 2003 21:00:00 PDT", "2003-06-10T04:00:00Z"},
+		{"Mon, 09 Jun 2003 22:00:00 CST", "2003-06-10T04:00:00Z"},
+		{"Tue, 3 Jun 2003 04:00:00 +0000", "2003-06-03T04:00:00Z"},
+		{"Tue, 3 Jun 2003 04:00:00 MDT", "2003-06-03T10:00:00Z"},
+		{"3 Jun 2003 04:00:00 -0100", "2003-06-03T05:00:00Z"},
+		{"10 Jun 03 04:00 +0000", "2003-06-10T04:00:00Z"},
+		{"10 Jun 03 04:00 GMT", "2003-06-10T04:00:00Z"},
+		{"  Tue, 10 Jun 2003 04:00:00 GMT\n", "2003-06-10T04:00:00Z"},
+
+		// Unknown timezone names are taken to be UTC.
+		{"Tue, 10 Jun 2003 04:00:00 XYZT", "2003-06-10T04:00:00Z"},
+
+		// Atom and dc:date (RFC 3339 and variants).
+		{"2003-12-13T18:30:02Z", "2003-12-13T18:30:02Z"},
+		{"2003-12-13T18:30:02.25Z", "2003-12-13T18:30:02.25Z"},
+		{"2003-12-13T18:30:02+01:00", "2003-12-13T17:30:02Z"},
+		{"2003-12-13T18:30:02", "2003-12-13T18:30:02Z"},
+		{"2003-12-13", "2003-12-13T00:00:00Z"},
+
+		// Invalid dates.
+		{"", ""},
+		{"yesterday", ""},
+		{"2003-13-13", ""},
+		{"Tue, 10 Jun 2003 25:00:00 GMT", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.in, func(t *testing.T) {
+			got := parseDate(c.in)
+			if c.want == "" {
+				if !got.IsZero() {
+					t.Errorf("parseDate(%q) = %s, want zero", c.in, got)
+				}
+				return
+			}
+
+			want, _ := time.Parse(time.RFC3339Nano, c.want)
+			if !got.Equal(want) {
+				t.Errorf("parseDate(%q) = %s, want %s", c.in, got.UTC(), want)
+			}
+		})
+	}
+}
+
+const rssFeed = `<?xml version="1.0"?>
+<rss version="2.0" xmlns:content="http://purl.org/rss/1.0/modules/content/" xmlns:dc="http://purl.org/dc/elements/1.1/">
+<channel>
+	<title>Blog</title>
+	<item>
+		<title> Older post </title>
+		<link>https://example.com/older</link>
+		<description>Older summary</description>
+		<author>jane@example.com (Jane)</author>
+		<pubDate>Mon, 09 Jun 2003 04:00:00 GMT</pubDate>
+	</item>
+	<item>
+		<title>Newer post</title>
+		<link>https://example.com/newer</link>
+		<guid>post-2</guid>
+		<description>Newer summary</description>
+		<content:encoded><![CDATA[<p>Newer content</p>]]></content:encoded>
+		<dc:creator>John</dc:creator>
+		<dc:date>2003-06-10T04:00:00Z</dc:date>
+	</item>
+	<item>
+		<title>Undated post</title>
+		<link>https://example.com/undated</link>
+	</item>
+</channel>
+</rss>`
+
+const atomFeed = `<?xml version="1.0" encoding="utf-8"?>
+<feed xmlns="http://www.w3.org/2005/Atom">
+	<title>Blog</title>
+	<entry>
+		<title>Updated entry</title>
+		<id>urn:uuid:1</id>
+		<link rel="edit" href="https://example.com/edit/1"/>
+		<link href="https://example.com/1"/>
+		<summary>Summary 1</summary>
+		<author><name>Jane</name></author>
+		<updated>2003-12-13T18:30:02Z</updated>
+	</entry>
+	<entry>
+		<title>Published entry</title>
+		<id>urn:uuid:2</id>
+		<link rel="alternate" href="https://example.com/2"/>
+		<summary>Summary 2</summary>
+		<content type="html">&lt;p&gt;Content 2&lt;/p&gt;</content>
+		<published>2003-12-14T10:00:00+01:00</published>
+		<updated>2003-12-01T00:00:00Z</updated>
+	</entry>
+</feed>`
+
+func TestParse(t *testing.T) {
+	type item struct {
+		id, title, url, desc, content, author, date string
+	}
+
+	cases := []struct {
+		name    string
+		feed    string
+		want    []item
+		wantErr bool
+	}{
+		{
+			// Items are sorted by date, latest first.
+			name: "rss",
+			feed: rssFeed,
+			want: []item{
+				{"post-2", "Newer post", "https://example.com/newer", "Newer summary", "<p>Newer content</p>", "John", "2003-06-10T04:00:00Z"},
+				{"https://example.com/older", "Older post", "https://example.com/older", "Older summary", "Older summary", "jane@example.com (Jane)", "2003-06-09T04:00:00Z"},
+				{"https://example.com/undated", "Undated post", "https://example.com/undated", "", "", "", ""},
+			},
+		},
+		{
+			name: "atom",
+			feed: atomFeed,
+			want: []item{
+				{"urn:uuid:2", "Published entry", "https://example.com/2", "Summary 2", "<p>Content 2</p>", "", "2003-12-14T09:00:00Z"},
+				{"urn:uuid:1", "Updated entry", "https://example.com/1", "Summary 1", "Summary 1", "Jane", "2003-12-13T18:30:02Z"},
+			},
+		},
+		{
+			name: "empty rss",
+			feed: `<rss version="2.0"><channel><title>Blog</title></channel></rss>`,
+		},
+		{
+			name:    "unknown format",
+			feed:    `<?xml version="1.0"?><html><body>Not a feed</body></html>`,
+			wantErr: true,
+		},
+		{
+			name:    "not xml",
+			feed:    `{"items": []}`,
+			wantErr: true,
+		},
+		{
+			name:    "broken rss",
+			feed:    `<rss version="2.0"><channel><item><title>Post</item></channel></rss>`,
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			out, err := Parse(strings.NewReader(c.feed))
+			if c.wantErr {
+				if err == nil {
+					t.Fatalf("expected an error, got %+v", out)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			if len(out) != len(c.want) {
+				t.Fatalf("got %d items, want %d: %+v", len(out), len(c.want), out)
+			}
+			for i, w := range c.want {
+				o := out[i]
+				got := item{o.ID, o.Title, o.URL, o.Description, o.Content, o.Author, ""}
+				if !o.PublishedAt.IsZero() {
+					got.date = o.PublishedAt.UTC().Format(time.RFC3339)
+				}
+				if got != w {
+					t.Errorf("item %d = %+v\nwant %+v", i, got, w)
+				}
+			}
+		})
+	}
+}
+
+func TestFetch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/feed.xml":
+			w.Write([]byte(atomFeed))
+		case "/slow.xml":
+			time.Sleep(time.Millisecond * 200)
+			w.Write([]byte(atomFeed))
+		default:
+			w.WriteHeader(http.StatusNotFound)
+		}
+	}))
+	defer srv.Close()
+
+	cases := []struct {
+		path    string
+		want    int
+		wantErr bool
+	}{
+		{"/feed.xml", 2, false},
+		{"/missing.xml", 0, true},
+		{"/slow.xml", 0, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.path, func(t *testing.T) {
+			out, err := Fetch(srv.URL+c.path, time.Millisecond*100)
+			if (err != nil) != c.wantErr || len(out) != c.want {
+				t.Errorf("got %d items, err = %v; want %d items, error: %v", len(out), err, c.want, c.wantErr)
+			}
+		})
+	}
+}
@@ -0,0 +1,153 @@
+package manager
+
+import (
+	"fmt"
+	"hash/fnv"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+// defaultABTestWindow is the window after which the winner of an A/B test
+// is picked if the campaign doesn't have a valid one.
+const defaultABTestWindow = time.Hour * 4
+
+// abVariant is an A/B test variant of a campaign compiled for sending.
+type abVariant struct {
+	id   int
+	camp *models.Campaign
+}
+
+// loadVariants compiles the variants of an A/B test campaign. If the test
+// window of the campaign has passed, the winning variant is picked first.
+func (m *Manager) loadVariants(c *models.Campaign) error {
+	if !c.IsABTest() {
+		return nil
+	}
+
+	// The campaign has been picked up after the test window. Pick the winner.
+	// If another node has already picked it, get it.
+	if !c.ABWinnerID.Valid && c.ABTestEndsAt.Valid {
+		id, err := m.src.PickABWinner(c.ID)
+		if err != nil {
+			return fmt.Errorf("error picking A/B test winner: %v", err)
+		}
+
+		if id == 0 {
+			cm, err := m.src.GetCampaign(c.ID)
+			if err != nil {
+				return err
+			}
+			c.ABWinnerID = cm.ABWinnerID
+		} else {
+			c.ABWinnerID = null.IntFrom(id)
+			m.logger.Printf("picked variant %d as the A/B test winner of campaign (%s)", id, c.Name)
+		}
+	}
+
+	out, err := m.compileVariants(c)
+	if err != nil {
+		return err
+	}
+
+	m.campsMut.Lock()
+	m.variants[c.ID] = out
+	m.campsMut.Unlock()
+	return nil
+}
+
+// compileVariants fetches and compiles the variants of an A/B test campaign.
+func (m *Manager) compileVariants(c *models.Campaign) ([]abVariant, error) {
+	vars, err := m.src.GetCampaignVariants(c.ID)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching A/B test variants: %v", err)
+	}
+	if len(vars) == 0 {
+		return nil, fmt.Errorf("campaign has no A/B test variants")
+	}
+
+	out := make([]abVariant, 0, len(vars))
+	for _, v := range vars {
+		vc := c.ApplyVariant(v)
+		if err := vc.CompileTemplate(m.TemplateFuncs(vc)); err != nil {
+			return nil, fmt.Errorf("error compiling A/B test variant (%s): %v", v.Name, err)
+		}
+		out = append(out, abVariant{id: v.ID, camp: vc})
+	}
+	return out, nil
+}
+
+// variant returns the A/B test variant of a campaign to be sent to a subscriber.
+// Whether a subscriber is in the test group and the variant they get are derived
+// from a hash of the campaign and subscriber UUIDs so that they're the same
+// across batches, retries, and nodes. It returns false if the subscriber isn't
+// to be sent anything in the current phase of the test, ie: subscribers outside
+// the test group until the winner is picked, and the ones in the test group
+// (who've already been sent a variant) after that, unless it's a retry.
+func (m *Manager) variant(c *models.Campaign, s models.Subscriber, retry bool) (abVariant, bool) {
+	m.campsMut.RLock()
+	vars := m.variants[c.ID]
+	m.campsMut.RUnlock()
+
+	// Not an A/B test.
+	if len(vars) == 0 {
+		return abVariant{camp: c}, true
+	}
+
+	v, test := pickVariant(c, vars, s)
+
+	// The subscriber is in the test group.
+	if test {
+		if c.ABWinnerID.Valid && !retry {
+			return abVariant{}, false
+		}
+		return v, true
+	}
+
+	if v.camp == nil {
+		return abVariant{}, false
+	}
+	return v, true
+}
+
+// pickVariant returns the variant of an A/B test campaign for a subscriber
+// and true if the subscriber is in the test group. Otherwise, it returns the
+// winner if it has been picked (an empty variant if not) and false.
+func pickVariant(c *models.Campaign, vars []abVariant, s models.Subscriber) (abVariant, bool) {
+	h := fnv.New32a()
+	h.Write([]byte(c.UUID))
+	h.Write([]byte(s.UUID))
+	n := h.Sum32()
+
+	if int(n%100) < c.ABTestPercent {
+		return vars[int(n/100)%len(vars)], true
+	}
+
+	if c.ABWinnerID.Valid {
+		for _, v := range vars {
+			if v.id == c.ABWinnerID.Int {
+				return v, false
+			}
+		}
+	}
+	return abVariant{}, false
+}
+
+// endABTest ends the test phase of an A/B test campaign once the variants
+// have been sent to the test group. It returns false if the test group is still
+// being processed (by other nodes).
+func (m *Manager) endABTest(c *models.Campaign) (bool, error) {
+	window, err := time.ParseDuration(c.ABTestWindow)
+	if err != nil || window <= 0 {
+		window = defaultABTestWindow
+	}
+
+	ok, err := m.src.EndABTest(c.ID, window)
+	if err != nil || !ok {
+		return ok, err
+	}
+
+	m.logger.Printf("campaign (%s) A/B test variants sent. Picking the winner in %v", c.Name, window)
+	return true, nil
+}
@@ -0,0 +1,178 @@
+package manager
+
+import (
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/knadh/listmonk/models"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+func testVariants(c *models.Campaign, ids ...int) []abVariant {
+	out := make([]abVariant, 0, len(ids))
+	for _, id := range ids {
+		out = append(out, abVariant{id: id, camp: c})
+	}
+	return out
+}
+
+func testSubs(n int) []models.Subscriber {
+	out := make([]models.Subscriber, n)
+	for i := range out {
+		out[i].ID = i + 1
+		out[i].UUID = fmt.Sprintf("6f0f5c72-2f4c-4a2b-9d1e-%012d", i+1)
+	}
+	return out
+}
+
+func TestPickVariant(t *testing.T) {
+	const numSubs = 10000
+
+	cases := []struct {
+		name    string
+		percent int
+		winner  int
+		vars    []int
+
+		// The expected share of subscribers in the test group.
+		wantTest float64
+	}{
+		{name: "no test group", percent: 0, vars: []int{1, 2}, wantTest: 0},
+		{name: "everyone", percent: 100, vars: []int{1, 2}, wantTest: 1},
+		{name: "two variants", percent: 20, vars: []int{1, 2}, wantTest: 0.2},
+		{name: "three variants", percent: 30, vars: []int{1, 2, 3}, wantTest: 0.3},
+		{name: "winner picked", percent: 20, winner: 2, vars: []int{1, 2}, wantTest: 0.2},
+		{name: "unknown winner", percent: 20, winner: 9, vars: []int{1, 2}, wantTest: 0.2},
+	}
+
+	subs := testSubs(numSubs)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			camp := &models.Campaign{UUID: "1b5c31a4-7c5f-4e4b-8f1d-2b5f6a9c0d3e", ABTestPercent: c.percent}
+			if c.winner > 0 {
+				camp.ABWinnerID = null.IntFrom(c.winner)
+			}
+			vars := testVariants(camp, c.vars...)
+
+			var (
+				inTest int
+				counts = make(map[int]int)
+			)
+			for _, s := range subs {
+				v, test := pickVariant(camp, vars, s)
+
+				// The same subscriber always gets the same variant.
+				for i := 0; i < 3; i++ {
+					if v2, test2 := pickVariant(camp, vars, s); v2.id != v.id || test2 != test {
+						t.Fatalf("subscriber %s got variant %d (%v), then %d (%v)", s.UUID, v.id, test, v2.id, test2)
+					}
+				}
+
+				if test {
+					inTest++
+					counts[v.id]++
+					continue
+				}
+
+				// Outside of the test group, it's the winner or nothing.
+				switch {
+				case c.winner > 0 && c.winner <= len(c.vars):
+					if v.id != c.winner {
+						t.Fatalf("subscriber %s outside the test group got variant %d, want the winner %d", s.UUID, v.id, c.winner)
+					}
+				case v.camp != nil:
+					t.Fatalf("subscriber %s outside the test group got variant %d before a winner", s.UUID, v.id)
+				}
+			}
+
+			if got := float64(inTest) / numSubs; math.Abs(got-c.wantTest) > 0.02 {
+				t.Errorf("test group = %.3f, want %.3f", got, c.wantTest)
+			}
+
+			// The test group is split evenly between the variants.
+			for _, id := range c.vars {
+				if inTest == 0 {
+					break
+				}
+				want := float64(inTest) / float64(len(c.vars))
+				if got := float64(counts[id]); math.Abs(got-want)/want > 0.1 {
+					t.Errorf("variant %d got %v of %d subscribers, want ~%.0f", id, got, inTest, want)
+				}
+			}
+		})
+	}
+}
+
+func TestPickVariantByCampaign(t *testing.T) {
+	var (
+		c1   = &models.Campaign{UUID: "1b5c31a4-7c5f-4e4b-8f1d-2b5f6a9c0d3e", ABTestPercent: 50}
+		c2   = &models.Campaign{UUID: "a7e0c2d9-3b8f-4d6a-9c1e-5f2b8d4a6e0c", ABTestPercent: 50}
+		subs = testSubs(1000)
+	)
+
+	// Test groups are picked independently for every campaign.
+	var same int
+	for _, s := range subs {
+		_, t1 := pickVariant(c1, testVariants(c1, 1, 2), s)
+		_, t2 := pickVariant(c2, testVariants(c2, 1, 2), s)
+		if t1 == t2 {
+			same++
+		}
+	}
+	if same == len(subs) || same == 0 {
+		t.Errorf("%d of %d subscribers in the same group of both campaigns", same, len(subs))
+	}
+}
+
+func TestVariantPhases(t *testing.T) {
+	var (
+		subs   = testSubs(200)
+		camp   = &models.Campaign{UUID: "1b5c31a4-7c5f-4e4b-8f1d-2b5f6a9c0d3e", ABTestPercent: 50}
+		winner models.Campaign
+	)
+	camp.ID = 1
+	winner = *camp
+	winner.ABWinnerID = null.IntFrom(2)
+
+	cases := []struct {
+		name  string
+		camp  *models.Campaign
+		retry bool
+
+		// Whether subscribers in and out of the test group are sent anything.
+		wantTest, wantRest bool
+	}{
+		{name: "test phase", camp: camp, wantTest: true, wantRest: false},
+		{name: "winner picked", camp: &winner, wantTest: false, wantRest: true},
+		{name: "retry after winner", camp: &winner, retry: true, wantTest: true, wantRest: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := &Manager{variants: map[int][]abVariant{1: testVariants(c.camp, 1, 2)}}
+
+			for _, s := range subs {
+				_, test := pickVariant(c.camp, m.variants[1], s)
+				v, ok := m.variant(c.camp, s, c.retry)
+
+				want := c.wantRest
+				if test {
+					want = c.wantTest
+				}
+				if ok != want {
+					t.Fatalf("subscriber %s (test group: %v) sent = %v, want %v", s.UUID, test, ok, want)
+				}
+				if ok && !test && v.id != 2 {
+					t.Errorf("subscriber %s got variant %d, want the winner", s.UUID, v.id)
+				}
+			}
+		})
+	}
+
+	// Campaigns that aren't A/B tests are sent as is.
+	m := &Manager{variants: map[int][]abVariant{}}
+	if v, ok := m.variant(camp, subs[0], false); !ok || v.camp != camp {
+		t.Errorf("variant() = %+v, %v; want the campaign", v, ok)
+	}
+}
@@ -0,0 +1,173 @@
+package manager
+
+import (
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/models"
+)
+
+// Delivery statuses of campaign messages.
+const (
+	DeliveryStatusQueued   = "queued"
+	DeliveryStatusDeferred = "deferred"
+	DeliveryStatusSent     = "sent"
+	DeliveryStatusFailed   = "failed"
+
+	// DeliveryStatusSkipped is recorded by the data source for subscribers
+	// who have crossed a frequency cap.
+	DeliveryStatusSkipped = "skipped"
+)
+
+const (
+	// Number of delivery records that are buffered before they're
+	// written to the data source.
+	deliveryBatchSize = 1000
+
+	// Interval at which buffered delivery records are written irrespective
+	// of the number of records.
+	deliveryFlushInterval = time.Second
+)
+
+// FrequencyCap is the maximum number of campaign messages that a subscriber
+// can be sent within a period. A cap with ListIDs only applies to the
+// subscribers of those lists when a campaign is sent to them.
+type FrequencyCap struct {
+	ListIDs []int
+	Max     int
+	Period  time.Duration
+}
+
+// Delivery represents the delivery attempt of a campaign message
+// to a subscriber.
+type Delivery struct {
+	CampaignID   int
+	SubscriberID int
+	Status       string
+	Messenger    string
+
+	// MessageID is the provider's unique ID of the message, if the
+	// messenger returns one.
+	MessageID string
+	Error     string
+
+	// RetryAfter is the duration after which a failed message should be
+	// retried or a deferred message should be sent. For failed messages,
+	// 0 indicates that it shouldn't be retried.
+	RetryAfter time.Duration
+
+	// VariantID is the ID of the campaign's A/B test variant that was sent.
+	VariantID int
+
+	// Credits is the number of units of the credit balance that a sent
+	// message used on its messenger, eg: the segments of an SMS.
+	Credits int
+}
+
+// recordDelivery buffers a delivery record and writes the buffered
+// records to the data source once there's a full batch.
+func (m *Manager) recordDelivery(d Delivery) {
+	m.deliveriesMut.Lock()
+	m.deliveries = append(m.deliveries, d)
+	full := len(m.deliveries) >= deliveryBatchSize
+	m.deliveriesMut.Unlock()
+
+	if full {
+		m.flushDeliveries()
+	}
+}
+
+// recordRenderError records the failure of a message that couldn't be
+// rendered. Such messages are not retried.
+func (m *Manager) recordRenderError(c *models.Campaign, s models.Subscriber, err error) {
+	m.recordDelivery(Delivery{
+		CampaignID:   c.ID,
+		SubscriberID: s.ID,
+		Status:       DeliveryStatusFailed,
+		Messenger:    c.Messenger,
+		Error:        err.Error(),
+	})
+}
+
+// addSent buffers a change to the sent count of a campaign for messages
+// that aren't counted by its leases.
+func (m *Manager) addSent(campID, n int) {
+	m.deliveriesMut.Lock()
+	m.sentCounts[campID] += n
+	m.deliveriesMut.Unlock()
+}
+
+// flushDeliveries writes all buffered delivery records and changes to the
+// sent counts of campaigns to the data source. Batches are written one at
+// a time so that a later status of a subscriber (sent) is never overwritten
+// by an earlier one (queued) from a concurrent batch.
+func (m *Manager) flushDeliveries() {
+	m.deliveryWriteMut.Lock()
+	defer m.deliveryWriteMut.Unlock()
+
+	m.deliveriesMut.Lock()
+	batch := m.deliveries
+	m.deliveries = make([]Delivery, 0, deliveryBatchSize)
+	counts := m.sentCounts
+	m.sentCounts = make(map[int]int)
+	m.deliveriesMut.Unlock()
+
+	m.writeDeliveries(batch)
+
+	for id, n := range counts {
+		if n == 0 {
+			continue
+		}
+		if err := m.src.AddCampaignSent(id, n); err != nil {
+			m.logger.Printf("error updating sent count of campaign %d: %v", id, err)
+		}
+	}
+}
+
+// writeDeliveries writes a batch of delivery records to the data source.
+// A subscriber may have multiple records in a batch (queued and then sent),
+// in which case, only the last one is written.
+func (m *Manager) writeDeliveries(batch []Delivery) {
+	if len(batch) == 0 {
+		return
+	}
+
+	type key struct{ camp, sub int }
+	var (
+		idx = make(map[key]int, len(batch))
+		out = make([]Delivery, 0, len(batch))
+	)
+	for _, d := range batch {
+		k := key{d.CampaignID, d.SubscriberID}
+		if i, ok := idx[k]; ok {
+			out[i] = d
+			continue
+		}
+		idx[k] = len(out)
+		out = append(out, d)
+	}
+
+	if err := m.src.RecordDeliveries(out); err != nil {
+		m.logger.Printf("error recording %d message deliveries: %v", len(out), err)
+	}
+}
+
+// deliveryFlusher is a blocking function that periodically writes
+// buffered delivery records to the data source.
+func (m *Manager) deliveryFlusher() {
+	t := time.NewTicker(deliveryFlushInterval)
+	defer t.Stop()
+
+	for range t.C {
+		m.flushDeliveries()
+	}
+}
+
+// push pushes a message to a messenger and returns the provider's ID of
+// the message if the messenger supports it.
+func push(msgr messenger.Messenger, msg messenger.Message) (string, error) {
+	if p, ok := msgr.(messenger.IDPusher); ok {
+		return p.PushWithID(msg)
+	}
+	return "", msgr.Push(msg)
+}
@@ -0,0 +1,139 @@
+package manager
+
+import (
+	"math/rand"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/internal/subimporter"
+)
+
+// Minimum duration for which a message to a domain whose concurrency is
+// saturated is deferred. A random jitter of upto the same duration is added
+// so that the deferred messages don't all come back at once.
+const domainDeferral = time.Second * 30
+
+// DomainThrottle limits the rate and the concurrency of campaign messages
+// to the recipients of a group of domains, for instance, a mailbox provider
+// that throttles senders.
+type DomainThrottle struct {
+	// Pattern is either a mailbox provider class returned by
+	// subimporter.ValidateSmartEmail (eg: SMART-GMAIL) or a glob that's
+	// matched against the recipient's domain (eg: *.yahoo.com).
+	Pattern string
+
+	// Rate is the number of messages allowed per minute and Concurrency is the
+	// number of messages that can be pushed at a time. < 1 disables either.
+	Rate        int
+	Concurrency int
+}
+
+// domainLimiter enforces a DomainThrottle. Unlike the messenger limiters,
+// it never blocks. Messages that don't get a slot are deferred instead so
+// that a saturated domain doesn't hold up the messages to other domains.
+type domainLimiter struct {
+	DomainThrottle
+
+	// Lowercased Pattern that's matched against the recipient's domain.
+	glob string
+
+	// Token bucket (tokens per second) that holds upto a second's worth of tokens.
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// Time by which the messages deferred so far are sent at the domain's
+	// rate. Every deferred message is scheduled after the ones before it
+	// so that the backlog drains at the rate and isn't tried over and over.
+	backlog time.Time
+
+	// Number of messages being pushed.
+	active int
+	mu     sync.Mutex
+}
+
+func newDomainLimiter(t DomainThrottle) *domainLimiter {
+	d := &domainLimiter{
+		DomainThrottle: t,
+		glob:           strings.ToLower(t.Pattern),
+		rate:           float64(t.Rate) / 60,
+		last:           time.Now(),
+	}
+	d.burst = d.rate
+	if d.burst < 1 {
+		d.burst = 1
+	}
+	d.tokens = d.burst
+	return d
+}
+
+// take acquires a slot for pushing a message. If the domain is saturated,
+// it returns false with the duration after which the message should
+// be tried again. When the rate is exceeded, that's the time it takes for
+// the messages already deferred to be sent at the rate.
+func (d *domainLimiter) take() (time.Duration, bool) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+
+	if d.Rate > 0 {
+		now := time.Now()
+		d.tokens += now.Sub(d.last).Seconds() * d.rate
+		if d.tokens > d.burst {
+			d.tokens = d.burst
+		}
+		d.last = now
+
+		// Schedule the message after the backlog of deferred messages.
+		if d.tokens < 1 {
+			next := now.Add(time.Duration((1 - d.tokens) / d.rate * float64(time.Second)))
+			if d.backlog.After(next) {
+				next = d.backlog
+			}
+			d.backlog = next.Add(time.Duration(float64(time.Second) / d.rate))
+			return next.Sub(now), false
+		}
+	}
+
+	if d.Concurrency > 0 && d.active >= d.Concurrency {
+		return domainDeferral + time.Duration(rand.Int63n(int64(domainDeferral))), false
+	}
+
+	if d.Rate > 0 {
+		d.tokens--
+	}
+	d.active++
+	return 0, true
+}
+
+// release releases a slot acquired with take.
+func (d *domainLimiter) release() {
+	d.mu.Lock()
+	d.active--
+	d.mu.Unlock()
+}
+
+// domainLimiter returns the limiter of the first domain throttle that
+// matches an e-mail address, if there's one.
+func (m *Manager) domainLimiter(email string) *domainLimiter {
+	if len(m.domainLimiters) == 0 {
+		return nil
+	}
+
+	email = strings.ToLower(email)
+	var (
+		class  = subimporter.ValidateSmartEmail(email)
+		domain = email[strings.LastIndex(email, "@")+1:]
+	)
+	for _, d := range m.domainLimiters {
+		if class != "" && strings.EqualFold(d.Pattern, class) {
+			return d
+		}
+		if ok, _ := path.Match(d.glob, domain); ok {
+			return d
+		}
+	}
+	return nil
+}
@@ -0,0 +1,190 @@
+package manager
+
+import (
+	"testing"
+	"time"
+)
+
+func TestDomainLimiterMatch(t *testing.T) {
+	m := New(Config{
+		DomainThrottles: []DomainThrottle{
+			{Pattern: "SMART-GMAIL", Rate: 100},
+			{Pattern: "smart-hotmail", Rate: 100},
+			{Pattern: "*.Yahoo.com", Rate: 100},
+			{Pattern: "example.com", Rate: 100},
+			{Pattern: "mail?.example.org", Concurrency: 5},
+			{Pattern: "[ab]*.test", Rate: 100},
+			{Pattern: "[", Rate: 100},
+
+			// Throttles without limits are ignored.
+			{Pattern: "*.net"},
+			{Pattern: "", Rate: 100},
+		},
+	}, nil, nil, nil, nil)
+
+	cases := []struct {
+		email string
+		want  string
+	}{
+		// Mailbox provider classes.
+		{"jane@gmail.com", "SMART-GMAIL"},
+		{"jane@googlemail.com", "SMART-GMAIL"},
+		{"Jane@GMAIL.com", "SMART-GMAIL"},
+		{"jane@outlook.com", "smart-hotmail"},
+
+		// Globs against the domain.
+		{"jane@mail.yahoo.com", "*.Yahoo.com"},
+		{"jane@MAIL.YAHOO.COM", "*.Yahoo.com"},
+		{"jane@example.com", "example.com"},
+		{"jane@sub.example.com", ""},
+		{"jane@mail1.example.org", "mail?.example.org"},
+		{"jane@mail12.example.org", ""},
+		{"jane@alpha.test", "[ab]*.test"},
+		{"jane@charlie.test", ""},
+
+		// The glob is matched against the domain and not the address.
+		{"example.com@other.com", ""},
+		{"jane@other.net", ""},
+		{"jane@", ""},
+	}
+
+	for _, c := range cases {
+		t.Run(c.email, func(t *testing.T) {
+			d := m.domainLimiter(c.email)
+			if c.want == "" {
+				if d != nil {
+					t.Errorf("matched %q, want none", d.Pattern)
+				}
+				return
+			}
+			if d == nil || d.Pattern != c.want {
+				t.Errorf("matched %v, want %q", d, c.want)
+			}
+		})
+	}
+
+	// No throttles.
+	m = New(Config{}, nil, nil, nil, nil)
+	if d := m.domainLimiter("jane@gmail.com"); d != nil {
+		t.Errorf("matched %q without throttles", d.Pattern)
+	}
+}
+
+func TestDomainLimiterTake(t *testing.T) {
+	type take struct {
+		ok       bool
+		min, max time.Duration
+	}
+
+	cases := []struct {
+		name     string
+		throttle DomainThrottle
+		takes    []take
+		release  int
+		after    take
+	}{
+		{
+			// 120/min is 2/s with a burst of 2. The messages over the burst
+			// are scheduled one after the other at the rate.
+			name:     "rate",
+			throttle: DomainThrottle{Rate: 120},
+			takes: []take{
+				{ok: true},
+				{ok: true},
+				{min: time.Millisecond * 450, max: time.Millisecond * 500},
+				{min: time.Millisecond * 950, max: time.Second},
+				{min: time.Millisecond * 1450, max: time.Millisecond * 1500},
+			},
+			release: 2,
+			after:   take{min: time.Millisecond * 1950, max: time.Second * 2},
+		},
+		{
+			// Below 60/min, the burst is 1.
+			name:     "slow rate",
+			throttle: DomainThrottle{Rate: 6},
+			takes: []take{
+				{ok: true},
+				{min: time.Millisecond * 9950, max: time.Second * 10},
+			},
+		},
+		{
+			name:     "concurrency",
+			throttle: DomainThrottle{Concurrency: 2},
+			takes: []take{
+				{ok: true},
+				{ok: true},
+				{min: domainDeferral, max: domainDeferral * 2},
+			},
+			release: 1,
+			after:   take{ok: true},
+		},
+		{
+			name:     "rate and concurrency",
+			throttle: DomainThrottle{Rate: 600, Concurrency: 1},
+			takes: []take{
+				{ok: true},
+				{min: domainDeferral, max: domainDeferral * 2},
+			},
+			release: 1,
+			after:   take{ok: true},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			d := newDomainLimiter(c.throttle)
+
+			check := func(i int, w take) {
+				wait, ok := d.take()
+				if ok != w.ok {
+					t.Fatalf("take %d: ok = %v, want %v", i, ok, w.ok)
+				}
+				if ok && wait != 0 {
+					t.Errorf("take %d: wait = %v with a slot", i, wait)
+				}
+				if !ok && (wait < w.min || wait > w.max) {
+					t.Errorf("take %d: wait = %v, want %v-%v", i, wait, w.min, w.max)
+				}
+			}
+
+			for i, w := range c.takes {
+				check(i, w)
+			}
+			if c.release == 0 {
+				return
+			}
+
+			for i := 0; i < c.release; i++ {
+				d.release()
+			}
+			check(len(c.takes), c.after)
+		})
+	}
+}
+
+func TestDomainLimiterRefill(t *testing.T) {
+	d := newDomainLimiter(DomainThrottle{Rate: 120})
+	for i := 0; i < 2; i++ {
+		if _, ok := d.take(); !ok {
+			t.Fatal("no slot within the burst")
+		}
+		d.release()
+	}
+	if _, ok := d.take(); ok {
+		t.Fatal("slot beyond the burst")
+	}
+
+	// Later, the bucket has refilled, but only upto the burst.
+	d.mu.Lock()
+	d.last = d.last.Add(-time.Second * 10)
+	d.backlog = time.Time{}
+	d.mu.Unlock()
+	for i := 0; i < 2; i++ {
+		if _, ok := d.take(); !ok {
+			t.Fatalf("take %d: no slot after refilling", i)
+		}
+	}
+	if _, ok := d.take(); ok {
+		t.Fatal("slot beyond the burst after refilling")
+	}
+}
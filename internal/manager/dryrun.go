@@ -0,0 +1,205 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger/sink"
+	"github.com/knadh/listmonk/models"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+// Dry run statuses.
+const (
+	DryRunStatusRunning  = "running"
+	DryRunStatusFinished = "finished"
+	DryRunStatusFailed   = "failed"
+)
+
+// Max number of render errors that are reported individually.
+const maxDryRunErrors = 100
+
+// ErrDryRunInProgress is returned when a dry run of a campaign is started
+// while one is already in progress.
+var ErrDryRunInProgress = errors.New("dry run already in progress")
+
+// DryRunReport is the report of a campaign dry run where the campaign's
+// messages are rendered for all its subscribers and pushed to a sink
+// messenger instead of being sent.
+type DryRunReport struct {
+	Status     string    `json:"status"`
+	Error      string    `json:"error"`
+	StartedAt  time.Time `json:"started_at"`
+	FinishedAt null.Time `json:"finished_at"`
+
+	// Recipients is the total number of subscribers as counted when the
+	// campaign starts and Processed is the number of subscribers that have
+	// been streamed so far.
+	Recipients int `json:"recipients"`
+	Processed  int `json:"processed"`
+
+	// Rendered messages and the sizes (bytes) of their bodies. OverClipLimit is
+	// the number of messages that are over Gmail's 102KB clip limit.
+	Rendered      int `json:"rendered"`
+	AvgSize       int `json:"avg_size"`
+	MaxSize       int `json:"max_size"`
+	OverClipLimit int `json:"over_clip_limit"`
+
+	// Messages that failed to render. Only the first few are listed.
+	NumRenderErrors int           `json:"num_render_errors"`
+	RenderErrors    []DryRunError `json:"render_errors"`
+
+	// EstimatedDuration is the time it'd take to send all the messages under
+	// the current rate limits of the campaign's messenger.
+	EstimatedDuration string `json:"estimated_duration"`
+}
+
+// DryRunError is a message of a dry run that failed to render.
+type DryRunError struct {
+	SubscriberID int    `json:"subscriber_id"`
+	Email        string `json:"email"`
+	Error        string `json:"error"`
+}
+
+// DryRun starts a dry run of a campaign in the background. The campaign goes
+// through the whole pipeline (recipient counts, subscriber streaming, rendering,
+// and link registration) except that the messages are pushed to a sink messenger.
+// The campaign's status and stats are left untouched. cb is called with the
+// report after every batch of subscribers and at the end.
+func (m *Manager) DryRun(c *models.Campaign, cb func(DryRunReport)) error {
+	m.dryRunMut.Lock()
+	defer m.dryRunMut.Unlock()
+	if m.dryRuns[c.ID] {
+		return ErrDryRunInProgress
+	}
+	m.dryRuns[c.ID] = true
+
+	go func() {
+		r := m.dryRun(c, cb)
+		if r.Status != DryRunStatusFailed {
+			r.Status = DryRunStatusFinished
+		}
+		r.FinishedAt = null.TimeFrom(time.Now())
+		cb(r)
+
+		m.dryRunMut.Lock()
+		delete(m.dryRuns, c.ID)
+		m.dryRunMut.Unlock()
+	}()
+	return nil
+}
+
+func (m *Manager) dryRun(c *models.Campaign, cb func(DryRunReport)) DryRunReport {
+	r := DryRunReport{
+		Status:       DryRunStatusRunning,
+		StartedAt:    time.Now(),
+		RenderErrors: []DryRunError{},
+	}
+	fail := func(err error) DryRunReport {
+		r.Status = DryRunStatusFailed
+		r.Error = err.Error()
+		return r
+	}
+
+	if err := c.CompileTemplate(m.TemplateFuncs(c)); err != nil {
+		return fail(err)
+	}
+
+	var vars []abVariant
+	if c.IsABTest() {
+		v, err := m.compileVariants(c)
+		if err != nil {
+			return fail(err)
+		}
+		vars = v
+	}
+
+	toSend, maxID, err := m.src.CountCampaignRecipients(c.ID)
+	if err != nil {
+		return fail(fmt.Errorf("error counting recipients: %v", err))
+	}
+	r.Recipients = toSend
+	cb(r)
+
+	var (
+		sk    = sink.New("dry_run")
+		batch = m.Cfg.BatchSize
+	)
+	for from := 0; from < maxID; from += batch {
+		subs, err := m.src.DryRunSubscribers(c.ID, from, from+batch, m.Cfg.FrequencyCaps)
+		if err != nil {
+			return fail(fmt.Errorf("error fetching subscribers: %v", err))
+		}
+
+		for _, s := range subs {
+			r.Processed++
+
+			msg, err := m.NewCampaignMessage(dryRunVariant(c, vars, s), s)
+			if err != nil {
+				r.NumRenderErrors++
+				if len(r.RenderErrors) < maxDryRunErrors {
+					r.RenderErrors = append(r.RenderErrors, DryRunError{
+						SubscriberID: s.ID,
+						Email:        s.Email,
+						Error:        err.Error(),
+					})
+				}
+				continue
+			}
+
+			sk.Push(m.outgoingMessage(msg))
+		}
+
+		if len(subs) > 0 {
+			r.setStats(sk.Stats())
+			cb(r)
+		}
+	}
+
+	r.setStats(sk.Stats())
+	r.EstimatedDuration = m.estimateDuration(c.Messenger, r.Rendered).String()
+	return r
+}
+
+func (r *DryRunReport) setStats(s sink.Stats) {
+	r.Rendered = s.Num
+	r.AvgSize = s.AvgSize
+	r.MaxSize = s.MaxSize
+	r.OverClipLimit = s.OverClip
+}
+
+// dryRunVariant returns the A/B test variant of a campaign that a subscriber
+// would get. Subscribers outside the test group get the winner, if it has been
+// picked, and the campaign itself otherwise.
+func dryRunVariant(c *models.Campaign, vars []abVariant, s models.Subscriber) *models.Campaign {
+	if len(vars) == 0 {
+		return c
+	}
+
+	if v, _ := pickVariant(c, vars, s); v.camp != nil {
+		return v.camp
+	}
+	return c
+}
+
+// estimateDuration estimates the time it'd take to push n messages to a
+// messenger (or messenger group) under its rate limit and the sliding window
+// limit, if one is configured.
+func (m *Manager) estimateDuration(msgr string, n int) time.Duration {
+	var d time.Duration
+	if r, ok := m.GetRateStats(msgr); ok && r.Rate > 0 {
+		d = time.Duration(float64(n) / float64(r.Rate) * float64(time.Second))
+	}
+
+	if m.Cfg.SlidingWindow && m.Cfg.SlidingWindowRate > 0 && m.Cfg.SlidingWindowDuration > 0 {
+		// Every full window has to pass before the next one starts.
+		windows := math.Ceil(float64(n)/float64(m.Cfg.SlidingWindowRate)) - 1
+		if w := time.Duration(windows) * m.Cfg.SlidingWindowDuration; w > d {
+			d = w
+		}
+	}
+
+	return d.Round(time.Second)
+}
@@ -0,0 +1,132 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"regexp"
+	"strings"
+)
+
+// Classes of errors returned by messengers. The rolling error window
+// can optionally evaluate the error threshold for each class separately
+// and failed messages are retried with a backoff specific to the class.
+const (
+	ErrClassAuth      = "auth"
+	ErrClassThrottle  = "throttling"
+	ErrClassTransient = "transient"
+	ErrClassRecipient = "recipient_rejected"
+	ErrClassOther     = "other"
+)
+
+var (
+	errClasses = []string{ErrClassAuth, ErrClassThrottle, ErrClassTransient, ErrClassRecipient, ErrClassOther}
+
+	reErrAuth      = regexp.MustCompile(`\b(401|403|530|534|535)\b|auth|credential|signature|forbidden|unauthori[sz]ed|invalidclienttokenid`)
+	reErrThrottle  = regexp.MustCompile(`\b429\b|throttl|rate exceeded|rate limit|too many|quota|try again later`)
+	reErrRecipient = regexp.MustCompile(`\b(550|551|553|554)\b|reject|not verified|mailbox|recipient|no such user|invalid address`)
+	reErrTransient = regexp.MustCompile(`\b(421|45[0-4]|50[0-4])\b|timeout|timed out|temporar|connection (refused|reset)|broken pipe|eof`)
+)
+
+// errWindow is a rolling window of the outcomes of the last N messages
+// pushed for a campaign. An empty string represents a successful push and
+// anything else, the class of the error.
+type errWindow struct {
+	buf    []string
+	pos    int
+	full   bool
+	errs   int
+	counts map[string]int
+}
+
+func newErrWindow(size int) *errWindow {
+	return &errWindow{
+		buf:    make([]string, size),
+		counts: make(map[string]int),
+	}
+}
+
+// add records the outcome of a push, evicting the oldest one
+// if the window is full.
+func (w *errWindow) add(class string) {
+	if w.full {
+		if old := w.buf[w.pos]; old != "" {
+			w.errs--
+			w.counts[old]--
+		}
+	}
+
+	w.buf[w.pos] = class
+	if class != "" {
+		w.errs++
+		w.counts[class]++
+	}
+
+	w.pos++
+	if w.pos == len(w.buf) {
+		w.pos = 0
+		w.full = true
+	}
+}
+
+// exceeds checks whether the percentage of errors in the window is above
+// the given threshold and returns a human readable reason if it is. The
+// threshold is only evaluated once the window is full so that a handful
+// of errors in the first few messages of a campaign don't pause it.
+// If perClass is set, the threshold applies to every error class separately.
+func (w *errWindow) exceeds(pct float64, perClass bool) (string, bool) {
+	if !w.full || pct <= 0 {
+		return "", false
+	}
+
+	size := float64(len(w.buf))
+	if !perClass {
+		if r := float64(w.errs) / size * 100; r > pct {
+			return fmt.Sprintf("%.1f%% of the last %d messages failed (threshold %.1f%%)",
+				r, len(w.buf), pct), true
+		}
+		return "", false
+	}
+
+	for _, class := range errClasses {
+		if r := float64(w.counts[class]) / size * 100; r > pct {
+			return fmt.Sprintf("%.1f%% of the last %d messages failed with %s errors (threshold %.1f%%)",
+				r, len(w.buf), class, pct), true
+		}
+	}
+	return "", false
+}
+
+// ErrorClass returns the class of an error returned by a messenger. SMTP
+// errors are classified by their reply codes (4xx transient, 5xx permanent)
+// and the rest (SES, HTTP APIs) are matched heuristically against their messages.
+func ErrorClass(err error) string {
+	s := strings.ToLower(err.Error())
+
+	var tErr *textproto.Error
+	if errors.As(err, &tErr) {
+		switch {
+		case tErr.Code == 530 || tErr.Code == 534 || tErr.Code == 535:
+			return ErrClassAuth
+		case tErr.Code >= 400 && tErr.Code < 500:
+			if reErrThrottle.MatchString(s) {
+				return ErrClassThrottle
+			}
+			return ErrClassTransient
+		case tErr.Code >= 500:
+			return ErrClassRecipient
+		}
+	}
+
+	switch {
+	case reErrAuth.MatchString(s):
+		return ErrClassAuth
+	case reErrThrottle.MatchString(s):
+		return ErrClassThrottle
+	case reErrRecipient.MatchString(s):
+		return ErrClassRecipient
+	case reErrTransient.MatchString(s):
+		return ErrClassTransient
+	}
+	return ErrClassOther
+}
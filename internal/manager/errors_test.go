@@ -0,0 +1,165 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"net/textproto"
+	"strings"
+	"testing"
+)
+
+func TestErrorClass(t *testing.T) {
+	cases := []struct {
+		name string
+		err  error
+		want string
+	}{
+		// SMTP reply codes.
+		{"smtp auth", &textproto.Error{Code: 535, Msg: "5.7.8 Username and Password not accepted"}, ErrClassAuth},
+		{"smtp auth required", &textproto.Error{Code: 530, Msg: "5.7.0 Must issue a STARTTLS command first"}, ErrClassAuth},
+		{"smtp transient", &textproto.Error{Code: 451, Msg: "4.3.0 Mail server temporarily rejected message"}, ErrClassTransient},
+		{"smtp throttled", &textproto.Error{Code: 421, Msg: "4.7.0 Too many messages, try again later"}, ErrClassThrottle},
+		{"smtp rejected", &textproto.Error{Code: 550, Msg: "5.1.1 The email account does not exist"}, ErrClassRecipient},
+
+		// The code takes precedence over the message.
+		{"smtp code over message", &textproto.Error{Code: 554, Msg: "authentication failed"}, ErrClassRecipient},
+		{"wrapped smtp error", fmt.Errorf("error sending: %w", &textproto.Error{Code: 452, Msg: "Insufficient storage"}), ErrClassTransient},
+
+		// Messages from SES and the HTTP APIs.
+		{"ses credentials", errors.New("InvalidClientTokenId: The security token included in the request is invalid"), ErrClassAuth},
+		{"ses signature", errors.New("SignatureDoesNotMatch: The request signature we calculated does not match"), ErrClassAuth},
+		{"http 401", errors.New("sendgrid: 401: unauthorized"), ErrClassAuth},
+		{"ses throttling", errors.New("Throttling: Maximum sending rate exceeded."), ErrClassThrottle},
+		{"http 429", errors.New("postmark: 429: too many requests"), ErrClassThrottle},
+		{"ses quota", errors.New("Daily message quota exceeded"), ErrClassThrottle},
+		{"ses unverified", errors.New("MessageRejected: Email address is not verified."), ErrClassRecipient},
+		{"http 554", errors.New("mailgun: 554: invalid address"), ErrClassRecipient},
+		{"timeout", errors.New("dial tcp 10.0.0.1:587: i/o timeout"), ErrClassTransient},
+		{"connection refused", errors.New("dial tcp 10.0.0.1:25: connect: connection refused"), ErrClassTransient},
+		{"eof", errors.New("EOF"), ErrClassTransient},
+		{"http 503", errors.New("sendgrid: 503: service unavailable"), ErrClassTransient},
+		{"other", errors.New("template: no such function"), ErrClassOther},
+
+		// Codes aren't matched inside other numbers.
+		{"code in a number", errors.New("invalid port 14290"), ErrClassOther},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := ErrorClass(c.err); got != c.want {
+				t.Errorf("ErrorClass(%q) = %q, want %q", c.err, got, c.want)
+			}
+		})
+	}
+}
+
+func TestErrWindow(t *testing.T) {
+	const (
+		a = ErrClassAuth
+		r = ErrClassRecipient
+		x = ErrClassTransient
+	)
+
+	cases := []struct {
+		name     string
+		size     int
+		add      []string
+		pct      float64
+		perClass bool
+		want     bool
+		wantMsg  string
+	}{
+		{
+			name: "not full",
+			size: 4,
+			add:  []string{a, a, a},
+			pct:  10,
+		},
+		{
+			name:    "full and exceeded",
+			size:    4,
+			add:     []string{"", a, r, ""},
+			pct:     25,
+			want:    true,
+			wantMsg: "50.0% of the last 4 messages failed (threshold 25.0%)",
+		},
+		{
+			// The threshold has to be exceeded, not reached.
+			name: "at threshold",
+			size: 4,
+			add:  []string{"", a, "", ""},
+			pct:  25,
+		},
+		{
+			name: "disabled",
+			size: 2,
+			add:  []string{a, a},
+			pct:  0,
+		},
+		{
+			// The oldest outcomes are evicted.
+			name: "errors rolled out",
+			size: 4,
+			add:  []string{a, a, a, a, "", "", "", ""},
+			pct:  10,
+		},
+		{
+			name:    "rolled over",
+			size:    3,
+			add:     []string{"", "", "", x, "", x},
+			pct:     50,
+			want:    true,
+			wantMsg: "66.7% of the last 3 messages failed (threshold 50.0%)",
+		},
+		{
+			// Together, the errors exceed the threshold, but no single
+			// class does.
+			name:     "per class under",
+			size:     4,
+			add:      []string{a, r, x, ""},
+			pct:      30,
+			perClass: true,
+		},
+		{
+			name:     "per class exceeded",
+			size:     4,
+			add:      []string{r, "", r, x},
+			pct:      30,
+			perClass: true,
+			want:     true,
+			wantMsg:  "50.0% of the last 4 messages failed with recipient_rejected errors (threshold 30.0%)",
+		},
+		{
+			name:     "per class evicted",
+			size:     2,
+			add:      []string{r, r, a, ""},
+			pct:      50,
+			perClass: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			w := newErrWindow(c.size)
+			for _, class := range c.add {
+				w.add(class)
+			}
+
+			msg, ok := w.exceeds(c.pct, c.perClass)
+			if ok != c.want || msg != c.wantMsg {
+				t.Errorf("exceeds() = %q, %v; want %q, %v", msg, ok, c.wantMsg, c.want)
+			}
+
+			// The counts always match the outcomes in the buffer.
+			var errs int
+			for _, class := range w.buf {
+				if class != "" {
+					errs++
+				}
+			}
+			if w.errs != errs {
+				t.Errorf("errs = %d, want %d (%s)", w.errs, errs, strings.Join(w.buf, ","))
+			}
+		})
+	}
+}
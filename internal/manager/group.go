@@ -0,0 +1,325 @@
+package manager
+
+import (
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+)
+
+const (
+	// Defaults for messenger groups that don't specify them.
+	defaultGroupErrorRate     = 20
+	defaultGroupErrorWindow   = 50
+	defaultGroupProbeInterval = time.Minute
+
+	// Interval at which the members of groups that are down are checked
+	// for whether they're due to be probed.
+	groupProbeTick = time.Second * 5
+)
+
+// MessengerGroup is a set of messengers that campaigns can target by the
+// group's name like any other messenger. Messages are routed to the
+// members that are up in the order of preference: the first member is
+// the primary and the rest are fallbacks. Members with a Weight share the
+// traffic in proportion to their weights (eg: 70 / 30) and the ones without
+// are only used when all the weighted members are down.
+//
+// A member is taken out of rotation (down) when more than MaxErrorRate
+// percent of its last ErrorWindow messages fail. Every ProbeInterval, down
+// members that implement messenger.Prober are probed and are put back
+// on success. Members that don't are put back on probation where the first
+// failure takes them down again.
+type MessengerGroup struct {
+	Name          string
+	Members       []GroupMember
+	MaxErrorRate  float64
+	ErrorWindow   int
+	ProbeInterval time.Duration
+}
+
+// GroupMember is a messenger in a MessengerGroup.
+type GroupMember struct {
+	Messenger string `json:"messenger"`
+	Weight    int    `json:"weight"`
+}
+
+// MemberHealth represents the health of a member of a messenger group.
+type MemberHealth struct {
+	Messenger string  `json:"messenger"`
+	Weight    int     `json:"weight"`
+	Up        bool    `json:"up"`
+	ErrorRate float64 `json:"error_rate"`
+}
+
+// group is a loaded MessengerGroup.
+type group struct {
+	MessengerGroup
+	members []*member
+	mu      sync.Mutex
+}
+
+// member is a messenger of a group with its recent results.
+type member struct {
+	GroupMember
+	msgr messenger.Messenger
+	g    *group
+
+	// Ring of the outcomes (true = failed) of the last ErrorWindow messages.
+	results []bool
+	pos     int
+	num     int
+	errs    int
+
+	down      bool
+	downAt    time.Time
+	probation bool
+}
+
+// AddMessengerGroup adds a messenger group to the manager. All the members
+// should be registered messengers.
+func (m *Manager) AddMessengerGroup(mg MessengerGroup) error {
+	if _, ok := m.messengers[mg.Name]; ok {
+		return fmt.Errorf("messenger '%s' is already loaded", mg.Name)
+	}
+	if _, ok := m.groups[mg.Name]; ok {
+		return fmt.Errorf("messenger group '%s' is already loaded", mg.Name)
+	}
+	if len(mg.Members) == 0 {
+		return fmt.Errorf("messenger group '%s' has no messengers", mg.Name)
+	}
+
+	if mg.MaxErrorRate <= 0 {
+		mg.MaxErrorRate = defaultGroupErrorRate
+	}
+	if mg.ErrorWindow < 1 {
+		mg.ErrorWindow = defaultGroupErrorWindow
+	}
+	if mg.ProbeInterval <= 0 {
+		mg.ProbeInterval = defaultGroupProbeInterval
+	}
+
+	g := &group{MessengerGroup: mg}
+	for _, gm := range mg.Members {
+		msgr, ok := m.messengers[gm.Messenger]
+		if !ok {
+			return fmt.Errorf("unknown messenger '%s' in group '%s'", gm.Messenger, mg.Name)
+		}
+		g.members = append(g.members, &member{
+			GroupMember: gm,
+			msgr:        msgr,
+			g:           g,
+			results:     make([]bool, mg.ErrorWindow),
+		})
+	}
+
+	m.groups[mg.Name] = g
+	return nil
+}
+
+// MessengerGroupNames returns the names of the loaded messenger groups.
+func (m *Manager) MessengerGroupNames() []string {
+	out := make([]string, 0, len(m.groups))
+	for name := range m.groups {
+		out = append(out, name)
+	}
+	sort.Strings(out)
+	return out
+}
+
+// GetGroupHealth returns the health of the members of a messenger group.
+func (m *Manager) GetGroupHealth(name string) ([]MemberHealth, bool) {
+	g, ok := m.groups[name]
+	if !ok {
+		return nil, false
+	}
+
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	out := make([]MemberHealth, 0, len(g.members))
+	for _, mb := range g.members {
+		h := MemberHealth{
+			Messenger: mb.Messenger,
+			Weight:    mb.Weight,
+			Up:        !mb.down,
+		}
+		if mb.num > 0 {
+			h.ErrorRate = float64(mb.errs) / float64(mb.num) * 100
+		}
+		out = append(out, h)
+	}
+	return out, true
+}
+
+// route returns the messenger to push a message meant for the given
+// messenger or messenger group to. For groups, the group member that's
+// picked is also returned to report the outcome of the push to.
+func (m *Manager) route(id string) (messenger.Messenger, *member) {
+	if g, ok := m.groups[id]; ok {
+		mb := g.pick()
+		return mb.msgr, mb
+	}
+	return m.messengers[id], nil
+}
+
+// flushMessenger flushes the messages buffered by a messenger, or by the
+// members of a messenger group, to their backends.
+func (m *Manager) flushMessenger(id string) {
+	var msgrs []messenger.Messenger
+	if g, ok := m.groups[id]; ok {
+		for _, mb := range g.members {
+			msgrs = append(msgrs, mb.msgr)
+		}
+	} else if msgr, ok := m.messengers[id]; ok {
+		msgrs = append(msgrs, msgr)
+	}
+
+	for _, msgr := range msgrs {
+		if err := msgr.Flush(); err != nil {
+			m.logger.Printf("error flushing messenger %s: %v", msgr.Name(), err)
+		}
+	}
+}
+
+// pick picks a member of the group for a message.
+func (g *group) pick() *member {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	// Weighted split between the members that are up.
+	total := 0
+	for _, mb := range g.members {
+		if !mb.down && mb.Weight > 0 {
+			total += mb.Weight
+		}
+	}
+	if total > 0 {
+		n := rand.Intn(total)
+		for _, mb := range g.members {
+			if mb.down || mb.Weight < 1 {
+				continue
+			}
+			if n < mb.Weight {
+				return mb
+			}
+			n -= mb.Weight
+		}
+	}
+
+	// The first member that's up in the order of preference.
+	for _, mb := range g.members {
+		if !mb.down {
+			return mb
+		}
+	}
+
+	// Everything's down. Stick to the primary rather than not sending at all.
+	return g.members[0]
+}
+
+// report records the outcome of a message pushed to the member and takes
+// the member down if its error rate crosses the group's threshold.
+func (mb *member) report(err error, lo *log.Logger) {
+	g := mb.g
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	if mb.down {
+		return
+	}
+
+	// A failure while on probation takes the member down right away.
+	if mb.probation {
+		if err == nil {
+			mb.probation = false
+			return
+		}
+		mb.setDown()
+		lo.Printf("messenger %s in group %s failed on probation: %v", mb.Messenger, g.Name, err)
+		return
+	}
+
+	if mb.num == len(mb.results) {
+		if mb.results[mb.pos] {
+			mb.errs--
+		}
+	} else {
+		mb.num++
+	}
+	mb.results[mb.pos] = err != nil
+	if err != nil {
+		mb.errs++
+	}
+	mb.pos = (mb.pos + 1) % len(mb.results)
+
+	// Only decide on a full window.
+	if mb.num < len(mb.results) {
+		return
+	}
+	if rate := float64(mb.errs) / float64(mb.num) * 100; rate > g.MaxErrorRate {
+		mb.setDown()
+		lo.Printf("messenger %s in group %s is down (error rate %.0f%%). Failing over", mb.Messenger, g.Name, rate)
+	}
+}
+
+// setDown takes the member out of rotation and resets its results.
+// It should be called with the group's lock held.
+func (mb *member) setDown() {
+	mb.down = true
+	mb.downAt = time.Now()
+	mb.probation = false
+	mb.pos, mb.num, mb.errs = 0, 0, 0
+}
+
+// probeGroups is a blocking function that periodically probes the members
+// of groups that are down and puts them back into rotation once they're due.
+func (m *Manager) probeGroups() {
+	t := time.NewTicker(groupProbeTick)
+	defer t.Stop()
+
+	for range t.C {
+		for _, g := range m.groups {
+			// Pick the due members under the lock and probe them outside it
+			// as probes may block on the network.
+			var due []*member
+			g.mu.Lock()
+			for _, mb := range g.members {
+				if mb.down && time.Since(mb.downAt) >= g.ProbeInterval {
+					due = append(due, mb)
+				}
+			}
+			g.mu.Unlock()
+
+			for _, mb := range due {
+				var (
+					err       error
+					probation = true
+				)
+				if p, ok := mb.msgr.(messenger.Prober); ok {
+					err = p.Probe()
+					probation = false
+				}
+
+				g.mu.Lock()
+				if err != nil {
+					mb.downAt = time.Now()
+				} else {
+					mb.down = false
+					mb.probation = probation
+				}
+				g.mu.Unlock()
+
+				if err != nil {
+					m.logger.Printf("messenger %s in group %s failed probe: %v", mb.Messenger, g.Name, err)
+				} else {
+					m.logger.Printf("messenger %s in group %s is back up", mb.Messenger, g.Name)
+				}
+			}
+		}
+	}
+}
@@ -0,0 +1,69 @@
+package manager
+
+import (
+	"time"
+)
+
+// Lease is a range of subscriber IDs (FromID, ToID] of a campaign that's
+// leased to a node for processing. Multiple nodes (listmonk instances)
+// can process the same campaign by leasing non-overlapping ranges.
+// A node keeps renewing its leases (heartbeat) while it processes them
+// and if it crashes, its leases expire and are taken over by another
+// node which resumes from LastID.
+type Lease struct {
+	ID         int64 `db:"id"`
+	CampaignID int   `db:"campaign_id"`
+	FromID     int   `db:"from_id"`
+	ToID       int   `db:"to_id"`
+
+	// LastID is the last subscriber ID in the range that has been processed
+	// and Sent is the number of messages sent in the range so far.
+	LastID int `db:"last_id"`
+	Sent   int `db:"sent"`
+}
+
+// setLease registers the lease currently being processed for a campaign.
+// A nil lease unregisters it.
+func (m *Manager) setLease(campID int, l *Lease) {
+	m.leaseMut.Lock()
+	if l == nil {
+		delete(m.leases, campID)
+	} else {
+		m.leases[campID] = l
+	}
+	m.leaseMut.Unlock()
+}
+
+// leaseProgress records the progress of processing a lease.
+func (m *Manager) leaseProgress(l *Lease, lastID int, sent bool) {
+	m.leaseMut.Lock()
+	l.LastID = lastID
+	if sent {
+		l.Sent++
+	}
+	m.leaseMut.Unlock()
+}
+
+// renewLeases is a blocking function that periodically renews the leases
+// held by the node so that they don't expire while they're being processed.
+// The progress of every lease is recorded along with the renewal so that
+// another node can pick up from where this one left off.
+func (m *Manager) renewLeases() {
+	t := time.NewTicker(m.Cfg.LeaseDuration / 3)
+	defer t.Stop()
+
+	for range t.C {
+		m.leaseMut.Lock()
+		leases := make([]Lease, 0, len(m.leases))
+		for _, l := range m.leases {
+			leases = append(leases, *l)
+		}
+		m.leaseMut.Unlock()
+
+		for _, l := range leases {
+			if err := m.src.RenewLease(l, m.Cfg.NodeID, m.Cfg.LeaseDuration); err != nil {
+				m.logger.Printf("error renewing lease %d of campaign %d: %v", l.ID, l.CampaignID, err)
+			}
+		}
+	}
+}
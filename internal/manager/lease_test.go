@@ -0,0 +1,125 @@
+package manager
+
+import (
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+)
+
+// leaseSource is a DataSource that records lease renewals.
+type leaseSource struct {
+	DataSource
+
+	mu      sync.Mutex
+	renewed map[int64][]Lease
+	nodes   []string
+}
+
+func (s *leaseSource) RenewLease(l Lease, node string, ttl time.Duration) error {
+	s.mu.Lock()
+	s.renewed[l.ID] = append(s.renewed[l.ID], l)
+	s.nodes = append(s.nodes, node)
+	s.mu.Unlock()
+	return nil
+}
+
+func (s *leaseSource) last(id int64) (Lease, int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	r := s.renewed[id]
+	if len(r) == 0 {
+		return Lease{}, 0
+	}
+	return r[len(r)-1], len(r)
+}
+
+func TestLeaseProgress(t *testing.T) {
+	cases := []struct {
+		name     string
+		progress []int
+		sent     []bool
+		wantLast int
+		wantSent int
+	}{
+		{"none", nil, nil, 0, 0},
+		{"all sent", []int{11, 12, 15}, []bool{true, true, true}, 15, 3},
+		{"skipped", []int{11, 12, 15}, []bool{true, false, false}, 15, 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := New(Config{}, &leaseSource{}, nil, nil, log.New(ioutil.Discard, "", 0))
+			l := &Lease{ID: 1, CampaignID: 1, FromID: 10, ToID: 20}
+
+			m.setLease(l.CampaignID, l)
+			for i, id := range c.progress {
+				m.leaseProgress(l, id, c.sent[i])
+			}
+			if l.LastID != c.wantLast || l.Sent != c.wantSent {
+				t.Errorf("last, sent = %d, %d; want %d, %d", l.LastID, l.Sent, c.wantLast, c.wantSent)
+			}
+
+			m.setLease(l.CampaignID, nil)
+			if len(m.leases) != 0 {
+				t.Errorf("lease not unregistered: %v", m.leases)
+			}
+		})
+	}
+}
+
+func TestRenewLeases(t *testing.T) {
+	src := &leaseSource{renewed: make(map[int64][]Lease)}
+	m := New(Config{NodeID: "node-1"}, src, nil, nil, log.New(ioutil.Discard, "", 0))
+	m.Cfg.LeaseDuration = time.Millisecond * 30
+
+	var (
+		l1 = &Lease{ID: 1, CampaignID: 1, FromID: 0, ToID: 100}
+		l2 = &Lease{ID: 2, CampaignID: 2, FromID: 100, ToID: 200}
+	)
+	m.setLease(l1.CampaignID, l1)
+	m.setLease(l2.CampaignID, l2)
+	m.leaseProgress(l1, 42, true)
+
+	go m.renewLeases()
+
+	// Leases are renewed with their progress until they're unregistered.
+	waitFor(t, func() bool {
+		r1, _ := src.last(1)
+		_, n := src.last(2)
+		return r1.LastID == 42 && r1.Sent == 1 && n > 0
+	})
+
+	m.setLease(l2.CampaignID, nil)
+	m.leaseProgress(l1, 50, true)
+	_, n2 := src.last(2)
+
+	waitFor(t, func() bool {
+		r1, _ := src.last(1)
+		return r1.LastID == 50 && r1.Sent == 2
+	})
+	if _, n := src.last(2); n > n2+1 {
+		t.Errorf("unregistered lease renewed %d more times", n-n2)
+	}
+
+	src.mu.Lock()
+	for _, n := range src.nodes {
+		if n != "node-1" {
+			t.Errorf("lease renewed for node %q", n)
+		}
+	}
+	src.mu.Unlock()
+}
+
+// waitFor polls a condition until it's true or a few seconds have passed.
+func waitFor(t *testing.T, cond func() bool) {
+	t.Helper()
+
+	for start := time.Now(); time.Since(start) < time.Second*3; time.Sleep(time.Millisecond * 5) {
+		if cond() {
+			return
+		}
+	}
+	t.Fatal("timed out waiting for the condition")
+}
@@ -1,12 +1,12 @@
 package manager
 
 import (
-	"bytes"
 	"errors"
 	"fmt"
 	"html/template"
 	"log"
 	"net/textproto"
+	"runtime"
 	"strings"
 	"sync"
 	"time"
@@ -31,12 +31,30 @@ const (
 // that provides subscriber and campaign records.
 type DataSource interface {
 	NextCampaigns(excludeIDs []int64) ([]*models.Campaign, error)
-	NextSubscribers(campID, limit int) ([]models.Subscriber, error)
+	NextSubscribers(campID, fromID, toID int, caps []FrequencyCap) ([]models.Subscriber, error)
+	NextLease(campID, limit int, node string, ttl time.Duration) (*Lease, error)
+	RenewLease(l Lease, node string, ttl time.Duration) error
+	CompleteLease(l Lease, node string) error
+	FinishCampaign(campID int) (bool, error)
+	EndABTest(campID int, window time.Duration) (bool, error)
+	PickABWinner(campID int) (int, error)
+	GetCampaignVariants(campID int) ([]models.CampaignVariant, error)
+	GetSendHours(subIDs []int) (map[int]int, error)
+	GetMedianSendHour(campID int) (int, error)
+	GetListTimezones(campID int, subIDs []int) (map[int]string, error)
+	GetCampaignAttachments(campID int) ([]messenger.Attachment, error)
+	GetMessengerSent(messenger string, since time.Time) (int, error)
+	CountCampaignRecipients(campID int) (int, int, error)
+	DryRunSubscribers(campID, fromID, toID int, caps []FrequencyCap) ([]models.Subscriber, error)
+	RecordDeliveries([]Delivery) error
+	RecordTxDelivery(id, status, messageID, errMsg string) error
+	NextRetries(campID, limit int, ttl time.Duration, caps []FrequencyCap) ([]Retry, error)
+	AddCampaignSent(campID, n int) error
 	GetCampaign(campID int) (*models.Campaign, error)
 	UpdateCampaignStatus(campID int, status string) error
+	PauseCampaign(campID int, reason string) error
 	CreateLink(url string) (string, error)
 	UpdateLastEmailSent(email string) error
-	UpdateSentCampaign(campID, limit, lastSubsId int) error
 }
 
 // Manager handles the scheduling, processing, and queuing of campaigns
@@ -49,10 +67,36 @@ type Manager struct {
 	notifCB    models.AdminNotifCallback
 	logger     *log.Logger
 
+	// Messenger groups that campaigns can target like messengers.
+	groups map[string]*group
+
+	// Token bucket rate limiters for every messenger, keyed by the messenger name.
+	// Messages are pushed to a messenger only after acquiring a token.
+	limiters map[string]*limiter
+	limMut   sync.RWMutex
+
+	// Limiters of the recipient domain throttles in the order of the config.
+	// Campaign messages to saturated domains are deferred.
+	domainLimiters []*domainLimiter
+
+	// Warm-up plans of messengers, keyed by the messenger name.
+	warmups map[string]*warmup
+
+	// IDs of the campaigns whose dry runs are in progress on the node.
+	dryRuns   map[int]bool
+	dryRunMut sync.Mutex
+
 	// Campaigns that are currently running.
 	camps    map[int]*models.Campaign
 	campsMut sync.RWMutex
 
+	// Compiled A/B test variants of running campaigns, the median send hours
+	// of campaigns that optimize send time, and the attachments of campaigns
+	// (guarded by campsMut).
+	variants    map[int][]abVariant
+	sendHours   map[int]int
+	attachments map[int][]messenger.Attachment
+
 	// Links generated using Track() are cached here so as to not query
 	// the database for the link UUID for every message sent. This has to
 	// be locked as it may be used externally when previewing campaigns.
@@ -60,16 +104,44 @@ type Manager struct {
 	linksMut sync.RWMutex
 
 	subFetchQueue      chan *models.Campaign
+	renderQueue        chan *renderJob
 	campMsgQueue       chan CampaignMessage
 	campMsgErrorQueue  chan msgError
 	campMsgErrorCounts map[int]int
+	campPauseQueue     chan msgError
 	msgQueue           chan Message
 
+	// Rolling windows of the outcomes of the last N messages of every
+	// running campaign for the percentage based error threshold.
+	errWindows   map[int]*errWindow
+	errWindowMut sync.Mutex
+
+	// Subscriber ranges of campaigns currently leased to the node, keyed
+	// by campaign ID.
+	leases   map[int]*Lease
+	leaseMut sync.Mutex
+
+	// Delivery records of campaign messages buffered to be written
+	// to the data source in batches.
+	deliveries       []Delivery
+	deliveriesMut    sync.Mutex
+	deliveryWriteMut sync.Mutex
+
+	// Changes to the sent counts of campaigns outside of leases (deferred
+	// messages that are sent later) that are written along with the deliveries.
+	sentCounts map[int]int
+
 	// Sliding window keeps track of the total number of messages sent in a period
 	// and on reaching the specified limit, waits until the window is over before
 	// sending further messages.
 	slidingWindowNumMsg int
 	slidingWindowStart  time.Time
+
+	// Time spent in fetching subscribers, rendering messages, and
+	// pushing them to messengers.
+	fetchTimer  stageTimer
+	renderTimer stageTimer
+	pushTimer   stageTimer
 }
 
 // CampaignMessage represents an instance of campaign message to be pushed out,
@@ -84,6 +156,12 @@ type CampaignMessage struct {
 	body     []byte
 	altBody  []byte
 	unsubURL string
+
+	// attempt is the nth attempt at sending the message to the subscriber.
+	attempt int
+
+	// variantID is the ID of the campaign's A/B test variant, if any.
+	variantID int
 }
 
 // Message represents a generic message to be pushed to a messenger.
@@ -93,6 +171,10 @@ type Message struct {
 
 	// Messenger is the messenger backend to use: email|postback.
 	Messenger string
+
+	// ID is the unique ID of a transactional message whose delivery is
+	// recorded in the data source. It's empty for admin notifications.
+	ID string
 }
 
 // Config has parameters for configuring the manager.
@@ -100,26 +182,74 @@ type Config struct {
 	// Number of subscribers to pull from the DB in a single iteration.
 	BatchSize int
 
-	Concurrency           int
-	MessageRate           int
-	MaxSendErrors         int
+	// NodeID uniquely identifies the instance when multiple instances
+	// process campaigns. Subscriber ranges leased to a node expire if it
+	// doesn't renew them within LeaseDuration.
+	NodeID        string
+	LeaseDuration time.Duration
+
+	Concurrency int
+
+	// Number of workers that render campaign messages in parallel before
+	// they're handed over to the message workers. Defaults to the number of CPUs.
+	RenderConcurrency int
+
+	// MessageRate and MessageBurst are the default per-messenger limits
+	// (messages / second) that can be overridden for individual messengers
+	// in MessengerRates.
+	MessageRate    int
+	MessageBurst   int
+	MessengerRates map[string]RateLimit
+
+	MaxSendErrors int
+
+	// Pause a campaign if more than MaxErrorRate percent of the last
+	// ErrorRateWindow messages failed, optionally for every error class
+	// separately.
+	MaxErrorRate      float64
+	ErrorRateWindow   int
+	ErrorRatePerClass bool
+
 	SlidingWindow         bool
 	SlidingWindowDuration time.Duration
 	SlidingWindowRate     int
-	RequeueOnError        bool
-	FromEmail             string
-	IndividualTracking    bool
-	LinkTrackURL          string
-	UnsubURL              string
-	OptinURL              string
-	MessageURL            string
-	ViewTrackURL          string
-	UnsubHeader           bool
+
+	// Failed messages are retried (if RequeueOnError is set) upto MaxAttempts
+	// times with an exponential backoff starting from the duration
+	// configured for the class of the error (ErrClass*). Errors of classes
+	// without a backoff are not retried.
+	RequeueOnError bool
+	MaxAttempts    int
+	RetryBackoff   map[string]time.Duration
+
+	// Subscribers who have been sent the maximum number of campaign
+	// messages allowed by a cap within its period are skipped.
+	FrequencyCaps []FrequencyCap
+
+	// Per recipient domain rate and concurrency limits. The first throttle
+	// that matches a recipient applies.
+	DomainThrottles []DomainThrottle
+
+	// Warm-up plans of new messengers.
+	Warmups []Warmup
+
+	FromEmail          string
+	IndividualTracking bool
+	LinkTrackURL       string
+	UnsubURL           string
+	OptinURL           string
+	MessageURL         string
+	ViewTrackURL       string
+	UnsubHeader        bool
 }
 
 type msgError struct {
 	camp *models.Campaign
 	err  error
+
+	// reason is set when the error threshold of the campaign has been
+	// crossed and it has to be paused.
+	reason string
 }
 
 // New returns a new instance of Mailer.
@@ -130,9 +260,30 @@ func New(cfg Config, src DataSource, notifCB models.AdminNotifCallback, i *i18n.
 	if cfg.Concurrency < 1 {
 		cfg.Concurrency = 1
 	}
+	if cfg.RenderConcurrency < 1 {
+		cfg.RenderConcurrency = runtime.NumCPU()
+	}
 	if cfg.MessageRate < 1 {
 		cfg.MessageRate = 1
 	}
+	if cfg.LeaseDuration < time.Second*3 {
+		cfg.LeaseDuration = time.Minute
+	}
+
+	dls := make([]*domainLimiter, 0, len(cfg.DomainThrottles))
+	for _, t := range cfg.DomainThrottles {
+		if t.Pattern == "" || (t.Rate < 1 && t.Concurrency < 1) {
+			continue
+		}
+		dls = append(dls, newDomainLimiter(t))
+	}
+
+	warmups := make(map[string]*warmup, len(cfg.Warmups))
+	for _, w := range cfg.Warmups {
+		if w.Messenger != "" && len(w.DailyCaps) > 0 {
+			warmups[w.Messenger] = &warmup{Warmup: w}
+		}
+	}
 
 	return &Manager{
 		Cfg:                cfg,
@@ -141,13 +292,27 @@ func New(cfg Config, src DataSource, notifCB models.AdminNotifCallback, i *i18n.
 		notifCB:            notifCB,
 		logger:             l,
 		messengers:         make(map[string]messenger.Messenger),
+		groups:             make(map[string]*group),
+		limiters:           make(map[string]*limiter),
+		domainLimiters:     dls,
+		warmups:            warmups,
+		dryRuns:            make(map[int]bool),
 		camps:              make(map[int]*models.Campaign),
+		variants:           make(map[int][]abVariant),
+		sendHours:          make(map[int]int),
+		attachments:        make(map[int][]messenger.Attachment),
 		links:              make(map[string]string),
 		subFetchQueue:      make(chan *models.Campaign, cfg.Concurrency),
+		renderQueue:        make(chan *renderJob, cfg.RenderConcurrency*2),
 		campMsgQueue:       make(chan CampaignMessage, cfg.Concurrency*2),
 		msgQueue:           make(chan Message, cfg.Concurrency),
 		campMsgErrorQueue:  make(chan msgError, cfg.MaxSendErrors),
 		campMsgErrorCounts: make(map[int]int),
+		campPauseQueue:     make(chan msgError, cfg.Concurrency),
+		errWindows:         make(map[int]*errWindow),
+		leases:             make(map[int]*Lease),
+		deliveries:         make([]Delivery, 0, deliveryBatchSize),
+		sentCounts:         make(map[int]int),
 		slidingWindowStart: time.Now(),
 	}
 }
@@ -156,7 +321,17 @@ func New(cfg Config, src DataSource, notifCB models.AdminNotifCallback, i *i18n.
 // to message templates while they're compiled. It represents a message from
 // a campaign that's bound to a single Subscriber.
 func (m *Manager) NewCampaignMessage(c *models.Campaign, s models.Subscriber) (CampaignMessage, error) {
-	msg := CampaignMessage{
+	msg := m.newCampaignMessage(c, s)
+	if err := msg.render(); err != nil {
+		return msg, err
+	}
+
+	return msg, nil
+}
+
+// newCampaignMessage returns a CampaignMessage that's yet to be rendered.
+func (m *Manager) newCampaignMessage(c *models.Campaign, s models.Subscriber) CampaignMessage {
+	return CampaignMessage{
 		Campaign:   c,
 		Subscriber: s,
 
@@ -164,13 +339,8 @@ func (m *Manager) NewCampaignMessage(c *models.Campaign, s models.Subscriber) (C
 		from:     c.FromEmail,
 		to:       s.Email,
 		unsubURL: fmt.Sprintf(m.Cfg.UnsubURL, c.UUID, s.UUID),
+		attempt:  1,
 	}
-
-	if err := msg.render(); err != nil {
-		return msg, err
-	}
-
-	return msg, nil
 }
 
 // AddMessenger adds a Messenger messaging backend to the manager.
@@ -180,9 +350,56 @@ func (m *Manager) AddMessenger(msg messenger.Messenger) error {
 		return fmt.Errorf("messenger '%s' is already loaded", id)
 	}
 	m.messengers[id] = msg
+
+	m.limMut.Lock()
+	m.limiters[id] = newLimiter(m.rateLimit(id))
+	m.limMut.Unlock()
 	return nil
 }
 
+// SetRateLimits reconfigures the default and per-messenger rate limits
+// of all registered messengers on the fly.
+func (m *Manager) SetRateLimits(rate, burst int, rates map[string]RateLimit) {
+	if rate < 1 {
+		rate = 1
+	}
+
+	m.limMut.Lock()
+	defer m.limMut.Unlock()
+
+	m.Cfg.MessageRate = rate
+	m.Cfg.MessageBurst = burst
+	m.Cfg.MessengerRates = rates
+
+	for id, l := range m.limiters {
+		l.set(m.rateLimit(id))
+	}
+}
+
+// GetRateStats returns the configured rate limit and the observed send rate
+// of a messenger. For messenger groups, they're the sum of the members'.
+func (m *Manager) GetRateStats(id string) (RateStats, bool) {
+	if g, ok := m.groups[id]; ok {
+		var out RateStats
+		for _, mb := range g.members {
+			if r, ok := m.GetRateStats(mb.Messenger); ok {
+				out.Rate += r.Rate
+				out.Burst += r.Burst
+				out.Current += r.Current
+			}
+		}
+		return out, true
+	}
+
+	m.limMut.RLock()
+	l, ok := m.limiters[id]
+	m.limMut.RUnlock()
+	if !ok {
+		return RateStats{}, false
+	}
+	return l.stats(), true
+}
+
 // PushMessage pushes an arbitrary non-campaign Message to be sent out by the workers.
 // It times out if the queue is busy.
 func (m *Manager) PushMessage(msg Message) error {
@@ -213,8 +430,11 @@ func (m *Manager) PushCampaignMessage(msg CampaignMessage) error {
 	return nil
 }
 
-// HasMessenger checks if a given messenger is registered.
+// HasMessenger checks if a given messenger or messenger group is registered.
 func (m *Manager) HasMessenger(id string) bool {
+	if _, ok := m.groups[id]; ok {
+		return true
+	}
 	_, ok := m.messengers[id]
 	return ok
 }
@@ -234,12 +454,20 @@ func (m *Manager) HasRunningCampaigns() bool {
 // as "finished".
 func (m *Manager) Run(tick time.Duration) {
 	go m.scanCampaigns(tick)
+	go m.renewLeases()
+	go m.deliveryFlusher()
+	go m.probeGroups()
 
 	// Spawn N message workers.
 	for i := 0; i < m.Cfg.Concurrency; i++ {
 		go m.messageWorker(i)
 	}
 
+	// Spawn N render workers.
+	for i := 0; i < m.Cfg.RenderConcurrency; i++ {
+		go m.renderWorker()
+	}
+
 	// Fetch the next set of subscribers for a campaign and process them.
 	for c := range m.subFetchQueue {
 		has, err := m.nextSubscribers(c, m.Cfg.BatchSize)
@@ -259,6 +487,11 @@ func (m *Manager) Run(tick time.Duration) {
 				m.logger.Printf("error exhausting campaign (%s): %v", c.Name, err)
 				continue
 			}
+
+			// The campaign is still being processed by other nodes.
+			if newC.Status == models.CampaignStatusRunning {
+				continue
+			}
 			m.sendNotif(newC, newC.Status, "")
 		}
 	}
@@ -267,9 +500,6 @@ func (m *Manager) Run(tick time.Duration) {
 // messageWorker is a blocking function that listens to the message queue
 // and pushes out incoming messages on it to the messenger.
 func (m *Manager) messageWorker(worker int) {
-	// Counter to keep track of the message / sec rate limit.
-	//rl := ratelimit.New(m.Cfg.MessageRate)
-	//start := time.Now()
 	for {
 		select {
 		// Campaign message.
@@ -277,39 +507,83 @@ func (m *Manager) messageWorker(worker int) {
 			if !ok {
 				return
 			}
-			//now := rl.Take()
 
 			// Outgoing message.
-			out := messenger.Message{
-				From:        msg.from,
-				To:          []string{msg.to},
-				Subject:     msg.subject,
-				ContentType: msg.Campaign.ContentType,
-				Body:        msg.body,
-				AltBody:     msg.altBody,
-				Subscriber:  msg.Subscriber,
-				Campaign:    msg.Campaign,
+			out := m.outgoingMessage(msg)
+
+			// If the recipient's domain is saturated, defer the message instead
+			// of blocking the worker so that other domains aren't held up.
+			dl := m.domainLimiter(msg.to)
+			if dl != nil {
+				if wait, ok := dl.take(); !ok {
+					m.recordDelivery(Delivery{
+						CampaignID:   msg.Campaign.ID,
+						SubscriberID: msg.Subscriber.ID,
+						Status:       DeliveryStatusDeferred,
+						Messenger:    msg.Campaign.Messenger,
+						VariantID:    msg.variantID,
+						RetryAfter:   wait,
+					})
+
+					// A first attempt has been counted as sent when it was queued.
+					// It's counted again when it's sent.
+					if msg.attempt == 1 {
+						m.addSent(msg.Campaign.ID, -1)
+					}
+					continue
+				}
 			}
 
-			// Attach List-Unsubscribe headers?
-			if m.Cfg.UnsubHeader {
-				h := textproto.MIMEHeader{}
-				h.Set("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
-				h.Set("List-Unsubscribe", `<`+msg.unsubURL+`>`)
-				out.Headers = h
+			// Messages of campaigns that target messenger groups are routed
+			// to a member and are recorded against it.
+			msgr, mb := m.route(msg.Campaign.Messenger)
+			m.waitRate(msgr.Name())
+			start := time.Now()
+			msgID, err := push(msgr, out)
+			m.pushTimer.add(time.Since(start), 1)
+			if dl != nil {
+				dl.release()
+			}
+			if mb != nil {
+				mb.report(err, m.logger)
 			}
 
-			if err := m.messengers[msg.Campaign.Messenger].Push(out, m.Cfg.Concurrency); err != nil {
+			d := Delivery{
+				CampaignID:   msg.Campaign.ID,
+				SubscriberID: msg.Subscriber.ID,
+				Status:       DeliveryStatusSent,
+				Messenger:    msgr.Name(),
+				MessageID:    msgID,
+				VariantID:    msg.variantID,
+				Credits:      1,
+			}
+			if mt, ok := msgr.(messenger.Metered); ok {
+				d.Credits = mt.Credits(out)
+			}
+			if err != nil {
 				m.logger.Printf("error sending message in campaign %s: subscriber %s: %v",
 					msg.Campaign.Name, msg.Subscriber.UUID, err)
 
+				d.Status = DeliveryStatusFailed
+				d.Error = err.Error()
+				d.RetryAfter = m.retryAfter(err, msg.attempt)
+
 				select {
 				case m.campMsgErrorQueue <- msgError{camp: msg.Campaign, err: err}:
 				default:
 				}
 			}
-			//m.logger.Printf("[%v] sent to %v at worker %v, taking at %v - %v", msg.Campaign.Messenger, out.To[0], worker, now, now.Sub(start))
-			//start = now
+			m.recordDelivery(d)
+
+			// Has the campaign crossed the percentage error threshold?
+			// The signal is dropped if the queue is full. As the campaign's window
+			// starts afresh, it's raised again once the window fills up.
+			if reason, ok := m.recordResult(msg.Campaign, err); ok {
+				select {
+				case m.campPauseQueue <- msgError{camp: msg.Campaign, reason: reason}:
+				default:
+				}
+			}
 
 			go func(email string) {
 				if err := m.src.UpdateLastEmailSent(email); err != nil {
@@ -323,23 +597,88 @@ func (m *Manager) messageWorker(worker int) {
 				return
 			}
 
-			err := m.messengers[msg.Messenger].Push(messenger.Message{
+			msgr, mb := m.route(msg.Messenger)
+			m.waitRate(msgr.Name())
+			msgID, err := push(msgr, messenger.Message{
 				From:        msg.From,
 				To:          msg.To,
 				Subject:     msg.Subject,
 				ContentType: msg.ContentType,
 				Body:        msg.Body,
 				AltBody:     msg.AltBody,
+				Headers:     msg.Headers,
+				Attachments: msg.Attachments,
 				Subscriber:  msg.Subscriber,
 				Campaign:    msg.Campaign,
-			}, m.Cfg.Concurrency)
+			})
+			if mb != nil {
+				mb.report(err, m.logger)
+			}
 			if err != nil {
 				m.logger.Printf("error sending message '%s': %v", msg.Subject, err)
 			}
+
+			// Record the outcome of transactional messages.
+			if msg.ID != "" {
+				status, errMsg := DeliveryStatusSent, ""
+				if err != nil {
+					status, errMsg = DeliveryStatusFailed, err.Error()
+				}
+				if err := m.src.RecordTxDelivery(msg.ID, status, msgID, errMsg); err != nil {
+					m.logger.Printf("error recording transactional message delivery: %v", err)
+				}
+			}
 		}
 	}
 }
 
+// outgoingMessage returns the message to be pushed to a messenger
+// for a rendered campaign message.
+func (m *Manager) outgoingMessage(msg CampaignMessage) messenger.Message {
+	out := messenger.Message{
+		From:        msg.from,
+		To:          []string{msg.to},
+		Subject:     msg.subject,
+		ContentType: msg.Campaign.ContentType,
+		Body:        msg.body,
+		AltBody:     msg.altBody,
+		Attachments: m.campaignAttachments(msg.Campaign.ID),
+		Subscriber:  msg.Subscriber,
+		Campaign:    msg.Campaign,
+	}
+
+	// Attach List-Unsubscribe headers?
+	if m.Cfg.UnsubHeader {
+		h := textproto.MIMEHeader{}
+		h.Set("List-Unsubscribe-Post", "List-Unsubscribe=One-Click")
+		h.Set("List-Unsubscribe", `<`+msg.unsubURL+`>`)
+		out.Headers = h
+	}
+
+	return out
+}
+
+// waitRate blocks until the rate limiter of the given messenger
+// allows a message to be pushed.
+func (m *Manager) waitRate(id string) {
+	m.limMut.RLock()
+	l, ok := m.limiters[id]
+	m.limMut.RUnlock()
+	if ok {
+		l.wait()
+	}
+}
+
+// rateLimit returns the rate limit for a messenger, which is its override
+// in MessengerRates if there's one, or the default message rate.
+// It should be called with limMut held.
+func (m *Manager) rateLimit(id string) RateLimit {
+	if r, ok := m.Cfg.MessengerRates[id]; ok && r.Rate > 0 {
+		return r
+	}
+	return RateLimit{Rate: m.Cfg.MessageRate, Burst: m.Cfg.MessageBurst}
+}
+
 // TemplateFuncs returns the template functions to be applied into
 // compiled campaign templates.
 func (m *Manager) TemplateFuncs(c *models.Campaign) template.FuncMap {
@@ -382,6 +721,17 @@ func (m *Manager) TemplateFuncs(c *models.Campaign) template.FuncMap {
 		"MessageURL": func(msg *CampaignMessage) string {
 			return fmt.Sprintf(m.Cfg.MessageURL, c.UUID, msg.Subscriber.UUID)
 		},
+	}
+	for k, v := range m.GenericTemplateFuncs() {
+		f[k] = v
+	}
+	return f
+}
+
+// GenericTemplateFuncs returns the template functions that aren't bound to a
+// campaign message, for instance, for rendering transactional messages.
+func (m *Manager) GenericTemplateFuncs() template.FuncMap {
+	f := template.FuncMap{
 		"Date": func(layout string) string {
 			if layout == "" {
 				layout = time.ANSIC
@@ -403,6 +753,7 @@ func (m *Manager) TemplateFuncs(c *models.Campaign) template.FuncMap {
 
 // Close closes and exits the campaign manager.
 func (m *Manager) Close() {
+	m.flushDeliveries()
 	close(m.subFetchQueue)
 	close(m.campMsgErrorQueue)
 	close(m.msgQueue)
@@ -440,12 +791,17 @@ func (m *Manager) scanCampaigns(tick time.Duration) {
 				}
 			}
 
+			// The percentage error threshold of a campaign has been crossed.
+		case e := <-m.campPauseQueue:
+			m.pauseCampaign(e.camp, e.reason)
+
 			// Aggregate errors from sending messages to check against the error threshold
 			// after which a campaign is paused.
 		case e, ok := <-m.campMsgErrorQueue:
 			if !ok {
 				return
 			}
+
 			if m.Cfg.MaxSendErrors < 1 {
 				continue
 			}
@@ -453,16 +809,7 @@ func (m *Manager) scanCampaigns(tick time.Duration) {
 			// If the error threshold is met, pause the campaign.
 			m.campMsgErrorCounts[e.camp.ID]++
 			if m.campMsgErrorCounts[e.camp.ID] >= m.Cfg.MaxSendErrors {
-				m.logger.Printf("error counted exceeded %d. pausing campaign %s",
-					m.Cfg.MaxSendErrors, e.camp.Name)
-
-				if m.isCampaignProcessing(e.camp.ID) {
-					m.exhaustCampaign(e.camp, models.CampaignStatusPaused)
-				}
-				delete(m.campMsgErrorCounts, e.camp.ID)
-
-				// Notify admins.
-				m.sendNotif(e.camp, models.CampaignStatusPaused, "Too many errors")
+				m.pauseCampaign(e.camp, fmt.Sprintf("error count exceeded %d", m.Cfg.MaxSendErrors))
 			}
 		}
 	}
@@ -471,7 +818,7 @@ func (m *Manager) scanCampaigns(tick time.Duration) {
 // addCampaign adds a campaign to the process queue.
 func (m *Manager) addCampaign(c *models.Campaign) error {
 	// Validate messenger.
-	if _, ok := m.messengers[c.Messenger]; !ok {
+	if !m.HasMessenger(c.Messenger) {
 		m.src.UpdateCampaignStatus(c.ID, models.CampaignStatusCancelled)
 		return fmt.Errorf("unknown messenger %s on campaign %s", c.Messenger, c.Name)
 	}
@@ -481,13 +828,40 @@ func (m *Manager) addCampaign(c *models.Campaign) error {
 		return err
 	}
 
+	// Load the A/B test variants, if any.
+	if err := m.loadVariants(c); err != nil {
+		return err
+	}
+
+	// Load the fallback send hour if the campaign optimizes send time.
+	if err := m.loadSendHour(c); err != nil {
+		return err
+	}
+
+	// Load the attachments once for all the messages of the campaign.
+	atts, err := m.src.GetCampaignAttachments(c.ID)
+	if err != nil {
+		return fmt.Errorf("error loading campaign attachments: %v", err)
+	}
+
 	// Add the campaign to the active map.
 	m.campsMut.Lock()
 	m.camps[c.ID] = c
+	if len(atts) > 0 {
+		m.attachments[c.ID] = atts
+	}
 	m.campsMut.Unlock()
 	return nil
 }
 
+// campaignAttachments returns the attachments of a running campaign. They're
+// shared by all the messages of the campaign and must not be modified.
+func (m *Manager) campaignAttachments(campID int) []messenger.Attachment {
+	m.campsMut.RLock()
+	defer m.campsMut.RUnlock()
+	return m.attachments[campID]
+}
+
 // getPendingCampaignIDs returns the IDs of campaigns currently being processed.
 func (m *Manager) getPendingCampaignIDs() []int64 {
 	// Needs to return an empty slice in case there are no campaigns.
@@ -500,98 +874,159 @@ func (m *Manager) getPendingCampaignIDs() []int64 {
 	return ids
 }
 
-// nextSubscribers processes the next batch of subscribers in a given campaign.
-// It returns a bool indicating whether any subscribers were processed
-// in the current batch or not. A false indicates that all subscribers
-// have been processed, or that a campaign has been paused or cancelled.
+// nextSubscribers leases the next range of subscribers in a given campaign
+// and processes them. It returns a bool indicating whether any subscribers were
+// processed in the current batch or not. A false indicates that all subscribers
+// have been processed (or are being processed by other nodes), or that a campaign
+// has been paused or cancelled.
 func (m *Manager) nextSubscribers(c *models.Campaign, batchSize int) (bool, error) {
-	// Fetch a batch of subscribers.
-	if len(c.SubsCamp) == 0 {
-		subs, err := m.src.NextSubscribers(c.ID, batchSize)
-		if err != nil {
-			return false, fmt.Errorf("error fetching campaign subscribers (%s): %v", c.Name, err)
-		}
-		for _, eachSub := range subs {
-			c.SubsCamp = append(c.SubsCamp, eachSub)
-		}
+	// Lease the next range of subscribers.
+	l, err := m.src.NextLease(c.ID, batchSize, m.Cfg.NodeID, m.Cfg.LeaseDuration)
+	if err != nil {
+		return false, fmt.Errorf("error leasing campaign subscribers (%s): %v", c.Name, err)
 	}
 
-	// There are no subscribers.
-	if len(c.SubsCamp) == 0 {
-		return false, nil
+	// There are no more subscribers to lease. Process the messages
+	// that have failed and are due to be retried, if any.
+	if l == nil {
+		return m.nextRetries(c, batchSize)
 	}
 
-	// Is there a sliding window limit configured?
-	hasSliding := m.Cfg.SlidingWindow &&
-		m.Cfg.SlidingWindowRate > 0 &&
-		m.Cfg.SlidingWindowDuration.Seconds() > 1
+	// Fetch the subscribers in the leased range. Subscribers who have already
+	// been sent the campaign or who have crossed a frequency cap are skipped
+	// by the data source, so if the lease was
+	// taken over from a node that went down, the whole range is fetched again
+	// to pick up the messages that the node had queued but never sent.
+	start := time.Now()
+	subs, err := m.src.NextSubscribers(c.ID, l.FromID, l.ToID, m.Cfg.FrequencyCaps)
+	if err != nil {
+		return false, fmt.Errorf("error fetching campaign subscribers (%s): %v", c.Name, err)
+	}
+	m.fetchTimer.add(time.Since(start), len(subs))
 
-	// Push messages.
-	sleep := 0
-	tmp := c.SubsCamp[:0]
-	lastSubID := 0
-
-	for _, s := range c.SubsCamp {
-		if sleep >= batchSize {
-			tmp = append(tmp, s)
-			sleep++
-			continue
-		}
-		// Send the message.
-		msg, err := m.NewCampaignMessage(c, s)
-		if err != nil {
-			m.logger.Printf("error rendering message (%s) (%s): %v", c.Name, s.Email, err)
-			continue
-		}
+	// If the campaign optimizes send time or has a local send time, get the
+	// durations for which the messages to the subscribers are to be held.
+	delays, err := m.sendDelays(c, subs)
+	if err != nil {
+		return false, err
+	}
 
-		// Push the message to the queue while blocking and waiting until
-		// the queue is drained.
-		m.campMsgQueue <- msg
+	// If the campaign's messenger is warming up, get its quota for the day.
+	wq, err := m.warmupQuota(c.Messenger)
+	if err != nil {
+		return false, fmt.Errorf("error fetching warm-up quota (%s): %v", c.Name, err)
+	}
 
-		// Check if the sliding window is active.
-		if hasSliding {
-			diff := time.Now().Sub(m.slidingWindowStart)
+	// Register the lease so that it's renewed while the subscribers are processed.
+	m.setLease(c.ID, l)
+	defer m.setLease(c.ID, nil)
 
-			// Window has expired. Reset the clock.
-			if diff >= m.Cfg.SlidingWindowDuration {
-				m.slidingWindowStart = time.Now()
-				m.slidingWindowNumMsg = 0
-				continue
+	// Messages are rendered by the render workers and pushed in order. The lease's
+	// progress is recorded by the pipeline once the messages before it are pushed.
+	p := m.newRenderPipeline(c, l)
+
+	// Push messages.
+	for _, s := range subs {
+		// The campaign has been paused or cancelled. Record the progress and leave
+		// the lease to expire. It's picked up from here when the campaign is resumed.
+		if !m.isCampaignProcessing(c.ID) {
+			p.wait()
+			if err := m.src.RenewLease(*l, m.Cfg.NodeID, m.Cfg.LeaseDuration); err != nil {
+				m.logger.Printf("error recording lease progress (%s): %v", c.Name, err)
 			}
+			return false, nil
+		}
 
-			// Have the messages exceeded the limit?
-			m.slidingWindowNumMsg++
-			if m.slidingWindowNumMsg >= m.Cfg.SlidingWindowRate {
-				wait := m.Cfg.SlidingWindowDuration - diff
+		// If it's an A/B test, pick the subscriber's variant.
+		v, ok := m.variant(c, s, false)
+		if !ok {
+			p.progress(s.ID, false)
+			continue
+		}
 
-				m.logger.Printf("messages exceeded (%d) for the window (%v since %s). Sleeping for %s.",
-					m.slidingWindowNumMsg,
-					m.Cfg.SlidingWindowDuration,
-					m.slidingWindowStart.Format(time.RFC822Z),
-					wait.Round(time.Second)*1)
+		// Defer the message until the subscriber's best hour or local send time.
+		// It's picked up again along with the retries when it's due.
+		if d, ok := delays[s.ID]; ok {
+			m.recordDelivery(Delivery{
+				CampaignID:   c.ID,
+				SubscriberID: s.ID,
+				Status:       DeliveryStatusDeferred,
+				Messenger:    c.Messenger,
+				VariantID:    v.id,
+				RetryAfter:   d,
+			})
+			p.progress(s.ID, false)
+			continue
+		}
 
-				m.slidingWindowNumMsg = 0
-				time.Sleep(wait)
-			}
+		// Defer the message if the messenger's warm-up plan doesn't allow
+		// it yet. It's picked up again along with the retries when it's due.
+		if d, ok := wq.hold(s); ok {
+			m.recordDelivery(Delivery{
+				CampaignID:   c.ID,
+				SubscriberID: s.ID,
+				Status:       DeliveryStatusDeferred,
+				Messenger:    c.Messenger,
+				VariantID:    v.id,
+				RetryAfter:   d,
+			})
+			p.progress(s.ID, false)
+			continue
 		}
-		sleep++
-		lastSubID = s.ID
+
+		// Send the message.
+		msg := m.newCampaignMessage(v.camp, s)
+		msg.variantID = v.id
+		p.render(msg)
+	}
+	p.wait()
+
+	// The whole range has been processed. Write the pending delivery records
+	// and release the lease and update the counts.
+	m.flushDeliveries()
+	m.leaseMut.Lock()
+	done := *l
+	m.leaseMut.Unlock()
+	if err := m.src.CompleteLease(done, m.Cfg.NodeID); err != nil {
+		return false, fmt.Errorf("error completing lease (%s): %v", c.Name, err)
 	}
 
-	count := batchSize
-	if batchSize > len(c.SubsCamp) {
-		count = len(c.SubsCamp)
+	return true, nil
+}
+
+// slideWindow counts a message pushed against the sliding window limit, if
+// one is configured, and on reaching the limit, waits until the window is over.
+func (m *Manager) slideWindow() {
+	// Is there a sliding window limit configured?
+	if !m.Cfg.SlidingWindow ||
+		m.Cfg.SlidingWindowRate < 1 ||
+		m.Cfg.SlidingWindowDuration.Seconds() <= 1 {
+		return
 	}
 
-	go m.src.UpdateSentCampaign(c.ID, count, lastSubID)
+	diff := time.Now().Sub(m.slidingWindowStart)
 
-	if batchSize >= len(c.SubsCamp) {
-		time.Sleep(5 * time.Second)
+	// Window has expired. Reset the clock.
+	if diff >= m.Cfg.SlidingWindowDuration {
+		m.slidingWindowStart = time.Now()
+		m.slidingWindowNumMsg = 0
+		return
 	}
 
-	c.SubsCamp = tmp
+	// Have the messages exceeded the limit?
+	m.slidingWindowNumMsg++
+	if m.slidingWindowNumMsg >= m.Cfg.SlidingWindowRate {
+		wait := m.Cfg.SlidingWindowDuration - diff
 
-	return true, nil
+		m.logger.Printf("messages exceeded (%d) for the window (%v since %s). Sleeping for %s.",
+			m.slidingWindowNumMsg,
+			m.Cfg.SlidingWindowDuration,
+			m.slidingWindowStart.Format(time.RFC822Z),
+			wait.Round(time.Second)*1)
+
+		m.slidingWindowNumMsg = 0
+		time.Sleep(wait)
+	}
 }
 
 // isCampaignProcessing checks if the campaign is bing processed.
@@ -603,10 +1038,20 @@ func (m *Manager) isCampaignProcessing(id int) bool {
 }
 
 func (m *Manager) exhaustCampaign(c *models.Campaign, status string) (*models.Campaign, error) {
+	// Send the messages of the campaign that are buffered by messengers that batch them.
+	m.flushMessenger(c.Messenger)
+
 	m.campsMut.Lock()
 	delete(m.camps, c.ID)
+	delete(m.variants, c.ID)
+	delete(m.sendHours, c.ID)
+	delete(m.attachments, c.ID)
 	m.campsMut.Unlock()
 
+	m.errWindowMut.Lock()
+	delete(m.errWindows, c.ID)
+	m.errWindowMut.Unlock()
+
 	// A status has been passed. Change the campaign's status
 	// without further checks.
 	if status != "" {
@@ -624,13 +1069,26 @@ func (m *Manager) exhaustCampaign(c *models.Campaign, status string) (*models.Ca
 		return nil, err
 	}
 
-	// If a running campaign has exhausted subscribers, it's finished.
-	if cm.Status == models.CampaignStatusRunning {
-		cm.Status = models.CampaignStatusFinished
-		if err := m.src.UpdateCampaignStatus(c.ID, models.CampaignStatusFinished); err != nil {
+	// If a running campaign has exhausted subscribers, it's finished, unless
+	// other nodes are still processing their leased subscribers, in which case,
+	// the last node to complete its lease finishes the campaign. An A/B test
+	// campaign, that has sent its variants to the test group, waits for the
+	// winner to be picked instead.
+	if cm.Status == models.CampaignStatusRunning && cm.IsABTest() && !cm.ABWinnerID.Valid {
+		if ok, err := m.endABTest(cm); err != nil {
+			m.logger.Printf("error ending A/B test of campaign (%s): %v", c.Name, err)
+		} else if !ok {
+			m.logger.Printf("campaign (%s) has pending leases or retries", c.Name)
+		}
+	} else if cm.Status == models.CampaignStatusRunning {
+		ok, err := m.src.FinishCampaign(c.ID)
+		if err != nil {
 			m.logger.Printf("error finishing campaign (%s): %v", c.Name, err)
-		} else {
+		} else if ok {
+			cm.Status = models.CampaignStatusFinished
 			m.logger.Printf("campaign (%s) finished", c.Name)
+		} else {
+			m.logger.Printf("campaign (%s) has pending leases or retries", c.Name)
 		}
 	} else {
 		m.logger.Printf("stop processing campaign (%s)", c.Name)
@@ -639,6 +1097,69 @@ func (m *Manager) exhaustCampaign(c *models.Campaign, status string) (*models.Ca
 	return cm, nil
 }
 
+// pauseCampaign stops processing a campaign that has crossed the error
+// threshold, records the reason on the campaign, and notifies the admins.
+func (m *Manager) pauseCampaign(c *models.Campaign, reason string) {
+	delete(m.campMsgErrorCounts, c.ID)
+
+	// The campaign may have already been paused by an earlier error.
+	if !m.isCampaignProcessing(c.ID) {
+		return
+	}
+
+	m.campsMut.Lock()
+	delete(m.camps, c.ID)
+	delete(m.variants, c.ID)
+	delete(m.sendHours, c.ID)
+	delete(m.attachments, c.ID)
+	m.campsMut.Unlock()
+
+	m.errWindowMut.Lock()
+	delete(m.errWindows, c.ID)
+	m.errWindowMut.Unlock()
+
+	m.logger.Printf("pausing campaign (%s): %s", c.Name, reason)
+	if err := m.src.PauseCampaign(c.ID, reason); err != nil {
+		m.logger.Printf("error pausing campaign (%s): %v", c.Name, err)
+	}
+	c.PauseReason = reason
+
+	// Notify admins.
+	m.sendNotif(c, models.CampaignStatusPaused, reason)
+}
+
+// recordResult records the outcome of a message push in the campaign's
+// rolling error window and checks whether the percentage of errors has
+// crossed the threshold. The check fires only once per window.
+func (m *Manager) recordResult(c *models.Campaign, err error) (string, bool) {
+	if m.Cfg.MaxErrorRate <= 0 || m.Cfg.ErrorRateWindow < 1 || !m.isCampaignProcessing(c.ID) {
+		return "", false
+	}
+
+	class := ""
+	if err != nil {
+		class = ErrorClass(err)
+	}
+
+	m.errWindowMut.Lock()
+	defer m.errWindowMut.Unlock()
+
+	w, ok := m.errWindows[c.ID]
+	if !ok {
+		w = newErrWindow(m.Cfg.ErrorRateWindow)
+		m.errWindows[c.ID] = w
+	}
+	w.add(class)
+
+	reason, ok := w.exceeds(m.Cfg.MaxErrorRate, m.Cfg.ErrorRatePerClass)
+	if ok {
+		// Start afresh so that the in-flight messages of the campaign
+		// don't trigger the threshold again.
+		delete(m.errWindows, c.ID)
+	}
+	return reason, ok
+}
+
 // trackLink register a URL and return its UUID to be used in message templates
 // for tracking links.
 func (m *Manager) trackLink(urlTemplate, url, campUUID, subUUID string) string {
@@ -683,12 +1204,14 @@ func (m *Manager) sendNotif(c *models.Campaign, status, reason string) error {
 
 // render takes a Message, executes its pre-compiled Campaign.Tpl
 // and applies the resultant bytes to Message.body to be used in messages.
+// The buffer is reused from a pool and the rendered bytes are copied out of it.
 func (m *CampaignMessage) render() error {
-	out := bytes.Buffer{}
+	out := getBuf()
+	defer putBuf(out)
 
 	// Render the subject if it's a template.
 	if m.Campaign.SubjectTpl != nil {
-		if err := m.Campaign.SubjectTpl.ExecuteTemplate(&out, models.ContentTpl, m); err != nil {
+		if err := m.Campaign.SubjectTpl.ExecuteTemplate(out, models.ContentTpl, m); err != nil {
 			return err
 		}
 		m.subject = out.String()
@@ -696,19 +1219,19 @@ func (m *CampaignMessage) render() error {
 	}
 
 	// Compile the main template.
-	if err := m.Campaign.Tpl.ExecuteTemplate(&out, models.BaseTpl, m); err != nil {
+	if err := m.Campaign.Tpl.ExecuteTemplate(out, models.BaseTpl, m); err != nil {
 		return err
 	}
-	m.body = out.Bytes()
+	m.body = copyBytes(out.Bytes())
+	out.Reset()
 
 	// Is there an alt body?
 	if m.Campaign.ContentType != models.CampaignContentTypePlain && m.Campaign.AltBody.Valid {
 		if m.Campaign.AltBodyTpl != nil {
-			b := bytes.Buffer{}
-			if err := m.Campaign.AltBodyTpl.ExecuteTemplate(&b, models.ContentTpl, m); err != nil {
+			if err := m.Campaign.AltBodyTpl.ExecuteTemplate(out, models.ContentTpl, m); err != nil {
 				return err
 			}
-			m.altBody = b.Bytes()
+			m.altBody = copyBytes(out.Bytes())
 		} else {
 			m.altBody = []byte(m.Campaign.AltBody.String)
 		}
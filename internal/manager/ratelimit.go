@@ -0,0 +1,138 @@
+package manager
+
+import (
+	"sync"
+	"time"
+)
+
+// RateLimit represents the throughput limit of a messenger expressed as a
+// token bucket: Rate messages are allowed per second on average with bursts
+// of up to Burst messages. A Rate < 1 disables limiting.
+type RateLimit struct {
+	Rate  int `json:"rate"`
+	Burst int `json:"burst"`
+}
+
+// RateStats represents the configured limit and the observed send rate
+// of a messenger.
+type RateStats struct {
+	Rate    int     `json:"rate"`
+	Burst   int     `json:"burst"`
+	Current float64 `json:"current"`
+}
+
+// limiter is a token bucket rate limiter. Tokens are replenished
+// continuously at the configured rate and a message can be pushed
+// only after it has acquired a token. The bucket can hold up to
+// burst tokens which allows short bursts above the average rate.
+type limiter struct {
+	rate   float64
+	burst  float64
+	tokens float64
+	last   time.Time
+
+	// Messages sent in the current measurement window and the
+	// rate observed in the previous one.
+	num      int
+	numStart time.Time
+	curRate  float64
+	mu       sync.Mutex
+}
+
+func newLimiter(l RateLimit) *limiter {
+	now := time.Now()
+	lim := &limiter{
+		last:     now,
+		numStart: now,
+	}
+	lim.set(l)
+	lim.tokens = lim.burst
+	return lim
+}
+
+// set reconfigures the limiter. Tokens that are already in the bucket
+// are retained upto the new burst size.
+func (l *limiter) set(r RateLimit) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	l.refill(time.Now())
+
+	l.rate = float64(r.Rate)
+	if r.Burst < 1 {
+		r.Burst = r.Rate
+	}
+	if r.Burst < 1 {
+		r.Burst = 1
+	}
+	l.burst = float64(r.Burst)
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+}
+
+// wait blocks until a token is available and consumes it. If there are no
+// tokens in the bucket, a token is reserved from the future (the bucket goes
+// negative) so that concurrent callers are queued fairly without polling.
+func (l *limiter) wait() {
+	l.mu.Lock()
+	now := time.Now()
+	l.count(now)
+
+	if l.rate <= 0 {
+		l.mu.Unlock()
+		return
+	}
+
+	l.refill(now)
+	l.tokens--
+
+	var wait time.Duration
+	if l.tokens < 0 {
+		wait = time.Duration(-l.tokens / l.rate * float64(time.Second))
+	}
+	l.mu.Unlock()
+
+	if wait > 0 {
+		time.Sleep(wait)
+	}
+}
+
+// stats returns the configured limit and the observed send rate.
+func (l *limiter) stats() RateStats {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	// If nothing has been sent for a while, the last measurement is stale.
+	cur := l.curRate
+	if time.Since(l.numStart) > time.Second*2 {
+		cur = 0
+	}
+
+	return RateStats{
+		Rate:    int(l.rate),
+		Burst:   int(l.burst),
+		Current: cur,
+	}
+}
+
+// refill adds the tokens accrued since the last refill to the bucket.
+func (l *limiter) refill(now time.Time) {
+	if d := now.Sub(l.last); d > 0 {
+		l.tokens += d.Seconds() * l.rate
+		if l.tokens > l.burst {
+			l.tokens = l.burst
+		}
+	}
+	l.last = now
+}
+
+// count records a send and recomputes the observed rate every second.
+func (l *limiter) count(now time.Time) {
+	if d := now.Sub(l.numStart); d >= time.Second {
+		l.curRate = float64(l.num) / d.Seconds()
+		l.num = 0
+		l.numStart = now
+	}
+	l.num++
+}
@@ -0,0 +1,142 @@
+package manager
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestLimiterSet(t *testing.T) {
+	cases := []struct {
+		name      string
+		limit     RateLimit
+		wantRate  float64
+		wantBurst float64
+	}{
+		{"rate and burst", RateLimit{Rate: 10, Burst: 20}, 10, 20},
+		{"burst defaults to rate", RateLimit{Rate: 10}, 10, 10},
+		{"min burst", RateLimit{Rate: 0}, 0, 1},
+		{"unlimited with burst", RateLimit{Rate: 0, Burst: 5}, 0, 5},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			l := newLimiter(c.limit)
+			if l.rate != c.wantRate || l.burst != c.wantBurst {
+				t.Errorf("rate, burst = %v, %v; want %v, %v", l.rate, l.burst, c.wantRate, c.wantBurst)
+			}
+			if l.tokens != c.wantBurst {
+				t.Errorf("a new bucket has %v tokens, want %v", l.tokens, c.wantBurst)
+			}
+		})
+	}
+}
+
+func TestLimiterSetRetainsTokens(t *testing.T) {
+	cases := []struct {
+		name   string
+		tokens float64
+		to     RateLimit
+		want   float64
+	}{
+		{"capped at a smaller burst", 20, RateLimit{Rate: 5, Burst: 5}, 5},
+		{"kept under a larger burst", 3, RateLimit{Rate: 50, Burst: 50}, 3},
+		{"reserved tokens are kept", -2, RateLimit{Rate: 1, Burst: 1}, -2},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			l := newLimiter(RateLimit{Rate: 20, Burst: 20})
+			l.tokens = c.tokens
+			l.last = time.Now().Add(time.Hour) // No refill.
+
+			l.set(c.to)
+			if l.tokens != c.want {
+				t.Errorf("tokens = %v, want %v", l.tokens, c.want)
+			}
+		})
+	}
+}
+
+func TestLimiterRefill(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name    string
+		rate    float64
+		burst   float64
+		tokens  float64
+		elapsed time.Duration
+		want    float64
+	}{
+		{"half a second", 10, 100, 0, time.Millisecond * 500, 5},
+		{"capped at burst", 10, 5, 0, time.Second * 10, 5},
+		{"repays reserved tokens", 10, 5, -3, time.Millisecond * 200, -1},
+		{"no time", 10, 5, 2, 0, 2},
+		{"clock going back", 10, 5, 2, -time.Second, 2},
+		{"unlimited", 0, 1, 0, time.Second, 0},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			l := &limiter{rate: c.rate, burst: c.burst, tokens: c.tokens, last: start}
+			l.refill(start.Add(c.elapsed))
+
+			if math.Abs(l.tokens-c.want) > 1e-9 {
+				t.Errorf("tokens = %v, want %v", l.tokens, c.want)
+			}
+			if !l.last.Equal(start.Add(c.elapsed)) {
+				t.Errorf("last = %v, want %v", l.last, start.Add(c.elapsed))
+			}
+		})
+	}
+}
+
+func TestLimiterWait(t *testing.T) {
+	cases := []struct {
+		name    string
+		limit   RateLimit
+		n       int
+		wantMin time.Duration
+		wantMax time.Duration
+	}{
+		// The burst goes through right away.
+		{"burst", RateLimit{Rate: 10, Burst: 5}, 5, 0, time.Millisecond * 50},
+		{"unlimited", RateLimit{Rate: 0}, 1000, 0, time.Millisecond * 50},
+
+		// Two messages beyond the burst wait for 1/rate each.
+		{"beyond burst", RateLimit{Rate: 50, Burst: 2}, 4, time.Millisecond * 35, time.Millisecond * 500},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			l := newLimiter(c.limit)
+
+			start := time.Now()
+			for i := 0; i < c.n; i++ {
+				l.wait()
+			}
+			if d := time.Since(start); d < c.wantMin || d > c.wantMax {
+				t.Errorf("%d waits took %v, want %v-%v", c.n, d, c.wantMin, c.wantMax)
+			}
+		})
+	}
+}
+
+func TestLimiterCount(t *testing.T) {
+	start := time.Date(2021, 1, 1, 0, 0, 0, 0, time.UTC)
+
+	l := &limiter{numStart: start}
+	for i := 0; i < 30; i++ {
+		l.count(start.Add(time.Millisecond * time.Duration(i*10)))
+	}
+	if l.curRate != 0 || l.num != 30 {
+		t.Fatalf("rate = %v, num = %d within the first second", l.curRate, l.num)
+	}
+
+	// The rate of the window is computed on the first count after it.
+	l.count(start.Add(time.Second * 2))
+	if l.curRate != 15 || l.num != 1 {
+		t.Errorf("rate = %v, num = %d; want 15, 1", l.curRate, l.num)
+	}
+}
@@ -0,0 +1,218 @@
+package manager
+
+import (
+	"bytes"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// Buffers that have grown larger than this (bytes) aren't returned to the
+// pool so that an occasional large message doesn't pin the memory.
+const maxPooledBufSize = 1 << 20
+
+// bufPool is a pool of buffers that messages are rendered into.
+var bufPool = sync.Pool{
+	New: func() interface{} {
+		return &bytes.Buffer{}
+	},
+}
+
+// renderJob is a message of a batch of subscribers that's rendered by the
+// render workers. Jobs without a message only record the progress of the
+// lease in the order of the subscribers.
+type renderJob struct {
+	msg   *CampaignMessage
+	subID int
+	sent  bool
+
+	err  error
+	done chan struct{}
+}
+
+// renderPipeline renders the messages of a leased batch of subscribers on the
+// render workers in parallel while the rendered messages are pushed to the
+// message queue in the order of the subscribers. pending is bounded and
+// blocks the fetching of subscribers when the render workers or the message
+// workers can't keep up.
+type renderPipeline struct {
+	m       *Manager
+	pending chan *renderJob
+	done    chan struct{}
+}
+
+// StageStats represents the time spent in a stage of processing campaign
+// messages. Items is the number of messages (or subscribers) processed.
+type StageStats struct {
+	Items   int64   `json:"items"`
+	Seconds float64 `json:"seconds"`
+	AvgMS   float64 `json:"avg_ms"`
+}
+
+// PipelineStats represents the time spent by the node in fetching subscribers,
+// rendering messages, and pushing them to messengers, and the number of
+// messages waiting in the queues between the stages.
+type PipelineStats struct {
+	Fetch  StageStats `json:"fetch"`
+	Render StageStats `json:"render"`
+	Push   StageStats `json:"push"`
+
+	RenderWorkers  int `json:"render_workers"`
+	RenderQueue    int `json:"render_queue"`
+	RenderQueueCap int `json:"render_queue_cap"`
+	PushQueue      int `json:"push_queue"`
+	PushQueueCap   int `json:"push_queue_cap"`
+}
+
+// stageTimer accumulates the time spent in a pipeline stage.
+type stageTimer struct {
+	items int64
+	ns    int64
+}
+
+func (t *stageTimer) add(d time.Duration, items int) {
+	atomic.AddInt64(&t.items, int64(items))
+	atomic.AddInt64(&t.ns, int64(d))
+}
+
+func (t *stageTimer) stats() StageStats {
+	var (
+		items = atomic.LoadInt64(&t.items)
+		ns    = atomic.LoadInt64(&t.ns)
+		out   = StageStats{Items: items, Seconds: time.Duration(ns).Seconds()}
+	)
+	if items > 0 {
+		out.AvgMS = float64(ns) / float64(items) / float64(time.Millisecond)
+	}
+	return out
+}
+
+// GetPipelineStats returns the time spent in the stages of processing
+// campaign messages on the node since it started.
+func (m *Manager) GetPipelineStats() PipelineStats {
+	return PipelineStats{
+		Fetch:          m.fetchTimer.stats(),
+		Render:         m.renderTimer.stats(),
+		Push:           m.pushTimer.stats(),
+		RenderWorkers:  m.Cfg.RenderConcurrency,
+		RenderQueue:    len(m.renderQueue),
+		RenderQueueCap: cap(m.renderQueue),
+		PushQueue:      len(m.campMsgQueue),
+		PushQueueCap:   cap(m.campMsgQueue),
+	}
+}
+
+// renderWorker is a blocking function that renders the messages on the
+// render queue.
+func (m *Manager) renderWorker() {
+	for j := range m.renderQueue {
+		start := time.Now()
+		j.err = j.msg.render()
+		m.renderTimer.add(time.Since(start), 1)
+		close(j.done)
+	}
+}
+
+// newRenderPipeline starts a pipeline for rendering and pushing the messages
+// of a leased batch of subscribers of a campaign.
+func (m *Manager) newRenderPipeline(c *models.Campaign, l *Lease) *renderPipeline {
+	p := &renderPipeline{
+		m:       m,
+		pending: make(chan *renderJob, m.Cfg.RenderConcurrency*4),
+		done:    make(chan struct{}),
+	}
+	go p.push(c, l)
+	return p
+}
+
+// render queues a message to be rendered and pushed.
+func (p *renderPipeline) render(msg CampaignMessage) {
+	j := &renderJob{msg: &msg, subID: msg.Subscriber.ID, done: make(chan struct{})}
+	p.m.renderQueue <- j
+	p.pending <- j
+}
+
+// progress records the progress of the lease after the messages queued
+// before it have been pushed.
+func (p *renderPipeline) progress(subID int, sent bool) {
+	p.pending <- &renderJob{subID: subID, sent: sent}
+}
+
+// wait waits for all the queued messages to be pushed and closes the pipeline.
+func (p *renderPipeline) wait() {
+	close(p.pending)
+	<-p.done
+}
+
+// push pushes the rendered messages to the message queue in order. If the
+// campaign is paused or cancelled, the remaining messages are dropped
+// without recording the lease's progress so that they're picked up again
+// when it's resumed.
+func (p *renderPipeline) push(c *models.Campaign, l *Lease) {
+	defer close(p.done)
+
+	m := p.m
+	stopped := false
+	for j := range p.pending {
+		if j.msg != nil {
+			<-j.done
+		}
+
+		if !stopped && !m.isCampaignProcessing(c.ID) {
+			stopped = true
+		}
+		if stopped {
+			continue
+		}
+
+		if j.msg == nil {
+			m.leaseProgress(l, j.subID, j.sent)
+			continue
+		}
+
+		if j.err != nil {
+			m.logger.Printf("error rendering message (%s) (%s): %v", c.Name, j.msg.to, j.err)
+			m.recordRenderError(c, j.msg.Subscriber, j.err)
+			m.leaseProgress(l, j.subID, false)
+			continue
+		}
+
+		m.recordDelivery(Delivery{
+			CampaignID:   c.ID,
+			SubscriberID: j.subID,
+			Status:       DeliveryStatusQueued,
+			Messenger:    c.Messenger,
+			VariantID:    j.msg.variantID,
+		})
+
+		// Push the message to the queue while blocking and waiting until
+		// the queue is drained.
+		m.campMsgQueue <- *j.msg
+		m.leaseProgress(l, j.subID, true)
+
+		m.slideWindow()
+	}
+}
+
+// getBuf returns an empty buffer from the pool.
+func getBuf() *bytes.Buffer {
+	b := bufPool.Get().(*bytes.Buffer)
+	b.Reset()
+	return b
+}
+
+// putBuf returns a buffer to the pool.
+func putBuf(b *bytes.Buffer) {
+	if b.Cap() <= maxPooledBufSize {
+		bufPool.Put(b)
+	}
+}
+
+// copyBytes returns a copy of b that doesn't share the buffer's memory.
+func copyBytes(b []byte) []byte {
+	out := make([]byte, len(b))
+	copy(out, b)
+	return out
+}
@@ -0,0 +1,244 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"html/template"
+	"io/ioutil"
+	"log"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// pipelineTest runs the render workers of a manager and collects the
+// messages pushed to its message queue.
+type pipelineTest struct {
+	m    *Manager
+	camp *models.Campaign
+
+	mu     sync.Mutex
+	pushed []CampaignMessage
+}
+
+// newPipelineTest returns a manager processing a campaign whose body is
+// rendered with the given template and functions.
+func newPipelineTest(t *testing.T, body string, funcs template.FuncMap) *pipelineTest {
+	t.Helper()
+
+	m := New(Config{RenderConcurrency: 4, Concurrency: 2, UnsubURL: "%s%s"}, nil, nil, nil,
+		log.New(ioutil.Discard, "", 0))
+	for i := 0; i < m.Cfg.RenderConcurrency; i++ {
+		go m.renderWorker()
+	}
+
+	tpl, err := template.New(models.BaseTpl).Funcs(funcs).Parse(body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := &models.Campaign{Name: "test", Messenger: "email", Tpl: tpl}
+	c.ID = 1
+	m.camps[c.ID] = c
+
+	p := &pipelineTest{m: m, camp: c}
+	go func() {
+		for msg := range m.campMsgQueue {
+			p.mu.Lock()
+			p.pushed = append(p.pushed, msg)
+			p.mu.Unlock()
+		}
+	}()
+	return p
+}
+
+func (p *pipelineTest) numPushed() int {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	return len(p.pushed)
+}
+
+func TestRenderPipeline(t *testing.T) {
+	const body = `{{ delay .Subscriber.ID }}{{ check .Subscriber.ID }}Hi {{ .Subscriber.Name }}`
+
+	cases := []struct {
+		name string
+
+		// Subscribers that are skipped (progress only) and that fail to render.
+		skip     map[int]bool
+		wantFail map[int]bool
+	}{
+		{name: "all rendered"},
+		{name: "skipped", skip: map[int]bool{2: true, 3: true, 10: true}},
+		{name: "render errors", wantFail: map[int]bool{4: true, 7: true}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			// Messages to earlier subscribers take longer to render so that
+			// they're rendered out of order.
+			p := newPipelineTest(t, body, template.FuncMap{
+				"delay": func(id int) string {
+					time.Sleep(time.Millisecond * time.Duration(20-id))
+					return ""
+				},
+				"check": func(id int) (string, error) {
+					if c.wantFail[id] {
+						return "", errors.New("bad template")
+					}
+					return "", nil
+				},
+			})
+			m := p.m
+
+			subs := testSubs(10)
+			for i := range subs {
+				subs[i].Name = fmt.Sprintf("Sub %d", subs[i].ID)
+				subs[i].Email = fmt.Sprintf("sub%d@listmonk.app", subs[i].ID)
+			}
+			l := &Lease{ID: 1, CampaignID: p.camp.ID, FromID: 0, ToID: 10}
+			m.setLease(p.camp.ID, l)
+
+			pl := m.newRenderPipeline(p.camp, l)
+			for _, s := range subs {
+				if c.skip[s.ID] {
+					pl.progress(s.ID, false)
+					continue
+				}
+				pl.render(m.newCampaignMessage(p.camp, s))
+			}
+			pl.wait()
+
+			// The rendered messages are pushed in the order of the subscribers.
+			var want []int
+			for _, s := range subs {
+				if !c.skip[s.ID] && !c.wantFail[s.ID] {
+					want = append(want, s.ID)
+				}
+			}
+			waitFor(t, func() bool { return p.numPushed() == len(want) })
+
+			p.mu.Lock()
+			for i, msg := range p.pushed {
+				if msg.Subscriber.ID != want[i] {
+					t.Errorf("message %d is to subscriber %d, want %d", i, msg.Subscriber.ID, want[i])
+				}
+				if b := fmt.Sprintf("Hi Sub %d", msg.Subscriber.ID); string(msg.body) != b {
+					t.Errorf("message %d body = %q, want %q", i, msg.body, b)
+				}
+			}
+			p.mu.Unlock()
+
+			// The lease's progress covers the whole batch.
+			if l.LastID != 10 || l.Sent != len(want) {
+				t.Errorf("lease last, sent = %d, %d; want 10, %d", l.LastID, l.Sent, len(want))
+			}
+
+			// Every pushed message is recorded as queued and every render
+			// error as failed.
+			var queued, failed int
+			for _, d := range m.deliveries {
+				switch d.Status {
+				case DeliveryStatusQueued:
+					queued++
+				case DeliveryStatusFailed:
+					failed++
+					if !c.wantFail[d.SubscriberID] || d.Error == "" {
+						t.Errorf("unexpected failure %+v", d)
+					}
+				}
+			}
+			if queued != len(want) || failed != len(c.wantFail) {
+				t.Errorf("queued, failed = %d, %d; want %d, %d", queued, failed, len(want), len(c.wantFail))
+			}
+
+			if s := m.renderTimer.stats(); s.Items != int64(10-len(c.skip)) {
+				t.Errorf("render stats items = %d, want %d", s.Items, 10-len(c.skip))
+			}
+		})
+	}
+}
+
+func TestRenderPipelineStopped(t *testing.T) {
+	block := make(chan struct{})
+	p := newPipelineTest(t, `{{ wait .Subscriber.ID }}Hi`, template.FuncMap{
+		"wait": func(id int) string {
+			if id == 3 {
+				<-block
+			}
+			return ""
+		},
+	})
+	m := p.m
+
+	l := &Lease{ID: 1, CampaignID: p.camp.ID, FromID: 0, ToID: 5}
+	pl := m.newRenderPipeline(p.camp, l)
+	for _, s := range testSubs(5) {
+		pl.render(m.newCampaignMessage(p.camp, s))
+	}
+
+	// The campaign is paused while the third message is being rendered.
+	waitFor(t, func() bool { return p.numPushed() == 2 })
+	m.campsMut.Lock()
+	delete(m.camps, p.camp.ID)
+	m.campsMut.Unlock()
+	close(block)
+	pl.wait()
+
+	// The rest of the messages are dropped without recording the progress
+	// so that they're sent when the campaign is resumed.
+	time.Sleep(time.Millisecond * 20)
+	if n := p.numPushed(); n != 2 {
+		t.Errorf("%d messages pushed, want 2", n)
+	}
+	if l.LastID != 2 || l.Sent != 2 {
+		t.Errorf("lease last, sent = %d, %d; want 2, 2", l.LastID, l.Sent)
+	}
+}
+
+func TestStageTimer(t *testing.T) {
+	cases := []struct {
+		name string
+		add  []time.Duration
+		n    []int
+		want StageStats
+	}{
+		{"empty", nil, nil, StageStats{}},
+		{"one", []time.Duration{time.Millisecond * 10}, []int{1}, StageStats{Items: 1, Seconds: 0.01, AvgMS: 10}},
+		{"batches", []time.Duration{time.Second, time.Second * 3}, []int{100, 300}, StageStats{Items: 400, Seconds: 4, AvgMS: 10}},
+		{"no items", []time.Duration{time.Second}, []int{0}, StageStats{Seconds: 1}},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var st stageTimer
+			for i, d := range c.add {
+				st.add(d, c.n[i])
+			}
+			if got := st.stats(); got != c.want {
+				t.Errorf("stats = %+v, want %+v", got, c.want)
+			}
+		})
+	}
+}
+
+func TestBufPool(t *testing.T) {
+	b := getBuf()
+	b.WriteString("hello")
+	putBuf(b)
+
+	if b := getBuf(); b.Len() != 0 {
+		t.Errorf("buffer from the pool has %q", b.String())
+	}
+
+	// copyBytes doesn't share the buffer's memory.
+	b.Reset()
+	b.WriteString("hello")
+	out := copyBytes(b.Bytes())
+	b.Reset()
+	b.WriteString("world")
+	if string(out) != "hello" {
+		t.Errorf("copy = %q, want hello", out)
+	}
+}
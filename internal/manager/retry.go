@@ -0,0 +1,113 @@
+package manager
+
+import (
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// maxRetryBackoff caps the exponential backoff between retries.
+const maxRetryBackoff = time.Hour * 24
+
+// Retry is a failed campaign message to a subscriber that's due to be retried
+// or a deferred one that's due to be sent.
+type Retry struct {
+	Subscriber models.Subscriber
+
+	// Number of times the message has been attempted so far.
+	Attempts int
+}
+
+// retryAfter returns the duration after which a message that failed with
+// the given error on its nth attempt should be retried. The backoff for an
+// error class doubles with every attempt. 0 indicates that the message
+// should not be retried, either because the error is permanent or the
+// attempts have been exhausted.
+func (m *Manager) retryAfter(err error, attempt int) time.Duration {
+	if !m.Cfg.RequeueOnError || attempt >= m.Cfg.MaxAttempts {
+		return 0
+	}
+
+	d := m.Cfg.RetryBackoff[ErrorClass(err)]
+	if d <= 0 {
+		return 0
+	}
+	for i := 1; i < attempt && d < maxRetryBackoff; i++ {
+		d *= 2
+	}
+	if d > maxRetryBackoff {
+		d = maxRetryBackoff
+	}
+	return d
+}
+
+// nextRetries processes the next batch of failed messages of a campaign that
+// are due to be retried and deferred messages that are due to be sent. It
+// returns a bool indicating whether any messages were processed or not.
+func (m *Manager) nextRetries(c *models.Campaign, batchSize int) (bool, error) {
+	// Retries are claimed for the lease duration so that another node doesn't
+	// pick them up while they're being sent. If this node goes down, they become
+	// due again once the duration passes.
+	start := time.Now()
+	retries, err := m.src.NextRetries(c.ID, batchSize, m.Cfg.LeaseDuration, m.Cfg.FrequencyCaps)
+	if err != nil {
+		return false, fmt.Errorf("error fetching campaign retries (%s): %v", c.Name, err)
+	}
+	m.fetchTimer.add(time.Since(start), len(retries))
+	if len(retries) == 0 {
+		return false, nil
+	}
+
+	wq, err := m.warmupQuota(c.Messenger)
+	if err != nil {
+		return false, fmt.Errorf("error fetching warm-up quota (%s): %v", c.Name, err)
+	}
+
+	for _, r := range retries {
+		if !m.isCampaignProcessing(c.ID) {
+			return false, nil
+		}
+
+		// The subscriber's A/B test variant may have been deleted.
+		v, ok := m.variant(c, r.Subscriber, true)
+		if !ok {
+			m.recordRenderError(c, r.Subscriber, errors.New("no A/B test variant for the subscriber"))
+			continue
+		}
+
+		// Defer the message again if the messenger's warm-up plan doesn't allow it yet.
+		if d, ok := wq.hold(r.Subscriber); ok {
+			m.recordDelivery(Delivery{
+				CampaignID:   c.ID,
+				SubscriberID: r.Subscriber.ID,
+				Status:       DeliveryStatusDeferred,
+				Messenger:    c.Messenger,
+				VariantID:    v.id,
+				RetryAfter:   d,
+			})
+			continue
+		}
+
+		msg, err := m.NewCampaignMessage(v.camp, r.Subscriber)
+		if err != nil {
+			m.logger.Printf("error rendering message (%s) (%s): %v", c.Name, r.Subscriber.Email, err)
+			m.recordRenderError(c, r.Subscriber, err)
+			continue
+		}
+		msg.attempt = r.Attempts + 1
+		msg.variantID = v.id
+
+		m.campMsgQueue <- msg
+
+		// Deferred messages that have never been attempted aren't counted
+		// by their leases.
+		if r.Attempts == 0 {
+			m.addSent(c.ID, 1)
+		}
+		m.slideWindow()
+	}
+
+	return true, nil
+}
@@ -0,0 +1,186 @@
+package manager
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// sendTimeSlack is the duration within which a message that's due at a
+// subscriber's best hour is sent right away instead of being deferred.
+const sendTimeSlack = time.Minute
+
+// LocalSendTimeFormat is the format of a campaign's local send time.
+const LocalSendTimeFormat = "15:04"
+
+// loadSendHour fetches the median hour of engagement of the subscribers of
+// the lists of a campaign that optimizes send time. It's the fallback for
+// subscribers who have never engaged with a campaign.
+func (m *Manager) loadSendHour(c *models.Campaign) error {
+	if !c.OptimizeSendTime {
+		return nil
+	}
+
+	h, err := m.src.GetMedianSendHour(c.ID)
+	if err != nil {
+		return fmt.Errorf("error fetching median send hour: %v", err)
+	}
+
+	m.campsMut.Lock()
+	m.sendHours[c.ID] = h
+	m.campsMut.Unlock()
+	return nil
+}
+
+// sendDelays returns the durations for which the messages to the given
+// subscribers of a campaign that optimizes send time or that has a local
+// send time are to be deferred, keyed by subscriber ID. Subscribers whose
+// messages are due are omitted.
+func (m *Manager) sendDelays(c *models.Campaign, subs []models.Subscriber) (map[int]time.Duration, error) {
+	if c.LocalSendTime != "" {
+		return m.localDelays(c, subs)
+	}
+	if !c.OptimizeSendTime || len(subs) == 0 {
+		return nil, nil
+	}
+
+	ids := make([]int, 0, len(subs))
+	for _, s := range subs {
+		ids = append(ids, s.ID)
+	}
+	hours, err := m.src.GetSendHours(ids)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching subscriber send hours: %v", err)
+	}
+
+	m.campsMut.RLock()
+	median, ok := m.sendHours[c.ID]
+	m.campsMut.RUnlock()
+	if !ok {
+		median = -1
+	}
+
+	var (
+		now   = time.Now()
+		start = now
+		out   = make(map[int]time.Duration)
+	)
+	if c.StartedAt.Valid {
+		start = c.StartedAt.Time
+	}
+
+	for _, s := range subs {
+		h, ok := hours[s.ID]
+		if !ok {
+			// No engagement and no fallback. Send right away.
+			if median < 0 {
+				continue
+			}
+			h = median
+		}
+
+		if d := sendAt(start, time.UTC, h, 0).Sub(now); d > sendTimeSlack {
+			out[s.ID] = d
+		}
+	}
+
+	return out, nil
+}
+
+// localDelays returns the durations for which the messages to the given
+// subscribers of a campaign are to be deferred until its local send time
+// arrives in their timezones, keyed by subscriber ID. The subscribers of
+// every timezone are thus released together as one bucket. The timezone is
+// the subscriber's "timezone" attribute, or failing that, the default of the
+// campaign's list that they're on, or UTC.
+func (m *Manager) localDelays(c *models.Campaign, subs []models.Subscriber) (map[int]time.Duration, error) {
+	if len(subs) == 0 {
+		return nil, nil
+	}
+
+	t, err := time.Parse(LocalSendTimeFormat, c.LocalSendTime)
+	if err != nil {
+		return nil, fmt.Errorf("invalid local send time: %v", err)
+	}
+
+	ids := make([]int, 0, len(subs))
+	for _, s := range subs {
+		ids = append(ids, s.ID)
+	}
+	listTZ, err := m.src.GetListTimezones(c.ID, ids)
+	if err != nil {
+		return nil, fmt.Errorf("error fetching list timezones: %v", err)
+	}
+
+	var (
+		now   = time.Now()
+		start = now
+		locs  = make(map[string]*time.Location)
+		out   = make(map[int]time.Duration)
+	)
+	if c.StartedAt.Valid {
+		start = c.StartedAt.Time
+	}
+
+	for _, s := range subs {
+		tz, _ := s.Attribs["timezone"].(string)
+		loc := location(tz, locs)
+		if loc == nil {
+			if loc = location(listTZ[s.ID], locs); loc == nil {
+				loc = time.UTC
+			}
+		}
+
+		if d := sendAt(start, loc, t.Hour(), t.Minute()).Sub(now); d > sendTimeSlack {
+			out[s.ID] = d
+		}
+	}
+
+	return out, nil
+}
+
+// location returns the location of a timezone name or nil if it's empty or
+// invalid. Locations are cached in locs.
+func location(name string, locs map[string]*time.Location) *time.Location {
+	if name == "" {
+		return nil
+	}
+	if l, ok := locs[name]; ok {
+		return l
+	}
+
+	l, err := time.LoadLocation(name)
+	if err != nil {
+		l = nil
+	}
+	locs[name] = l
+	return l
+}
+
+// sendAt returns the first occurrence of a time of the day in a location
+// within 24 hours of the given start time. If the time had passed within an
+// hour before the start time, it's that time, that is, it's due right away.
+func sendAt(start time.Time, loc *time.Location, hour, min int) time.Time {
+	start = start.In(loc)
+	t := wallTime(start.Year(), start.Month(), start.Day(), hour, min, loc)
+	if !t.Add(time.Hour).After(start) {
+		t = wallTime(start.Year(), start.Month(), start.Day()+1, hour, min, loc)
+	}
+	return t
+}
+
+// wallTime returns a time of the day on a date in a location. A time that's
+// skipped when DST starts (eg: 02:30 when the clocks go from 02:00 to 03:00)
+// is moved forward by the change as time.Date may normalize it to an hour
+// before the change.
+func wallTime(year int, month time.Month, day, hour, min int, loc *time.Location) time.Time {
+	t := time.Date(year, month, day, hour, min, 0, 0, loc)
+	if t.Hour() == hour && t.Minute() == min {
+		return t
+	}
+
+	_, before := t.Zone()
+	_, after := t.Add(time.Hour * 3).Zone()
+	return t.Add(time.Duration(after-before) * time.Second)
+}
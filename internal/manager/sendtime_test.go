@@ -0,0 +1,216 @@
+package manager
+
+import (
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// sendTimeSource is a DataSource with the send hours and list timezones
+// of subscribers.
+type sendTimeSource struct {
+	DataSource
+
+	hours  map[int]int
+	listTZ map[int]string
+}
+
+func (s *sendTimeSource) GetSendHours(subIDs []int) (map[int]int, error) {
+	return s.hours, nil
+}
+
+func (s *sendTimeSource) GetListTimezones(campID int, subIDs []int) (map[int]string, error) {
+	return s.listTZ, nil
+}
+
+func mustLocation(t *testing.T, name string) *time.Location {
+	t.Helper()
+
+	l, err := time.LoadLocation(name)
+	if err != nil {
+		t.Skipf("timezone data unavailable: %v", err)
+	}
+	return l
+}
+
+func TestSendAt(t *testing.T) {
+	utc := func(s string) time.Time {
+		t, err := time.Parse(time.RFC3339, s)
+		if err != nil {
+			panic(err)
+		}
+		return t
+	}
+
+	cases := []struct {
+		name  string
+		start string
+		loc   string
+		hour  int
+		min   int
+		want  string
+	}{
+		{"later today", "2021-06-01T08:00:00Z", "UTC", 10, 0, "2021-06-01T10:00:00Z"},
+		{"passed within the hour", "2021-06-01T10:30:00Z", "UTC", 10, 0, "2021-06-01T10:00:00Z"},
+		{"passed an hour ago", "2021-06-01T11:00:00Z", "UTC", 10, 0, "2021-06-02T10:00:00Z"},
+		{"past midnight", "2021-06-01T23:30:00Z", "UTC", 0, 15, "2021-06-02T00:15:00Z"},
+		{"end of month", "2021-06-30T22:00:00Z", "UTC", 9, 30, "2021-07-01T09:30:00Z"},
+
+		// The day is that of the location, not UTC.
+		{"location ahead", "2021-06-01T20:00:00Z", "Asia/Kolkata", 9, 0, "2021-06-02T03:30:00Z"},
+		{"location behind", "2021-06-02T02:00:00Z", "America/New_York", 23, 0, "2021-06-02T03:00:00Z"},
+
+		// The wall clock time is kept across DST changes.
+		{"dst starts", "2021-03-13T17:00:00Z", "America/New_York", 9, 0, "2021-03-14T13:00:00Z"},
+		{"dst ends", "2021-11-06T16:00:00Z", "America/New_York", 9, 0, "2021-11-07T14:00:00Z"},
+		{"dst starts london", "2021-03-27T12:00:00Z", "Europe/London", 8, 0, "2021-03-28T07:00:00Z"},
+
+		// A time skipped when DST starts is moved forward by the change.
+		{"skipped time", "2021-03-14T05:00:00Z", "America/New_York", 2, 30, "2021-03-14T07:30:00Z"},
+		{"skipped time tomorrow", "2021-03-13T12:00:00Z", "America/New_York", 2, 30, "2021-03-14T07:30:00Z"},
+		{"skipped half hour", "2021-10-02T12:00:00Z", "Australia/Lord_Howe", 2, 15, "2021-10-02T15:45:00Z"},
+
+		// A time repeated when DST ends is its first occurrence.
+		{"repeated time", "2021-11-07T04:00:00Z", "America/New_York", 1, 30, "2021-11-07T05:30:00Z"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			loc := mustLocation(t, c.loc)
+			got := sendAt(utc(c.start), loc, c.hour, c.min)
+			if !got.Equal(utc(c.want)) {
+				t.Errorf("sendAt(%s, %s, %02d:%02d) = %s, want %s", c.start, c.loc, c.hour, c.min, got.UTC(), c.want)
+			}
+			if got.Location() != loc {
+				t.Errorf("location = %s, want %s", got.Location(), loc)
+			}
+		})
+	}
+}
+
+func TestSendDelays(t *testing.T) {
+	h := time.Now().UTC().Hour()
+
+	cases := []struct {
+		name     string
+		optimize bool
+		hours    map[int]int
+		median   int
+
+		// The approximate delay in hours of the subscribers that are deferred.
+		want map[int]int
+	}{
+		{
+			name:     "not optimized",
+			optimize: false,
+			hours:    map[int]int{1: (h + 3) % 24},
+			median:   -1,
+			want:     map[int]int{},
+		},
+		{
+			name:     "send hours",
+			optimize: true,
+			hours:    map[int]int{1: (h + 3) % 24, 2: h, 3: (h + 23) % 24},
+			median:   -1,
+			want:     map[int]int{1: 3, 3: 23},
+		},
+		{
+			name:     "median fallback",
+			optimize: true,
+			hours:    map[int]int{1: (h + 3) % 24},
+			median:   (h + 5) % 24,
+			want:     map[int]int{1: 3, 2: 5, 3: 5},
+		},
+	}
+
+	subs := testSubs(3)
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			m := New(Config{}, &sendTimeSource{hours: c.hours}, nil, nil, nil)
+			camp := &models.Campaign{OptimizeSendTime: c.optimize}
+			camp.ID = 1
+			if c.median >= 0 {
+				m.sendHours[camp.ID] = c.median
+			}
+
+			got, err := m.sendDelays(camp, subs)
+			if err != nil {
+				t.Fatal(err)
+			}
+			checkDelays(t, got, c.want)
+		})
+	}
+}
+
+func TestLocalDelays(t *testing.T) {
+	mustLocation(t, "Etc/GMT-3")
+
+	// The local send time is three hours from now in UTC.
+	sendTime := time.Now().UTC().Add(time.Hour * 3).Format(LocalSendTimeFormat)
+
+	cases := []struct {
+		name    string
+		attrib  interface{}
+		listTZ  string
+		want    int
+		wantDue bool
+	}{
+		{name: "utc", want: 3},
+		{name: "attribute", attrib: "Etc/GMT-1", want: 2},
+		{name: "attribute behind", attrib: "Etc/GMT+2", want: 5},
+		{name: "due", attrib: "Etc/GMT-3", wantDue: true},
+		{name: "list timezone", listTZ: "Etc/GMT-1", want: 2},
+		{name: "attribute over list", attrib: "Etc/GMT+2", listTZ: "Etc/GMT-1", want: 5},
+		{name: "invalid attribute", attrib: "Mars/Olympus_Mons", listTZ: "Etc/GMT-1", want: 2},
+		{name: "invalid attribute type", attrib: 3, want: 3},
+		{name: "invalid list timezone", listTZ: "Mars/Olympus_Mons", want: 3},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			sub := testSubs(1)[0]
+			if c.attrib != nil {
+				sub.Attribs = models.SubscriberAttribs{"timezone": c.attrib}
+			}
+			src := &sendTimeSource{listTZ: map[int]string{}}
+			if c.listTZ != "" {
+				src.listTZ[sub.ID] = c.listTZ
+			}
+
+			m := New(Config{}, src, nil, nil, nil)
+			got, err := m.sendDelays(&models.Campaign{LocalSendTime: sendTime}, []models.Subscriber{sub})
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			want := map[int]int{sub.ID: c.want}
+			if c.wantDue {
+				want = map[int]int{}
+			}
+			checkDelays(t, got, want)
+		})
+	}
+
+	m := New(Config{}, &sendTimeSource{}, nil, nil, nil)
+	if _, err := m.sendDelays(&models.Campaign{LocalSendTime: "25:00"}, testSubs(1)); err == nil {
+		t.Error("expected an error on an invalid local send time")
+	}
+}
+
+// checkDelays checks that the delays are within an hour (the start of the
+// hour) of the expected hours.
+func checkDelays(t *testing.T, got map[int]time.Duration, want map[int]int) {
+	t.Helper()
+
+	if len(got) != len(want) {
+		t.Errorf("delays = %v, want %v hours", got, want)
+	}
+	for id, d := range got {
+		h, ok := want[id]
+		max := time.Duration(h) * time.Hour
+		if !ok || d > max || d < max-time.Hour-time.Minute {
+			t.Errorf("subscriber %d deferred by %v, want ~%dh", id, d, h)
+		}
+	}
+}
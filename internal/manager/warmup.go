@@ -0,0 +1,184 @@
+package manager
+
+import (
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+)
+
+// Warmup is a warm-up plan of a new messenger (eg: a new SES account or SMTP
+// server) whose sending reputation is built up gradually. The number of
+// campaign messages the messenger can send every day (UTC) follows the
+// DailyCaps curve starting from StartDate, and once the curve ends, the
+// messenger is warmed up and is no longer capped. During the first
+// EngagedOnlyDays of the plan, only the subscribers who have opened a message
+// within EngagedWithin are sent to.
+//
+// The plan only applies to campaigns that target the messenger directly.
+// Messages that are over the day's cap are deferred to the next day, and the
+// ones to subscribers who aren't engaged, until the end of the engaged days.
+type Warmup struct {
+	Messenger       string
+	StartDate       time.Time
+	DailyCaps       []int
+	EngagedOnlyDays int
+	EngagedWithin   time.Duration
+}
+
+// WarmupProgress represents the progress of a messenger's warm-up plan.
+type WarmupProgress struct {
+	Messenger   string    `json:"messenger"`
+	StartDate   time.Time `json:"start_date"`
+	Day         int       `json:"day"`
+	Days        int       `json:"days"`
+	DailyCap    int       `json:"daily_cap"`
+	SentToday   int       `json:"sent_today"`
+	EngagedOnly bool      `json:"engaged_only"`
+	Complete    bool      `json:"complete"`
+}
+
+// warmup is a messenger's warm-up plan with the number of messages sent by
+// the messenger on the day. The count is read from the data source once a day
+// and is then counted in memory across all the campaigns and retries on the
+// messenger as the delivery records are written in batches.
+type warmup struct {
+	Warmup
+
+	mu    sync.Mutex
+	today time.Time
+	sent  int
+}
+
+// warmupQuota is the quota of a messenger that's warming up while a batch
+// of subscribers is processed.
+type warmupQuota struct {
+	w            *warmup
+	engagedOnly  bool
+	engagedUntil time.Time
+}
+
+// day returns the 0 indexed day of the plan (UTC) at the given time.
+// Days before the start of the plan are its first day.
+func (w Warmup) day(now time.Time) int {
+	d := int(now.UTC().Sub(w.StartDate.UTC()).Hours() / 24)
+	if d < 0 {
+		return 0
+	}
+	return d
+}
+
+// warmupQuota returns the quota of a messenger if it has a warm-up plan
+// that's still in progress. The count of the messages the messenger has sent
+// is read from the data source on the first batch of the day.
+func (m *Manager) warmupQuota(msgr string) (*warmupQuota, error) {
+	w, ok := m.warmups[msgr]
+	if !ok {
+		return nil, nil
+	}
+
+	now := time.Now().UTC()
+	day := w.day(now)
+	if day >= len(w.DailyCaps) {
+		return nil, nil
+	}
+
+	today := now.Truncate(time.Hour * 24)
+	w.mu.Lock()
+	defer w.mu.Unlock()
+	if !w.today.Equal(today) {
+		sent, err := m.src.GetMessengerSent(msgr, today)
+		if err != nil {
+			return nil, err
+		}
+		w.today = today
+		w.sent = sent
+	}
+
+	start := w.StartDate.UTC().Truncate(time.Hour * 24)
+	return &warmupQuota{
+		w:            w,
+		engagedOnly:  day < w.EngagedOnlyDays,
+		engagedUntil: start.Add(time.Hour * 24 * time.Duration(w.EngagedOnlyDays)),
+	}, nil
+}
+
+// hold returns the duration for which the message to a subscriber should be
+// deferred as per the warm-up plan. Otherwise, the message counts against
+// the messenger's cap for the day.
+func (q *warmupQuota) hold(s models.Subscriber) (time.Duration, bool) {
+	if q == nil {
+		return 0, false
+	}
+
+	now := time.Now()
+	if q.engagedOnly && !(s.LastEmailOpen.Valid && now.Sub(s.LastEmailOpen.Time) <= q.w.EngagedWithin) {
+		return q.engagedUntil.Sub(now), true
+	}
+
+	day := q.w.day(now)
+	if day >= len(q.w.DailyCaps) {
+		return 0, false
+	}
+
+	// The day has changed since the quota was fetched.
+	today := now.UTC().Truncate(time.Hour * 24)
+	q.w.mu.Lock()
+	defer q.w.mu.Unlock()
+	if !q.w.today.Equal(today) {
+		q.w.today = today
+		q.w.sent = 0
+	}
+
+	if q.w.sent >= q.w.DailyCaps[day] {
+		return today.Add(time.Hour * 24).Sub(now), true
+	}
+
+	q.w.sent++
+	return 0, false
+}
+
+// GetWarmupProgress returns the progress of the warm-up plans of all
+// the messengers.
+func (m *Manager) GetWarmupProgress() ([]WarmupProgress, error) {
+	var (
+		now   = time.Now().UTC()
+		today = now.Truncate(time.Hour * 24)
+		out   = make([]WarmupProgress, 0, len(m.warmups))
+	)
+	for _, w := range m.warmups {
+		p := WarmupProgress{
+			Messenger: w.Messenger,
+			StartDate: w.StartDate,
+			Day:       w.day(now) + 1,
+			Days:      len(w.DailyCaps),
+		}
+		if p.Day > p.Days {
+			p.Complete = true
+			out = append(out, p)
+			continue
+		}
+
+		// Messages counted by the node today may not have been recorded yet.
+		sent, err := m.src.GetMessengerSent(w.Messenger, today)
+		if err != nil {
+			return nil, err
+		}
+		w.mu.Lock()
+		if w.today.Equal(today) && w.sent > sent {
+			sent = w.sent
+		}
+		w.mu.Unlock()
+
+		p.DailyCap = w.DailyCaps[p.Day-1]
+		p.SentToday = sent
+		p.EngagedOnly = p.Day <= w.EngagedOnlyDays
+		out = append(out, p)
+	}
+
+	sort.Slice(out, func(i, j int) bool {
+		return out[i].Messenger < out[j].Messenger
+	})
+	return out, nil
+}
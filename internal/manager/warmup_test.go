@@ -0,0 +1,299 @@
+package manager
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/models"
+	null "gopkg.in/volatiletech/null.v6"
+)
+
+// warmupSource is a DataSource with the number of messages sent by
+// messengers.
+type warmupSource struct {
+	DataSource
+
+	mu    sync.Mutex
+	sent  map[string]int
+	err   error
+	calls int
+	since time.Time
+}
+
+func (s *warmupSource) GetMessengerSent(msgr string, since time.Time) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.calls++
+	s.since = since
+	return s.sent[msgr], s.err
+}
+
+// openedAt returns a subscriber who last opened a message at t.
+func openedAt(t time.Time) models.Subscriber {
+	var s models.Subscriber
+	s.LastEmailOpen = null.TimeFrom(t)
+	return s
+}
+
+func TestWarmupDay(t *testing.T) {
+	start := time.Date(2021, 3, 1, 0, 0, 0, 0, time.UTC)
+
+	cases := []struct {
+		name string
+		now  time.Time
+		want int
+	}{
+		{"start", start, 0},
+		{"end of first day", start.Add(time.Hour*24 - time.Second), 0},
+		{"second day", start.Add(time.Hour * 24), 1},
+		{"tenth day", start.AddDate(0, 0, 9).Add(time.Hour * 5), 9},
+		{"before start", start.Add(-time.Hour * 48), 0},
+
+		// Days are UTC days irrespective of the timezone.
+		{"other timezone", time.Date(2021, 3, 2, 1, 0, 0, 0, time.FixedZone("IST", 19800)), 0},
+		{"other timezone, next day", time.Date(2021, 3, 2, 6, 0, 0, 0, time.FixedZone("IST", 19800)), 1},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := (Warmup{StartDate: start}).day(c.now); got != c.want {
+				t.Errorf("day(%s) = %d, want %d", c.now, got, c.want)
+			}
+		})
+	}
+}
+
+func TestWarmupQuota(t *testing.T) {
+	today := time.Now().UTC().Truncate(time.Hour * 24)
+
+	cases := []struct {
+		name        string
+		warmup      Warmup
+		msgr        string
+		wantQuota   bool
+		wantEngaged bool
+	}{
+		{
+			name:   "no plan",
+			warmup: Warmup{Messenger: "ses", StartDate: today, DailyCaps: []int{10}},
+			msgr:   "email",
+		},
+		{
+			name:      "first day",
+			warmup:    Warmup{Messenger: "email", StartDate: today, DailyCaps: []int{10, 20}},
+			msgr:      "email",
+			wantQuota: true,
+		},
+		{
+			name:      "not started",
+			warmup:    Warmup{Messenger: "email", StartDate: today.AddDate(0, 0, 3), DailyCaps: []int{10}},
+			msgr:      "email",
+			wantQuota: true,
+		},
+		{
+			name:   "complete",
+			warmup: Warmup{Messenger: "email", StartDate: today.AddDate(0, 0, -2), DailyCaps: []int{10, 20}},
+			msgr:   "email",
+		},
+		{
+			name:        "engaged only",
+			warmup:      Warmup{Messenger: "email", StartDate: today.AddDate(0, 0, -1), DailyCaps: []int{10, 20, 30}, EngagedOnlyDays: 2},
+			msgr:        "email",
+			wantQuota:   true,
+			wantEngaged: true,
+		},
+		{
+			name:      "engaged days over",
+			warmup:    Warmup{Messenger: "email", StartDate: today.AddDate(0, 0, -2), DailyCaps: []int{10, 20, 30}, EngagedOnlyDays: 2},
+			msgr:      "email",
+			wantQuota: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			src := &warmupSource{sent: map[string]int{"email": 4}}
+			m := New(Config{Warmups: []Warmup{c.warmup}}, src, nil, nil, nil)
+
+			q, err := m.warmupQuota(c.msgr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if (q != nil) != c.wantQuota {
+				t.Fatalf("quota = %+v, want a quota: %v", q, c.wantQuota)
+			}
+			if q == nil {
+				if src.calls != 0 {
+					t.Errorf("sent count fetched %d times without a quota", src.calls)
+				}
+				return
+			}
+
+			if q.engagedOnly != c.wantEngaged {
+				t.Errorf("engagedOnly = %v, want %v", q.engagedOnly, c.wantEngaged)
+			}
+			if want := c.warmup.StartDate.AddDate(0, 0, c.warmup.EngagedOnlyDays); !q.engagedUntil.Equal(want) {
+				t.Errorf("engagedUntil = %s, want %s", q.engagedUntil, want)
+			}
+
+			// The count is fetched once a day.
+			if _, err := m.warmupQuota(c.msgr); err != nil {
+				t.Fatal(err)
+			}
+			if src.calls != 1 || !src.since.Equal(today) || q.w.sent != 4 {
+				t.Errorf("calls = %d, since = %s, sent = %d; want 1, %s, 4", src.calls, src.since, q.w.sent, today)
+			}
+		})
+	}
+}
+
+func TestWarmupQuotaError(t *testing.T) {
+	today := time.Now().UTC().Truncate(time.Hour * 24)
+
+	src := &warmupSource{err: errors.New("db error")}
+	m := New(Config{Warmups: []Warmup{{Messenger: "email", StartDate: today, DailyCaps: []int{10}}}}, src, nil, nil, nil)
+	if _, err := m.warmupQuota("email"); err == nil {
+		t.Fatal("expected an error")
+	}
+
+	// The count is fetched again on the next batch.
+	src.err = nil
+	if q, err := m.warmupQuota("email"); err != nil || q == nil || src.calls != 2 {
+		t.Errorf("quota = %v, err = %v, calls = %d", q, err, src.calls)
+	}
+}
+
+func TestWarmupHold(t *testing.T) {
+	var (
+		now      = time.Now()
+		today    = now.UTC().Truncate(time.Hour * 24)
+		tomorrow = today.Add(time.Hour * 24)
+
+		engaged   = openedAt(now.Add(-time.Hour * 24))
+		unengaged = openedAt(now.Add(-time.Hour * 24 * 60))
+		never     = models.Subscriber{}
+	)
+
+	cases := []struct {
+		name   string
+		warmup Warmup
+		sent   int
+		subs   []models.Subscriber
+
+		// The number of messages that go through and the time until which
+		// the rest are held.
+		wantSent int
+		wantHold time.Time
+	}{
+		{
+			name:     "under cap",
+			warmup:   Warmup{StartDate: today, DailyCaps: []int{10, 20}},
+			subs:     []models.Subscriber{engaged, unengaged, never},
+			wantSent: 3,
+		},
+		{
+			name:     "cap reached",
+			warmup:   Warmup{StartDate: today, DailyCaps: []int{10, 20}},
+			sent:     8,
+			subs:     []models.Subscriber{engaged, unengaged, never, engaged},
+			wantSent: 2,
+			wantHold: tomorrow,
+		},
+		{
+			name:     "day's cap",
+			warmup:   Warmup{StartDate: today.AddDate(0, 0, -1), DailyCaps: []int{10, 20}},
+			sent:     18,
+			subs:     []models.Subscriber{engaged, engaged, engaged},
+			wantSent: 2,
+			wantHold: tomorrow,
+		},
+		{
+			// Subscribers who aren't engaged are held until the end of the
+			// engaged days and don't count against the cap.
+			name:     "engaged only",
+			warmup:   Warmup{StartDate: today.AddDate(0, 0, -1), DailyCaps: []int{10, 20, 30}, EngagedOnlyDays: 3, EngagedWithin: time.Hour * 24 * 30},
+			subs:     []models.Subscriber{engaged, unengaged, never, engaged},
+			wantSent: 2,
+			wantHold: today.AddDate(0, 0, 2),
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			c.warmup.Messenger = "email"
+			src := &warmupSource{sent: map[string]int{"email": c.sent}}
+			m := New(Config{Warmups: []Warmup{c.warmup}}, src, nil, nil, nil)
+
+			q, err := m.warmupQuota("email")
+			if err != nil || q == nil {
+				t.Fatalf("quota = %v, err = %v", q, err)
+			}
+
+			var sent int
+			for i, s := range c.subs {
+				d, ok := q.hold(s)
+				if !ok {
+					sent++
+					continue
+				}
+
+				until := time.Now().Add(d)
+				if until.Before(c.wantHold.Add(-time.Second)) || until.After(c.wantHold.Add(time.Second)) {
+					t.Errorf("subscriber %d held until %s, want %s", i, until.UTC(), c.wantHold)
+				}
+			}
+			if sent != c.wantSent {
+				t.Errorf("%d messages sent, want %d", sent, c.wantSent)
+			}
+			if want := c.sent + c.wantSent; q.w.sent != want {
+				t.Errorf("count = %d, want %d", q.w.sent, want)
+			}
+		})
+	}
+
+	// Messengers without a plan aren't held.
+	var q *warmupQuota
+	if _, ok := q.hold(never); ok {
+		t.Error("held without a quota")
+	}
+}
+
+func TestGetWarmupProgress(t *testing.T) {
+	today := time.Now().UTC().Truncate(time.Hour * 24)
+
+	src := &warmupSource{sent: map[string]int{"ses": 40, "smtp": 5}}
+	m := New(Config{
+		Warmups: []Warmup{
+			{Messenger: "smtp", StartDate: today.AddDate(0, 0, -1), DailyCaps: []int{10, 20, 30}, EngagedOnlyDays: 2, EngagedWithin: time.Hour},
+			{Messenger: "ses", StartDate: today, DailyCaps: []int{50, 100}},
+			{Messenger: "postback", StartDate: today.AddDate(0, 0, -5), DailyCaps: []int{10, 20}},
+		},
+	}, src, nil, nil, nil)
+
+	// Messages counted by the node but not recorded yet.
+	q, _ := m.warmupQuota("smtp")
+	for i := 0; i < 3; i++ {
+		q.hold(openedAt(time.Now()))
+	}
+
+	out, err := m.GetWarmupProgress()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := []WarmupProgress{
+		{Messenger: "postback", StartDate: today.AddDate(0, 0, -5), Day: 6, Days: 2, Complete: true},
+		{Messenger: "ses", StartDate: today, Day: 1, Days: 2, DailyCap: 50, SentToday: 40},
+		{Messenger: "smtp", StartDate: today.AddDate(0, 0, -1), Day: 2, Days: 3, DailyCap: 20, SentToday: 8, EngagedOnly: true},
+	}
+	if len(out) != len(want) {
+		t.Fatalf("got %d plans, want %d", len(out), len(want))
+	}
+	for i := range want {
+		if out[i] != want[i] {
+			t.Errorf("progress = %+v\nwant %+v", out[i], want[i])
+		}
+	}
+}
@@ -4,6 +4,7 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"strings"
 	"time"
 
@@ -99,6 +100,20 @@ func (c *Client) Get(name string) string {
 	return url
 }
 
+// GetBlob accepts the filename of the object stored and downloads it from S3.
+func (c *Client) GetBlob(name string) ([]byte, error) {
+	file, err := c.s3.FileDownload(simples3.DownloadInput{
+		Bucket:    c.opts.Bucket,
+		ObjectKey: strings.TrimPrefix(makeBucketPath(c.opts.BucketPath, name), "/"),
+	})
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	return ioutil.ReadAll(file)
+}
+
 // Delete accepts the filename of the object and deletes from S3.
 func (c *Client) Delete(name string) error {
 	err := c.s3.FileDelete(simples3.DeleteInput{
@@ -1,22 +1,20 @@
 package aws_email
 
 import (
-	"bytes"
 	"errors"
+	"fmt"
 	"log"
 	"math/rand"
-	"mime/multipart"
+	"net/mail"
 	"net/textproto"
-	"strings"
-	"sync"
-	"time"
-	"unicode"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	AwsSes "github.com/aws/aws-sdk-go/service/ses"
 	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/internal/messenger/dkim"
+	"github.com/knadh/smtppool"
 )
 
 const emName = "email"
@@ -24,9 +22,7 @@ const emName = "email"
 // Server represents an AWS server's credentials.
 
 type AWSEmailer struct {
-	sesClients []*AwsSes.SES
-	mu         sync.Mutex
-	v          int
+	sesClients []*sesClient
 	lo         *log.Logger
 	name       string
 }
@@ -35,11 +31,30 @@ type AWSConfig struct {
 	Username string `json:"username"`
 	Password string `json:"password"`
 	Region   string `json:"region"`
+
+	// DKIM signing config. Raw messages are signed before they're handed
+	// over to SES.
+	DKIM dkim.Options `json:"dkim"`
+}
+
+// sesHeaders are the headers that are DKIM signed if none are configured.
+// SES replaces the Message-Id and may rewrite the Date of a raw message,
+// which would break a signature over them.
+var sesHeaders = []string{
+	"From", "Reply-To", "Subject", "To", "Cc",
+	"Mime-Version", "Content-Type", "Content-Transfer-Encoding",
+	"List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+// sesClient is an SES session with its optional DKIM signer.
+type sesClient struct {
+	ses    *AwsSes.SES
+	signer *dkim.Signer
 }
 
 func New(lo *log.Logger, name string, conf ...AWSConfig) (*AWSEmailer, error) {
 	e := &AWSEmailer{
-		sesClients: make([]*AwsSes.SES, 0, len(conf)),
+		sesClients: make([]*sesClient, 0, len(conf)),
 		lo:         lo,
 		name:       name,
 	}
@@ -54,7 +69,17 @@ func New(lo *log.Logger, name string, conf ...AWSConfig) (*AWSEmailer, error) {
 		}
 
 		// Create an SES session.
-		client := AwsSes.New(sess)
+		client := &sesClient{ses: AwsSes.New(sess)}
+		if c.DKIM.Enabled {
+			if len(c.DKIM.Headers) == 0 {
+				c.DKIM.Headers = sesHeaders
+			}
+			signer, err := dkim.New(c.DKIM)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DKIM config for %s: %v", c.Region, err)
+			}
+			client.signer = signer
+		}
 		e.sesClients = append(e.sesClients, client)
 	}
 
@@ -70,130 +95,60 @@ func (e *AWSEmailer) Name() string {
 }
 
 // Push pushes a message to the server.
-func (e *AWSEmailer) Push(m messenger.Message, threshold int) error {
+func (e *AWSEmailer) Push(m messenger.Message) error {
+	_, err := e.PushWithID(m)
+	return err
+}
+
+// PushWithID pushes a message to the server and returns the SES message ID.
+func (e *AWSEmailer) PushWithID(m messenger.Message) (string, error) {
 	var (
 		ln  = len(e.sesClients)
-		srv *AwsSes.SES
+		srv *sesClient
 	)
 	if ln > 1 {
 		srv = e.sesClients[rand.Intn(ln)]
 	} else if ln == 1 {
 		srv = e.sesClients[0]
 	} else {
-		return errors.New("no AWS emailer")
-	}
-
-	buf := &bytes.Buffer{}
-	writer := multipart.NewWriter(buf)
-	// email main header:
-	h := textproto.MIMEHeader{}
-	// Attach e-mail level headers.
-	if len(m.Headers) > 0 {
-		h = m.Headers
-	}
-	h.Set("From", m.From)
-	h.Set("To", m.To[0])
-	h.Set("Return-Path", m.From)
-	cleanSubject := strings.Map(func(r rune) rune {
-		if r > unicode.MaxASCII {
-			return -1
-		}
-		return r
-	}, m.Subject)
-	h.Set("Subject", cleanSubject)
-	h.Set("Content-Language", "en-US")
-	h.Set("Content-Type", "multipart/alternative; boundary=\""+writer.Boundary()+"\"")
-	h.Set("MIME-Version", "1.0")
-
-	_, err := writer.CreatePart(h)
-	if err != nil {
-		log.Println("Error: email main header - ", err)
+		return "", errors.New("no AWS emailer")
 	}
 
-	// body:
-	h = make(textproto.MIMEHeader)
-	h.Set("Content-Transfer-Encoding", "quoted-printable")
-	h.Set("Content-Type", "text/plain; charset=iso-8859-1")
-	h.Set("MIME-Version", "1.0")
-	part, err := writer.CreatePart(h)
-	if err != nil {
-		log.Println("Error: email createPart body - ", err)
-	}
-	clean := strings.Map(func(r rune) rune {
-		if r > unicode.MaxASCII {
-			return -1
-		}
-		return r
-	}, string(m.AltBody))
-	_, err = part.Write([]byte(clean))
+	raw, err := makeRawMessage(m)
 	if err != nil {
-		log.Println("Error: email write body - ", err)
+		return "", err
 	}
 
-	// body:
-	h = make(textproto.MIMEHeader)
-	h.Set("Content-Transfer-Encoding", "quoted-printable")
-	h.Set("Content-Type", "text/html; charset=us-ascii")
-	h.Set("MIME-Version", "1.0")
-	partHtml, err := writer.CreatePart(h)
-	if err != nil {
-		return err
-	}
-	cleanBody := strings.Map(func(r rune) rune {
-		if r > unicode.MaxASCII {
-			return -1
+	// Sign the message just before it's handed over to SES.
+	if srv.signer != nil {
+		if raw, err = srv.signer.Sign(raw); err != nil {
+			return "", err
 		}
-		return r
-	}, string(m.Body))
-	_, err = partHtml.Write([]byte(cleanBody))
-	if err != nil {
-		return err
-	}
-
-	// Strip boundary line before header (doesn't work with it present)
-	s := buf.String()
-	if strings.Count(s, "\n") < 2 {
-		return errors.New("error: invalid e-mail content")
-	}
-	s = strings.SplitN(s, "\n", 2)[1]
-
-	raw := AwsSes.RawMessage{
-		Data: []byte(s),
 	}
 
-	toAddresses := make([]*string, 0)
+	toAddresses := make([]*string, 0, len(m.To))
 	for _, to := range m.To {
 		toAddresses = append(toAddresses, aws.String(to))
 	}
 
+	// SES requires the source to be 7-bit ASCII. Re-format the address
+	// so that a non-ASCII display name is sent as an encoded-word.
+	from := m.From
+	if a, err := mail.ParseAddress(m.From); err == nil {
+		from = a.String()
+	}
+
 	inputs := &AwsSes.SendRawEmailInput{
 		Destinations: toAddresses,
-		Source:       aws.String(m.From),
-		RawMessage:   &raw,
+		Source:       aws.String(from),
+		RawMessage:   &AwsSes.RawMessage{Data: raw},
 	}
 
-	e.Inc(threshold)
-
-	// Attempt to send the email.
-	//defer func(begin time.Time) {
-	//	e.lo.Printf("AWS Send Email Destinations: %s , took: %v", toAddresses, time.Since(begin))
-	//}(time.Now())
-
-	_, err = srv.SendRawEmail(inputs)
-
-	return err
-}
-
-func (e *AWSEmailer) Inc(threshold int) {
-	e.mu.Lock()
-	// Lock so only one goroutine at a time can access the map c.v.
-	if e.v >= threshold {
-		time.Sleep(time.Second)
-		//atomic.CompareAndSwapInt32(&numMsg, numMsg, 0)
-		e.v = 0
+	out, err := srv.ses.SendRawEmail(inputs)
+	if err != nil {
+		return "", err
 	}
-	e.v++
-	e.mu.Unlock()
+	return aws.StringValue(out.MessageId), nil
 }
 
 // Flush flushes the message queue to the server.
@@ -205,3 +160,57 @@ func (e *AWSEmailer) Flush() error {
 func (e *AWSEmailer) Close() error {
 	return nil
 }
+
+// makeRawMessage builds the RFC 5322 message that is handed over to SES.
+// The MIME structure is the same that the SMTP messenger sends: UTF-8
+// quoted-printable text and HTML parts, RFC 2047 encoded-word headers
+// and base64 attachments in a multipart/mixed envelope.
+func makeRawMessage(m messenger.Message) ([]byte, error) {
+	// Are there attachments?
+	var files []smtppool.Attachment
+	if m.Attachments != nil {
+		files = make([]smtppool.Attachment, 0, len(m.Attachments))
+		for _, f := range m.Attachments {
+			h := f.Header
+			if len(h) == 0 {
+				h = messenger.MakeAttachmentHeader(f.Name, "")
+			}
+			files = append(files, smtppool.Attachment{
+				Filename: f.Name,
+				Header:   h,
+				Content:  f.Content,
+			})
+		}
+	}
+
+	em := smtppool.Email{
+		From:        m.From,
+		To:          m.To,
+		Subject:     m.Subject,
+		Attachments: files,
+	}
+
+	// Copy the e-mail level headers so that the shared header map
+	// of the message isn't mutated.
+	em.Headers = make(textproto.MIMEHeader, len(m.Headers)+1)
+	for k, v := range m.Headers {
+		em.Headers[k] = v
+	}
+	if em.Headers.Get("Return-Path") == "" {
+		if a, err := mail.ParseAddress(m.From); err == nil {
+			em.Headers.Set("Return-Path", "<"+a.Address+">")
+		}
+	}
+
+	switch m.ContentType {
+	case "plain":
+		em.Text = m.Body
+	default:
+		em.HTML = m.Body
+		if len(m.AltBody) > 0 {
+			em.Text = m.AltBody
+		}
+	}
+
+	return em.Bytes()
+}
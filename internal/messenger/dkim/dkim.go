@@ -0,0 +1,315 @@
+// Package dkim signs e-mail messages with DKIM signatures (RFC 6376).
+// RSA (rsa-sha256) and Ed25519 (ed25519-sha256, RFC 8463) keys are supported.
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Canonicalization algorithms.
+const (
+	CanonSimple  = "simple"
+	CanonRelaxed = "relaxed"
+)
+
+// DefaultHeaders are the headers that are signed if none are configured.
+// The ones that aren't in a message are skipped.
+var DefaultHeaders = []string{
+	"From", "Reply-To", "Subject", "Date", "To", "Cc", "Message-Id",
+	"Mime-Version", "Content-Type", "Content-Transfer-Encoding",
+	"List-Unsubscribe", "List-Unsubscribe-Post",
+}
+
+// Options represents the DKIM signing config of a connection.
+type Options struct {
+	Enabled  bool   `json:"enabled"`
+	Domain   string `json:"domain"`
+	Selector string `json:"selector"`
+
+	// PrivateKey is the PEM encoded RSA (PKCS #1 or #8) or Ed25519 (PKCS #8) key.
+	PrivateKey string `json:"private_key"`
+
+	// Headers to sign. From is always signed.
+	Headers []string `json:"headers"`
+
+	// Canonicalization is header/body, eg: relaxed/simple. A single algorithm
+	// applies to both. Defaults to relaxed/relaxed.
+	Canonicalization string `json:"canonicalization"`
+}
+
+// Signer signs messages with a DKIM key.
+type Signer struct {
+	domain     string
+	selector   string
+	headers    []string
+	headerCan  string
+	bodyCan    string
+	algo       string
+	key        crypto.Signer
+	hashSigned bool
+}
+
+// New validates DKIM options and returns a Signer.
+func New(o Options) (*Signer, error) {
+	if o.Domain == "" || o.Selector == "" {
+		return nil, errors.New("DKIM domain and selector are required")
+	}
+
+	s := &Signer{
+		domain:   o.Domain,
+		selector: o.Selector,
+	}
+
+	// Canonicalization.
+	s.headerCan, s.bodyCan = CanonRelaxed, CanonRelaxed
+	if o.Canonicalization != "" {
+		c := strings.SplitN(strings.ToLower(o.Canonicalization), "/", 2)
+		s.headerCan, s.bodyCan = c[0], c[0]
+		if len(c) == 2 {
+			s.bodyCan = c[1]
+		}
+	}
+	for _, c := range []string{s.headerCan, s.bodyCan} {
+		if c != CanonSimple && c != CanonRelaxed {
+			return nil, fmt.Errorf("unknown DKIM canonicalization '%s'", c)
+		}
+	}
+
+	// Headers.
+	s.headers = o.Headers
+	if len(s.headers) == 0 {
+		s.headers = DefaultHeaders
+	}
+	hasFrom := false
+	for _, h := range s.headers {
+		if strings.ContainsAny(h, ": \t\r\n") || h == "" {
+			return nil, fmt.Errorf("invalid DKIM header '%s'", h)
+		}
+		if strings.EqualFold(h, "From") {
+			hasFrom = true
+		}
+	}
+	if !hasFrom {
+		s.headers = append([]string{"From"}, s.headers...)
+	}
+
+	// Key.
+	key, err := parseKey(o.PrivateKey)
+	if err != nil {
+		return nil, err
+	}
+	s.key = key
+	switch k := key.(type) {
+	case *rsa.PrivateKey:
+		if k.N.BitLen() < 1024 {
+			return nil, errors.New("DKIM RSA key should be at least 1024 bits")
+		}
+		s.algo = "rsa-sha256"
+		s.hashSigned = true
+	case ed25519.PrivateKey:
+		s.algo = "ed25519-sha256"
+	}
+
+	return s, nil
+}
+
+// parseKey parses a PEM encoded RSA or Ed25519 private key.
+func parseKey(s string) (crypto.Signer, error) {
+	b, _ := pem.Decode([]byte(s))
+	if b == nil {
+		return nil, errors.New("DKIM private key is not PEM encoded")
+	}
+
+	if k, err := x509.ParsePKCS1PrivateKey(b.Bytes); err == nil {
+		return k, nil
+	}
+	k, err := x509.ParsePKCS8PrivateKey(b.Bytes)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing DKIM private key: %v", err)
+	}
+	switch k := k.(type) {
+	case *rsa.PrivateKey:
+		return k, nil
+	case ed25519.PrivateKey:
+		return k, nil
+	}
+	return nil, errors.New("DKIM private key should be RSA or Ed25519")
+}
+
+// Sign returns the message (RFC 5322 with CRLF line endings) with
+// a DKIM-Signature header prepended.
+func (s *Signer) Sign(msg []byte) ([]byte, error) {
+	var hdr, body []byte
+	if i := bytes.Index(msg, []byte("\r\n\r\n")); i > -1 {
+		hdr, body = msg[:i+2], msg[i+4:]
+	} else {
+		hdr = msg
+	}
+	fields := splitHeader(hdr)
+
+	// Body hash.
+	bh := sha256.Sum256(canonBody(body, s.bodyCan))
+
+	// Pick the signed header fields. Multiple instances of a field are
+	// signed bottom-up.
+	var (
+		h      = sha256.New()
+		names  = make([]string, 0, len(s.headers))
+		picked = make(map[string]int)
+	)
+	for _, name := range s.headers {
+		key := strings.ToLower(name)
+		n := picked[key]
+		for i := len(fields) - 1; i >= 0; i-- {
+			if strings.ToLower(fieldName(fields[i])) != key {
+				continue
+			}
+			if n > 0 {
+				n--
+				continue
+			}
+			h.Write([]byte(canonHeader(fields[i], s.headerCan)))
+			names = append(names, name)
+			picked[key]++
+			break
+		}
+	}
+
+	sig := fmt.Sprintf("DKIM-Signature: v=1; a=%s; c=%s/%s; d=%s; s=%s;\r\n"+
+		"\tt=%s; h=%s;\r\n"+
+		"\tbh=%s;\r\n"+
+		"\tb=",
+		s.algo, s.headerCan, s.bodyCan, s.domain, s.selector,
+		strconv.FormatInt(time.Now().Unix(), 10), strings.Join(names, ":"),
+		base64.StdEncoding.EncodeToString(bh[:]))
+
+	// The signature header itself is hashed with an empty b= and without
+	// the trailing CRLF.
+	h.Write([]byte(strings.TrimSuffix(canonHeader(sig+"\r\n", s.headerCan), "\r\n")))
+
+	var (
+		b   []byte
+		err error
+	)
+	if s.hashSigned {
+		b, err = s.key.Sign(rand.Reader, h.Sum(nil), crypto.SHA256)
+	} else {
+		b, err = s.key.Sign(rand.Reader, h.Sum(nil), crypto.Hash(0))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error signing message: %v", err)
+	}
+
+	out := make([]byte, 0, len(sig)+len(msg)+512)
+	out = append(out, sig...)
+	out = append(out, base64.StdEncoding.EncodeToString(b)...)
+	out = append(out, "\r\n"...)
+	out = append(out, msg...)
+	return out, nil
+}
+
+// splitHeader splits a header block into fields, each with its folded
+// continuation lines and the trailing CRLF.
+func splitHeader(hdr []byte) []string {
+	var (
+		out   []string
+		lines = strings.SplitAfter(string(hdr), "\r\n")
+	)
+	for _, l := range lines {
+		if l == "" {
+			continue
+		}
+		if (l[0] == ' ' || l[0] == '\t') && len(out) > 0 {
+			out[len(out)-1] += l
+			continue
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+func fieldName(f string) string {
+	if i := strings.IndexByte(f, ':'); i > -1 {
+		return strings.TrimRight(f[:i], " \t")
+	}
+	return f
+}
+
+// canonHeader canonicalizes a header field (with its trailing CRLF).
+func canonHeader(f, can string) string {
+	if can == CanonSimple {
+		return f
+	}
+
+	i := strings.IndexByte(f, ':')
+	if i < 0 {
+		return f
+	}
+	var (
+		name = strings.ToLower(strings.TrimRight(f[:i], " \t"))
+		val  = strings.NewReplacer("\r\n", "").Replace(f[i+1:])
+	)
+	return name + ":" + strings.TrimSpace(collapseWSP(val)) + "\r\n"
+}
+
+// canonBody canonicalizes a message body.
+func canonBody(body []byte, can string) []byte {
+	lines := strings.Split(string(body), "\r\n")
+
+	if can == CanonRelaxed {
+		for i, l := range lines {
+			lines[i] = strings.TrimRight(collapseWSP(l), " ")
+		}
+	}
+
+	// Strip the trailing empty lines.
+	n := len(lines)
+	for n > 0 && lines[n-1] == "" {
+		n--
+	}
+	if n == 0 {
+		if can == CanonSimple {
+			return []byte("\r\n")
+		}
+		return nil
+	}
+	return []byte(strings.Join(lines[:n], "\r\n") + "\r\n")
+}
+
+// collapseWSP reduces every sequence of spaces and tabs to a single space.
+func collapseWSP(s string) string {
+	var (
+		b  strings.Builder
+		ws bool
+	)
+	b.Grow(len(s))
+	for i := 0; i < len(s); i++ {
+		c := s[i]
+		if c == ' ' || c == '\t' {
+			ws = true
+			continue
+		}
+		if ws {
+			b.WriteByte(' ')
+			ws = false
+		}
+		b.WriteByte(c)
+	}
+	if ws {
+		b.WriteByte(' ')
+	}
+	return b.String()
+}
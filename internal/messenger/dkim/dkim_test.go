@@ -0,0 +1,478 @@
+package dkim
+
+import (
+	"bytes"
+	"crypto"
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/base64"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+// The example message from RFC 6376 appendix A and RFC 8463 appendix A.
+const (
+	rfcHeader = "From: Joe SixPack <joe@football.example.com>\r\n" +
+		"To: Suzie Q <suzie@shopping.example.net>\r\n" +
+		"Subject: Is dinner ready?\r\n" +
+		"Date: Fri, 11 Jul 2003 21:00:37 -0700 (PDT)\r\n" +
+		"Message-ID: <20030712040037.46341.5F8J@football.example.com>\r\n"
+	rfcBody = "Hi.\r\n\r\nWe lost the game. Are you hungry yet?\r\n\r\nJoe.\r\n"
+
+	// The body hash of rfcBody in both the RFCs.
+	rfcBodyHash = "2jUSOH9NhtVGCQWNr9BrIAPreKQjO6Sn7XIkfJVOzv8="
+
+	// RFC 8463 appendix A.2, the Ed25519 key's seed and public key.
+	rfcEd25519Seed = "nWGxne/9WmC6hEr0kuwsxERJxWl7MmkZcDusAxyuf2A="
+	rfcEd25519Pub  = "11qYAYKxCrfVS/7TyWQHOg7hcvPapiMlrwIaaPcHURo="
+)
+
+func TestCanonHeader(t *testing.T) {
+	cases := []struct {
+		name  string
+		field string
+		can   string
+		want  string
+	}{
+		// RFC 6376 section 3.4.6.
+		{"rfc relaxed a", "A: X\r\n", CanonRelaxed, "a:X\r\n"},
+		{"rfc relaxed b", "B : Y\t\r\n\tZ  \r\n", CanonRelaxed, "b:Y Z\r\n"},
+		{"rfc simple a", "A: X\r\n", CanonSimple, "A: X\r\n"},
+		{"rfc simple b", "B : Y\t\r\n\tZ  \r\n", CanonSimple, "B : Y\t\r\n\tZ  \r\n"},
+
+		{"relaxed inner whitespace", "Subject:  Is \t dinner   ready?\r\n", CanonRelaxed, "subject:Is dinner ready?\r\n"},
+		{"relaxed empty value", "X-Empty:\r\n", CanonRelaxed, "x-empty:\r\n"},
+		{"relaxed folded", "To: a@example.com,\r\n b@example.com\r\n", CanonRelaxed, "to:a@example.com, b@example.com\r\n"},
+		{"relaxed colon in value", "Subject: Re: hi\r\n", CanonRelaxed, "subject:Re: hi\r\n"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := canonHeader(c.field, c.can); got != c.want {
+				t.Errorf("canonHeader(%q, %s) = %q, want %q", c.field, c.can, got, c.want)
+			}
+		})
+	}
+}
+
+func TestCanonBody(t *testing.T) {
+	cases := []struct {
+		name string
+		body string
+		can  string
+		want string
+	}{
+		// RFC 6376 section 3.4.6.
+		{"rfc relaxed", " C \r\nD \t E\r\n\r\n\r\n", CanonRelaxed, " C\r\nD E\r\n"},
+		{"rfc simple", " C \r\nD \t E\r\n\r\n\r\n", CanonSimple, " C \r\nD \t E\r\n"},
+
+		// An empty body is a CRLF in simple and empty in relaxed.
+		{"empty relaxed", "", CanonRelaxed, ""},
+		{"empty simple", "", CanonSimple, "\r\n"},
+		{"only CRLFs relaxed", "\r\n\r\n", CanonRelaxed, ""},
+		{"only CRLFs simple", "\r\n\r\n", CanonSimple, "\r\n"},
+		{"whitespace lines relaxed", " \r\n\t\r\n", CanonRelaxed, ""},
+
+		{"no trailing CRLF relaxed", "Hi", CanonRelaxed, "Hi\r\n"},
+		{"no trailing CRLF simple", "Hi", CanonSimple, "Hi\r\n"},
+		{"inner empty lines kept", "a\r\n\r\nb\r\n", CanonRelaxed, "a\r\n\r\nb\r\n"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			if got := string(canonBody([]byte(c.body), c.can)); got != c.want {
+				t.Errorf("canonBody(%q, %s) = %q, want %q", c.body, c.can, got, c.want)
+			}
+		})
+	}
+}
+
+func TestSignBodyHash(t *testing.T) {
+	cases := []struct {
+		name  string
+		canon string
+		body  string
+		want  string
+	}{
+		{"rfc simple/simple", "simple/simple", rfcBody, rfcBodyHash},
+		{"rfc relaxed/relaxed", "relaxed/relaxed", rfcBody, rfcBodyHash},
+
+		// RFC 8463 has two spaces in the body which relaxed reduces to one.
+		{"rfc 8463 relaxed", "relaxed", strings.Replace(rfcBody, "game. Are", "game.  Are", 1), rfcBodyHash},
+		{"rfc 8463 simple", "simple", strings.Replace(rfcBody, "game. Are", "game.  Are", 1),
+			"4bLNXImK9drULnmePzZNEBleUanJCX5PIsDIFoH4KTQ="},
+
+		// SHA-256 of "\r\n" and "".
+		{"empty simple", "simple/simple", "", "frcCV1k9oG9oKj3dpUqdJg1PxRT2RSN/XKdLCPjaYaY="},
+		{"empty relaxed", "relaxed/relaxed", "", "47DEQpj8HBSa+/TImW+5JCeuQeRkm5NMpJWZG3hSuFU="},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			s, pub := newSigner(t, "ed25519", Options{Canonicalization: c.canon})
+
+			out, err := s.Sign([]byte(rfcHeader + "\r\n" + c.body))
+			if err != nil {
+				t.Fatal(err)
+			}
+			tags := sigTags(t, out)
+			if tags["bh"] != c.want {
+				t.Errorf("bh = %s, want %s", tags["bh"], c.want)
+			}
+			if err := verify(out, pub); err != nil {
+				t.Errorf("verify: %v", err)
+			}
+		})
+	}
+}
+
+func TestSignEd25519RFCKey(t *testing.T) {
+	seed, _ := base64.StdEncoding.DecodeString(rfcEd25519Seed)
+	key := ed25519.NewKeyFromSeed(seed)
+	if got := base64.StdEncoding.EncodeToString(key.Public().(ed25519.PublicKey)); got != rfcEd25519Pub {
+		t.Fatalf("public key = %s, want %s", got, rfcEd25519Pub)
+	}
+
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s, err := New(Options{
+		Domain:     "football.example.com",
+		Selector:   "brisbane",
+		PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	out, err := s.Sign([]byte(rfcHeader + "\r\n" + rfcBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tags := sigTags(t, out)
+	want := map[string]string{
+		"a":  "ed25519-sha256",
+		"c":  "relaxed/relaxed",
+		"d":  "football.example.com",
+		"s":  "brisbane",
+		"h":  "From:Subject:Date:To:Message-Id",
+		"bh": rfcBodyHash,
+	}
+	for k, v := range want {
+		if tags[k] != v {
+			t.Errorf("%s= is %q, want %q", k, tags[k], v)
+		}
+	}
+	if err := verify(out, key.Public()); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+}
+
+func TestSign(t *testing.T) {
+	cases := []struct {
+		name    string
+		key     string
+		opt     Options
+		msg     string
+		wantH   string
+		wantErr bool
+	}{
+		{
+			name:  "rsa relaxed/relaxed",
+			key:   "rsa",
+			msg:   rfcHeader + "\r\n" + rfcBody,
+			wantH: "From:Subject:Date:To:Message-Id",
+		},
+		{
+			name:  "rsa simple/simple",
+			key:   "rsa",
+			opt:   Options{Canonicalization: "simple/simple"},
+			msg:   rfcHeader + "\r\n" + rfcBody,
+			wantH: "From:Subject:Date:To:Message-Id",
+		},
+		{
+			name:  "ed25519 relaxed/simple",
+			key:   "ed25519",
+			opt:   Options{Canonicalization: "relaxed/simple"},
+			msg:   rfcHeader + "\r\n" + rfcBody,
+			wantH: "From:Subject:Date:To:Message-Id",
+		},
+		{
+			name:  "empty body",
+			key:   "ed25519",
+			msg:   rfcHeader + "\r\n",
+			wantH: "From:Subject:Date:To:Message-Id",
+		},
+		{
+			name:  "no body",
+			key:   "rsa",
+			opt:   Options{Canonicalization: "simple"},
+			msg:   rfcHeader,
+			wantH: "From:Subject:Date:To:Message-Id",
+		},
+		{
+			name:  "from is always signed",
+			key:   "ed25519",
+			opt:   Options{Headers: []string{"Subject"}},
+			msg:   rfcHeader + "\r\n" + rfcBody,
+			wantH: "From:Subject",
+		},
+		{
+			name:  "folded and mixed case headers",
+			key:   "rsa",
+			opt:   Options{Headers: []string{"from", "TO", "subject"}},
+			msg:   "FROM: a@example.com\r\nto: b@example.com,\r\n\tc@example.com\r\nSubject:\t Hi \r\n\r\nHello\r\n",
+			wantH: "from:TO:subject",
+		},
+		{
+			// Only the instances that are present are signed, bottom-up.
+			name:  "repeated header",
+			key:   "ed25519",
+			opt:   Options{Headers: []string{"From", "X-Tag", "X-Tag", "X-Tag"}},
+			msg:   "From: a@example.com\r\nX-Tag: one\r\nSubject: Hi\r\nX-Tag: two\r\n\r\nHello\r\n",
+			wantH: "From:X-Tag:X-Tag",
+		},
+		{
+			name:    "bad canonicalization",
+			key:     "ed25519",
+			opt:     Options{Canonicalization: "relaxed/nowsp"},
+			wantErr: true,
+		},
+		{
+			name:    "bad header",
+			key:     "ed25519",
+			opt:     Options{Headers: []string{"From", "X-Tag:"}},
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			o := c.opt
+			o.Domain, o.Selector, o.PrivateKey = "example.com", "test", makeKey(t, c.key)
+
+			s, err := New(o)
+			if c.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			out, err := s.Sign([]byte(c.msg))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.HasSuffix(out, []byte(c.msg)) {
+				t.Error("the message isn't intact after the signature")
+			}
+
+			tags := sigTags(t, out)
+			if tags["h"] != c.wantH {
+				t.Errorf("h= is %q, want %q", tags["h"], c.wantH)
+			}
+
+			pub := s.key.Public()
+			if err := verify(out, pub); err != nil {
+				t.Fatalf("verify: %v", err)
+			}
+
+			// Tampering with a signed header breaks the signature.
+			bad := bytes.Replace(out, []byte("a@example.com"), []byte("x@example.com"), 1)
+			bad = bytes.Replace(bad, []byte("joe@football"), []byte("jim@football"), 1)
+			if err := verify(bad, pub); err == nil {
+				t.Error("verify passed on a tampered message")
+			}
+		})
+	}
+}
+
+func TestSignRepeatedHeaderOrder(t *testing.T) {
+	s, pub := newSigner(t, "ed25519", Options{Headers: []string{"From", "X-Tag"}})
+
+	msg := "From: a@example.com\r\nX-Tag: one\r\nX-Tag: two\r\n\r\nHello\r\n"
+	out, err := s.Sign([]byte(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := verify(out, pub); err != nil {
+		t.Fatalf("verify: %v", err)
+	}
+
+	// The bottom-most instance is signed. Changing it breaks the signature
+	// and changing the unsigned one above it doesn't.
+	if err := verify(bytes.Replace(out, []byte("X-Tag: two"), []byte("X-Tag: 2"), 1), pub); err == nil {
+		t.Error("verify passed with the signed instance changed")
+	}
+	if err := verify(bytes.Replace(out, []byte("X-Tag: one"), []byte("X-Tag: 1"), 1), pub); err != nil {
+		t.Errorf("verify failed with the unsigned instance changed: %v", err)
+	}
+}
+
+func TestSignRelaxedSurvivesRewrapping(t *testing.T) {
+	s, pub := newSigner(t, "rsa", Options{})
+
+	out, err := s.Sign([]byte(rfcHeader + "\r\n" + rfcBody))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Relaxed canonicalization tolerates whitespace changes in transit.
+	out = bytes.Replace(out, []byte("Subject: Is dinner ready?"), []byte("subject:   Is dinner\r\n ready?"), 1)
+	out = bytes.Replace(out, []byte("Joe.\r\n"), []byte("Joe.  \r\n\r\n"), 1)
+	if err := verify(out, pub); err != nil {
+		t.Errorf("verify: %v", err)
+	}
+}
+
+func newSigner(t *testing.T, typ string, o Options) (*Signer, crypto.PublicKey) {
+	t.Helper()
+
+	o.Domain, o.Selector, o.PrivateKey = "example.com", "test", makeKey(t, typ)
+	s, err := New(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s, s.key.Public()
+}
+
+// makeKey returns a PEM encoded RSA (PKCS #1) or Ed25519 (PKCS #8) key.
+func makeKey(t *testing.T, typ string) string {
+	t.Helper()
+
+	var b *pem.Block
+	switch typ {
+	case "rsa":
+		k, err := rsa.GenerateKey(rand.Reader, 1024)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = &pem.Block{Type: "RSA PRIVATE KEY", Bytes: x509.MarshalPKCS1PrivateKey(k)}
+	case "ed25519":
+		_, k, err := ed25519.GenerateKey(rand.Reader)
+		if err != nil {
+			t.Fatal(err)
+		}
+		der, err := x509.MarshalPKCS8PrivateKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		b = &pem.Block{Type: "PRIVATE KEY", Bytes: der}
+	default:
+		t.Fatalf("unknown key type %s", typ)
+	}
+	return string(pem.EncodeToMemory(b))
+}
+
+var reWSP = regexp.MustCompile(`[ \t\r\n]+`)
+
+// sigTags returns the tags of the DKIM-Signature header of a message.
+func sigTags(t *testing.T, msg []byte) map[string]string {
+	t.Helper()
+
+	f, _ := sigField(msg)
+	if f == "" {
+		t.Fatal("no DKIM-Signature header")
+	}
+	return parseTags(f)
+}
+
+// sigField returns the DKIM-Signature field of a message and the message
+// without it.
+func sigField(msg []byte) (string, []byte) {
+	fields := splitHeader(msg[:bytes.Index(append(msg, "\r\n\r\n"...), []byte("\r\n\r\n"))+2])
+	if len(fields) == 0 || !strings.EqualFold(fieldName(fields[0]), "DKIM-Signature") {
+		return "", msg
+	}
+	return fields[0], msg[len(fields[0]):]
+}
+
+func parseTags(f string) map[string]string {
+	out := make(map[string]string)
+	for _, t := range strings.Split(f[strings.IndexByte(f, ':')+1:], ";") {
+		kv := strings.SplitN(t, "=", 2)
+		if len(kv) != 2 {
+			continue
+		}
+		out[strings.TrimSpace(kv[0])] = reWSP.ReplaceAllString(kv[1], "")
+	}
+	return out
+}
+
+// verify is a minimal DKIM verifier (RFC 6376 section 6.1.3) that checks
+// the signature of a message signed by Sign against a public key.
+func verify(msg []byte, pub crypto.PublicKey) error {
+	sig, msg := sigField(msg)
+	if sig == "" {
+		return errors.New("no DKIM-Signature header")
+	}
+	tags := parseTags(sig)
+
+	can := strings.SplitN(tags["c"], "/", 2)
+	if len(can) != 2 {
+		return fmt.Errorf("bad c= %q", tags["c"])
+	}
+
+	var hdr, body []byte
+	if i := bytes.Index(msg, []byte("\r\n\r\n")); i > -1 {
+		hdr, body = msg[:i+2], msg[i+4:]
+	} else {
+		hdr = msg
+	}
+
+	// Body hash.
+	bh := sha256.Sum256(canonBody(body, can[1]))
+	if base64.StdEncoding.EncodeToString(bh[:]) != tags["bh"] {
+		return errors.New("body hash mismatch")
+	}
+
+	// Signed headers, each picked bottom-up from the ones not picked yet.
+	var (
+		h      = sha256.New()
+		fields = splitHeader(hdr)
+		used   = make([]bool, len(fields))
+	)
+	for _, name := range strings.Split(tags["h"], ":") {
+		for i := len(fields) - 1; i >= 0; i-- {
+			if used[i] || !strings.EqualFold(fieldName(fields[i]), name) {
+				continue
+			}
+			used[i] = true
+			h.Write([]byte(canonHeader(fields[i], can[0])))
+			break
+		}
+	}
+
+	// The signature field with an empty b= and no trailing CRLF.
+	empty := regexp.MustCompile(`([;\s]b=)[^;]*$`).ReplaceAllString(strings.TrimSuffix(sig, "\r\n"), "$1")
+	h.Write([]byte(strings.TrimSuffix(canonHeader(empty+"\r\n", can[0]), "\r\n")))
+	digest := h.Sum(nil)
+
+	b, err := base64.StdEncoding.DecodeString(tags["b"])
+	if err != nil {
+		return err
+	}
+
+	switch tags["a"] {
+	case "rsa-sha256":
+		return rsa.VerifyPKCS1v15(pub.(*rsa.PublicKey), crypto.SHA256, digest, b)
+	case "ed25519-sha256":
+		if !ed25519.Verify(pub.(ed25519.PublicKey), digest, b) {
+			return errors.New("ed25519 signature mismatch")
+		}
+		return nil
+	}
+	return fmt.Errorf("unknown a= %q", tags["a"])
+}
@@ -5,16 +5,25 @@ import (
 	"fmt"
 	"log"
 	"math/rand"
+	"net"
+	"net/mail"
 	"net/smtp"
 	"net/textproto"
-	"sync"
+	"strconv"
+	"strings"
 	"time"
 
 	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/internal/messenger/dkim"
 	"github.com/knadh/smtppool"
 )
 
-const emName = "smtp_email"
+const (
+	emName = "smtp_email"
+
+	// Timeout for connecting to an SMTP server when probing it.
+	probeTimeout = time.Second * 10
+)
 
 // Server represents an SMTP server's credentials.
 type Server struct {
@@ -25,18 +34,22 @@ type Server struct {
 	TLSSkipVerify bool              `json:"tls_skip_verify"`
 	EmailHeaders  map[string]string `json:"email_headers"`
 
+	// DKIM signing config. Signed messages are sent over raw connections
+	// instead of the smtppool.
+	DKIM dkim.Options `json:"dkim"`
+
 	// Rest of the options are embedded directly from the smtppool lib.
 	// The JSON tag is for config unmarshal to work.
 	smtppool.Opt `json:",squash"`
 
-	pool *smtppool.Pool
+	pool   *smtppool.Pool
+	signer *dkim.Signer
+	raw    *rawPool
 }
 
 // Emailer is the SMTP e-mail messenger.
 type Emailer struct {
 	servers []*Server
-	mu      sync.Mutex
-	v       int
 	lo      *log.Logger
 	name    string
 }
@@ -75,12 +88,21 @@ func New(lo *log.Logger, name string, servers ...Server) (*Emailer, error) {
 			}
 		}
 
-		pool, err := smtppool.New(s.Opt)
-		if err != nil {
-			return nil, err
+		if s.DKIM.Enabled {
+			signer, err := dkim.New(s.DKIM)
+			if err != nil {
+				return nil, fmt.Errorf("invalid DKIM config for %s: %v", s.Host, err)
+			}
+			s.signer = signer
+			s.raw = newRawPool(s.Opt)
+		} else {
+			pool, err := smtppool.New(s.Opt)
+			if err != nil {
+				return nil, err
+			}
+			s.pool = pool
 		}
 
-		s.pool = pool
 		e.servers = append(e.servers, &s)
 	}
 
@@ -96,7 +118,13 @@ func (e *Emailer) Name() string {
 }
 
 // Push pushes a message to the server.
-func (e *Emailer) Push(m messenger.Message, threshold int) error {
+func (e *Emailer) Push(m messenger.Message) error {
+	_, err := e.PushWithID(m)
+	return err
+}
+
+// PushWithID pushes a message to the server and returns its Message-Id.
+func (e *Emailer) PushWithID(m messenger.Message) (string, error) {
 	// If there are more than one SMTP servers, send to a random
 	// one from the list.
 	var (
@@ -133,8 +161,8 @@ func (e *Emailer) Push(m messenger.Message, threshold int) error {
 
 	em.Headers = textproto.MIMEHeader{}
 	// Attach e-mail level headers.
-	if len(m.Headers) > 0 {
-		em.Headers = m.Headers
+	for k, v := range m.Headers {
+		em.Headers[k] = v
 	}
 
 	// Attach SMTP level headers.
@@ -154,21 +182,59 @@ func (e *Emailer) Push(m messenger.Message, threshold int) error {
 		}
 	}
 
-	e.Inc(threshold)
+	// Generate the Message-Id here instead of leaving it to the pool
+	// so that it can be returned to the caller.
+	id := em.Headers.Get("Message-Id")
+	if id == "" {
+		id = makeMessageID(m.From)
+		em.Headers.Set("Message-Id", id)
+	}
+
+	// Sign the message just before it's sent.
+	if srv.signer != nil {
+		b, err := em.Bytes()
+		if err != nil {
+			return "", err
+		}
+		if b, err = srv.signer.Sign(b); err != nil {
+			return "", err
+		}
+		if err := srv.raw.send(m.From, m.To, b); err != nil {
+			return "", err
+		}
+		return id, nil
+	}
+
+	if err := srv.pool.Send(em); err != nil {
+		return "", err
+	}
+	return id, nil
+}
 
-	return srv.pool.Send(em)
+// makeMessageID returns a unique RFC 5322 Message-Id with the domain
+// of the sender's address.
+func makeMessageID(from string) string {
+	domain := "localhost"
+	if a, err := mail.ParseAddress(from); err == nil {
+		if i := strings.LastIndex(a.Address, "@"); i > -1 {
+			domain = a.Address[i+1:]
+		}
+	}
+	return fmt.Sprintf("<%d.%d@%s>", time.Now().UnixNano(), rand.Int63(), domain)
 }
 
-func (e *Emailer) Inc(threshold int) {
-	e.mu.Lock()
-	// Lock so only one goroutine at a time can access the map c.v.
-	if e.v >= threshold {
-		time.Sleep(time.Second)
-		//atomic.CompareAndSwapInt32(&numMsg, numMsg, 0)
-		e.v = 0
+// Probe checks whether any of the SMTP servers accept connections.
+func (e *Emailer) Probe() error {
+	var err error
+	for _, s := range e.servers {
+		var conn net.Conn
+		conn, err = net.DialTimeout("tcp", net.JoinHostPort(s.Host, strconv.Itoa(s.Port)), probeTimeout)
+		if err == nil {
+			conn.Close()
+			return nil
+		}
 	}
-	e.v++
-	e.mu.Unlock()
+	return err
 }
 
 // Flush flushes the message queue to the server.
@@ -179,7 +245,12 @@ func (e *Emailer) Flush() error {
 // Close closes the SMTP pools.
 func (e *Emailer) Close() error {
 	for _, s := range e.servers {
-		s.pool.Close()
+		if s.pool != nil {
+			s.pool.Close()
+		}
+		if s.raw != nil {
+			s.raw.close()
+		}
 	}
 	return nil
 }
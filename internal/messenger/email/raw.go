@@ -0,0 +1,228 @@
+package email
+
+import (
+	"crypto/tls"
+	"errors"
+	"net"
+	"net/mail"
+	"net/smtp"
+	"net/textproto"
+	"strconv"
+	"time"
+
+	"github.com/knadh/smtppool"
+)
+
+// rawPool is a pool of SMTP connections that pre-built messages are sent
+// over. smtppool builds a message from an Email on every send with random
+// MIME boundaries, which would invalidate a DKIM signature's body hash, so
+// signed messages are sent over these connections instead. The connections
+// are set up and retried the same way as smtppool's.
+type rawPool struct {
+	opt   smtppool.Opt
+	conns chan *rawConn
+
+	// slots limits the number of open connections to MaxConns.
+	slots chan struct{}
+}
+
+type rawConn struct {
+	c    *smtp.Client
+	last time.Time
+}
+
+func newRawPool(o smtppool.Opt) *rawPool {
+	if o.MaxConns < 1 {
+		o.MaxConns = 1
+	}
+	if o.MaxMessageRetries == 0 {
+		o.MaxMessageRetries = 2
+	}
+	if o.PoolWaitTimeout.Seconds() < 1 {
+		o.PoolWaitTimeout = time.Second * 2
+	}
+
+	return &rawPool{
+		opt:   o,
+		conns: make(chan *rawConn, o.MaxConns),
+		slots: make(chan struct{}, o.MaxConns),
+	}
+}
+
+// send sends a message. On connection errors, the message is retried
+// on a new connection.
+func (p *rawPool) send(from string, to []string, msg []byte) error {
+	addr, err := mail.ParseAddress(from)
+	if err != nil {
+		return err
+	}
+	rcpts := make([]string, 0, len(to))
+	for _, t := range to {
+		a, err := mail.ParseAddress(t)
+		if err != nil {
+			return err
+		}
+		rcpts = append(rcpts, a.Address)
+	}
+
+	var lastErr error
+	for i := 0; i < p.opt.MaxMessageRetries; i++ {
+		c, err := p.borrow()
+		if err != nil {
+			return err
+		}
+
+		err = c.send(addr.Address, rcpts, msg)
+		p.release(c, err)
+		if err == nil {
+			return nil
+		}
+		lastErr = err
+
+		// SMTP errors (eg: a rejected recipient) aren't retried.
+		if _, ok := err.(*textproto.Error); ok {
+			return err
+		}
+	}
+	return lastErr
+}
+
+// borrow returns an idle connection or a new one if there's room.
+func (p *rawPool) borrow() (*rawConn, error) {
+	for {
+		select {
+		case c := <-p.conns:
+			// Close connections that have been idle for too long.
+			if p.opt.IdleTimeout > 0 && time.Since(c.last) > p.opt.IdleTimeout {
+				p.discard(c)
+				continue
+			}
+			return c, nil
+
+		case p.slots <- struct{}{}:
+			c, err := p.dial()
+			if err != nil {
+				<-p.slots
+				return nil, err
+			}
+			return c, nil
+
+		case <-time.After(p.opt.PoolWaitTimeout):
+			return nil, errors.New("timed out waiting for free conn in pool")
+		}
+	}
+}
+
+// release returns a connection to the pool unless the last error on it
+// indicates that it's broken.
+func (p *rawPool) release(c *rawConn, lastErr error) {
+	if lastErr != nil {
+		if _, ok := lastErr.(*textproto.Error); !ok {
+			p.discard(c)
+			return
+		}
+
+		// Abort the failed transaction.
+		if err := c.c.Reset(); err != nil {
+			p.discard(c)
+			return
+		}
+	}
+
+	c.last = time.Now()
+	p.conns <- c
+}
+
+func (p *rawPool) discard(c *rawConn) {
+	c.c.Close()
+	<-p.slots
+}
+
+// dial opens and sets up a new SMTP connection.
+func (p *rawPool) dial() (c *rawConn, err error) {
+	var (
+		nc   net.Conn
+		addr = net.JoinHostPort(p.opt.Host, strconv.Itoa(p.opt.Port))
+	)
+	if p.opt.TLSConfig != nil && p.opt.SSL {
+		// Implicit TLS (SMTPS).
+		nc, err = tls.DialWithDialer(&net.Dialer{Timeout: p.opt.PoolWaitTimeout}, "tcp", addr, p.opt.TLSConfig)
+	} else {
+		// Plain connection that may be upgraded with STARTTLS.
+		nc, err = net.DialTimeout("tcp", addr, p.opt.PoolWaitTimeout)
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	sm, err := smtp.NewClient(nc, p.opt.Host)
+	if err != nil {
+		nc.Close()
+		return nil, err
+	}
+	defer func() {
+		if err != nil {
+			sm.Close()
+		}
+	}()
+
+	if p.opt.HelloHostname != "" {
+		if err := sm.Hello(p.opt.HelloHostname); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.opt.TLSConfig != nil && !p.opt.SSL {
+		if ok, _ := sm.Extension("STARTTLS"); !ok {
+			return nil, errors.New("SMTP STARTTLS extension not found")
+		}
+		if err := sm.StartTLS(p.opt.TLSConfig); err != nil {
+			return nil, err
+		}
+	}
+
+	if p.opt.Auth != nil {
+		if ok, _ := sm.Extension("AUTH"); !ok {
+			return nil, errors.New("SMTP AUTH extension not found")
+		}
+		if err := sm.Auth(p.opt.Auth); err != nil {
+			return nil, err
+		}
+	}
+
+	return &rawConn{c: sm, last: time.Now()}, nil
+}
+
+// close closes all the idle connections.
+func (p *rawPool) close() {
+	for {
+		select {
+		case c := <-p.conns:
+			c.c.Quit()
+			<-p.slots
+		default:
+			return
+		}
+	}
+}
+
+func (c *rawConn) send(from string, to []string, msg []byte) error {
+	if err := c.c.Mail(from); err != nil {
+		return err
+	}
+	for _, t := range to {
+		if err := c.c.Rcpt(t); err != nil {
+			return err
+		}
+	}
+
+	w, err := c.c.Data()
+	if err != nil {
+		return err
+	}
+	if _, err := w.Write(msg); err != nil {
+		w.Close()
+		return err
+	}
+	return w.Close()
+}
@@ -0,0 +1,306 @@
+package email
+
+import (
+	"bufio"
+	"crypto/ecdsa"
+	"crypto/ed25519"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"math/big"
+	"net"
+	"net/textproto"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/internal/messenger/dkim"
+	"github.com/knadh/smtppool"
+)
+
+// fakeSMTP is a minimal SMTP server that records the messages it receives.
+type fakeSMTP struct {
+	ln       net.Listener
+	tls      *tls.Config
+	startTLS bool
+	msgs     chan fakeMsg
+}
+
+type fakeMsg struct {
+	from string
+	to   []string
+	data string
+	tls  bool
+}
+
+// newFakeSMTP starts a server that should be closed with close(). With ssl, connections are TLS from the start.
+// With startTLS, the STARTTLS extension is offered on plain connections.
+func newFakeSMTP(t *testing.T, ssl, startTLS bool) *fakeSMTP {
+	t.Helper()
+
+	s := &fakeSMTP{
+		tls:      &tls.Config{Certificates: []tls.Certificate{makeCert(t)}},
+		startTLS: startTLS,
+		msgs:     make(chan fakeMsg, 10),
+	}
+
+	var err error
+	if ssl {
+		s.ln, err = tls.Listen("tcp", "127.0.0.1:0", s.tls)
+	} else {
+		s.ln, err = net.Listen("tcp", "127.0.0.1:0")
+	}
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := s.ln.Accept()
+			if err != nil {
+				return
+			}
+			go s.serve(c)
+		}
+	}()
+	return s
+}
+
+func (s *fakeSMTP) close() {
+	s.ln.Close()
+}
+
+func (s *fakeSMTP) opt() smtppool.Opt {
+	a := s.ln.Addr().(*net.TCPAddr)
+	return smtppool.Opt{
+		Host:            a.IP.String(),
+		Port:            a.Port,
+		MaxConns:        1,
+		PoolWaitTimeout: time.Second * 2,
+	}
+}
+
+func (s *fakeSMTP) serve(c net.Conn) {
+	defer c.Close()
+
+	var (
+		_, isTLS = c.(*tls.Conn)
+		tp       = textproto.NewConn(c)
+		msg      fakeMsg
+	)
+	tp.PrintfLine("220 localhost ESMTP")
+	for {
+		line, err := tp.ReadLine()
+		if err != nil {
+			return
+		}
+		cmd := strings.ToUpper(line)
+
+		switch {
+		case strings.HasPrefix(cmd, "EHLO"), strings.HasPrefix(cmd, "HELO"):
+			if s.startTLS && !isTLS {
+				tp.PrintfLine("250-localhost")
+				tp.PrintfLine("250 STARTTLS")
+			} else {
+				tp.PrintfLine("250 localhost")
+			}
+
+		case cmd == "STARTTLS":
+			tp.PrintfLine("220 ready")
+			tc := tls.Server(c, s.tls)
+			if err := tc.Handshake(); err != nil {
+				return
+			}
+			c, isTLS = tc, true
+			tp = textproto.NewConn(c)
+
+		case strings.HasPrefix(cmd, "MAIL FROM:"):
+			msg = fakeMsg{from: strings.Trim(line[10:], "<>"), tls: isTLS}
+			tp.PrintfLine("250 ok")
+
+		case strings.HasPrefix(cmd, "RCPT TO:"):
+			msg.to = append(msg.to, strings.Trim(line[8:], "<>"))
+			tp.PrintfLine("250 ok")
+
+		case cmd == "DATA":
+			tp.PrintfLine("354 go ahead")
+			b, err := tp.ReadDotBytes()
+			if err != nil {
+				return
+			}
+			msg.data = string(b) // Line endings are LF.
+			s.msgs <- msg
+			tp.PrintfLine("250 queued")
+
+		case cmd == "RSET", cmd == "NOOP":
+			tp.PrintfLine("250 ok")
+
+		case cmd == "QUIT":
+			tp.PrintfLine("221 bye")
+			return
+
+		default:
+			tp.PrintfLine("502 unknown command")
+		}
+	}
+}
+
+func (s *fakeSMTP) next(t *testing.T) fakeMsg {
+	t.Helper()
+	select {
+	case m := <-s.msgs:
+		return m
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for message")
+	}
+	return fakeMsg{}
+}
+
+func makeCert(t *testing.T) tls.Certificate {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tpl := &x509.Certificate{
+		SerialNumber: big.NewInt(1),
+		Subject:      pkix.Name{CommonName: "localhost"},
+		IPAddresses:  []net.IP{net.ParseIP("127.0.0.1")},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().Add(time.Hour),
+	}
+	der, err := x509.CreateCertificate(rand.Reader, tpl, tpl, &key.PublicKey, key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}
+}
+
+func TestRawPoolDial(t *testing.T) {
+	msg := "From: a@listmonk.app\r\nTo: b@listmonk.app\r\nSubject: Hi\r\n\r\nHello\r\n.dot\r\n"
+
+	cases := []struct {
+		name     string
+		ssl      bool
+		startTLS bool
+		tls      bool
+		wantTLS  bool
+	}{
+		{name: "plain"},
+		{name: "starttls", startTLS: true, tls: true, wantTLS: true},
+		{name: "ssl", ssl: true, tls: true, wantTLS: true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := newFakeSMTP(t, c.ssl, c.startTLS)
+			defer srv.close()
+
+			o := srv.opt()
+			o.SSL = c.ssl
+			if c.tls {
+				o.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+			}
+			p := newRawPool(o)
+			defer p.close()
+
+			// Send twice to reuse the pooled connection.
+			for i := 0; i < 2; i++ {
+				if err := p.send("Listmonk <a@listmonk.app>", []string{"b@listmonk.app"}, []byte(msg)); err != nil {
+					t.Fatalf("send: %v", err)
+				}
+
+				got := srv.next(t)
+				if got.from != "a@listmonk.app" || len(got.to) != 1 || got.to[0] != "b@listmonk.app" {
+					t.Errorf("envelope = %q %q", got.from, got.to)
+				}
+				// The received data has its line endings normalized.
+				if want := strings.ReplaceAll(msg, "\r\n", "\n"); got.data != want {
+					t.Errorf("data = %q, want %q", got.data, want)
+				}
+				if got.tls != c.wantTLS {
+					t.Errorf("tls = %v, want %v", got.tls, c.wantTLS)
+				}
+			}
+		})
+	}
+}
+
+func TestRawPoolSSLMismatch(t *testing.T) {
+	// A plain server doesn't complete a TLS handshake.
+	srv := newFakeSMTP(t, false, false)
+	defer srv.close()
+
+	o := srv.opt()
+	o.SSL = true
+	o.TLSConfig = &tls.Config{InsecureSkipVerify: true}
+	p := newRawPool(o)
+	defer p.close()
+
+	if err := p.send("a@listmonk.app", []string{"b@listmonk.app"}, []byte("\r\n")); err == nil {
+		t.Fatal("expected an error connecting with SSL to a plain server")
+	}
+}
+
+func TestPushSignedSSL(t *testing.T) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := x509.MarshalPKCS8PrivateKey(key)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	srv := newFakeSMTP(t, true, false)
+	defer srv.close()
+	s := Server{
+		TLSEnabled:    true,
+		TLSSkipVerify: true,
+		DKIM: dkim.Options{
+			Enabled:    true,
+			Domain:     "listmonk.app",
+			Selector:   "test",
+			PrivateKey: string(pem.EncodeToMemory(&pem.Block{Type: "PRIVATE KEY", Bytes: der})),
+		},
+		Opt: srv.opt(),
+	}
+	s.Opt.SSL = true
+
+	e, err := New(nil, "", s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer e.Close()
+
+	id, err := e.PushWithID(messenger.Message{
+		From:        "a@listmonk.app",
+		To:          []string{"b@listmonk.app"},
+		Subject:     "Hi",
+		ContentType: "html",
+		Body:        []byte("<p>Hello</p>"),
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	got := srv.next(t)
+	if !got.tls {
+		t.Error("message wasn't sent over TLS")
+	}
+	if !strings.HasPrefix(got.data, "DKIM-Signature: v=1; a=ed25519-sha256;") {
+		t.Errorf("message isn't signed: %q", got.data)
+	}
+	r := textproto.NewReader(bufio.NewReader(strings.NewReader(got.data)))
+	h, err := r.ReadMIMEHeader()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.Get("Message-Id") != id {
+		t.Errorf("Message-Id = %q, want %q", h.Get("Message-Id"), id)
+	}
+}
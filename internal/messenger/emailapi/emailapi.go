@@ -0,0 +1,480 @@
+// Package emailapi implements messengers that send e-mails over the HTTP
+// APIs of e-mail providers (SendGrid v3, Mailgun and Postmark) instead
+// of SMTP.
+package emailapi
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"math/rand"
+	"mime"
+	"net/http"
+	"net/textproto"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+)
+
+// Providers.
+const (
+	ProviderSendGrid = "SendGrid"
+	ProviderMailgun  = "Mailgun"
+	ProviderPostmark = "Postmark"
+)
+
+// Max size of a response body that's read.
+const maxRespSize = 1 << 20
+
+// ErrClosed is returned when a message is pushed to a closed messenger.
+var ErrClosed = errors.New("e-mail API messenger is closed")
+
+// Options represents the config of a provider's API connection.
+type Options struct {
+	Provider string `json:"provider"`
+
+	// RootURL is the provider's API root URL, eg: https://api.eu.mailgun.net.
+	// If it's empty, the provider's default is used.
+	RootURL string `json:"root_url"`
+	APIKey  string `json:"api_key"`
+
+	// Domain is the sending domain (Mailgun).
+	Domain string `json:"domain"`
+
+	// Headers are added to all the messages.
+	Headers map[string]string `json:"headers"`
+
+	MaxConns int           `json:"max_conns"`
+	Retries  int           `json:"retries"`
+	Timeout  time.Duration `json:"timeout"`
+
+	// Messages pushed concurrently are sent in a single request of up to
+	// BatchSize messages if the provider has a batch endpoint. A batch is
+	// sent when it's full or BatchWait after its first message.
+	BatchSize int           `json:"batch_size"`
+	BatchWait time.Duration `json:"batch_wait"`
+}
+
+// APIError is a non-OK response from a provider's API.
+type APIError struct {
+	Provider string
+	Status   int
+	Body     string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("non-OK response from %s: %d: %s", e.Provider, e.Status, e.Body)
+}
+
+// provider sends messages over a provider's API.
+type provider interface {
+	// send sends a message and returns the provider's message ID.
+	send(m messenger.Message) (string, error)
+
+	// sendBatch sends a batch of messages in a single request and returns
+	// the message ID and error of each in the order of the messages.
+	// It's only called if maxBatch is more than one.
+	sendBatch(msgs []messenger.Message) ([]result, error)
+
+	// maxBatch is the max number of messages that can be sent in a batch.
+	maxBatch() int
+}
+
+// result is the outcome of sending a message in a batch.
+type result struct {
+	id  string
+	err error
+}
+
+// Emailer is a messenger that sends e-mails over a provider's HTTP API.
+// Messages are distributed randomly among multiple connections.
+type Emailer struct {
+	name    string
+	clients []*client
+	lo      *log.Logger
+}
+
+// client is a connection to a provider's API with its optional batcher.
+type client struct {
+	p provider
+	h *httpClient
+	b *batcher
+}
+
+// New returns a new instance of the e-mail API messenger with one or more
+// connections.
+func New(lo *log.Logger, name string, opts ...Options) (*Emailer, error) {
+	e := &Emailer{
+		name:    name,
+		clients: make([]*client, 0, len(opts)),
+		lo:      lo,
+	}
+
+	for _, o := range opts {
+		if o.APIKey == "" {
+			return nil, fmt.Errorf("%s API key is required", o.Provider)
+		}
+		if o.Timeout == 0 {
+			o.Timeout = time.Second * 10
+		}
+		if o.MaxConns < 1 {
+			o.MaxConns = 1
+		}
+
+		h := newHTTPClient(o)
+
+		var p provider
+		switch o.Provider {
+		case ProviderSendGrid:
+			p = newSendGrid(h, o)
+		case ProviderMailgun:
+			if o.Domain == "" {
+				return nil, errors.New("Mailgun sending domain is required")
+			}
+			p = newMailgun(h, o)
+		case ProviderPostmark:
+			p = newPostmark(h, o)
+		default:
+			return nil, fmt.Errorf("unknown e-mail API provider '%s'", o.Provider)
+		}
+
+		c := &client{p: p, h: h}
+		if n := o.BatchSize; n > 1 && p.maxBatch() > 1 {
+			if n > p.maxBatch() {
+				n = p.maxBatch()
+			}
+			if o.BatchWait == 0 {
+				o.BatchWait = time.Millisecond * 100
+			}
+			c.b = newBatcher(p, n, o.BatchWait, lo)
+		}
+		e.clients = append(e.clients, c)
+	}
+
+	if len(e.clients) == 0 {
+		return nil, errors.New("no e-mail API connections")
+	}
+	return e, nil
+}
+
+// Name returns the messenger's name.
+func (e *Emailer) Name() string {
+	return e.name
+}
+
+// Push pushes a message to the provider.
+func (e *Emailer) Push(m messenger.Message) error {
+	_, err := e.PushWithID(m)
+	return err
+}
+
+// PushWithID pushes a message to the provider and returns the provider's
+// message ID. If batching is enabled, it blocks until the batch that the
+// message is in is sent.
+func (e *Emailer) PushWithID(m messenger.Message) (string, error) {
+	c := e.clients[0]
+	if ln := len(e.clients); ln > 1 {
+		c = e.clients[rand.Intn(ln)]
+	}
+
+	if c.b != nil {
+		return c.b.push(m)
+	}
+	return c.p.send(m)
+}
+
+// Flush sends the pending batches and waits for them to be sent.
+func (e *Emailer) Flush() error {
+	for _, c := range e.clients {
+		if c.b != nil {
+			c.b.flush()
+		}
+	}
+	return nil
+}
+
+// Close sends the pending batches and closes idle HTTP connections.
+func (e *Emailer) Close() error {
+	for _, c := range e.clients {
+		if c.b != nil {
+			c.b.close()
+		}
+		c.h.c.CloseIdleConnections()
+	}
+	return nil
+}
+
+// httpClient is a pooled HTTP client for a provider's API.
+type httpClient struct {
+	provider string
+	retries  int
+	c        *http.Client
+}
+
+func newHTTPClient(o Options) *httpClient {
+	return &httpClient{
+		provider: o.Provider,
+		retries:  o.Retries,
+		c: &http.Client{
+			Timeout: o.Timeout,
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				MaxIdleConns:          o.MaxConns,
+				MaxIdleConnsPerHost:   o.MaxConns,
+				MaxConnsPerHost:       o.MaxConns,
+				ResponseHeaderTimeout: o.Timeout,
+				IdleConnTimeout:       time.Second * 90,
+			},
+		},
+	}
+}
+
+// do makes an HTTP request and returns the response body and headers.
+// Network errors, 429s and 5xx responses are retried with a backoff.
+func (h *httpClient) do(method, url string, body []byte, hdr http.Header) ([]byte, http.Header, error) {
+	var lastErr error
+	for i := 0; i <= h.retries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * time.Millisecond * 500)
+		}
+
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, nil, err
+		}
+		for k, v := range hdr {
+			req.Header[k] = v
+		}
+		req.Header.Set("User-Agent", "listmonk")
+
+		r, err := h.c.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRespSize))
+
+		// Drain and close the body to let the Transport reuse the connection.
+		io.Copy(ioutil.Discard, r.Body)
+		r.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if r.StatusCode >= 200 && r.StatusCode < 300 {
+			return b, r.Header, nil
+		}
+
+		lastErr = &APIError{Provider: h.provider, Status: r.StatusCode, Body: strings.TrimSpace(string(b))}
+		if r.StatusCode != http.StatusTooManyRequests && r.StatusCode < 500 {
+			break
+		}
+	}
+	return nil, nil, lastErr
+}
+
+// batcher collects messages that are pushed concurrently and sends them
+// in batch requests.
+type batcher struct {
+	p    provider
+	size int
+	wait time.Duration
+	lo   *log.Logger
+
+	queue  chan *batchItem
+	flushQ chan chan struct{}
+	stop   chan struct{}
+	done   chan struct{}
+
+	// wg tracks the batches that are being sent.
+	wg sync.WaitGroup
+
+	mu     sync.RWMutex
+	closed bool
+}
+
+type batchItem struct {
+	msg  messenger.Message
+	res  result
+	done chan struct{}
+}
+
+func newBatcher(p provider, size int, wait time.Duration, lo *log.Logger) *batcher {
+	b := &batcher{
+		p:      p,
+		size:   size,
+		wait:   wait,
+		lo:     lo,
+		queue:  make(chan *batchItem, size),
+		flushQ: make(chan chan struct{}),
+		stop:   make(chan struct{}),
+		done:   make(chan struct{}),
+	}
+	go b.run()
+	return b
+}
+
+// push adds a message to the current batch and waits for it to be sent.
+func (b *batcher) push(m messenger.Message) (string, error) {
+	it := &batchItem{msg: m, done: make(chan struct{})}
+
+	b.mu.RLock()
+	if b.closed {
+		b.mu.RUnlock()
+		return "", ErrClosed
+	}
+	b.queue <- it
+	b.mu.RUnlock()
+
+	<-it.done
+	return it.res.id, it.res.err
+}
+
+// flush sends the current batch and waits for all the batches to be sent.
+func (b *batcher) flush() {
+	ch := make(chan struct{})
+	select {
+	case b.flushQ <- ch:
+		<-ch
+	case <-b.done:
+	}
+	b.wg.Wait()
+}
+
+// close sends the current batch and stops the batcher.
+func (b *batcher) close() {
+	b.mu.Lock()
+	if !b.closed {
+		b.closed = true
+		close(b.stop)
+	}
+	b.mu.Unlock()
+
+	<-b.done
+	b.wg.Wait()
+}
+
+// run is a blocking function that collects the pushed messages into batches.
+func (b *batcher) run() {
+	defer close(b.done)
+
+	var (
+		items = make([]*batchItem, 0, b.size)
+		timer = time.NewTimer(b.wait)
+	)
+	timer.Stop()
+
+	send := func() {
+		if len(items) == 0 {
+			return
+		}
+		if !timer.Stop() {
+			select {
+			case <-timer.C:
+			default:
+			}
+		}
+
+		b.wg.Add(1)
+		go b.send(items)
+		items = make([]*batchItem, 0, b.size)
+	}
+
+	for {
+		select {
+		case it := <-b.queue:
+			items = append(items, it)
+			if len(items) == 1 {
+				timer.Reset(b.wait)
+			}
+			if len(items) >= b.size {
+				send()
+			}
+
+		case <-timer.C:
+			send()
+
+		case ch := <-b.flushQ:
+			send()
+			close(ch)
+
+		case <-b.stop:
+			// Pick up the messages that made it to the queue before
+			// it was closed.
+			for len(b.queue) > 0 {
+				items = append(items, <-b.queue)
+				if len(items) >= b.size {
+					send()
+				}
+			}
+			send()
+			return
+		}
+	}
+}
+
+// send sends a batch and hands the results over to the waiting pushes.
+func (b *batcher) send(items []*batchItem) {
+	defer b.wg.Done()
+
+	// A single message is sent on the regular endpoint.
+	if len(items) == 1 {
+		items[0].res.id, items[0].res.err = b.p.send(items[0].msg)
+		close(items[0].done)
+		return
+	}
+
+	msgs := make([]messenger.Message, len(items))
+	for i, it := range items {
+		msgs[i] = it.msg
+	}
+
+	res, err := b.p.sendBatch(msgs)
+	if err == nil && len(res) != len(items) {
+		err = fmt.Errorf("expected %d results in the batch response, got %d", len(items), len(res))
+	}
+	if err != nil {
+		b.lo.Printf("error sending batch of %d messages: %v", len(items), err)
+	}
+
+	for i, it := range items {
+		if err != nil {
+			it.res.err = err
+		} else {
+			it.res = res[i]
+		}
+		close(it.done)
+	}
+}
+
+// makeHeaders merges the connection's headers into the message's headers.
+func makeHeaders(m messenger.Message, hdr map[string]string) textproto.MIMEHeader {
+	out := make(textproto.MIMEHeader, len(m.Headers)+len(hdr))
+	for k, v := range m.Headers {
+		out[k] = v
+	}
+	for k, v := range hdr {
+		out.Set(k, v)
+	}
+	return out
+}
+
+// attachmentType returns the media type of an attachment without the
+// parameters. The APIs take the filename separately.
+func attachmentType(a messenger.Attachment) string {
+	t := a.Header.Get("Content-Type")
+	if t == "" {
+		t = messenger.MakeAttachmentHeader(a.Name, "").Get("Content-Type")
+	}
+	if typ, _, err := mime.ParseMediaType(t); err == nil {
+		return typ
+	}
+	return t
+}
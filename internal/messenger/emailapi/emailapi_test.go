@@ -0,0 +1,200 @@
+package emailapi
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"net/http/httptest"
+	"net/textproto"
+	"reflect"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+)
+
+// testServer is an API server that records the requests it receives and
+// responds with the handler's response.
+type testServer struct {
+	*httptest.Server
+
+	mu   sync.Mutex
+	reqs []testReq
+}
+
+type testReq struct {
+	method string
+	path   string
+	header http.Header
+	body   []byte
+}
+
+// newTestServer starts a server that responds with fn. It should be closed
+// with Close().
+func newTestServer(fn func(w http.ResponseWriter, r testReq)) *testServer {
+	s := &testServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+		req := testReq{method: r.Method, path: r.URL.Path, header: r.Header, body: b}
+
+		s.mu.Lock()
+		s.reqs = append(s.reqs, req)
+		s.mu.Unlock()
+
+		fn(w, req)
+	}))
+	return s
+}
+
+func (s *testServer) requests() []testReq {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]testReq(nil), s.reqs...)
+}
+
+func newTestEmailer(t *testing.T, o Options) *Emailer {
+	t.Helper()
+
+	if o.APIKey == "" {
+		o.APIKey = "secret"
+	}
+	e, err := New(log.New(ioutil.Discard, "", 0), "test", o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return e
+}
+
+func testMsg() messenger.Message {
+	return messenger.Message{
+		From:        "Listmonk <noreply@listmonk.app>",
+		To:          []string{"Jane Doe <jane@example.com>"},
+		Subject:     "Hello",
+		ContentType: "html",
+		Body:        []byte("<p>Hello</p>"),
+		AltBody:     []byte("Hello"),
+		Headers: textproto.MIMEHeader{
+			"List-Unsubscribe": []string{"<https://listmonk.app/unsub>"},
+		},
+		Attachments: []messenger.Attachment{
+			{Name: "a.pdf", Content: []byte("hi")},
+		},
+	}
+}
+
+// jsonEqual checks whether a JSON payload is the same as the expected
+// JSON regardless of the formatting and the order of keys.
+func jsonEqual(t *testing.T, got []byte, want string) {
+	t.Helper()
+
+	var g, w interface{}
+	if err := json.Unmarshal(got, &g); err != nil {
+		t.Fatalf("invalid JSON payload %s: %v", got, err)
+	}
+	if err := json.Unmarshal([]byte(want), &w); err != nil {
+		t.Fatalf("invalid expected JSON: %v", err)
+	}
+	if !reflect.DeepEqual(g, w) {
+		t.Errorf("payload = %s\nwant %s", got, want)
+	}
+}
+
+func TestNew(t *testing.T) {
+	cases := []struct {
+		name    string
+		opt     Options
+		wantErr bool
+	}{
+		{"sendgrid", Options{Provider: ProviderSendGrid, APIKey: "k"}, false},
+		{"mailgun", Options{Provider: ProviderMailgun, APIKey: "k", Domain: "mg.example.com"}, false},
+		{"postmark", Options{Provider: ProviderPostmark, APIKey: "k"}, false},
+		{"no key", Options{Provider: ProviderSendGrid}, true},
+		{"mailgun without domain", Options{Provider: ProviderMailgun, APIKey: "k"}, true},
+		{"unknown provider", Options{Provider: "Sendmail", APIKey: "k"}, true},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			e, err := New(log.New(ioutil.Discard, "", 0), "test", c.opt)
+			if (err != nil) != c.wantErr {
+				t.Fatalf("err = %v, want error = %v", err, c.wantErr)
+			}
+			if err == nil {
+				e.Close()
+			}
+		})
+	}
+}
+
+func TestHTTPClientStatus(t *testing.T) {
+	cases := []struct {
+		name     string
+		statuses []int
+		retries  int
+		wantReqs int
+		wantErr  int
+	}{
+		{"ok", []int{200}, 1, 1, 0},
+		{"accepted", []int{202}, 1, 1, 0},
+		{"bad request isn't retried", []int{400}, 2, 1, 400},
+		{"unauthorized isn't retried", []int{401}, 2, 1, 401},
+		{"server error is retried", []int{500, 200}, 1, 2, 0},
+		{"rate limit is retried", []int{429, 202}, 1, 2, 0},
+		{"retries exhausted", []int{503, 503}, 1, 2, 503},
+		{"no retries", []int{500}, 0, 1, 500},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var (
+				mu sync.Mutex
+				n  int
+			)
+			srv := newTestServer(func(w http.ResponseWriter, r testReq) {
+				mu.Lock()
+				st := c.statuses[n]
+				n++
+				mu.Unlock()
+
+				w.WriteHeader(st)
+				w.Write([]byte(" response \n"))
+			})
+			defer srv.Close()
+
+			h := newHTTPClient(Options{Provider: "Test", Retries: c.retries, MaxConns: 1, Timeout: time.Second})
+			body, _, err := h.do(http.MethodPost, srv.URL, []byte("{}"), http.Header{"X-Test": []string{"1"}})
+
+			if got := len(srv.requests()); got != c.wantReqs {
+				t.Errorf("requests = %d, want %d", got, c.wantReqs)
+			}
+			for _, r := range srv.requests() {
+				if r.header.Get("X-Test") != "1" || r.header.Get("User-Agent") != "listmonk" {
+					t.Errorf("unexpected request headers %v", r.header)
+				}
+				if string(r.body) != "{}" {
+					t.Errorf("body = %q on a retry", r.body)
+				}
+			}
+
+			if c.wantErr == 0 {
+				if err != nil {
+					t.Fatalf("unexpected error: %v", err)
+				}
+				if string(body) != " response \n" {
+					t.Errorf("body = %q", body)
+				}
+				return
+			}
+
+			e, ok := err.(*APIError)
+			if !ok {
+				t.Fatalf("err = %v, want *APIError", err)
+			}
+			if e.Status != c.wantErr || e.Provider != "Test" || e.Body != "response" {
+				t.Errorf("err = %+v", e)
+			}
+		})
+	}
+}
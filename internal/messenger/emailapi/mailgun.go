@@ -0,0 +1,121 @@
+package emailapi
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"strings"
+
+	"github.com/knadh/listmonk/internal/messenger"
+)
+
+const mailgunURL = "https://api.mailgun.net"
+
+// mailgun sends messages over Mailgun's messages API.
+// https://documentation.mailgun.com/en/latest/api-sending.html
+//
+// Mailgun's batch sending substitutes recipient variables in a shared
+// message, so every individually rendered message is sent in its own request.
+type mailgun struct {
+	h       *httpClient
+	url     string
+	headers map[string]string
+	auth    string
+}
+
+type mailgunResp struct {
+	ID      string `json:"id"`
+	Message string `json:"message"`
+}
+
+func newMailgun(h *httpClient, o Options) *mailgun {
+	u := mailgunURL
+	if o.RootURL != "" {
+		u = strings.TrimRight(o.RootURL, "/")
+	}
+
+	return &mailgun{
+		h:       h,
+		url:     u + "/v3/" + o.Domain + "/messages",
+		headers: o.Headers,
+		auth:    "Basic " + base64.StdEncoding.EncodeToString([]byte("api:"+o.APIKey)),
+	}
+}
+
+func (g *mailgun) send(m messenger.Message) (string, error) {
+	var (
+		b bytes.Buffer
+		w = multipart.NewWriter(&b)
+	)
+
+	w.WriteField("from", m.From)
+	for _, t := range m.To {
+		w.WriteField("to", t)
+	}
+	w.WriteField("subject", m.Subject)
+
+	switch m.ContentType {
+	case "plain":
+		w.WriteField("text", string(m.Body))
+	default:
+		w.WriteField("html", string(m.Body))
+		if len(m.AltBody) > 0 {
+			w.WriteField("text", string(m.AltBody))
+		}
+	}
+
+	for k, vals := range makeHeaders(m, g.headers) {
+		for _, v := range vals {
+			w.WriteField("h:"+k, v)
+		}
+	}
+
+	for _, a := range m.Attachments {
+		h := textproto.MIMEHeader{}
+		h.Set("Content-Disposition", fmt.Sprintf(`form-data; name="attachment"; filename="%s"`,
+			strings.NewReplacer(`\`, `\\`, `"`, `\"`).Replace(a.Name)))
+		h.Set("Content-Type", attachmentType(a))
+
+		p, err := w.CreatePart(h)
+		if err != nil {
+			return "", err
+		}
+		if _, err := p.Write(a.Content); err != nil {
+			return "", err
+		}
+	}
+
+	if err := w.Close(); err != nil {
+		return "", err
+	}
+
+	body, _, err := g.h.do(http.MethodPost, g.url, b.Bytes(), http.Header{
+		"Authorization": []string{g.auth},
+		"Content-Type":  []string{w.FormDataContentType()},
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var r mailgunResp
+	if err := json.Unmarshal(body, &r); err != nil {
+		return "", fmt.Errorf("error parsing Mailgun response: %v", err)
+	}
+
+	// The ID is a Message-Id, eg: <20210101.1@mg.example.com>. Mailgun's
+	// events refer to it without the brackets.
+	return strings.Trim(r.ID, "<>"), nil
+}
+
+func (g *mailgun) sendBatch(msgs []messenger.Message) ([]result, error) {
+	return nil, errors.New("Mailgun doesn't support batches of different messages")
+}
+
+func (g *mailgun) maxBatch() int {
+	return 1
+}
@@ -0,0 +1,155 @@
+package emailapi
+
+import (
+	"bytes"
+	"io/ioutil"
+	"net/http"
+	"reflect"
+	"testing"
+
+	"github.com/knadh/listmonk/internal/messenger"
+)
+
+func TestMailgun(t *testing.T) {
+	plain := testMsg()
+	plain.ContentType = "plain"
+	plain.Body = []byte("Hello plain")
+	plain.Attachments = nil
+
+	cases := []struct {
+		name     string
+		msg      messenger.Message
+		status   int
+		resp     string
+		want     map[string][]string
+		wantFile string
+		wantID   string
+		wantErr  bool
+	}{
+		{
+			name:   "html",
+			msg:    testMsg(),
+			status: http.StatusOK,
+			resp:   `{"id": "<20210101.1@mg.example.com>", "message": "Queued. Thank you."}`,
+			want: map[string][]string{
+				"from":               {"Listmonk <noreply@listmonk.app>"},
+				"to":                 {"Jane Doe <jane@example.com>"},
+				"subject":            {"Hello"},
+				"html":               {"<p>Hello</p>"},
+				"text":               {"Hello"},
+				"h:List-Unsubscribe": {"<https://listmonk.app/unsub>"},
+				"h:X-Conn":           {"1"},
+			},
+			wantFile: "a.pdf",
+			wantID:   "20210101.1@mg.example.com",
+		},
+		{
+			name:   "plain",
+			msg:    plain,
+			status: http.StatusOK,
+			resp:   `{"id": "<2@mg.example.com>"}`,
+			want: map[string][]string{
+				"from":               {"Listmonk <noreply@listmonk.app>"},
+				"to":                 {"Jane Doe <jane@example.com>"},
+				"subject":            {"Hello"},
+				"text":               {"Hello plain"},
+				"h:List-Unsubscribe": {"<https://listmonk.app/unsub>"},
+				"h:X-Conn":           {"1"},
+			},
+			wantID: "2@mg.example.com",
+		},
+		{
+			name:    "unauthorized",
+			msg:     testMsg(),
+			status:  http.StatusUnauthorized,
+			resp:    "Forbidden",
+			wantErr: true,
+		},
+		{
+			name:    "invalid response",
+			msg:     testMsg(),
+			status:  http.StatusOK,
+			resp:    "<html>",
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			var (
+				form  map[string][]string
+				files []string
+				data  [][]byte
+			)
+			srv := newTestServer(func(w http.ResponseWriter, r testReq) {
+				req, _ := http.NewRequest(r.method, "/", bytes.NewReader(r.body))
+				req.Header = r.header
+				if err := req.ParseMultipartForm(1 << 20); err == nil {
+					form = req.MultipartForm.Value
+					for _, f := range req.MultipartForm.File["attachment"] {
+						files = append(files, f.Filename)
+						fd, _ := f.Open()
+						b, _ := ioutil.ReadAll(fd)
+						data = append(data, b)
+					}
+				}
+
+				w.WriteHeader(c.status)
+				w.Write([]byte(c.resp))
+			})
+			defer srv.Close()
+
+			e := newTestEmailer(t, Options{
+				Provider: ProviderMailgun,
+				RootURL:  srv.URL,
+				APIKey:   "mg-key",
+				Domain:   "mg.example.com",
+				Headers:  map[string]string{"X-Conn": "1"},
+			})
+			defer e.Close()
+
+			id, err := e.PushWithID(c.msg)
+
+			reqs := srv.requests()
+			if len(reqs) != 1 {
+				t.Fatalf("requests = %d, want 1", len(reqs))
+			}
+			r := reqs[0]
+			if r.method != http.MethodPost || r.path != "/v3/mg.example.com/messages" {
+				t.Errorf("request = %s %s", r.method, r.path)
+			}
+			req := &http.Request{Header: r.header}
+			if u, p, ok := req.BasicAuth(); !ok || u != "api" || p != "mg-key" {
+				t.Errorf("basic auth = %q %q %v", u, p, ok)
+			}
+
+			if c.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if c.status != http.StatusOK {
+					if e, ok := err.(*APIError); !ok || e.Status != c.status || e.Body != c.resp {
+						t.Errorf("err = %v, want APIError %d", err, c.status)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != c.wantID {
+				t.Errorf("id = %q, want %q", id, c.wantID)
+			}
+			if !reflect.DeepEqual(form, c.want) {
+				t.Errorf("form = %v\nwant %v", form, c.want)
+			}
+			if c.wantFile != "" {
+				if len(files) != 1 || files[0] != c.wantFile || string(data[0]) != "hi" {
+					t.Errorf("attachments = %v %q", files, data)
+				}
+			} else if len(files) != 0 {
+				t.Errorf("unexpected attachments %v", files)
+			}
+		})
+	}
+}
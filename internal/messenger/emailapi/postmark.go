@@ -0,0 +1,161 @@
+package emailapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/knadh/listmonk/internal/messenger"
+)
+
+const postmarkURL = "https://api.postmarkapp.com"
+
+// Postmark accepts up to 500 messages in a batch request.
+const postmarkMaxBatch = 500
+
+// postmark sends messages over Postmark's API.
+// https://postmarkapp.com/developer/api/email-api
+type postmark struct {
+	h       *httpClient
+	url     string
+	headers map[string]string
+	hdr     http.Header
+}
+
+type postmarkMsg struct {
+	From        string               `json:"From"`
+	To          string               `json:"To"`
+	Subject     string               `json:"Subject"`
+	HTMLBody    string               `json:"HtmlBody,omitempty"`
+	TextBody    string               `json:"TextBody,omitempty"`
+	Headers     []postmarkHeader     `json:"Headers,omitempty"`
+	Attachments []postmarkAttachment `json:"Attachments,omitempty"`
+}
+
+type postmarkHeader struct {
+	Name  string `json:"Name"`
+	Value string `json:"Value"`
+}
+
+type postmarkAttachment struct {
+	Name        string `json:"Name"`
+	Content     []byte `json:"Content"`
+	ContentType string `json:"ContentType"`
+}
+
+type postmarkResp struct {
+	ErrorCode int    `json:"ErrorCode"`
+	Message   string `json:"Message"`
+	MessageID string `json:"MessageID"`
+}
+
+func newPostmark(h *httpClient, o Options) *postmark {
+	u := postmarkURL
+	if o.RootURL != "" {
+		u = strings.TrimRight(o.RootURL, "/")
+	}
+
+	return &postmark{
+		h:       h,
+		url:     u,
+		headers: o.Headers,
+		hdr: http.Header{
+			"Accept":                  []string{"application/json"},
+			"Content-Type":            []string{"application/json"},
+			"X-Postmark-Server-Token": []string{o.APIKey},
+		},
+	}
+}
+
+func (p *postmark) send(m messenger.Message) (string, error) {
+	b, err := json.Marshal(p.makeMsg(m))
+	if err != nil {
+		return "", err
+	}
+
+	body, _, err := p.h.do(http.MethodPost, p.url+"/email", b, p.hdr)
+	if err != nil {
+		return "", err
+	}
+
+	var r postmarkResp
+	if err := json.Unmarshal(body, &r); err != nil {
+		return "", fmt.Errorf("error parsing Postmark response: %v", err)
+	}
+	if r.ErrorCode != 0 {
+		return "", fmt.Errorf("Postmark error %d: %s", r.ErrorCode, r.Message)
+	}
+	return r.MessageID, nil
+}
+
+func (p *postmark) sendBatch(msgs []messenger.Message) ([]result, error) {
+	batch := make([]postmarkMsg, len(msgs))
+	for i, m := range msgs {
+		batch[i] = p.makeMsg(m)
+	}
+
+	b, err := json.Marshal(batch)
+	if err != nil {
+		return nil, err
+	}
+
+	body, _, err := p.h.do(http.MethodPost, p.url+"/email/batch", b, p.hdr)
+	if err != nil {
+		return nil, err
+	}
+
+	// The response has the result of each message in the order of the request.
+	var resp []postmarkResp
+	if err := json.Unmarshal(body, &resp); err != nil {
+		return nil, fmt.Errorf("error parsing Postmark response: %v", err)
+	}
+
+	out := make([]result, len(resp))
+	for i, r := range resp {
+		if r.ErrorCode != 0 {
+			out[i].err = fmt.Errorf("Postmark error %d: %s", r.ErrorCode, r.Message)
+			continue
+		}
+		out[i].id = r.MessageID
+	}
+	return out, nil
+}
+
+func (p *postmark) maxBatch() int {
+	return postmarkMaxBatch
+}
+
+func (p *postmark) makeMsg(m messenger.Message) postmarkMsg {
+	out := postmarkMsg{
+		From:    m.From,
+		To:      strings.Join(m.To, ","),
+		Subject: m.Subject,
+	}
+
+	switch m.ContentType {
+	case "plain":
+		out.TextBody = string(m.Body)
+	default:
+		out.HTMLBody = string(m.Body)
+		if len(m.AltBody) > 0 {
+			out.TextBody = string(m.AltBody)
+		}
+	}
+
+	for k, vals := range makeHeaders(m, p.headers) {
+		for _, v := range vals {
+			out.Headers = append(out.Headers, postmarkHeader{Name: k, Value: v})
+		}
+	}
+
+	for _, a := range m.Attachments {
+		out.Attachments = append(out.Attachments, postmarkAttachment{
+			Name:        a.Name,
+			Content:     a.Content,
+			ContentType: attachmentType(a),
+		})
+	}
+
+	return out
+}
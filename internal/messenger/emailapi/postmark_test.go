@@ -0,0 +1,325 @@
+package emailapi
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+)
+
+func TestPostmark(t *testing.T) {
+	plain := testMsg()
+	plain.ContentType = "plain"
+	plain.Body = []byte("Hello plain")
+	plain.Headers = nil
+	plain.Attachments = nil
+
+	cases := []struct {
+		name    string
+		msg     messenger.Message
+		status  int
+		resp    string
+		want    string
+		wantID  string
+		wantErr bool
+	}{
+		{
+			name:   "html",
+			msg:    testMsg(),
+			status: http.StatusOK,
+			resp:   `{"ErrorCode": 0, "Message": "OK", "MessageID": "pm-id-1"}`,
+			wantID: "pm-id-1",
+			want: `{
+				"From": "Listmonk <noreply@listmonk.app>",
+				"To": "Jane Doe <jane@example.com>",
+				"Subject": "Hello",
+				"HtmlBody": "<p>Hello</p>",
+				"TextBody": "Hello",
+				"Headers": [
+					{"Name": "List-Unsubscribe", "Value": "<https://listmonk.app/unsub>"},
+					{"Name": "X-Conn", "Value": "1"}
+				],
+				"Attachments": [{"Name": "a.pdf", "Content": "aGk=", "ContentType": "application/pdf"}]
+			}`,
+		},
+		{
+			name:   "plain",
+			msg:    plain,
+			status: http.StatusOK,
+			resp:   `{"ErrorCode": 0, "MessageID": "pm-id-2"}`,
+			wantID: "pm-id-2",
+			want: `{
+				"From": "Listmonk <noreply@listmonk.app>",
+				"To": "Jane Doe <jane@example.com>",
+				"Subject": "Hello",
+				"TextBody": "Hello plain",
+				"Headers": [{"Name": "X-Conn", "Value": "1"}]
+			}`,
+		},
+		{
+			name:    "rejected",
+			msg:     testMsg(),
+			status:  http.StatusUnprocessableEntity,
+			resp:    `{"ErrorCode": 300, "Message": "Invalid email request"}`,
+			wantErr: true,
+		},
+		{
+			name:    "error code on OK",
+			msg:     testMsg(),
+			status:  http.StatusOK,
+			resp:    `{"ErrorCode": 406, "Message": "Inactive recipient"}`,
+			wantErr: true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := newTestServer(func(w http.ResponseWriter, r testReq) {
+				w.WriteHeader(c.status)
+				w.Write([]byte(c.resp))
+			})
+			defer srv.Close()
+
+			e := newTestEmailer(t, Options{
+				Provider: ProviderPostmark,
+				RootURL:  srv.URL,
+				APIKey:   "pm-key",
+				Headers:  map[string]string{"X-Conn": "1"},
+			})
+			defer e.Close()
+
+			id, err := e.PushWithID(c.msg)
+
+			reqs := srv.requests()
+			if len(reqs) != 1 {
+				t.Fatalf("requests = %d, want 1", len(reqs))
+			}
+			r := reqs[0]
+			if r.method != http.MethodPost || r.path != "/email" {
+				t.Errorf("request = %s %s", r.method, r.path)
+			}
+			for k, v := range map[string]string{
+				"X-Postmark-Server-Token": "pm-key",
+				"Accept":                  "application/json",
+				"Content-Type":            "application/json",
+			} {
+				if got := r.header.Get(k); got != v {
+					t.Errorf("%s = %q, want %q", k, got, v)
+				}
+			}
+
+			if c.wantErr {
+				if err == nil {
+					t.Fatal("expected an error")
+				}
+				if c.status != http.StatusOK {
+					if e, ok := err.(*APIError); !ok || e.Status != c.status {
+						t.Errorf("err = %v, want APIError %d", err, c.status)
+					}
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != c.wantID {
+				t.Errorf("id = %q, want %q", id, c.wantID)
+			}
+			jsonEqual(t, sortHeaders(t, r.body), c.want)
+		})
+	}
+}
+
+func TestPostmarkBatch(t *testing.T) {
+	cases := []struct {
+		name      string
+		size      int
+		wait      time.Duration
+		push      int
+		flush     bool
+		badResp   bool
+		wantPaths []string
+	}{
+		{
+			name:      "full batch",
+			size:      3,
+			wait:      time.Second * 10,
+			push:      3,
+			wantPaths: []string{"/email/batch"},
+		},
+		{
+			name:      "full batches",
+			size:      2,
+			wait:      time.Second * 10,
+			push:      4,
+			wantPaths: []string{"/email/batch", "/email/batch"},
+		},
+		{
+			// A batch that doesn't fill up is sent after the wait. A single
+			// message goes to the regular endpoint.
+			name:      "single after wait",
+			size:      3,
+			wait:      time.Millisecond * 50,
+			push:      1,
+			wantPaths: []string{"/email"},
+		},
+		{
+			name:      "flushed",
+			size:      5,
+			wait:      time.Second * 10,
+			push:      2,
+			flush:     true,
+			wantPaths: []string{"/email/batch"},
+		},
+		{
+			name:      "result count mismatch",
+			size:      2,
+			wait:      time.Second * 10,
+			push:      2,
+			badResp:   true,
+			wantPaths: []string{"/email/batch"},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := newTestServer(func(w http.ResponseWriter, r testReq) {
+				if r.path == "/email" {
+					var m postmarkMsg
+					json.Unmarshal(r.body, &m)
+					fmt.Fprintf(w, `{"ErrorCode": 0, "MessageID": "id-%s"}`, m.Subject)
+					return
+				}
+
+				var msgs []postmarkMsg
+				json.Unmarshal(r.body, &msgs)
+				if c.badResp {
+					msgs = msgs[1:]
+				}
+
+				// Every odd message is rejected.
+				out := make([]postmarkResp, len(msgs))
+				for i, m := range msgs {
+					var n int
+					fmt.Sscanf(m.Subject, "%d", &n)
+					if n%2 == 1 {
+						out[i] = postmarkResp{ErrorCode: 406, Message: "Inactive recipient"}
+					} else {
+						out[i] = postmarkResp{MessageID: "id-" + m.Subject}
+					}
+				}
+				json.NewEncoder(w).Encode(out)
+			})
+			defer srv.Close()
+
+			e := newTestEmailer(t, Options{
+				Provider:  ProviderPostmark,
+				RootURL:   srv.URL,
+				BatchSize: c.size,
+				BatchWait: c.wait,
+			})
+			defer e.Close()
+
+			var (
+				wg   sync.WaitGroup
+				ids  = make([]string, c.push)
+				errs = make([]error, c.push)
+			)
+			for i := 0; i < c.push; i++ {
+				wg.Add(1)
+				go func(i int) {
+					defer wg.Done()
+					m := testMsg()
+					m.Subject = fmt.Sprintf("%d", i)
+					ids[i], errs[i] = e.PushWithID(m)
+				}(i)
+			}
+
+			if c.flush {
+				// Wait for the messages to be queued.
+				time.Sleep(time.Millisecond * 100)
+				if err := e.Flush(); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			done := make(chan struct{})
+			go func() {
+				wg.Wait()
+				close(done)
+			}()
+			select {
+			case <-done:
+			case <-time.After(time.Second * 5):
+				t.Fatal("timed out waiting for the pushes")
+			}
+
+			var paths []string
+			for _, r := range srv.requests() {
+				paths = append(paths, r.path)
+			}
+			if fmt.Sprint(paths) != fmt.Sprint(c.wantPaths) {
+				t.Errorf("requests = %v, want %v", paths, c.wantPaths)
+			}
+
+			for i := 0; i < c.push; i++ {
+				switch {
+				case c.badResp:
+					if errs[i] == nil {
+						t.Errorf("message %d: expected an error on a mismatched response", i)
+					}
+				case i%2 == 1 && c.push > 1:
+					if errs[i] == nil {
+						t.Errorf("message %d: expected an error", i)
+					}
+				default:
+					if errs[i] != nil || ids[i] != fmt.Sprintf("id-%d", i) {
+						t.Errorf("message %d: id = %q, err = %v", i, ids[i], errs[i])
+					}
+				}
+			}
+		})
+	}
+}
+
+func TestPostmarkBatchClosed(t *testing.T) {
+	srv := newTestServer(func(w http.ResponseWriter, r testReq) {
+		w.Write([]byte(`{"ErrorCode": 0, "MessageID": "1"}`))
+	})
+	defer srv.Close()
+
+	e := newTestEmailer(t, Options{
+		Provider:  ProviderPostmark,
+		RootURL:   srv.URL,
+		BatchSize: 10,
+		BatchWait: time.Second * 10,
+	})
+	e.Close()
+
+	if _, err := e.PushWithID(testMsg()); err != ErrClosed {
+		t.Errorf("err = %v, want ErrClosed", err)
+	}
+}
+
+// sortHeaders sorts the Headers of a Postmark payload by name as they're
+// added from a map.
+func sortHeaders(t *testing.T, b []byte) []byte {
+	t.Helper()
+
+	var m map[string]interface{}
+	if err := json.Unmarshal(b, &m); err != nil {
+		t.Fatalf("invalid JSON payload %s: %v", b, err)
+	}
+	if h, ok := m["Headers"].([]interface{}); ok {
+		sort.Slice(h, func(i, j int) bool {
+			return h[i].(map[string]interface{})["Name"].(string) < h[j].(map[string]interface{})["Name"].(string)
+		})
+	}
+	out, _ := json.Marshal(m)
+	return out
+}
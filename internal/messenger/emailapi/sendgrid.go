@@ -0,0 +1,161 @@
+package emailapi
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/mail"
+	"strings"
+
+	"github.com/knadh/listmonk/internal/messenger"
+)
+
+const sendgridURL = "https://api.sendgrid.com"
+
+// sendgrid sends messages over SendGrid's v3 mail send API.
+// https://docs.sendgrid.com/api-reference/mail-send/mail-send
+//
+// A request can have multiple recipients (personalizations), but they share
+// the same content, so every individually rendered message is sent in its
+// own request.
+type sendgrid struct {
+	h       *httpClient
+	url     string
+	headers map[string]string
+	hdr     http.Header
+}
+
+type sendgridMsg struct {
+	Personalizations []sendgridPersonalization `json:"personalizations"`
+	From             sendgridAddr              `json:"from"`
+	Subject          string                    `json:"subject"`
+	Content          []sendgridContent         `json:"content"`
+	Headers          map[string]string         `json:"headers,omitempty"`
+	Attachments      []sendgridAttachment      `json:"attachments,omitempty"`
+}
+
+type sendgridPersonalization struct {
+	To []sendgridAddr `json:"to"`
+}
+
+type sendgridAddr struct {
+	Email string `json:"email"`
+	Name  string `json:"name,omitempty"`
+}
+
+type sendgridContent struct {
+	Type  string `json:"type"`
+	Value string `json:"value"`
+}
+
+type sendgridAttachment struct {
+	Content     []byte `json:"content"`
+	Filename    string `json:"filename"`
+	Type        string `json:"type,omitempty"`
+	Disposition string `json:"disposition"`
+}
+
+func newSendGrid(h *httpClient, o Options) *sendgrid {
+	u := sendgridURL
+	if o.RootURL != "" {
+		u = strings.TrimRight(o.RootURL, "/")
+	}
+
+	return &sendgrid{
+		h:       h,
+		url:     u,
+		headers: o.Headers,
+		hdr: http.Header{
+			"Authorization": []string{"Bearer " + o.APIKey},
+			"Content-Type":  []string{"application/json"},
+		},
+	}
+}
+
+func (s *sendgrid) send(m messenger.Message) (string, error) {
+	msg, err := s.makeMsg(m)
+	if err != nil {
+		return "", err
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+
+	// The message ID is only returned in the response header.
+	_, hdr, err := s.h.do(http.MethodPost, s.url+"/v3/mail/send", b, s.hdr)
+	if err != nil {
+		return "", err
+	}
+	return hdr.Get("X-Message-Id"), nil
+}
+
+func (s *sendgrid) sendBatch(msgs []messenger.Message) ([]result, error) {
+	return nil, errors.New("SendGrid doesn't support batches of different messages")
+}
+
+func (s *sendgrid) maxBatch() int {
+	return 1
+}
+
+func (s *sendgrid) makeMsg(m messenger.Message) (sendgridMsg, error) {
+	from, err := parseAddr(m.From)
+	if err != nil {
+		return sendgridMsg{}, err
+	}
+
+	to := make([]sendgridAddr, 0, len(m.To))
+	for _, t := range m.To {
+		a, err := parseAddr(t)
+		if err != nil {
+			return sendgridMsg{}, err
+		}
+		to = append(to, a)
+	}
+
+	out := sendgridMsg{
+		Personalizations: []sendgridPersonalization{{To: to}},
+		From:             from,
+		Subject:          m.Subject,
+	}
+
+	// text/plain has to be the first content.
+	switch m.ContentType {
+	case "plain":
+		out.Content = []sendgridContent{{Type: "text/plain", Value: string(m.Body)}}
+	default:
+		if len(m.AltBody) > 0 {
+			out.Content = append(out.Content, sendgridContent{Type: "text/plain", Value: string(m.AltBody)})
+		}
+		out.Content = append(out.Content, sendgridContent{Type: "text/html", Value: string(m.Body)})
+	}
+
+	// Headers are a map, so only the first value of a header is sent.
+	if h := makeHeaders(m, s.headers); len(h) > 0 {
+		out.Headers = make(map[string]string, len(h))
+		for k := range h {
+			out.Headers[k] = h.Get(k)
+		}
+	}
+
+	for _, a := range m.Attachments {
+		out.Attachments = append(out.Attachments, sendgridAttachment{
+			Content:     a.Content,
+			Filename:    a.Name,
+			Type:        attachmentType(a),
+			Disposition: "attachment",
+		})
+	}
+
+	return out, nil
+}
+
+func parseAddr(s string) (sendgridAddr, error) {
+	a, err := mail.ParseAddress(s)
+	if err != nil {
+		return sendgridAddr{}, fmt.Errorf("invalid address '%s': %v", s, err)
+	}
+	return sendgridAddr{Email: a.Address, Name: a.Name}, nil
+}
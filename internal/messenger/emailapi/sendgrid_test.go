@@ -0,0 +1,127 @@
+package emailapi
+
+import (
+	"net/http"
+	"testing"
+
+	"github.com/knadh/listmonk/internal/messenger"
+)
+
+func TestSendGrid(t *testing.T) {
+	plain := testMsg()
+	plain.ContentType = "plain"
+	plain.Body = []byte("Hello plain")
+	plain.Headers = nil
+	plain.Attachments = nil
+
+	badFrom := testMsg()
+	badFrom.From = "not an address"
+
+	cases := []struct {
+		name    string
+		msg     messenger.Message
+		status  int
+		want    string
+		wantID  string
+		wantErr bool
+		noReq   bool
+	}{
+		{
+			name:   "html",
+			msg:    testMsg(),
+			status: http.StatusAccepted,
+			wantID: "sg-id-1",
+			want: `{
+				"personalizations": [{"to": [{"email": "jane@example.com", "name": "Jane Doe"}]}],
+				"from": {"email": "noreply@listmonk.app", "name": "Listmonk"},
+				"subject": "Hello",
+				"content": [
+					{"type": "text/plain", "value": "Hello"},
+					{"type": "text/html", "value": "<p>Hello</p>"}
+				],
+				"headers": {"List-Unsubscribe": "<https://listmonk.app/unsub>", "X-Conn": "1"},
+				"attachments": [{"content": "aGk=", "filename": "a.pdf", "type": "application/pdf", "disposition": "attachment"}]
+			}`,
+		},
+		{
+			name:   "plain",
+			msg:    plain,
+			status: http.StatusAccepted,
+			wantID: "sg-id-1",
+			want: `{
+				"personalizations": [{"to": [{"email": "jane@example.com", "name": "Jane Doe"}]}],
+				"from": {"email": "noreply@listmonk.app", "name": "Listmonk"},
+				"subject": "Hello",
+				"content": [{"type": "text/plain", "value": "Hello plain"}],
+				"headers": {"X-Conn": "1"}
+			}`,
+		},
+		{
+			name:    "rejected",
+			msg:     testMsg(),
+			status:  http.StatusBadRequest,
+			wantErr: true,
+		},
+		{
+			name:    "invalid from",
+			msg:     badFrom,
+			wantErr: true,
+			noReq:   true,
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := newTestServer(func(w http.ResponseWriter, r testReq) {
+				w.Header().Set("X-Message-Id", "sg-id-1")
+				w.WriteHeader(c.status)
+			})
+			defer srv.Close()
+
+			e := newTestEmailer(t, Options{
+				Provider: ProviderSendGrid,
+				RootURL:  srv.URL + "/",
+				APIKey:   "sg-key",
+				Headers:  map[string]string{"X-Conn": "1"},
+			})
+			defer e.Close()
+
+			id, err := e.PushWithID(c.msg)
+			reqs := srv.requests()
+			if c.noReq {
+				if err == nil || len(reqs) != 0 {
+					t.Fatalf("err = %v, requests = %d; want an error and no requests", err, len(reqs))
+				}
+				return
+			}
+			if len(reqs) != 1 {
+				t.Fatalf("requests = %d, want 1", len(reqs))
+			}
+
+			r := reqs[0]
+			if r.method != http.MethodPost || r.path != "/v3/mail/send" {
+				t.Errorf("request = %s %s", r.method, r.path)
+			}
+			if got := r.header.Get("Authorization"); got != "Bearer sg-key" {
+				t.Errorf("Authorization = %q", got)
+			}
+			if got := r.header.Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q", got)
+			}
+
+			if c.wantErr {
+				if e, ok := err.(*APIError); !ok || e.Status != c.status || e.Provider != ProviderSendGrid {
+					t.Errorf("err = %v, want APIError %d", err, c.status)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if id != c.wantID {
+				t.Errorf("id = %q, want %q", id, c.wantID)
+			}
+			jsonEqual(t, r.body, c.want)
+		})
+	}
+}
@@ -1,20 +1,55 @@
 package messenger
 
 import (
+	"html"
+	"mime"
 	"net/textproto"
+	"path/filepath"
+	"regexp"
+	"strings"
 
 	"github.com/knadh/listmonk/models"
 )
 
+var (
+	reBlocks   = regexp.MustCompile(`(?is)<(style|script|head)[^>]*>.*?</(style|script|head)>`)
+	reBreaks   = regexp.MustCompile(`(?i)<br\s*/?>|</(p|div|h[1-6]|li|tr)>`)
+	reTags     = regexp.MustCompile(`<[^>]*>`)
+	reSpaces   = regexp.MustCompile(`[ \t]+`)
+	reNewlines = regexp.MustCompile(`\s*\n\s*`)
+)
+
 // Messenger is an interface for a generic messaging backend,
 // for instance, e-mail, SMS etc.
 type Messenger interface {
 	Name() string
-	Push(Message, int) error
+	Push(Message) error
 	Flush() error
 	Close() error
 }
 
+// IDPusher is an optional interface implemented by messengers that return
+// the provider's unique ID of a pushed message, for instance, the SES
+// message ID or the Message-Id of an e-mail.
+type IDPusher interface {
+	PushWithID(Message) (string, error)
+}
+
+// Prober is an optional interface implemented by messengers that can check
+// whether their backends are reachable, for instance, by connecting to the
+// SMTP server. It's used to bring messengers in messenger groups back
+// into rotation after they've failed.
+type Prober interface {
+	Probe() error
+}
+
+// Metered is an optional interface implemented by messengers whose messages
+// can use more than one unit of the credit balance, for instance, SMS that
+// are split into multiple segments.
+type Metered interface {
+	Credits(Message) int
+}
+
 // Message is the message pushed to a Messenger.
 type Message struct {
 	From        string
@@ -42,14 +77,46 @@ type Attachment struct {
 
 // MakeAttachmentHeader is a helper function that returns a
 // textproto.MIMEHeader tailored for attachments, primarily
-// email. If no encoding is given, base64 is assumed.
+// email. If no encoding is given, base64 is assumed. The content type
+// is guessed from the file extension and non-ASCII filenames are
+// encoded as per RFC 2231.
 func MakeAttachmentHeader(filename, encoding string) textproto.MIMEHeader {
 	if encoding == "" {
 		encoding = "base64"
 	}
+
+	typ := mime.TypeByExtension(filepath.Ext(filename))
+	if typ == "" {
+		typ = "application/octet-stream"
+	}
+	if t, params, err := mime.ParseMediaType(typ); err == nil {
+		params["name"] = filename
+		typ = mime.FormatMediaType(t, params)
+	}
+
 	h := textproto.MIMEHeader{}
-	h.Set("Content-Disposition", "attachment; filename="+filename)
-	h.Set("Content-Type", "application/json; name=\""+filename+"\"")
+	h.Set("Content-Disposition", mime.FormatMediaType("attachment", map[string]string{"filename": filename}))
+	h.Set("Content-Type", typ)
 	h.Set("Content-Transfer-Encoding", encoding)
 	return h
 }
+
+// PlainText returns the plain text body of a message for messengers that
+// can't send HTML, for instance, SMS. The alternate plain text body of an
+// HTML message is preferred to stripping the HTML.
+func PlainText(m Message) string {
+	if m.ContentType == "plain" {
+		return strings.TrimSpace(string(m.Body))
+	}
+	if len(m.AltBody) > 0 {
+		return strings.TrimSpace(string(m.AltBody))
+	}
+
+	b := reBlocks.ReplaceAllString(string(m.Body), "")
+	b = reBreaks.ReplaceAllString(b, "\n")
+	b = reTags.ReplaceAllString(b, "")
+	b = html.UnescapeString(b)
+	b = reSpaces.ReplaceAllString(b, " ")
+	b = reNewlines.ReplaceAllString(b, "\n")
+	return strings.TrimSpace(b)
+}
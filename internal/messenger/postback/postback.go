@@ -2,11 +2,16 @@ package postback
 
 import (
 	"bytes"
+	"crypto/hmac"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net/http"
+	"net/textproto"
+	"strconv"
 	"sync"
 	"time"
 
@@ -20,8 +25,9 @@ type postback struct {
 	Subject     string      `json:"subject"`
 	ContentType string      `json:"content_type"`
 	Body        string      `json:"body"`
-	Recipients  []recipient `json:"recipients"`
-	Campaign    *campaign   `json:"campaign"`
+	Recipients  []recipient  `json:"recipients"`
+	Campaign    *campaign    `json:"campaign"`
+	Attachments []attachment `json:"attachments"`
 }
 
 type campaign struct {
@@ -36,6 +42,17 @@ type recipient struct {
 	Name    string                   `db:"name" json:"name"`
 	Attribs models.SubscriberAttribs `db:"attribs" json:"attribs"`
 	Status  string                   `db:"status" json:"status"`
+
+	// The subject and body rendered for the recipient in a batch.
+	Subject string `json:"subject,omitempty"`
+	Body    string `json:"body,omitempty"`
+}
+
+// attachment is a file attachment. The content is base64 encoded in the JSON.
+type attachment struct {
+	Name    string               `json:"name"`
+	Header  textproto.MIMEHeader `json:"header"`
+	Content []byte               `json:"content"`
 }
 
 // Options represents HTTP Postback server options.
@@ -47,6 +64,20 @@ type Options struct {
 	MaxConns int           `json:"max_conns"`
 	Retries  int           `json:"retries"`
 	Timeout  time.Duration `json:"timeout"`
+
+	// HMACSecret, if set, signs every request with the X-Listmonk-Signature
+	// header, the hex HMAC-SHA256 of "{X-Listmonk-Timestamp}.{body}".
+	HMACSecret string `json:"hmac_secret"`
+
+	// Messages of the same campaign are batched into a single payload of up
+	// to BatchSize recipients that's posted when it's full, BatchWait after
+	// its first message, or on Flush(). Every recipient in a batch has its
+	// own rendered subject and body, and the payload's are empty. Messages
+	// without a campaign aren't batched. Push() blocks until its message's
+	// batch is posted, so batches only fill up if there are at least as many
+	// concurrent pushes.
+	BatchSize int           `json:"batch_size"`
+	BatchWait time.Duration `json:"batch_wait"`
 }
 
 // Postback represents an HTTP Message server.
@@ -54,8 +85,20 @@ type Postback struct {
 	authStr string
 	o       Options
 	c       *http.Client
+
+	// Pending batches by campaign.
 	mu      sync.Mutex
-	v       int
+	batches map[string]*batch
+}
+
+// batch is a payload that's accumulating recipients. done is closed
+// once it has been posted with err, its outcome.
+type batch struct {
+	pb    postback
+	timer *time.Timer
+
+	err  error
+	done chan struct{}
 }
 
 // New returns a new instance of the HTTP Postback messenger.
@@ -66,9 +109,14 @@ func New(o Options) (*Postback, error) {
 			[]byte(o.Username+":"+o.Password)))
 	}
 
+	if o.BatchSize > 1 && o.BatchWait <= 0 {
+		o.BatchWait = time.Second
+	}
+
 	return &Postback{
 		authStr: authStr,
 		o:       o,
+		batches: make(map[string]*batch),
 		c: &http.Client{
 			Timeout: o.Timeout,
 			Transport: &http.Transport{
@@ -86,20 +134,75 @@ func (p *Postback) Name() string {
 	return p.o.Name
 }
 
-// Push pushes a message to the server.
-func (p *Postback) Push(m messenger.Message, threshold int) error {
+// Push pushes a message to the server. In the batch mode, the message is
+// added to the batch of its campaign and Push waits until the batch has
+// been posted and returns its outcome.
+func (p *Postback) Push(m messenger.Message) error {
+	if p.o.BatchSize <= 1 || m.Campaign == nil {
+		return p.send(makePayload(m, makeRecipient(m)))
+	}
+
+	key := batchKey(m)
+
+	// The subject and body are rendered for every recipient.
+	r := makeRecipient(m)
+	r.Subject, r.Body = m.Subject, string(m.Body)
+
+	p.mu.Lock()
+	b, ok := p.batches[key]
+	if !ok {
+		b = &batch{pb: makePayload(m), done: make(chan struct{})}
+		b.pb.Subject, b.pb.Body = "", ""
+		b.pb.Recipients = make([]recipient, 0, p.o.BatchSize)
+		b.timer = time.AfterFunc(p.o.BatchWait, func() {
+			p.flushBatch(key, b)
+		})
+		p.batches[key] = b
+	}
+	b.pb.Recipients = append(b.pb.Recipients, r)
+
+	if len(b.pb.Recipients) < p.o.BatchSize {
+		p.mu.Unlock()
+		<-b.done
+		return b.err
+	}
+
+	// The batch is full.
+	b.timer.Stop()
+	delete(p.batches, key)
+	p.mu.Unlock()
+
+	p.sendBatch(b)
+	return b.err
+}
+
+// flushBatch posts a batch whose wait has elapsed if it hasn't been
+// posted already.
+func (p *Postback) flushBatch(key string, b *batch) {
+	p.mu.Lock()
+	if p.batches[key] != b {
+		p.mu.Unlock()
+		return
+	}
+	delete(p.batches, key)
+	p.mu.Unlock()
+
+	p.sendBatch(b)
+}
 
+// sendBatch posts a batch and releases the pushes waiting on it.
+func (p *Postback) sendBatch(b *batch) {
+	b.err = p.send(b.pb)
+	close(b.done)
+}
+
+// makePayload returns the payload of a message with the given recipients.
+func makePayload(m messenger.Message, recipients ...recipient) postback {
 	pb := postback{
 		Subject:     m.Subject,
 		ContentType: m.ContentType,
 		Body:        string(m.Body),
-		Recipients: []recipient{{
-			UUID:    m.Subscriber.UUID,
-			Email:   m.Subscriber.Email,
-			Name:    m.Subscriber.Name,
-			Status:  m.Subscriber.Status,
-			Attribs: m.Subscriber.Attribs,
-		}},
+		Recipients:  recipients,
 	}
 
 	if m.Campaign != nil {
@@ -110,37 +213,69 @@ func (p *Postback) Push(m messenger.Message, threshold int) error {
 		}
 	}
 
-	b, err := pb.MarshalJSON()
-	if err != nil {
-		return err
+	if len(m.Attachments) > 0 {
+		pb.Attachments = make([]attachment, 0, len(m.Attachments))
+		for _, a := range m.Attachments {
+			pb.Attachments = append(pb.Attachments, attachment{
+				Name:    a.Name,
+				Header:  a.Header,
+				Content: a.Content,
+			})
+		}
 	}
 
-	p.Inc(threshold)
+	return pb
+}
 
-	return p.exec(http.MethodPost, p.o.RootURL, b, nil)
+func makeRecipient(m messenger.Message) recipient {
+	return recipient{
+		UUID:    m.Subscriber.UUID,
+		Email:   m.Subscriber.Email,
+		Name:    m.Subscriber.Name,
+		Status:  m.Subscriber.Status,
+		Attribs: m.Subscriber.Attribs,
+	}
 }
 
-func (e *Postback) Inc(threshold int) {
-	e.mu.Lock()
-	// Lock so only one goroutine at a time can access the map c.v.
-	if e.v >= threshold {
-		time.Sleep(time.Second)
-		//atomic.CompareAndSwapInt32(&numMsg, numMsg, 0)
-		e.v = 0
+// batchKey returns the key of the batch that a campaign message can be sent
+// in. The messages of a campaign share the content type and attachments.
+func batchKey(m messenger.Message) string {
+	return m.Campaign.UUID + "\x00" + m.ContentType
+}
+
+// send posts a payload to the server.
+func (p *Postback) send(pb postback) error {
+	b, err := pb.MarshalJSON()
+	if err != nil {
+		return err
 	}
-	e.v++
-	e.mu.Unlock()
+
+	return p.exec(http.MethodPost, p.o.RootURL, b, nil)
 }
 
-// Flush flushes the message queue to the server.
+// Flush posts all the pending batches to the server.
 func (p *Postback) Flush() error {
-	return nil
+	p.mu.Lock()
+	batches := p.batches
+	p.batches = make(map[string]*batch)
+	p.mu.Unlock()
+
+	var lastErr error
+	for _, b := range batches {
+		b.timer.Stop()
+		p.sendBatch(b)
+		if b.err != nil {
+			lastErr = b.err
+		}
+	}
+	return lastErr
 }
 
-// Close closes idle HTTP connections.
+// Close posts the pending batches and closes idle HTTP connections.
 func (p *Postback) Close() error {
+	err := p.Flush()
 	p.c.CloseIdleConnections()
-	return nil
+	return err
 }
 
 func (p *Postback) exec(method, rURL string, reqBody []byte, headers http.Header) error {
@@ -171,6 +306,18 @@ func (p *Postback) exec(method, rURL string, reqBody []byte, headers http.Header
 		req.Header.Set("Authorization", p.authStr)
 	}
 
+	// Optional signature of the timestamp and the body that lets the server
+	// verify the request and reject replays.
+	if p.o.HMACSecret != "" {
+		ts := strconv.FormatInt(time.Now().Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(p.o.HMACSecret))
+		mac.Write([]byte(ts + "."))
+		mac.Write(reqBody)
+
+		req.Header.Set("X-Listmonk-Timestamp", ts)
+		req.Header.Set("X-Listmonk-Signature", hex.EncodeToString(mac.Sum(nil)))
+	}
+
 	// If a content-type isn't set, set the default one.
 	if req.Header.Get("Content-Type") == "" {
 		if method == http.MethodPost || method == http.MethodPut {
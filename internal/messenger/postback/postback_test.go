@@ -0,0 +1,363 @@
+package postback
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+	"github.com/knadh/listmonk/models"
+)
+
+// testServer is a Postback server that records the payloads it receives.
+type testServer struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	payloads []postback
+	headers  []http.Header
+	bodies   [][]byte
+}
+
+func newTestServer(status int) *testServer {
+	s := &testServer{}
+	s.Server = httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		b, _ := ioutil.ReadAll(r.Body)
+
+		var pb postback
+		if err := pb.UnmarshalJSON(b); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+
+		s.mu.Lock()
+		s.payloads = append(s.payloads, pb)
+		s.headers = append(s.headers, r.Header)
+		s.bodies = append(s.bodies, b)
+		s.mu.Unlock()
+
+		w.WriteHeader(status)
+	}))
+	return s
+}
+
+func (s *testServer) received() []postback {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return append([]postback(nil), s.payloads...)
+}
+
+func testMsg(camp string, n int) messenger.Message {
+	m := messenger.Message{
+		Subject:     fmt.Sprintf("Hi %d", n),
+		ContentType: "html",
+		Body:        []byte(fmt.Sprintf("<p>Hello %d</p>", n)),
+		Subscriber: models.Subscriber{
+			UUID:  fmt.Sprintf("sub-%d", n),
+			Email: fmt.Sprintf("sub%d@listmonk.app", n),
+			Name:  fmt.Sprintf("Sub %d", n),
+		},
+	}
+	if camp != "" {
+		m.Campaign = &models.Campaign{UUID: camp, Name: "Campaign " + camp}
+	}
+	return m
+}
+
+// pushAll pushes the messages concurrently and returns their errors once
+// all of them have returned.
+func pushAll(t *testing.T, p *Postback, msgs []messenger.Message, after func()) []error {
+	t.Helper()
+
+	var (
+		wg   sync.WaitGroup
+		errs = make([]error, len(msgs))
+		done = make(chan struct{})
+	)
+	for i, m := range msgs {
+		wg.Add(1)
+		go func(i int, m messenger.Message) {
+			defer wg.Done()
+			errs[i] = p.Push(m)
+		}(i, m)
+	}
+	go func() {
+		wg.Wait()
+		close(done)
+	}()
+
+	if after != nil {
+		after()
+	}
+
+	select {
+	case <-done:
+	case <-time.After(time.Second * 5):
+		t.Fatal("timed out waiting for the pushes")
+	}
+	return errs
+}
+
+func TestSignature(t *testing.T) {
+	cases := []struct {
+		name   string
+		secret string
+		user   string
+	}{
+		{name: "unsigned"},
+		{name: "signed", secret: "s3cret"},
+		{name: "signed with auth", secret: "s3cret", user: "listmonk"},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			srv := newTestServer(http.StatusOK)
+			defer srv.Close()
+
+			p, _ := New(Options{
+				RootURL:    srv.URL,
+				HMACSecret: c.secret,
+				Username:   c.user,
+				Password:   "pass",
+				Timeout:    time.Second,
+			})
+			defer p.Close()
+
+			if err := p.Push(testMsg("c1", 1)); err != nil {
+				t.Fatal(err)
+			}
+
+			var (
+				h  = srv.headers[0]
+				ts = h.Get("X-Listmonk-Timestamp")
+				sg = h.Get("X-Listmonk-Signature")
+			)
+			if got := h.Get("Content-Type"); got != "application/json" {
+				t.Errorf("Content-Type = %q", got)
+			}
+			req := &http.Request{Header: h}
+			if u, pw, ok := req.BasicAuth(); (c.user != "") != ok || u != c.user || (ok && pw != "pass") {
+				t.Errorf("basic auth = %q %q %v", u, pw, ok)
+			}
+
+			if c.secret == "" {
+				if ts != "" || sg != "" {
+					t.Errorf("unexpected signature headers %q %q", ts, sg)
+				}
+				return
+			}
+
+			n, err := strconv.ParseInt(ts, 10, 64)
+			if err != nil || time.Since(time.Unix(n, 0)) > time.Minute {
+				t.Errorf("invalid timestamp %q", ts)
+			}
+
+			mac := hmac.New(sha256.New, []byte(c.secret))
+			mac.Write([]byte(ts + "."))
+			mac.Write(srv.bodies[0])
+			if want := hex.EncodeToString(mac.Sum(nil)); sg != want {
+				t.Errorf("signature = %s, want %s", sg, want)
+			}
+		})
+	}
+}
+
+func TestPushSingle(t *testing.T) {
+	srv := newTestServer(http.StatusOK)
+	defer srv.Close()
+
+	p, _ := New(Options{RootURL: srv.URL, Timeout: time.Second})
+	defer p.Close()
+
+	if err := p.Push(testMsg("c1", 1)); err != nil {
+		t.Fatal(err)
+	}
+
+	got := srv.received()
+	if len(got) != 1 || len(got[0].Recipients) != 1 {
+		t.Fatalf("payloads = %+v", got)
+	}
+	pb := got[0]
+	if pb.Subject != "Hi 1" || pb.Body != "<p>Hello 1</p>" || pb.Campaign == nil || pb.Campaign.UUID != "c1" {
+		t.Errorf("payload = %+v", pb)
+	}
+	if r := pb.Recipients[0]; r.UUID != "sub-1" || r.Subject != "" || r.Body != "" {
+		t.Errorf("recipient = %+v", r)
+	}
+}
+
+func TestPushBatch(t *testing.T) {
+	var msgs []messenger.Message
+	for i := 0; i < 4; i++ {
+		msgs = append(msgs, testMsg("c1", i))
+	}
+	mixed := []messenger.Message{testMsg("c1", 0), testMsg("c2", 1), testMsg("c1", 2), testMsg("c2", 3)}
+
+	cases := []struct {
+		name      string
+		size      int
+		wait      time.Duration
+		msgs      []messenger.Message
+		flush     bool
+		status    int
+		wantSizes []int
+		minWait   time.Duration
+	}{
+		{
+			// Messages with different bodies and subjects share a batch.
+			name:      "full batch",
+			size:      4,
+			wait:      time.Second * 10,
+			msgs:      msgs,
+			wantSizes: []int{4},
+		},
+		{
+			name:      "full batches",
+			size:      2,
+			wait:      time.Second * 10,
+			msgs:      msgs,
+			wantSizes: []int{2, 2},
+		},
+		{
+			name:      "batches by campaign",
+			size:      2,
+			wait:      time.Second * 10,
+			msgs:      mixed,
+			wantSizes: []int{2, 2},
+		},
+		{
+			// Messages without a campaign are posted right away.
+			name:      "no campaign",
+			size:      5,
+			wait:      time.Second * 10,
+			msgs:      []messenger.Message{testMsg("", 1)},
+			wantSizes: []int{1},
+		},
+		{
+			name:      "timeout",
+			size:      10,
+			wait:      time.Millisecond * 100,
+			msgs:      msgs[:3],
+			wantSizes: []int{3},
+			minWait:   time.Millisecond * 100,
+		},
+		{
+			name:      "flush",
+			size:      10,
+			wait:      time.Second * 10,
+			msgs:      msgs[:3],
+			flush:     true,
+			wantSizes: []int{3},
+		},
+		{
+			name:      "error",
+			size:      2,
+			wait:      time.Second * 10,
+			msgs:      msgs[:2],
+			status:    http.StatusInternalServerError,
+			wantSizes: []int{2},
+		},
+	}
+
+	for _, c := range cases {
+		t.Run(c.name, func(t *testing.T) {
+			status := c.status
+			if status == 0 {
+				status = http.StatusOK
+			}
+			srv := newTestServer(status)
+			defer srv.Close()
+
+			p, _ := New(Options{RootURL: srv.URL, Timeout: time.Second, BatchSize: c.size, BatchWait: c.wait})
+			defer p.Close()
+
+			var after func()
+			if c.flush {
+				after = func() {
+					// Wait for the messages to be added to the batch.
+					time.Sleep(time.Millisecond * 100)
+					if err := p.Flush(); err != nil {
+						t.Error(err)
+					}
+				}
+			}
+
+			start := time.Now()
+			errs := pushAll(t, p, c.msgs, after)
+			if c.minWait > 0 && time.Since(start) < c.minWait {
+				t.Errorf("batch posted after %v, before the wait of %v", time.Since(start), c.minWait)
+			}
+
+			for i, err := range errs {
+				if (err != nil) != (status != http.StatusOK) {
+					t.Errorf("message %d: err = %v", i, err)
+				}
+			}
+
+			var (
+				got   = srv.received()
+				sizes []int
+				seen  = map[string]bool{}
+			)
+			for _, pb := range got {
+				sizes = append(sizes, len(pb.Recipients))
+
+				// Batches have the content of every recipient.
+				batched := pb.Campaign != nil
+				if batched && (pb.Subject != "" || pb.Body != "") {
+					t.Errorf("batch payload has a subject or body: %+v", pb)
+				}
+				for _, r := range pb.Recipients {
+					seen[r.UUID] = true
+
+					var n int
+					fmt.Sscanf(r.UUID, "sub-%d", &n)
+					if batched && (r.Subject != fmt.Sprintf("Hi %d", n) || r.Body != fmt.Sprintf("<p>Hello %d</p>", n)) {
+						t.Errorf("recipient %s has subject %q, body %q", r.UUID, r.Subject, r.Body)
+					}
+					for _, m := range c.msgs {
+						if batched && m.Subscriber.UUID == r.UUID && m.Campaign.UUID != pb.Campaign.UUID {
+							t.Errorf("recipient %s in the batch of campaign %s", r.UUID, pb.Campaign.UUID)
+						}
+					}
+				}
+			}
+			if fmt.Sprint(sizes) != fmt.Sprint(c.wantSizes) {
+				t.Errorf("batch sizes = %v, want %v", sizes, c.wantSizes)
+			}
+			if len(seen) != len(c.msgs) {
+				t.Errorf("%d recipients posted, want %d", len(seen), len(c.msgs))
+			}
+		})
+	}
+}
+
+func TestClosePostsPending(t *testing.T) {
+	srv := newTestServer(http.StatusOK)
+	defer srv.Close()
+
+	p, _ := New(Options{RootURL: srv.URL, Timeout: time.Second, BatchSize: 10, BatchWait: time.Second * 10})
+
+	errs := pushAll(t, p, []messenger.Message{testMsg("c1", 1), testMsg("c1", 2)}, func() {
+		time.Sleep(time.Millisecond * 100)
+		if err := p.Close(); err != nil {
+			t.Error(err)
+		}
+	})
+	for _, err := range errs {
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if got := srv.received(); len(got) != 1 || len(got[0].Recipients) != 2 {
+		t.Errorf("payloads = %+v", got)
+	}
+}
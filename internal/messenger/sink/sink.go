@@ -0,0 +1,85 @@
+// Package sink is a messenger that records the messages pushed to it
+// instead of delivering them. It's used for campaign dry runs.
+package sink
+
+import (
+	"sync"
+
+	"github.com/knadh/listmonk/internal/messenger"
+)
+
+// ClipSize is the size of a message body above which Gmail clips it
+// and shows a "View entire message" link instead.
+const ClipSize = 102 * 1024
+
+// Stats represents the sizes (bytes) of the message bodies pushed to a Sink.
+type Stats struct {
+	Num      int `json:"num"`
+	AvgSize  int `json:"avg_size"`
+	MaxSize  int `json:"max_size"`
+	OverClip int `json:"over_clip"`
+}
+
+// Sink is a messenger that records the sizes of the messages pushed to it.
+type Sink struct {
+	name string
+
+	num      int
+	total    int64
+	max      int
+	overClip int
+	mu       sync.Mutex
+}
+
+// New returns a new Sink messenger.
+func New(name string) *Sink {
+	return &Sink{name: name}
+}
+
+// Name returns the messenger's name.
+func (s *Sink) Name() string {
+	return s.name
+}
+
+// Push records a message.
+func (s *Sink) Push(m messenger.Message) error {
+	size := len(m.Body)
+
+	s.mu.Lock()
+	s.num++
+	s.total += int64(size)
+	if size > s.max {
+		s.max = size
+	}
+	if size > ClipSize {
+		s.overClip++
+	}
+	s.mu.Unlock()
+	return nil
+}
+
+// Stats returns the stats of the messages recorded so far.
+func (s *Sink) Stats() Stats {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	out := Stats{
+		Num:      s.num,
+		MaxSize:  s.max,
+		OverClip: s.overClip,
+	}
+	if s.num > 0 {
+		out.AvgSize = int(s.total / int64(s.num))
+	}
+	return out
+}
+
+// Flush is a no-op.
+func (s *Sink) Flush() error {
+	return nil
+}
+
+// Close is a no-op.
+func (s *Sink) Close() error {
+	return nil
+}
@@ -0,0 +1,97 @@
+package sms
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"net/http"
+
+	"github.com/knadh/listmonk/internal/messenger"
+)
+
+// httpProvider posts messages as JSON to a generic HTTP endpoint. If the
+// response is a JSON object with an "id", it's recorded as the message ID.
+type httpProvider struct {
+	h    *httpClient
+	url  string
+	from string
+	hdr  http.Header
+}
+
+type httpMsg struct {
+	To         string         `json:"to"`
+	From       string         `json:"from"`
+	Body       string         `json:"body"`
+	Subscriber httpSubscriber `json:"subscriber"`
+	Campaign   *httpCampaign  `json:"campaign"`
+}
+
+type httpSubscriber struct {
+	UUID  string `json:"uuid"`
+	Email string `json:"email"`
+	Name  string `json:"name"`
+}
+
+type httpCampaign struct {
+	UUID string `json:"uuid"`
+	Name string `json:"name"`
+}
+
+type httpResp struct {
+	ID json.RawMessage `json:"id"`
+}
+
+func newHTTPProvider(h *httpClient, o Options) *httpProvider {
+	hdr := http.Header{
+		"Accept":       []string{"application/json"},
+		"Content-Type": []string{"application/json"},
+	}
+	if o.Username != "" {
+		hdr.Set("Authorization", "Basic "+base64.StdEncoding.EncodeToString([]byte(o.Username+":"+o.Password)))
+	} else if o.Password != "" {
+		hdr.Set("Authorization", "Bearer "+o.Password)
+	}
+
+	return &httpProvider{
+		h:    h,
+		url:  o.RootURL,
+		from: o.From,
+		hdr:  hdr,
+	}
+}
+
+func (p *httpProvider) send(to, body string, m messenger.Message) (string, error) {
+	msg := httpMsg{
+		To:   to,
+		From: p.from,
+		Body: body,
+		Subscriber: httpSubscriber{
+			UUID:  m.Subscriber.UUID,
+			Email: m.Subscriber.Email,
+			Name:  m.Subscriber.Name,
+		},
+	}
+	if m.Campaign != nil {
+		msg.Campaign = &httpCampaign{UUID: m.Campaign.UUID, Name: m.Campaign.Name}
+	}
+
+	b, err := json.Marshal(msg)
+	if err != nil {
+		return "", err
+	}
+
+	resp, err := p.h.do(http.MethodPost, p.url, b, p.hdr)
+	if err != nil {
+		return "", err
+	}
+
+	// The ID is optional and can be a string or a number.
+	var r httpResp
+	if err := json.Unmarshal(resp, &r); err != nil || len(r.ID) == 0 || string(r.ID) == "null" {
+		return "", nil
+	}
+	var id string
+	if err := json.Unmarshal(r.ID, &id); err == nil {
+		return id, nil
+	}
+	return string(r.ID), nil
+}
@@ -0,0 +1,53 @@
+package sms
+
+import "unicode/utf16"
+
+// Characters of the GSM 03.38 basic character set (7 bits each) and its
+// extension table (escaped, 14 bits each).
+const (
+	gsmBasic = "@£$¥èéùìòÇ\nØø\rÅåΔ_ΦΓΛΩΠΨΣΘΞÆæßÉ !\"#¤%&'()*+,-./0123456789:;<=>?" +
+		"¡ABCDEFGHIJKLMNOPQRSTUVWXYZÄÖÑÜ§¿abcdefghijklmnopqrstuvwxyzäöñüà"
+	gsmExt = "\f^{}\\[~]|€"
+)
+
+// Max characters in a single SMS and in each part of a concatenated SMS,
+// which carries a header.
+const (
+	gsmSingle  = 160
+	gsmPart    = 153
+	ucs2Single = 70
+	ucs2Part   = 67
+)
+
+var gsmChars = func() map[rune]int {
+	m := make(map[rune]int, len(gsmBasic)+len(gsmExt))
+	for _, r := range gsmBasic {
+		m[r] = 1
+	}
+	for _, r := range gsmExt {
+		m[r] = 2
+	}
+	return m
+}()
+
+// segments returns the number of segments that a message is split into
+// and whether it has to be sent as UCS-2 as it has characters outside
+// the GSM-7 character set.
+func segments(s string) (int, bool) {
+	septets := 0
+	for _, r := range s {
+		n, ok := gsmChars[r]
+		if !ok {
+			return count(len(utf16.Encode([]rune(s))), ucs2Single, ucs2Part), true
+		}
+		septets += n
+	}
+	return count(septets, gsmSingle, gsmPart), false
+}
+
+func count(n, single, part int) int {
+	if n <= single {
+		return 1
+	}
+	return (n + part - 1) / part
+}
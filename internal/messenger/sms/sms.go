@@ -0,0 +1,293 @@
+// Package sms implements a messenger that sends campaigns as SMS over
+// Twilio compatible or generic HTTP APIs.
+package sms
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/knadh/listmonk/internal/messenger"
+)
+
+// Providers.
+const (
+	ProviderTwilio = "Twilio"
+	ProviderHTTP   = "HTTP"
+)
+
+// DefaultPhoneAttrib is the subscriber attribute that phone numbers
+// are read from if none is configured.
+const DefaultPhoneAttrib = "phone"
+
+// Max size of a response body that's read.
+const maxRespSize = 1 << 20
+
+var (
+	rePhone    = regexp.MustCompile(`^\+[1-9][0-9]{6,14}$`)
+	rePhoneSep = regexp.MustCompile(`[\s\-().]`)
+)
+
+// Options represents the config of an SMS provider's connection.
+type Options struct {
+	Provider string `json:"provider"`
+
+	// RootURL is the API's root URL on Twilio (defaults to Twilio's) and
+	// the URL that messages are posted to on the generic HTTP provider.
+	RootURL string `json:"root_url"`
+
+	// Username and Password are the account SID and auth token on Twilio.
+	// On the generic HTTP provider, they're sent as BasicAuth, or the
+	// password alone as a Bearer token.
+	Username string `json:"username"`
+	Password string `json:"password"`
+
+	// From is the sender's number or ID. On Twilio, it can also be
+	// a messaging service SID (MG...).
+	From string `json:"from"`
+
+	// PhoneAttrib is the subscriber attribute that has the phone number
+	// in the E.164 format, eg: +14155550100.
+	PhoneAttrib string `json:"phone_attribute"`
+
+	// MaxSegments is the max number of segments a message can be split
+	// into. Longer messages aren't sent. 0 is unlimited.
+	MaxSegments int `json:"max_segments"`
+
+	MaxConns int           `json:"max_conns"`
+	Retries  int           `json:"retries"`
+	Timeout  time.Duration `json:"timeout"`
+}
+
+// APIError is a non-OK response from a provider's API.
+type APIError struct {
+	Provider string
+	Status   int
+	Body     string
+}
+
+func (e *APIError) Error() string {
+	return fmt.Sprintf("non-OK response from %s: %d: %s", e.Provider, e.Status, e.Body)
+}
+
+// provider sends an SMS and returns the provider's message ID.
+type provider interface {
+	send(to, body string, m messenger.Message) (string, error)
+}
+
+// SMS is a messenger that sends messages as SMS.
+type SMS struct {
+	name string
+	o    Options
+	p    provider
+	h    *httpClient
+	lo   *log.Logger
+
+	// Campaigns whose messages have been warned about being split
+	// into multiple segments.
+	warned sync.Map
+}
+
+// New returns a new instance of the SMS messenger.
+func New(lo *log.Logger, name string, o Options) (*SMS, error) {
+	if o.PhoneAttrib == "" {
+		o.PhoneAttrib = DefaultPhoneAttrib
+	}
+	if o.Timeout == 0 {
+		o.Timeout = time.Second * 10
+	}
+	if o.MaxConns < 1 {
+		o.MaxConns = 1
+	}
+
+	s := &SMS{
+		name: name,
+		o:    o,
+		h:    newHTTPClient(o),
+		lo:   lo,
+	}
+
+	switch o.Provider {
+	case ProviderTwilio:
+		if o.Username == "" || o.Password == "" {
+			return nil, errors.New("Twilio account SID and auth token are required")
+		}
+		if o.From == "" {
+			return nil, errors.New("Twilio sender number is required")
+		}
+		s.p = newTwilio(s.h, o)
+	case ProviderHTTP:
+		if o.RootURL == "" {
+			return nil, errors.New("SMS HTTP provider URL is required")
+		}
+		s.p = newHTTPProvider(s.h, o)
+	default:
+		return nil, fmt.Errorf("unknown SMS provider '%s'", o.Provider)
+	}
+
+	return s, nil
+}
+
+// Name returns the messenger's name.
+func (s *SMS) Name() string {
+	return s.name
+}
+
+// Push sends a message as an SMS.
+func (s *SMS) Push(m messenger.Message) error {
+	_, err := s.PushWithID(m)
+	return err
+}
+
+// PushWithID sends a message as an SMS to the subscriber's phone number
+// and returns the provider's message ID.
+func (s *SMS) PushWithID(m messenger.Message) (string, error) {
+	to, err := s.phone(m.Subscriber.Attribs)
+	if err != nil {
+		return "", err
+	}
+
+	body := messenger.PlainText(m)
+	if body == "" {
+		return "", errors.New("SMS body is empty")
+	}
+
+	n, unicode := segments(body)
+	if s.o.MaxSegments > 0 && n > s.o.MaxSegments {
+		return "", fmt.Errorf("SMS is %d segments long, more than the max of %d", n, s.o.MaxSegments)
+	}
+	if n > 1 && m.Campaign != nil {
+		if _, ok := s.warned.LoadOrStore(m.Campaign.UUID, true); !ok {
+			enc := "GSM-7"
+			if unicode {
+				enc = "UCS-2"
+			}
+			s.lo.Printf("warning: SMS of campaign '%s' is split into %d segments (%d characters, %s). Each segment is billed separately.",
+				m.Campaign.Name, n, len([]rune(body)), enc)
+		}
+	}
+
+	return s.p.send(to, body, m)
+}
+
+// Credits returns the number of segments that a message is split into.
+func (s *SMS) Credits(m messenger.Message) int {
+	n, _ := segments(messenger.PlainText(m))
+	return n
+}
+
+// Flush flushes the message queue to the server.
+func (s *SMS) Flush() error {
+	return nil
+}
+
+// Close closes idle HTTP connections.
+func (s *SMS) Close() error {
+	s.h.c.CloseIdleConnections()
+	return nil
+}
+
+// phone returns the E.164 phone number from the subscriber's attributes.
+func (s *SMS) phone(attribs map[string]interface{}) (string, error) {
+	v, ok := attribs[s.o.PhoneAttrib]
+	if !ok {
+		return "", fmt.Errorf("subscriber has no phone number in the '%s' attribute", s.o.PhoneAttrib)
+	}
+
+	var p string
+	switch n := v.(type) {
+	case string:
+		p = n
+	case float64:
+		p = fmt.Sprintf("+%.0f", n)
+	default:
+		return "", fmt.Errorf("invalid phone number in the '%s' attribute", s.o.PhoneAttrib)
+	}
+
+	p = rePhoneSep.ReplaceAllString(p, "")
+	if strings.HasPrefix(p, "00") {
+		p = "+" + p[2:]
+	}
+	if !rePhone.MatchString(p) {
+		return "", fmt.Errorf("invalid phone number '%s' in the '%s' attribute", p, s.o.PhoneAttrib)
+	}
+	return p, nil
+}
+
+// httpClient is a pooled HTTP client for a provider's API.
+type httpClient struct {
+	provider string
+	retries  int
+	c        *http.Client
+}
+
+func newHTTPClient(o Options) *httpClient {
+	return &httpClient{
+		provider: o.Provider,
+		retries:  o.Retries,
+		c: &http.Client{
+			Timeout: o.Timeout,
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				MaxIdleConnsPerHost:   o.MaxConns,
+				MaxConnsPerHost:       o.MaxConns,
+				ResponseHeaderTimeout: o.Timeout,
+				IdleConnTimeout:       time.Second * 90,
+			},
+		},
+	}
+}
+
+// do makes an HTTP request and returns the response body. Network errors,
+// 429s and 5xx responses are retried with a backoff.
+func (h *httpClient) do(method, url string, body []byte, hdr http.Header) ([]byte, error) {
+	var lastErr error
+	for i := 0; i <= h.retries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * time.Millisecond * 500)
+		}
+
+		req, err := http.NewRequest(method, url, bytes.NewReader(body))
+		if err != nil {
+			return nil, err
+		}
+		for k, v := range hdr {
+			req.Header[k] = v
+		}
+		req.Header.Set("User-Agent", "listmonk")
+
+		r, err := h.c.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		b, err := ioutil.ReadAll(io.LimitReader(r.Body, maxRespSize))
+
+		// Drain and close the body to let the Transport reuse the connection.
+		io.Copy(ioutil.Discard, r.Body)
+		r.Body.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if r.StatusCode >= 200 && r.StatusCode < 300 {
+			return b, nil
+		}
+
+		lastErr = &APIError{Provider: h.provider, Status: r.StatusCode, Body: strings.TrimSpace(string(b))}
+		if r.StatusCode != http.StatusTooManyRequests && r.StatusCode < 500 {
+			break
+		}
+	}
+	return nil, lastErr
+}
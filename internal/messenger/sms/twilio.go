@@ -0,0 +1,69 @@
+package sms
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/knadh/listmonk/internal/messenger"
+)
+
+const twilioURL = "https://api.twilio.com"
+
+// twilio sends messages over Twilio's (or a compatible provider's)
+// messages API.
+// https://www.twilio.com/docs/sms/api/message-resource#create-a-message-resource
+type twilio struct {
+	h    *httpClient
+	url  string
+	from string
+	hdr  http.Header
+}
+
+type twilioResp struct {
+	SID string `json:"sid"`
+}
+
+func newTwilio(h *httpClient, o Options) *twilio {
+	u := twilioURL
+	if o.RootURL != "" {
+		u = strings.TrimRight(o.RootURL, "/")
+	}
+
+	return &twilio{
+		h:    h,
+		url:  fmt.Sprintf("%s/2010-04-01/Accounts/%s/Messages.json", u, url.PathEscape(o.Username)),
+		from: o.From,
+		hdr: http.Header{
+			"Authorization": []string{"Basic " + base64.StdEncoding.EncodeToString([]byte(o.Username+":"+o.Password))},
+			"Content-Type":  []string{"application/x-www-form-urlencoded"},
+		},
+	}
+}
+
+func (t *twilio) send(to, body string, m messenger.Message) (string, error) {
+	p := url.Values{}
+	p.Set("To", to)
+	p.Set("Body", body)
+
+	// Messaging service SIDs start with MG.
+	if strings.HasPrefix(t.from, "MG") {
+		p.Set("MessagingServiceSid", t.from)
+	} else {
+		p.Set("From", t.from)
+	}
+
+	b, err := t.h.do(http.MethodPost, t.url, []byte(p.Encode()), t.hdr)
+	if err != nil {
+		return "", err
+	}
+
+	var r twilioResp
+	if err := json.Unmarshal(b, &r); err != nil {
+		return "", fmt.Errorf("error parsing Twilio response: %v", err)
+	}
+	return r.SID, nil
+}
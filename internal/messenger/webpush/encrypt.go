@@ -0,0 +1,117 @@
+package webpush
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/elliptic"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"errors"
+)
+
+// Push services accept up to 4096 bytes in a message. The encrypted message
+// is the header (salt, record size, key ID length and the 65 byte key ID),
+// a single record with the payload and its delimiter, and the AES-GCM tag.
+const (
+	maxMessageSize = 4096
+	headerSize     = 16 + 4 + 1 + 65
+	maxPayloadSize = maxMessageSize - headerSize - 1 - 16
+)
+
+var (
+	infoKey   = []byte("WebPush: info\x00")
+	infoCEK   = []byte("Content-Encoding: aes128gcm\x00")
+	infoNonce = []byte("Content-Encoding: nonce\x00")
+)
+
+// encrypt encrypts a payload for a subscription as per RFC 8291
+// (Message Encryption for Web Push) with the aes128gcm content encoding
+// (RFC 8188).
+func encrypt(payload []byte, sub Subscription) ([]byte, error) {
+	if len(payload) > maxPayloadSize {
+		return nil, errors.New("push message payload is too large")
+	}
+
+	uaPub, err := decodeB64(sub.P256dh)
+	if err != nil {
+		return nil, errors.New("invalid p256dh key in push subscription")
+	}
+	authSecret, err := decodeB64(sub.Auth)
+	if err != nil || len(authSecret) == 0 {
+		return nil, errors.New("invalid auth secret in push subscription")
+	}
+
+	c := elliptic.P256()
+	ux, uy := elliptic.Unmarshal(c, uaPub)
+	if ux == nil {
+		return nil, errors.New("invalid p256dh key in push subscription")
+	}
+
+	// Ephemeral application server key pair and the shared ECDH secret.
+	asPriv, ax, ay, err := elliptic.GenerateKey(c, rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	asPub := elliptic.Marshal(c, ax, ay)
+
+	sx, _ := c.ScalarMult(ux, uy, asPriv)
+	secret := make([]byte, 32)
+	sb := sx.Bytes()
+	copy(secret[32-len(sb):], sb)
+
+	salt := make([]byte, 16)
+	if _, err := rand.Read(salt); err != nil {
+		return nil, err
+	}
+
+	// Derive the content encryption key and the nonce.
+	info := make([]byte, 0, len(infoKey)+len(uaPub)+len(asPub))
+	info = append(append(append(info, infoKey...), uaPub...), asPub...)
+	var (
+		ikm   = hkdf(authSecret, secret, info, 32)
+		prk   = hmacSHA256(salt, ikm)
+		cek   = hkdfExpand(prk, infoCEK, 16)
+		nonce = hkdfExpand(prk, infoNonce, 12)
+	)
+
+	block, err := aes.NewCipher(cek)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+
+	// A single record with the last record delimiter (0x02) and no padding.
+	plain := make([]byte, 0, len(payload)+1)
+	plain = append(append(plain, payload...), 2)
+
+	out := make([]byte, headerSize, headerSize+len(plain)+gcm.Overhead())
+	copy(out, salt)
+	binary.BigEndian.PutUint32(out[16:], maxMessageSize)
+	out[20] = byte(len(asPub))
+	copy(out[21:], asPub)
+
+	return gcm.Seal(out, nonce, plain, nil), nil
+}
+
+// hkdf derives a key of up to 32 bytes with HKDF-SHA256 (RFC 5869).
+func hkdf(salt, ikm, info []byte, n int) []byte {
+	return hkdfExpand(hmacSHA256(salt, ikm), info, n)
+}
+
+// hkdfExpand is the single block HKDF-Expand step.
+func hkdfExpand(prk, info []byte, n int) []byte {
+	b := make([]byte, 0, len(info)+1)
+	b = append(append(b, info...), 1)
+	return hmacSHA256(prk, b)[:n]
+}
+
+func hmacSHA256(key, data []byte) []byte {
+	h := hmac.New(sha256.New, key)
+	h.Write(data)
+	return h.Sum(nil)
+}
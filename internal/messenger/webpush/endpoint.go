@@ -0,0 +1,115 @@
+package webpush
+
+import (
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// Max length of a subscription's endpoint URL.
+const maxEndpointLen = 1024
+
+// pushHosts are the hosts of the push services of the major browsers.
+// Subdomains of the hosts are allowed too.
+var pushHosts = []string{
+	"fcm.googleapis.com",        // Chrome and other Chromium based browsers.
+	"android.googleapis.com",    // Older Chrome versions.
+	"push.services.mozilla.com", // Firefox.
+	"notify.windows.com",        // Edge (legacy).
+	"push.apple.com",            // Safari.
+}
+
+// privateNets are the networks that push services are never on.
+var privateNets = mustParseCIDRs(
+	"0.0.0.0/8",
+	"10.0.0.0/8",
+	"100.64.0.0/10",
+	"127.0.0.0/8",
+	"169.254.0.0/16",
+	"172.16.0.0/12",
+	"192.0.0.0/24",
+	"192.168.0.0/16",
+	"198.18.0.0/15",
+	"::1/128",
+	"fc00::/7",
+	"fe80::/10",
+)
+
+// ValidEndpoint checks whether the endpoint of a push subscription is an
+// HTTPS URL on the push service of a known browser. Subscriptions are
+// recorded from the public, and anything else would have the server post
+// requests to arbitrary URLs.
+func ValidEndpoint(endpoint string) bool {
+	if len(endpoint) > maxEndpointLen {
+		return false
+	}
+
+	u, err := url.Parse(endpoint)
+	if err != nil || u.Scheme != "https" || u.User != nil {
+		return false
+	}
+	if p := u.Port(); p != "" && p != "443" {
+		return false
+	}
+
+	host := strings.ToLower(u.Hostname())
+	for _, h := range pushHosts {
+		if host == h || strings.HasSuffix(host, "."+h) {
+			return true
+		}
+	}
+	return false
+}
+
+// newDialer returns a dialer that refuses to connect to private addresses.
+// If a proxy is configured in the environment, connections are made to it
+// instead and aren't checked.
+func newDialer(timeout time.Duration) *net.Dialer {
+	d := &net.Dialer{
+		Timeout:   timeout,
+		KeepAlive: time.Second * 30,
+	}
+
+	req, _ := http.NewRequest(http.MethodPost, "https://"+pushHosts[0], nil)
+	if u, err := http.ProxyFromEnvironment(req); err == nil && u == nil {
+		d.Control = dialControl
+	}
+	return d
+}
+
+// dialControl refuses connections to private and loopback addresses so that
+// a push service's host can't be resolved to an internal service.
+func dialControl(network, address string, _ syscall.RawConn) error {
+	host, _, err := net.SplitHostPort(address)
+	if err != nil {
+		return err
+	}
+
+	ip := net.ParseIP(host)
+	if ip == nil || ip.IsLoopback() || ip.IsUnspecified() || ip.IsMulticast() ||
+		ip.IsLinkLocalUnicast() {
+		return fmt.Errorf("refusing to connect to push service on %s", host)
+	}
+	for _, n := range privateNets {
+		if n.Contains(ip) {
+			return fmt.Errorf("refusing to connect to push service on private address %s", host)
+		}
+	}
+	return nil
+}
+
+func mustParseCIDRs(cidrs ...string) []*net.IPNet {
+	out := make([]*net.IPNet, 0, len(cidrs))
+	for _, c := range cidrs {
+		_, n, err := net.ParseCIDR(c)
+		if err != nil {
+			panic(err)
+		}
+		out = append(out, n)
+	}
+	return out
+}
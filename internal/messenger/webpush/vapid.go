@@ -0,0 +1,145 @@
+package webpush
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"math/big"
+	"net/url"
+	"sync"
+	"time"
+)
+
+// VAPID tokens are valid for 12 hours (the max is 24) and are renewed an
+// hour before they expire.
+const (
+	vapidTTL   = time.Hour * 12
+	vapidRenew = time.Hour
+)
+
+// vapid signs the VAPID (RFC 8292) tokens that identify the application
+// server to push services.
+type vapid struct {
+	key     *ecdsa.PrivateKey
+	pub     string
+	subject string
+
+	// Tokens per push service (audience).
+	mu     sync.Mutex
+	tokens map[string]vapidToken
+}
+
+type vapidToken struct {
+	token string
+	exp   time.Time
+}
+
+// GenerateKeys generates a VAPID key pair and returns the private key and
+// the public key (the uncompressed P-256 point) encoded as base64url.
+func GenerateKeys() (string, string, error) {
+	priv, x, y, err := elliptic.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return "", "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(priv),
+		base64.RawURLEncoding.EncodeToString(elliptic.Marshal(elliptic.P256(), x, y)), nil
+}
+
+func newVAPID(privKey, subject string) (*vapid, error) {
+	b, err := decodeB64(privKey)
+	if err != nil || len(b) != 32 {
+		return nil, errors.New("VAPID private key should be a base64url encoded 32 byte P-256 key")
+	}
+
+	var (
+		c   = elliptic.P256()
+		key = &ecdsa.PrivateKey{D: new(big.Int).SetBytes(b)}
+	)
+	if key.D.Sign() == 0 || key.D.Cmp(c.Params().N) >= 0 {
+		return nil, errors.New("invalid VAPID private key")
+	}
+	key.PublicKey.Curve = c
+	key.PublicKey.X, key.PublicKey.Y = c.ScalarBaseMult(b)
+
+	if subject == "" {
+		return nil, errors.New("VAPID subject (mailto: or https: contact URL) is required")
+	}
+
+	return &vapid{
+		key:     key,
+		pub:     base64.RawURLEncoding.EncodeToString(elliptic.Marshal(c, key.X, key.Y)),
+		subject: subject,
+		tokens:  make(map[string]vapidToken),
+	}, nil
+}
+
+// header returns the Authorization header for a push service endpoint.
+func (v *vapid) header(endpoint string) (string, error) {
+	u, err := url.Parse(endpoint)
+	if err != nil {
+		return "", err
+	}
+	aud := u.Scheme + "://" + u.Host
+
+	v.mu.Lock()
+	defer v.mu.Unlock()
+
+	t, ok := v.tokens[aud]
+	if !ok || time.Until(t.exp) < vapidRenew {
+		exp := time.Now().Add(vapidTTL)
+		tok, err := v.sign(aud, exp)
+		if err != nil {
+			return "", err
+		}
+		t = vapidToken{token: tok, exp: exp}
+		v.tokens[aud] = t
+	}
+
+	return fmt.Sprintf("vapid t=%s, k=%s", t.token, v.pub), nil
+}
+
+// sign returns an ES256 signed JWT for the audience.
+func (v *vapid) sign(aud string, exp time.Time) (string, error) {
+	claims, err := json.Marshal(map[string]interface{}{
+		"aud": aud,
+		"exp": exp.Unix(),
+		"sub": v.subject,
+	})
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		enc = base64.RawURLEncoding
+		msg = enc.EncodeToString([]byte(`{"typ":"JWT","alg":"ES256"}`)) + "." + enc.EncodeToString(claims)
+		h   = sha256.Sum256([]byte(msg))
+	)
+	r, s, err := ecdsa.Sign(rand.Reader, v.key, h[:])
+	if err != nil {
+		return "", err
+	}
+
+	// The signature is the fixed size r || s.
+	sig := make([]byte, 64)
+	rb, sb := r.Bytes(), s.Bytes()
+	copy(sig[32-len(rb):32], rb)
+	copy(sig[64-len(sb):], sb)
+
+	return msg + "." + enc.EncodeToString(sig), nil
+}
+
+// decodeB64 decodes base64url or standard base64 with or without padding.
+func decodeB64(s string) ([]byte, error) {
+	for _, e := range []*base64.Encoding{base64.RawURLEncoding, base64.URLEncoding,
+		base64.RawStdEncoding, base64.StdEncoding} {
+		if b, err := e.DecodeString(s); err == nil {
+			return b, nil
+		}
+	}
+	return nil, errors.New("invalid base64 encoding")
+}
@@ -0,0 +1,333 @@
+// Package webpush implements a messenger that sends campaigns as browser
+// push notifications over the Web Push protocol (RFC 8030) with VAPID
+// (RFC 8292) authentication and encrypted payloads (RFC 8291).
+package webpush
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"html"
+	"io"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/knadh/listmonk/internal/messenger"
+)
+
+// Max size of a response body that's read.
+const maxRespSize = 1 << 16
+
+var (
+	reImgSrc  = regexp.MustCompile(`(?i)<img[^>]+src\s*=\s*["']([^"']+)["']`)
+	reLinkURL = regexp.MustCompile(`(?i)<a[^>]+href\s*=\s*["'](https?://[^"']+)["']`)
+	reTextURL = regexp.MustCompile(`https?://[^\s<>"']+`)
+)
+
+// ErrNoSubscriptions is returned when a subscriber has no push subscriptions.
+var ErrNoSubscriptions = errors.New("subscriber has no push subscriptions")
+
+// Subscription is the push subscription of a browser. P256dh and Auth are
+// the base64url encoded keys from PushSubscription.toJSON().
+type Subscription struct {
+	Endpoint string `db:"endpoint" json:"endpoint"`
+	P256dh   string `db:"p256dh" json:"p256dh"`
+	Auth     string `db:"auth" json:"auth"`
+}
+
+// Store is the store of the push subscriptions of subscribers.
+type Store interface {
+	GetSubscriptions(subID int) ([]Subscription, error)
+
+	// DeleteSubscription deletes a subscription that has expired or has been
+	// unsubscribed from by the browser.
+	DeleteSubscription(endpoint string) error
+}
+
+// Options represents the config of the web push messenger.
+type Options struct {
+	// Subject is the contact of the application server (mailto: or https:).
+	Subject string `json:"subject"`
+
+	// PrivateKey is the base64url encoded VAPID private key. See GenerateKeys().
+	PrivateKey string `json:"private_key"`
+
+	// Icon and URL are the notification's icon and the URL that's opened on
+	// clicking it for messages that don't have an image or a link.
+	Icon string `json:"icon"`
+	URL  string `json:"url"`
+
+	// TTL is how long push services retain messages for offline browsers.
+	TTL time.Duration `json:"ttl"`
+
+	MaxConns int           `json:"max_conns"`
+	Retries  int           `json:"retries"`
+	Timeout  time.Duration `json:"timeout"`
+}
+
+// notification is the payload that's delivered to the service worker.
+type notification struct {
+	Title string `json:"title"`
+	Body  string `json:"body"`
+	Icon  string `json:"icon,omitempty"`
+	URL   string `json:"url,omitempty"`
+	Tag   string `json:"tag,omitempty"`
+}
+
+// WebPush is a messenger that sends messages as web push notifications.
+type WebPush struct {
+	name  string
+	o     Options
+	vapid *vapid
+	store Store
+	c     *http.Client
+	lo    *log.Logger
+}
+
+// New returns a new instance of the web push messenger.
+func New(lo *log.Logger, name string, o Options, store Store) (*WebPush, error) {
+	v, err := newVAPID(o.PrivateKey, o.Subject)
+	if err != nil {
+		return nil, err
+	}
+
+	if o.TTL == 0 {
+		o.TTL = time.Hour * 24
+	}
+	if o.Timeout == 0 {
+		o.Timeout = time.Second * 10
+	}
+	if o.MaxConns < 1 {
+		o.MaxConns = 1
+	}
+
+	return &WebPush{
+		name:  name,
+		o:     o,
+		vapid: v,
+		store: store,
+		c: &http.Client{
+			Timeout: o.Timeout,
+			Transport: &http.Transport{
+				Proxy:                 http.ProxyFromEnvironment,
+				DialContext:           newDialer(o.Timeout).DialContext,
+				MaxIdleConnsPerHost:   o.MaxConns,
+				MaxConnsPerHost:       o.MaxConns,
+				ResponseHeaderTimeout: o.Timeout,
+				IdleConnTimeout:       time.Second * 90,
+			},
+
+			// Push services don't redirect.
+			CheckRedirect: func(*http.Request, []*http.Request) error {
+				return http.ErrUseLastResponse
+			},
+		},
+		lo: lo,
+	}, nil
+}
+
+// Name returns the messenger's name.
+func (w *WebPush) Name() string {
+	return w.name
+}
+
+// PublicKey returns the base64url encoded VAPID public key that browsers
+// subscribe with (applicationServerKey).
+func (w *WebPush) PublicKey() string {
+	return w.vapid.pub
+}
+
+// Push sends a message as a push notification.
+func (w *WebPush) Push(m messenger.Message) error {
+	_, err := w.PushWithID(m)
+	return err
+}
+
+// PushWithID sends a message as a push notification to all the browsers
+// that the subscriber has subscribed on. Subscriptions that have expired are
+// deleted. The ID is the push service's message URL of the first delivery.
+func (w *WebPush) PushWithID(m messenger.Message) (string, error) {
+	subs, err := w.store.GetSubscriptions(m.Subscriber.ID)
+	if err != nil {
+		return "", fmt.Errorf("error fetching push subscriptions: %v", err)
+	}
+	if len(subs) == 0 {
+		return "", ErrNoSubscriptions
+	}
+
+	payload, err := w.makePayload(m)
+	if err != nil {
+		return "", err
+	}
+
+	var (
+		msgID   string
+		sent    int
+		lastErr error
+	)
+	for _, s := range subs {
+		// Subscriptions that aren't on a known push service are never sent to.
+		if !ValidEndpoint(s.Endpoint) {
+			w.lo.Printf("deleting push subscription with invalid endpoint: %s", s.Endpoint)
+			if err := w.store.DeleteSubscription(s.Endpoint); err != nil {
+				w.lo.Printf("error deleting push subscription: %v", err)
+			}
+			continue
+		}
+
+		id, gone, err := w.send(s, payload)
+		if gone {
+			if err := w.store.DeleteSubscription(s.Endpoint); err != nil {
+				w.lo.Printf("error deleting expired push subscription: %v", err)
+			}
+			continue
+		}
+		if err != nil {
+			lastErr = err
+			continue
+		}
+
+		if sent == 0 {
+			msgID = id
+		}
+		sent++
+	}
+
+	if sent > 0 {
+		return msgID, nil
+	}
+	if lastErr == nil {
+		lastErr = errors.New("push subscriptions of the subscriber have expired")
+	}
+	return "", lastErr
+}
+
+// Flush flushes the message queue to the server.
+func (w *WebPush) Flush() error {
+	return nil
+}
+
+// Close closes idle HTTP connections.
+func (w *WebPush) Close() error {
+	w.c.CloseIdleConnections()
+	return nil
+}
+
+// makePayload renders the notification from a message. The subject is the
+// title and the plain text body is the body. The first image in the message
+// is the icon and the first link (tracked) is the URL that's opened.
+func (w *WebPush) makePayload(m messenger.Message) ([]byte, error) {
+	n := notification{
+		Title: m.Subject,
+		Body:  messenger.PlainText(m),
+		Icon:  w.o.Icon,
+		URL:   w.o.URL,
+	}
+	if m.Campaign != nil {
+		n.Tag = m.Campaign.UUID
+	}
+
+	if m.ContentType == "plain" {
+		if u := reTextURL.FindString(string(m.Body)); u != "" {
+			n.URL = u
+		}
+	} else {
+		for _, s := range reImgSrc.FindAllStringSubmatch(string(m.Body), -1) {
+			// Skip the view tracking pixel.
+			if !strings.Contains(s[1], "/px.png") {
+				n.Icon = html.UnescapeString(s[1])
+				break
+			}
+		}
+		if s := reLinkURL.FindStringSubmatch(string(m.Body)); s != nil {
+			n.URL = html.UnescapeString(s[1])
+		}
+	}
+
+	b, err := json.Marshal(n)
+	if err != nil {
+		return nil, err
+	}
+
+	// Shorten the body to fit the payload into a push message.
+	for len(b) > maxPayloadSize {
+		over := len(b) - maxPayloadSize
+		if over+3 >= len(n.Body) {
+			return nil, errors.New("push notification is too large")
+		}
+
+		body := n.Body[:len(n.Body)-over-3]
+		for !utf8.ValidString(body) {
+			body = body[:len(body)-1]
+		}
+		n.Body = body + "..."
+
+		if b, err = json.Marshal(n); err != nil {
+			return nil, err
+		}
+	}
+
+	return b, nil
+}
+
+// send sends an encrypted payload to a subscription's push service and
+// returns the message's URL. gone is true if the subscription has expired.
+func (w *WebPush) send(s Subscription, payload []byte) (string, bool, error) {
+	body, err := encrypt(payload, s)
+	if err != nil {
+		return "", false, err
+	}
+
+	auth, err := w.vapid.header(s.Endpoint)
+	if err != nil {
+		return "", false, err
+	}
+
+	var lastErr error
+	for i := 0; i <= w.o.Retries; i++ {
+		if i > 0 {
+			time.Sleep(time.Duration(i) * time.Millisecond * 500)
+		}
+
+		req, err := http.NewRequest(http.MethodPost, s.Endpoint, bytes.NewReader(body))
+		if err != nil {
+			return "", false, err
+		}
+		req.Header.Set("Authorization", auth)
+		req.Header.Set("Content-Encoding", "aes128gcm")
+		req.Header.Set("Content-Type", "application/octet-stream")
+		req.Header.Set("TTL", strconv.Itoa(int(w.o.TTL.Seconds())))
+		req.Header.Set("User-Agent", "listmonk")
+
+		r, err := w.c.Do(req)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		b, _ := ioutil.ReadAll(io.LimitReader(r.Body, maxRespSize))
+
+		// Drain and close the body to let the Transport reuse the connection.
+		io.Copy(ioutil.Discard, r.Body)
+		r.Body.Close()
+
+		switch {
+		case r.StatusCode >= 200 && r.StatusCode < 300:
+			return r.Header.Get("Location"), false, nil
+		case r.StatusCode == http.StatusNotFound || r.StatusCode == http.StatusGone:
+			return "", true, nil
+		}
+
+		lastErr = fmt.Errorf("non-OK response from push service: %d: %s", r.StatusCode, strings.TrimSpace(string(b)))
+		if r.StatusCode != http.StatusTooManyRequests && r.StatusCode < 500 {
+			break
+		}
+	}
+	return "", false, lastErr
+}
@@ -0,0 +1,257 @@
+package migrations
+
+import (
+	"github.com/jmoiron/sqlx"
+	"github.com/knadh/koanf"
+	"github.com/knadh/stuffbin"
+)
+
+// V1_1_0 performs the DB migrations for v.1.1.0.
+func V1_1_0(db *sqlx.DB, fs stuffbin.FileSystem, ko *koanf.Koanf) error {
+	if _, err := db.Exec(`
+		INSERT INTO settings (key, value) VALUES
+			('app.message_burst', '10'),
+			('app.messenger_rates', '[]'),
+			('app.messenger_groups', '[]'),
+			('app.domain_throttles', '[]'),
+			('app.warmups', '[]'),
+			('app.render_concurrency', '0'),
+			('app.max_error_rate', '0'),
+			('app.error_rate_window', '1000'),
+			('app.error_rate_per_class', 'false'),
+			('app.requeue_on_error', 'false'),
+			('app.max_attempts', '3'),
+			('app.retry_backoff', '{"throttling": "1m", "transient": "30s", "other": "1m", "auth": "0s", "recipient_rejected": "0s"}'),
+			('app.frequency_caps', '[]'),
+			('app.attachments_max_size', '10')
+			ON CONFLICT DO NOTHING;
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS pause_reason TEXT NOT NULL DEFAULT ''`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		CREATE TABLE IF NOT EXISTS campaign_leases (
+			id               BIGSERIAL PRIMARY KEY,
+			campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+
+			-- The range of subscriber IDs (from_id, to_id] of a campaign leased to a node,
+			-- the last subscriber ID in the range that has been processed and the number
+			-- of messages sent in the range so far. When a node stops renewing a lease
+			-- (heartbeat), it expires and is picked up by another node from last_id.
+			from_id          INT NOT NULL,
+			to_id            INT NOT NULL,
+			last_id          INT NOT NULL,
+			sent             INT NOT NULL DEFAULT 0,
+
+			node             TEXT NOT NULL,
+			expires_at       TIMESTAMP WITH TIME ZONE NOT NULL,
+			created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_camp_leases_camp_id ON campaign_leases(campaign_id, expires_at);
+	`); err != nil {
+		return err
+	}
+
+	if _, err := db.Exec(`
+		DO $$
+		BEGIN
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'delivery_status') THEN
+				CREATE TYPE delivery_status AS ENUM ('queued', 'deferred', 'sent', 'failed', 'skipped');
+			END IF;
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'ab_test_metric') THEN
+				CREATE TYPE ab_test_metric AS ENUM ('views', 'clicks');
+			END IF;
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'automation_trigger') THEN
+				CREATE TYPE automation_trigger AS ENUM ('subscriber_insert', 'optin_confirm', 'list_add', 'attribute_change');
+			END IF;
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'automation_condition') THEN
+				CREATE TYPE automation_condition AS ENUM ('none', 'not_opened', 'not_clicked');
+			END IF;
+			IF NOT EXISTS (SELECT 1 FROM pg_type WHERE typname = 'automation_sub_status') THEN
+				CREATE TYPE automation_sub_status AS ENUM ('active', 'completed', 'exited');
+			END IF;
+		END$$;
+
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS ab_test_percent INT NOT NULL DEFAULT 0;
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS ab_test_metric ab_test_metric NOT NULL DEFAULT 'views';
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS ab_test_window TEXT NOT NULL DEFAULT '4h';
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS ab_test_ends_at TIMESTAMP WITH TIME ZONE NULL;
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS ab_winner_id INTEGER NULL;
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS optimize_send_time BOOLEAN NOT NULL DEFAULT false;
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS local_send_time TEXT NOT NULL DEFAULT '';
+		ALTER TABLE lists ADD COLUMN IF NOT EXISTS timezone TEXT NOT NULL DEFAULT '';
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS recurrence TEXT NOT NULL DEFAULT '';
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS recurrence_tz TEXT NOT NULL DEFAULT 'UTC';
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS feed_url TEXT NOT NULL DEFAULT '';
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS feed_last_item_at TIMESTAMP WITH TIME ZONE NULL;
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS feed_items JSONB NOT NULL DEFAULT '[]';
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS parent_id INTEGER NULL REFERENCES campaigns(id) ON DELETE SET NULL;
+		ALTER TABLE campaigns ADD COLUMN IF NOT EXISTS last_run_at TIMESTAMP WITH TIME ZONE NULL;
+
+		CREATE TABLE IF NOT EXISTS campaign_variants (
+			id               SERIAL PRIMARY KEY,
+			campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			name             TEXT NOT NULL,
+
+			-- Empty values (and deleted templates) fall back to the campaign's.
+			subject          TEXT NOT NULL DEFAULT '',
+			body             TEXT NOT NULL DEFAULT '',
+			template_id      INTEGER NULL REFERENCES templates(id) ON DELETE SET NULL,
+
+			created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_camp_variants_camp_id ON campaign_variants(campaign_id);
+
+		CREATE TABLE IF NOT EXISTS campaign_exclude_lists (
+			campaign_id  INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			list_id      INTEGER NULL REFERENCES lists(id) ON DELETE SET NULL ON UPDATE CASCADE,
+			list_name    TEXT NOT NULL DEFAULT ''
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_camp_excl_lists ON campaign_exclude_lists(campaign_id, list_id);
+		CREATE INDEX IF NOT EXISTS idx_camp_excl_lists_list_id ON campaign_exclude_lists(list_id);
+
+		CREATE TABLE IF NOT EXISTS campaign_deliveries (
+			id               BIGSERIAL PRIMARY KEY,
+			campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+
+			-- The status of the last delivery attempt of the campaign to the subscriber
+			-- and the messenger and the provider's message ID or the error of the attempt.
+			status           delivery_status NOT NULL DEFAULT 'queued',
+			messenger        TEXT NOT NULL,
+			message_id       TEXT NOT NULL DEFAULT '',
+			error            TEXT NOT NULL DEFAULT '',
+			attempts         INT NOT NULL DEFAULT 0,
+
+			-- If a failed message is to be retried or a deferred message is to be sent,
+			-- the time after which it's due.
+			retry_at         TIMESTAMP WITH TIME ZONE NULL,
+
+			-- The A/B test variant of the campaign that was sent, if any.
+			variant_id       INTEGER NULL REFERENCES campaign_variants(id) ON DELETE SET NULL,
+
+			created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_camp_deliveries ON campaign_deliveries(campaign_id, subscriber_id);
+		CREATE INDEX IF NOT EXISTS idx_camp_deliveries_status ON campaign_deliveries(campaign_id, status);
+		CREATE INDEX IF NOT EXISTS idx_camp_deliveries_sub_sent ON campaign_deliveries(subscriber_id, updated_at) WHERE status = 'sent';
+		CREATE INDEX IF NOT EXISTS idx_camp_deliveries_retry ON campaign_deliveries(campaign_id, retry_at) WHERE retry_at IS NOT NULL;
+		CREATE INDEX IF NOT EXISTS idx_camp_deliveries_msgr ON campaign_deliveries(messenger, updated_at) WHERE status IN ('queued', 'sent');
+
+		CREATE TABLE IF NOT EXISTS automations (
+			id               SERIAL PRIMARY KEY,
+			uuid             uuid NOT NULL UNIQUE,
+			name             TEXT NOT NULL,
+			trigger          automation_trigger NOT NULL,
+
+			-- The list the trigger applies to (any list if it's null) and the attribute
+			-- whose change triggers an attribute_change automation (any attribute if it's empty).
+			list_id          INTEGER NULL REFERENCES lists(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			attribute        TEXT NOT NULL DEFAULT '',
+
+			messenger        TEXT NOT NULL,
+			from_email       TEXT NOT NULL DEFAULT '',
+			enabled          BOOLEAN NOT NULL DEFAULT false,
+
+			created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+
+		CREATE TABLE IF NOT EXISTS automation_steps (
+			id               SERIAL PRIMARY KEY,
+			automation_id    INTEGER NOT NULL REFERENCES automations(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			position         INT NOT NULL,
+			template_id      INTEGER NULL REFERENCES templates(id) ON DELETE SET NULL,
+			subject          TEXT NOT NULL,
+			body             TEXT NOT NULL DEFAULT '',
+			content_type     content_type NOT NULL DEFAULT 'richtext',
+
+			-- Duration (eg: 72h) after the subscriber enters the automation after which the step is sent.
+			delay            TEXT NOT NULL DEFAULT '0s',
+			condition        automation_condition NOT NULL DEFAULT 'none',
+
+			created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_auto_steps_auto_id ON automation_steps(automation_id, position);
+
+		-- The progress of subscribers through automations. A subscriber enters an automation only once.
+		CREATE TABLE IF NOT EXISTS automation_subscribers (
+			id               BIGSERIAL PRIMARY KEY,
+			automation_id    INTEGER NOT NULL REFERENCES automations(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			status           automation_sub_status NOT NULL DEFAULT 'active',
+
+			-- The position of the next step and the time at which it's due.
+			step             INT NOT NULL DEFAULT 0,
+			next_at          TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			exit_reason      TEXT NOT NULL DEFAULT '',
+
+			created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_auto_subs ON automation_subscribers(automation_id, subscriber_id);
+		CREATE INDEX IF NOT EXISTS idx_auto_subs_next_at ON automation_subscribers(next_at) WHERE status = 'active';
+
+		CREATE TABLE IF NOT EXISTS tx_messages (
+			id               BIGSERIAL PRIMARY KEY,
+			uuid             uuid NOT NULL UNIQUE,
+			subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+			template_id      INTEGER NULL REFERENCES templates(id) ON DELETE SET NULL ON UPDATE CASCADE,
+			email            TEXT NOT NULL,
+			subject          TEXT NOT NULL,
+
+			-- The status of the delivery and the provider's message ID or the error.
+			status           delivery_status NOT NULL DEFAULT 'queued',
+			messenger        TEXT NOT NULL,
+			message_id       TEXT NOT NULL DEFAULT '',
+			error            TEXT NOT NULL DEFAULT '',
+
+			-- The automation step that sent the message, if any.
+			automation_step_id INTEGER NULL REFERENCES automation_steps(id) ON DELETE SET NULL,
+
+			created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_tx_messages_step_id ON tx_messages(automation_step_id);
+		CREATE INDEX IF NOT EXISTS idx_tx_messages_sub_id ON tx_messages(subscriber_id);
+
+		CREATE TABLE IF NOT EXISTS campaign_media (
+			campaign_id  INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			media_id     INTEGER NULL REFERENCES media(id) ON DELETE SET NULL ON UPDATE CASCADE,
+			filename     TEXT NOT NULL DEFAULT ''
+		);
+		CREATE UNIQUE INDEX IF NOT EXISTS idx_camp_media_id ON campaign_media (campaign_id, media_id);
+		CREATE INDEX IF NOT EXISTS idx_camp_media_camp_id ON campaign_media(campaign_id);
+
+		CREATE TABLE IF NOT EXISTS campaign_dry_runs (
+			campaign_id  INTEGER NOT NULL UNIQUE REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			report       JSONB NOT NULL DEFAULT '{}',
+			created_at   TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			updated_at   TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+
+		CREATE TABLE IF NOT EXISTS push_subscriptions (
+			id               SERIAL PRIMARY KEY,
+			subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+			endpoint         TEXT NOT NULL UNIQUE,
+			p256dh           TEXT NOT NULL,
+			auth             TEXT NOT NULL,
+			user_agent       TEXT NOT NULL DEFAULT '',
+			created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+			updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+		);
+		CREATE INDEX IF NOT EXISTS idx_push_subs_sub_id ON push_subscriptions(subscriber_id);
+	`); err != nil {
+		return err
+	}
+
+	return nil
+}
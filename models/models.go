@@ -45,6 +45,20 @@ const (
 	CampaignContentTypeHTML     = "html"
 	CampaignContentTypeMarkdown = "markdown"
 	CampaignContentTypePlain    = "plain"
+	ABTestMetricViews           = "views"
+	ABTestMetricClicks          = "clicks"
+
+	// Automation.
+	AutomationTriggerSubscriberInsert = "subscriber_insert"
+	AutomationTriggerOptinConfirm     = "optin_confirm"
+	AutomationTriggerListAdd          = "list_add"
+	AutomationTriggerAttributeChange  = "attribute_change"
+	AutomationConditionNone           = "none"
+	AutomationConditionNotOpened      = "not_opened"
+	AutomationConditionNotClicked     = "not_clicked"
+	AutomationSubStatusActive         = "active"
+	AutomationSubStatusCompleted      = "completed"
+	AutomationSubStatusExited         = "exited"
 
 	// List.
 	ListTypePrivate = "private"
@@ -163,6 +177,7 @@ type List struct {
 	Type            string         `db:"type" json:"type"`
 	Optin           string         `db:"optin" json:"optin"`
 	Tags            pq.StringArray `db:"tags" json:"tags"`
+	Timezone        string         `db:"timezone" json:"timezone"`
 	SubscriberCount int            `db:"subscriber_count" json:"subscriber_count"`
 	SubscriberID    int            `db:"subscriber_id" json:"-"`
 
@@ -201,14 +216,51 @@ type Campaign struct {
 	TemplateID  int            `db:"template_id" json:"template_id"`
 	Messenger   string         `db:"messenger" json:"messenger"`
 
+	// Media is the list of {id, filename} pairs of the media that are attached
+	// to the campaign's messages. The id is 0 if the media has been deleted.
+	Media types.JSONText `db:"media" json:"media"`
+
+	// PauseReason is the reason why the campaign was automatically paused.
+	PauseReason string `db:"pause_reason" json:"pause_reason"`
+
+	// A/B test. If ABTestPercent is set, that percentage of the subscribers
+	// are sent one of the Variants, and ABTestWindow (duration) after that,
+	// the variant with the highest rate of ABTestMetric (views or clicks)
+	// is picked as the winner and sent to the rest of the subscribers.
+	ABTestPercent int               `db:"ab_test_percent" json:"ab_test_percent"`
+	ABTestMetric  string            `db:"ab_test_metric" json:"ab_test_metric"`
+	ABTestWindow  string            `db:"ab_test_window" json:"ab_test_window"`
+	ABTestEndsAt  null.Time         `db:"ab_test_ends_at" json:"ab_test_ends_at"`
+	ABWinnerID    null.Int          `db:"ab_winner_id" json:"ab_winner_id"`
+	Variants      []CampaignVariant `json:"variants"`
+
+	// OptimizeSendTime holds the message to every subscriber until their
+	// best hour of engagement within 24 hours of the campaign's start.
+	OptimizeSendTime bool `db:"optimize_send_time" json:"optimize_send_time"`
+
+	// LocalSendTime (HH:MM) holds the message to every subscriber until the
+	// time of the day in their timezone (attribs.timezone or their list's
+	// default) within 24 hours of the campaign's start.
+	LocalSendTime string `db:"local_send_time" json:"local_send_time"`
+
+	// Recurrence is a cron expression (in RecurrenceTZ) on which the campaign
+	// is cloned into a new child campaign (ParentID) that's sent. If FeedURL is
+	// set, the feed items published since the last run are rendered into the
+	// child as FeedItems, eg: {{ range .Campaign.FeedItems }}.
+	Recurrence     string    `db:"recurrence" json:"recurrence"`
+	RecurrenceTZ   string    `db:"recurrence_tz" json:"recurrence_tz"`
+	FeedURL        string    `db:"feed_url" json:"feed_url"`
+	FeedLastItemAt null.Time `db:"feed_last_item_at" json:"feed_last_item_at"`
+	FeedItems      FeedItems `db:"feed_items" json:"feed_items"`
+	ParentID       null.Int  `db:"parent_id" json:"parent_id"`
+	LastRunAt      null.Time `db:"last_run_at" json:"last_run_at"`
+
 	// TemplateBody is joined in from templates by the next-campaigns query.
 	TemplateBody string             `db:"template_body" json:"-"`
 	Tpl          *template.Template `json:"-"`
 	SubjectTpl   *template.Template `json:"-"`
 	AltBodyTpl   *template.Template `json:"-"`
 
-	SubsCamp []Subscriber `json:"-"`
-
 	// Pseudofield for getting the total number of subscribers
 	// in searches and queries.
 	Total int `db:"total" json:"-"`
@@ -227,6 +279,10 @@ type CampaignMeta struct {
 	// even after a list is deleted.
 	Lists types.JSONText `db:"lists" json:"lists"`
 
+	// ExcludeLists are the {list_id, name} pairs of the lists whose subscribers
+	// are excluded from the campaign.
+	ExcludeLists types.JSONText `db:"exclude_lists" json:"exclude_lists"`
+
 	SentPercentage int `db:"sent_percentage" json:"sent_percentage"`
 
 	StartedAt    null.Time `db:"started_at" json:"started_at"`
@@ -234,8 +290,48 @@ type CampaignMeta struct {
 	Sent         int       `db:"sent" json:"sent"`
 	TotalSent    int       `db:"total_send" json:"total_send"`
 	EmailAllowed int       `db:"email_allowed" json:"email_allowed"`
+
+	// Skipped is the number of subscribers skipped for having crossed
+	// a frequency cap.
+	Skipped int `db:"skipped" json:"skipped"`
+
+	// Sent counts, unique views and clicks of the A/B test variants.
+	VariantStats types.JSONText `db:"variant_stats" json:"variant_stats"`
+
+	// Sent and failed counts of messages per messenger, which are split
+	// between the members for campaigns that target messenger groups.
+	MessengerStats types.JSONText `db:"messenger_stats" json:"messenger_stats"`
+}
+
+// CampaignVariant is a variant of a campaign's subject and content that's
+// tested against the other variants in an A/B test. Empty fields fall back
+// to the campaign's.
+type CampaignVariant struct {
+	ID         int    `db:"id" json:"id"`
+	CampaignID int    `db:"campaign_id" json:"-"`
+	Name       string `db:"name" json:"name"`
+	Subject    string `db:"subject" json:"subject"`
+	Body       string `db:"body" json:"body"`
+	TemplateID int    `db:"template_id" json:"template_id"`
+
+	// TemplateBody is joined in from templates.
+	TemplateBody string `db:"template_body" json:"-"`
 }
 
+// FeedItem is an item from the RSS/Atom feed of a recurring campaign.
+type FeedItem struct {
+	ID          string    `json:"id"`
+	Title       string    `json:"title"`
+	URL         string    `json:"url"`
+	Description string    `json:"description"`
+	Content     string    `json:"content"`
+	Author      string    `json:"author"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+// FeedItems represents a slice of FeedItems stored as JSON.
+type FeedItems []FeedItem
+
 // Campaigns represents a slice of Campaigns.
 type Campaigns []Campaign
 
@@ -248,6 +344,96 @@ type Template struct {
 	IsDefault bool   `db:"is_default" json:"is_default"`
 }
 
+// TxMessage represents a transactional message sent to a single subscriber
+// by rendering a stored template with arbitrary data.
+type TxMessage struct {
+	// The subscriber is looked up by ID, UUID, or e-mail in that order.
+	SubscriberID    int    `json:"subscriber_id"`
+	SubscriberUUID  string `json:"subscriber_uuid"`
+	SubscriberEmail string `json:"subscriber_email"`
+
+	TemplateID int    `json:"template_id"`
+	Subject    string `json:"subject"`
+
+	// Body is the optional content that's inserted into the template
+	// where it has {{ template "content" . }}.
+	Body        string                 `json:"body"`
+	ContentType string                 `json:"content_type"`
+	Data        map[string]interface{} `json:"data"`
+	FromEmail   string                 `json:"from_email"`
+	Messenger   string                 `json:"messenger"`
+	Headers     map[string]string      `json:"headers"`
+	Attachments []TxAttachment         `json:"attachments"`
+
+	Subscriber Subscriber         `json:"-"`
+	Tpl        *template.Template `json:"-"`
+	SubjectTpl *template.Template `json:"-"`
+}
+
+// TxAttachment is a file attached to a transactional message. The content
+// is base64 encoded in JSON.
+type TxAttachment struct {
+	Name    string `json:"name"`
+	Content []byte `json:"content"`
+}
+
+// Automation is a sequence of messages (steps) that are sent to a subscriber
+// one after the other with delays once the subscriber enters the automation
+// on a trigger event.
+type Automation struct {
+	Base
+
+	UUID    string `db:"uuid" json:"uuid"`
+	Name    string `db:"name" json:"name"`
+	Trigger string `db:"trigger" json:"trigger"`
+
+	// ListID optionally restricts the trigger to a list. Subscribers exit
+	// the automation when they unsubscribe from it.
+	ListID null.Int `db:"list_id" json:"list_id"`
+
+	// Attribute is the subscriber attribute that's watched by the
+	// attribute_change trigger. Empty means any attribute.
+	Attribute string           `db:"attribute" json:"attribute"`
+	Messenger string           `db:"messenger" json:"messenger"`
+	FromEmail string           `db:"from_email" json:"from_email"`
+	Enabled   bool             `db:"enabled" json:"enabled"`
+	Steps     []AutomationStep `db:"-" json:"steps"`
+
+	// Number of subscribers in the automation by their status.
+	Active    int `db:"active" json:"active"`
+	Completed int `db:"completed" json:"completed"`
+	Exited    int `db:"exited" json:"exited"`
+
+	// Pseudofield for getting the total number of automations.
+	Total int `db:"total" json:"-"`
+}
+
+// AutomationStep is a message in an automation's sequence. It's sent Delay
+// after the subscriber has entered the automation, provided that the
+// condition holds.
+type AutomationStep struct {
+	ID           int    `db:"id" json:"id"`
+	AutomationID int    `db:"automation_id" json:"-"`
+	Position     int    `db:"position" json:"position"`
+	TemplateID   int    `db:"template_id" json:"template_id"`
+	Subject      string `db:"subject" json:"subject"`
+	Body         string `db:"body" json:"body"`
+	ContentType  string `db:"content_type" json:"content_type"`
+	Delay        string `db:"delay" json:"delay"`
+	Condition    string `db:"condition" json:"condition"`
+
+	// TemplateBody is joined in from templates.
+	TemplateBody string `db:"template_body" json:"-"`
+
+	// Number of messages of the step by their delivery status and the
+	// number of subscribers waiting for the step.
+	Queued  int `db:"queued" json:"queued"`
+	Sent    int `db:"sent" json:"sent"`
+	Failed  int `db:"failed" json:"failed"`
+	Skipped int `db:"skipped" json:"skipped"`
+	Waiting int `db:"waiting" json:"waiting"`
+}
+
 // markdown is a global instance of Markdown parser and renderer.
 var markdown = goldmark.New(
 	goldmark.WithRendererOptions(
@@ -306,6 +492,22 @@ func (s SubscriberAttribs) Scan(src interface{}) error {
 	return fmt.Errorf("Could not not decode type %T -> %T", src, s)
 }
 
+// Value returns the JSON marshalled FeedItems.
+func (f FeedItems) Value() (driver.Value, error) {
+	if f == nil {
+		return []byte("[]"), nil
+	}
+	return json.Marshal(f)
+}
+
+// Scan unmarshals JSON into FeedItems.
+func (f *FeedItems) Scan(src interface{}) error {
+	if data, ok := src.([]byte); ok {
+		return json.Unmarshal(data, f)
+	}
+	return fmt.Errorf("Could not not decode type %T -> %T", src, f)
+}
+
 // GetIDs returns the list of campaign IDs.
 func (camps Campaigns) GetIDs() []int {
 	IDs := make([]int, len(camps))
@@ -330,8 +532,12 @@ func (camps Campaigns) LoadStats(stmt *sqlx.Stmt) error {
 	for i, c := range meta {
 		if c.CampaignID == camps[i].ID {
 			camps[i].Lists = c.Lists
+			camps[i].ExcludeLists = c.ExcludeLists
 			camps[i].Views = c.Views
 			camps[i].Clicks = c.Clicks
+			camps[i].Skipped = c.Skipped
+			camps[i].VariantStats = c.VariantStats
+			camps[i].MessengerStats = c.MessengerStats
 		}
 	}
 
@@ -405,6 +611,33 @@ func (c *Campaign) CompileTemplate(f template.FuncMap) error {
 	return nil
 }
 
+// IsABTest checks if the campaign is an A/B test of variants.
+func (c *Campaign) IsABTest() bool {
+	return c.ABTestPercent > 0
+}
+
+// ApplyVariant returns a copy of the campaign with the subject and content
+// of an A/B test variant. The copy's templates have to be compiled again.
+func (c *Campaign) ApplyVariant(v CampaignVariant) *Campaign {
+	out := *c
+	if v.Subject != "" {
+		out.Subject = v.Subject
+	}
+	if v.Body != "" {
+		out.Body = v.Body
+	}
+	if v.TemplateID > 0 && v.TemplateBody != "" {
+		out.TemplateID = v.TemplateID
+		out.TemplateBody = v.TemplateBody
+	}
+
+	out.Variants = nil
+	out.Tpl = nil
+	out.SubjectTpl = nil
+	out.AltBodyTpl = nil
+	return &out
+}
+
 // ConvertContent converts a campaign's body from one format to another,
 // for example, Markdown to HTML.
 func (c *Campaign) ConvertContent(from, to string) (string, error) {
@@ -456,3 +689,54 @@ func (s Subscriber) LastName() string {
 
 	return s.Name
 }
+
+// Compile compiles the template body and the subject of a transactional
+// message. The message's Body, if any, is inserted as the content template.
+func (m *TxMessage) Compile(tplBody string, f template.FuncMap) error {
+	baseTPL, err := template.New(BaseTpl).Funcs(f).Parse(tplBody)
+	if err != nil {
+		return fmt.Errorf("error compiling template: %v", err)
+	}
+
+	body := m.Body
+	if m.ContentType == CampaignContentTypeMarkdown {
+		var b bytes.Buffer
+		if err := markdown.Convert([]byte(m.Body), &b); err != nil {
+			return err
+		}
+		body = b.String()
+	}
+	msgTpl, err := template.New(ContentTpl).Funcs(f).Parse(body)
+	if err != nil {
+		return fmt.Errorf("error compiling message: %v", err)
+	}
+
+	out, err := baseTPL.AddParseTree(ContentTpl, msgTpl.Tree)
+	if err != nil {
+		return fmt.Errorf("error inserting child template: %v", err)
+	}
+	m.Tpl = out
+
+	subjTpl, err := template.New(ContentTpl).Funcs(f).Parse(m.Subject)
+	if err != nil {
+		return fmt.Errorf("error compiling subject: %v", err)
+	}
+	m.SubjectTpl = subjTpl
+	return nil
+}
+
+// Render renders the compiled subject and body of a transactional message
+// for its subscriber. The message itself is the template context, that is,
+// {{ .Subscriber.Name }} and {{ .Data.key }}.
+func (m *TxMessage) Render() (string, []byte, error) {
+	var subj bytes.Buffer
+	if err := m.SubjectTpl.ExecuteTemplate(&subj, ContentTpl, m); err != nil {
+		return "", nil, err
+	}
+
+	var body bytes.Buffer
+	if err := m.Tpl.ExecuteTemplate(&body, BaseTpl, m); err != nil {
+		return "", nil, err
+	}
+	return subj.String(), body.Bytes(), nil
+}
@@ -66,6 +66,16 @@ listIDs AS (
         (CASE WHEN ARRAY_LENGTH($6::INT[], 1) > 0 THEN id=ANY($6)
               ELSE uuid=ANY($7::UUID[]) END)
 ),
+auto AS (
+    -- Enter new subscribers into subscriber_insert automations. Existing subscribers
+    -- are visible in the statement's snapshot, unlike the one that's being inserted.
+    INSERT INTO automation_subscribers (automation_id, subscriber_id)
+        SELECT id, (SELECT id FROM sub) FROM automations
+        WHERE enabled AND trigger = 'subscriber_insert' AND $4 != 'blocklisted'
+        AND NOT EXISTS (SELECT 1 FROM subscribers WHERE email = $2)
+        AND (list_id IS NULL OR list_id = ANY(SELECT id FROM listIDs))
+    ON CONFLICT DO NOTHING
+),
 subs AS (
     INSERT INTO subscriber_lists (subscriber_id, list_id, status)
     VALUES(
@@ -127,6 +137,17 @@ WITH s AS (
 ),
 d AS (
     DELETE FROM subscriber_lists WHERE subscriber_id = $1 AND list_id != ALL($6)
+),
+auto AS (
+    -- Enter the subscriber into attribute_change automations if the automation's attribute
+    -- (or any attribute) has changed. The subquery sees the attributes before the update.
+    INSERT INTO automation_subscribers (automation_id, subscriber_id)
+        SELECT a.id, old.id FROM automations a, (SELECT id, attribs, status FROM subscribers WHERE id = $1) old
+        WHERE a.enabled AND a.trigger = 'attribute_change' AND $5 != '' AND old.status != 'blocklisted'
+        AND (CASE WHEN a.attribute = '' THEN old.attribs IS DISTINCT FROM $5::JSONB
+            ELSE old.attribs->a.attribute IS DISTINCT FROM $5::JSONB->a.attribute END)
+        AND (a.list_id IS NULL OR a.list_id = ANY($6::INT[]))
+    ON CONFLICT DO NOTHING
 )
 INSERT INTO subscriber_lists (subscriber_id, list_id, status)
     VALUES(
@@ -150,9 +171,19 @@ UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
     WHERE subscriber_id = ANY($1::INT[]);
 
 -- name: add-subscribers-to-lists
-INSERT INTO subscriber_lists (subscriber_id, list_id)
-    (SELECT a, b FROM UNNEST($1::INT[]) a, UNNEST($2::INT[]) b)
-    ON CONFLICT (subscriber_id, list_id) DO NOTHING;
+-- Subscribers that are newly added to lists enter the list_add automations of the lists.
+WITH subs AS (
+    INSERT INTO subscriber_lists (subscriber_id, list_id)
+        (SELECT a, b FROM UNNEST($1::INT[]) a, UNNEST($2::INT[]) b)
+        ON CONFLICT (subscriber_id, list_id) DO NOTHING
+    RETURNING subscriber_id, list_id
+)
+INSERT INTO automation_subscribers (automation_id, subscriber_id)
+    SELECT DISTINCT a.id, subs.subscriber_id FROM subs
+    INNER JOIN automations a ON (a.list_id IS NULL OR a.list_id = subs.list_id)
+    INNER JOIN subscribers s ON (s.id = subs.subscriber_id AND s.status != 'blocklisted')
+    WHERE a.enabled AND a.trigger = 'list_add'
+    ON CONFLICT DO NOTHING;
 
 -- name: delete-subscriptions
 DELETE FROM subscriber_lists
@@ -164,9 +195,19 @@ WITH subID AS (
 ),
 listIDs AS (
     SELECT id FROM lists WHERE uuid = ANY($2::UUID[])
+),
+confirmed AS (
+    UPDATE subscriber_lists SET status='confirmed', updated_at=NOW()
+        WHERE subscriber_id = (SELECT id FROM subID) AND list_id = ANY(SELECT id FROM listIDs)
+        AND status != 'confirmed'
+    RETURNING subscriber_id, list_id
 )
-UPDATE subscriber_lists SET status='confirmed', updated_at=NOW()
-    WHERE subscriber_id = (SELECT id FROM subID) AND list_id = ANY(SELECT id FROM listIDs);
+-- Enter the subscriber into the optin_confirm automations of the confirmed lists.
+INSERT INTO automation_subscribers (automation_id, subscriber_id)
+    SELECT DISTINCT a.id, confirmed.subscriber_id FROM confirmed
+    INNER JOIN automations a ON (a.list_id IS NULL OR a.list_id = confirmed.list_id)
+    WHERE a.enabled AND a.trigger = 'optin_confirm'
+    ON CONFLICT DO NOTHING;
 
 -- name: unsubscribe-subscribers-from-lists
 UPDATE subscriber_lists SET status='unsubscribed', updated_at=NOW()
@@ -351,7 +392,7 @@ SELECT * FROM lists WHERE (CASE WHEN $1 != '' THEN optin=$1::list_optin ELSE TRU
     END) ORDER BY name;
 
 -- name: create-list
-INSERT INTO lists (uuid, name, type, optin, tags) VALUES($1, $2, $3, $4, $5) RETURNING id;
+INSERT INTO lists (uuid, name, type, optin, tags, timezone) VALUES($1, $2, $3, $4, $5, $6) RETURNING id;
 
 -- name: update-list
 UPDATE lists SET
@@ -359,6 +400,7 @@ UPDATE lists SET
     type=(CASE WHEN $3 != '' THEN $3::list_type ELSE type END),
     optin=(CASE WHEN $4 != '' THEN $4::list_optin ELSE optin END),
     tags=$5::VARCHAR(100)[],
+    timezone=COALESCE($6, timezone),
     updated_at=NOW()
 WHERE id = $1;
 
@@ -400,11 +442,26 @@ counts AS (
     )
     WHERE subscriber_lists.list_id=ANY($13::INT[])
     AND subscribers.status='enabled'
+    -- Exclude the subscribers of the exclusion lists.
+    AND NOT EXISTS (
+        SELECT 1 FROM subscriber_lists ex WHERE ex.subscriber_id = subscribers.id
+        AND ex.list_id = ANY($18::INT[]) AND ex.status != 'unsubscribed'
+    )
 ),
 camp AS (
-    INSERT INTO campaigns (uuid, type, name, subject, from_email, body, altbody, content_type, send_at, tags, messenger, template_id, to_send, max_subscriber_id)
-        SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, (SELECT id FROM tpl), (SELECT to_send FROM counts), (SELECT max_sub_id FROM counts)
+    INSERT INTO campaigns (uuid, type, name, subject, from_email, body, altbody, content_type, send_at, tags, messenger, template_id, to_send, max_subscriber_id,
+        ab_test_percent, ab_test_metric, ab_test_window, optimize_send_time, recurrence, recurrence_tz, feed_url, local_send_time)
+        SELECT $1, $2, $3, $4, $5, $6, $7, $8, $9, $10, $11, (SELECT id FROM tpl), (SELECT to_send FROM counts), (SELECT max_sub_id FROM counts),
+        $14, $15::ab_test_metric, $16, $17, $19, $20, $21, $23
         RETURNING id
+),
+exLists AS (
+    INSERT INTO campaign_exclude_lists (campaign_id, list_id, list_name)
+        (SELECT (SELECT id FROM camp), id, name FROM lists WHERE id=ANY($18::INT[]))
+),
+med AS (
+    INSERT INTO campaign_media (campaign_id, media_id, filename)
+        (SELECT (SELECT id FROM camp), id, filename FROM media WHERE id=ANY($22::INT[]))
 )
 INSERT INTO campaign_lists (campaign_id, list_id, list_name)
     (SELECT (SELECT id FROM camp), id, name FROM lists WHERE id=ANY($13::INT[]))
@@ -420,7 +477,10 @@ INSERT INTO campaign_lists (campaign_id, list_id, list_name)
 SELECT  c.id, c.uuid, c.name, c.subject, c.from_email,
         c.messenger, c.started_at, c.to_send, c.sent, c.type,
         c.body, c.altbody, c.send_at, c.status, c.content_type, c.tags,
-        c.template_id, c.created_at, c.updated_at,
+        c.template_id, c.pause_reason, c.created_at, c.updated_at,
+        c.ab_test_percent, c.ab_test_metric, c.ab_test_window, c.ab_test_ends_at, c.ab_winner_id,
+        c.optimize_send_time, c.local_send_time, c.recurrence, c.recurrence_tz, c.feed_url, c.feed_last_item_at, c.feed_items,
+        c.parent_id, c.last_run_at,
         COUNT(*) OVER () AS total,
         (
             SELECT COALESCE(ARRAY_TO_JSON(ARRAY_AGG(l)), '[]') FROM (
@@ -428,7 +488,21 @@ SELECT  c.id, c.uuid, c.name, c.subject, c.from_email,
                 campaign_lists.list_name AS name
                 FROM campaign_lists WHERE campaign_lists.campaign_id = c.id
         ) l
-    ) AS lists
+    ) AS lists,
+        (
+            SELECT COALESCE(ARRAY_TO_JSON(ARRAY_AGG(l)), '[]') FROM (
+                SELECT COALESCE(campaign_exclude_lists.list_id, 0) AS id,
+                campaign_exclude_lists.list_name AS name
+                FROM campaign_exclude_lists WHERE campaign_exclude_lists.campaign_id = c.id
+        ) l
+    ) AS exclude_lists,
+        (
+            SELECT COALESCE(ARRAY_TO_JSON(ARRAY_AGG(m)), '[]') FROM (
+                SELECT COALESCE(campaign_media.media_id, 0) AS id,
+                campaign_media.filename
+                FROM campaign_media WHERE campaign_media.campaign_id = c.id
+        ) m
+    ) AS media
 FROM campaigns c
 WHERE ($1 = 0 OR id = $1)
     AND status=ANY(CASE WHEN ARRAY_LENGTH($2::campaign_status[], 1) != 0 THEN $2::campaign_status[] ELSE ARRAY[status] END)
@@ -450,6 +524,9 @@ SELECT campaigns.*,
 WITH lists AS (
     SELECT campaign_id, JSON_AGG(JSON_BUILD_OBJECT('id', list_id, 'name', list_name)) AS lists FROM campaign_lists
     WHERE campaign_id = ANY($1) GROUP BY campaign_id
+), excludeLists AS (
+    SELECT campaign_id, JSON_AGG(JSON_BUILD_OBJECT('id', list_id, 'name', list_name)) AS lists FROM campaign_exclude_lists
+    WHERE campaign_id = ANY($1) GROUP BY campaign_id
 ), views AS (
     SELECT campaign_id, COUNT(campaign_id) as num FROM campaign_views
     WHERE campaign_id = ANY($1)
@@ -459,18 +536,110 @@ clicks AS (
     SELECT campaign_id, COUNT(campaign_id) as num FROM link_clicks
     WHERE campaign_id = ANY($1)
     GROUP BY campaign_id
+),
+skipped AS (
+    -- Subscribers skipped for having crossed a frequency cap.
+    SELECT campaign_id, COUNT(*) as num FROM campaign_deliveries
+    WHERE campaign_id = ANY($1) AND status = 'skipped'
+    GROUP BY campaign_id
+),
+-- A/B test variants with the number of messages sent and the unique views and clicks
+-- of the subscribers they were sent to.
+variantSent AS (
+    SELECT variant_id, COUNT(*) AS num FROM campaign_deliveries
+    WHERE campaign_id = ANY($1) AND status = 'sent' AND variant_id IS NOT NULL
+    GROUP BY variant_id
+),
+variantViews AS (
+    SELECT d.variant_id, COUNT(DISTINCT v.subscriber_id) AS num FROM campaign_views v
+    INNER JOIN campaign_deliveries d ON (d.campaign_id = v.campaign_id AND d.subscriber_id = v.subscriber_id)
+    WHERE v.campaign_id = ANY($1) AND d.variant_id IS NOT NULL
+    GROUP BY d.variant_id
+),
+variantClicks AS (
+    SELECT d.variant_id, COUNT(DISTINCT c.subscriber_id) AS num FROM link_clicks c
+    INNER JOIN campaign_deliveries d ON (d.campaign_id = c.campaign_id AND d.subscriber_id = c.subscriber_id)
+    WHERE c.campaign_id = ANY($1) AND d.variant_id IS NOT NULL
+    GROUP BY d.variant_id
+),
+variants AS (
+    SELECT cv.campaign_id, JSON_AGG(JSON_BUILD_OBJECT(
+        'id', cv.id,
+        'name', cv.name,
+        'sent', COALESCE(s.num, 0),
+        'views', COALESCE(v.num, 0),
+        'clicks', COALESCE(c.num, 0),
+        'winner', COALESCE(cv.id = camp.ab_winner_id, false)
+    ) ORDER BY cv.id) AS variants
+    FROM campaign_variants cv
+    INNER JOIN campaigns camp ON (camp.id = cv.campaign_id)
+    LEFT JOIN variantSent s ON (s.variant_id = cv.id)
+    LEFT JOIN variantViews v ON (v.variant_id = cv.id)
+    LEFT JOIN variantClicks c ON (c.variant_id = cv.id)
+    WHERE cv.campaign_id = ANY($1)
+    GROUP BY cv.campaign_id
+),
+-- Messages sent and failed per messenger. Campaigns that target messenger groups
+-- are split between the members.
+messengers AS (
+    SELECT campaign_id, JSON_AGG(JSON_BUILD_OBJECT(
+        'messenger', messenger,
+        'sent', sent,
+        'failed', failed
+    ) ORDER BY messenger) AS messengers FROM (
+        SELECT campaign_id, messenger,
+            COUNT(*) FILTER (WHERE status = 'sent') AS sent,
+            COUNT(*) FILTER (WHERE status = 'failed') AS failed
+        FROM campaign_deliveries
+        WHERE campaign_id = ANY($1) AND status IN ('sent', 'failed')
+        GROUP BY campaign_id, messenger
+    ) m
+    GROUP BY campaign_id
 )
 SELECT id as campaign_id,
     COALESCE(v.num, 0) AS views,
     COALESCE(c.num, 0) AS clicks,
+    COALESCE(s.num, 0) AS skipped,
     COALESCE(v.num, 0)::decimal AS sent_percentage,
-    COALESCE(l.lists, '[]') AS lists
+    COALESCE(l.lists, '[]') AS lists,
+    COALESCE(el.lists, '[]') AS exclude_lists,
+    COALESCE(vs.variants, '[]') AS variant_stats,
+    COALESCE(ms.messengers, '[]') AS messenger_stats
 FROM (SELECT id FROM UNNEST($1) AS id) x
 LEFT JOIN lists AS l ON (l.campaign_id = id)
+LEFT JOIN excludeLists AS el ON (el.campaign_id = id)
 LEFT JOIN views AS v ON (v.campaign_id = id)
 LEFT JOIN clicks AS c ON (c.campaign_id = id)
+LEFT JOIN skipped AS s ON (s.campaign_id = id)
+LEFT JOIN variants AS vs ON (vs.campaign_id = id)
+LEFT JOIN messengers AS ms ON (ms.campaign_id = id)
 ORDER BY ARRAY_POSITION($1, id);
 
+-- name: get-campaign-variants
+SELECT campaign_variants.id, campaign_id, name, subject, campaign_variants.body,
+    COALESCE(template_id, 0) AS template_id, COALESCE(templates.body, '') AS template_body
+    FROM campaign_variants
+    LEFT JOIN templates ON (templates.id = campaign_variants.template_id)
+    WHERE campaign_id=$1 ORDER BY campaign_variants.id;
+
+-- name: upsert-campaign-variants
+-- Replaces the A/B test variants of a campaign. Variants that already exist ($2 ID != 0)
+-- are updated in place so that the records of their deliveries are retained.
+WITH v AS (
+    SELECT * FROM UNNEST($2::INT[], $3::TEXT[], $4::TEXT[], $5::TEXT[], $6::INT[])
+        AS v(id, name, subject, body, template_id)
+),
+d AS (
+    DELETE FROM campaign_variants WHERE campaign_id=$1 AND NOT(id = ANY($2::INT[]))
+),
+u AS (
+    UPDATE campaign_variants SET name=v.name, subject=v.subject, body=v.body,
+        template_id=NULLIF(v.template_id, 0), updated_at=NOW()
+    FROM v WHERE campaign_variants.id = v.id AND campaign_variants.campaign_id = $1
+)
+INSERT INTO campaign_variants (campaign_id, name, subject, body, template_id)
+    SELECT $1, name, subject, body, NULLIF(template_id, 0) FROM v WHERE id = 0;
+
 -- name: get-campaign-for-preview
 SELECT campaigns.*, COALESCE(templates.body, (SELECT body FROM templates WHERE is_default = true LIMIT 1)) AS template_body,
 (
@@ -485,7 +654,8 @@ LEFT JOIN templates ON (templates.id = campaigns.template_id)
 WHERE campaigns.id = $1;
 
 -- name: get-campaign-status
-SELECT id, status, to_send, sent, started_at, updated_at
+SELECT id, status, messenger, to_send, sent, started_at, updated_at,
+    (SELECT COUNT(*) FROM campaign_deliveries d WHERE d.campaign_id = campaigns.id AND d.status = 'skipped') AS skipped
     FROM campaigns
     WHERE status=$1;
 
@@ -503,6 +673,18 @@ WITH camps AS (
     LEFT JOIN templates ON (templates.id = campaigns.template_id)
     WHERE (status='running' OR (status='scheduled' AND NOW() >= campaigns.send_at))
     AND NOT(campaigns.id = ANY($1::INT[]))
+    -- Recurring campaigns aren't sent themselves. Their runs are cloned into child campaigns.
+    AND campaigns.recurrence = ''
+    -- Skip A/B test campaigns waiting for the test window to pass.
+    AND (campaigns.ab_winner_id IS NOT NULL OR campaigns.ab_test_ends_at IS NULL OR NOW() >= campaigns.ab_test_ends_at)
+    -- Skip running campaigns whose subscribers have all been processed and that are only
+    -- waiting for failed or deferred messages that aren't due yet.
+    AND NOT (
+        campaigns.status = 'running' AND campaigns.last_subscriber_id >= campaigns.max_subscriber_id
+        AND NOT EXISTS (SELECT 1 FROM campaign_leases WHERE campaign_id = campaigns.id)
+        AND EXISTS (SELECT 1 FROM campaign_deliveries WHERE campaign_id = campaigns.id AND retry_at > NOW())
+        AND NOT EXISTS (SELECT 1 FROM campaign_deliveries WHERE campaign_id = campaigns.id AND retry_at <= NOW())
+    )
 ),
 campLists AS (
     -- Get the list_ids and their optin statuses for the campaigns found in the previous step.
@@ -530,7 +712,14 @@ counts AS (
             -- For regular campaigns with non-double optin lists, e-mail everyone
             -- except unsubscribed subscribers.
             ELSE subscriber_lists.status != 'unsubscribed'
-        END)
+        END) AND
+        -- Exclude the subscribers of the campaign's exclusion lists.
+        NOT EXISTS (
+            SELECT 1 FROM subscriber_lists ex
+            INNER JOIN campaign_exclude_lists cel ON (cel.list_id = ex.list_id)
+            WHERE cel.campaign_id = camps.id AND ex.subscriber_id = subscriber_lists.subscriber_id
+            AND ex.status != 'unsubscribed'
+        )
     )
     GROUP BY camps.id
 ),
@@ -547,19 +736,26 @@ u AS (
 SELECT * FROM camps;
 
 -- name: next-campaign-subscribers
--- Returns a batch of subscribers in a given campaign starting from the last checkpoint
--- (last_subscriber_id). Every fetch updates the checkpoint and the sent count, which means
--- every fetch returns a new batch of subscribers until all rows are exhausted.
+-- Returns the subscribers in a given campaign within a leased range of subscriber IDs ($2, $3].
+-- Subscribers who have crossed a frequency cap ($4) are skipped and recorded as such, unless
+-- it's a dry run ($5).
 WITH camps AS (
-    SELECT last_subscriber_id, max_subscriber_id, type
+    SELECT type, messenger
     FROM campaigns
-    WHERE id=$1 AND status='running'
+    WHERE id=$1
 ),
 campLists AS (
     SELECT id AS list_id, optin FROM lists
     INNER JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
     WHERE campaign_lists.campaign_id = $1
 ),
+caps AS (
+    -- The maximum number of campaign messages a subscriber can be sent in a period (seconds).
+    -- A cap with a list_id only applies to the subscribers of that list when the campaign is
+    -- sent to it and the ones without (0), to all subscribers. Opt-in campaigns are exempt.
+    SELECT * FROM JSONB_TO_RECORDSET($4::JSONB) AS c(list_id INT, max INT, period FLOAT)
+    WHERE (SELECT type FROM camps) != 'optin'
+),
 subs AS (
     SELECT DISTINCT ON(subscribers.id) id AS uniq_id, subscribers.* FROM subscriber_lists
     INNER JOIN campLists ON (
@@ -582,11 +778,375 @@ subs AS (
         END)
     )
     WHERE subscriber_lists.status != 'unsubscribed' AND
-    id > (SELECT last_subscriber_id FROM camps) AND
-    id <= (SELECT max_subscriber_id FROM camps)
+    id > $2 AND id <= $3 AND
+    -- Skip subscribers of the campaign's exclusion lists.
+    NOT EXISTS (
+        SELECT 1 FROM subscriber_lists ex
+        INNER JOIN campaign_exclude_lists cel ON (cel.list_id = ex.list_id)
+        WHERE cel.campaign_id = $1 AND ex.subscriber_id = subscribers.id AND ex.status != 'unsubscribed'
+    ) AND
+    -- Skip subscribers who have already been sent the campaign.
+    NOT EXISTS (
+        SELECT 1 FROM campaign_deliveries d
+        WHERE d.campaign_id = $1 AND d.subscriber_id = subscribers.id AND d.status = 'sent'
+    )
     ORDER BY subscribers.id
+),
+capped AS (
+    SELECT subs.id FROM subs
+    WHERE EXISTS (
+        SELECT 1 FROM caps
+        WHERE (caps.list_id = 0 OR EXISTS (
+            SELECT 1 FROM subscriber_lists sl
+            WHERE sl.subscriber_id = subs.id AND sl.list_id = caps.list_id
+                AND sl.list_id = ANY(SELECT list_id FROM campLists) AND sl.status != 'unsubscribed'
+        ))
+        AND (
+            SELECT COUNT(*) FROM campaign_deliveries d
+            WHERE d.subscriber_id = subs.id AND d.campaign_id != $1 AND d.status = 'sent'
+                AND d.updated_at > NOW() - caps.period * INTERVAL '1 second'
+        ) >= caps.max
+    )
+),
+skipped AS (
+    -- Record the capped subscribers as skipped so that they're reported.
+    INSERT INTO campaign_deliveries (campaign_id, subscriber_id, status, messenger, error)
+        SELECT $1, id, 'skipped', (SELECT messenger FROM camps), 'frequency cap' FROM capped
+        WHERE NOT $5::BOOLEAN
+    ON CONFLICT (campaign_id, subscriber_id) DO UPDATE SET
+        status=EXCLUDED.status, error=EXCLUDED.error, retry_at=NULL, updated_at=NOW()
+)
+SELECT * FROM subs WHERE NOT(id = ANY(SELECT id FROM capped)) ORDER BY id;
+
+-- name: count-campaign-recipients
+-- Returns the total number of subscribers of a campaign and the max subscriber ID across its
+-- lists. These are the same counts that next-campaigns sets on a campaign when it starts,
+-- without the side effect. It's used for dry runs.
+WITH camp AS (
+    SELECT id, type FROM campaigns WHERE id = $1
+),
+campLists AS (
+    SELECT id AS list_id, optin FROM lists
+    INNER JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
+    WHERE campaign_lists.campaign_id = $1
+)
+SELECT COUNT(DISTINCT(subscriber_lists.subscriber_id)) AS to_send,
+    COALESCE(MAX(subscriber_lists.subscriber_id), 0) AS max_subscriber_id
+FROM camp
+LEFT JOIN campLists ON TRUE
+LEFT JOIN subscriber_lists ON (
+    subscriber_lists.list_id = campLists.list_id AND
+    (CASE
+        WHEN camp.type = 'optin' THEN subscriber_lists.status = 'unconfirmed' AND campLists.optin = 'double'
+        WHEN campLists.optin = 'double' THEN subscriber_lists.status = 'confirmed'
+        ELSE subscriber_lists.status != 'unsubscribed'
+    END) AND
+    NOT EXISTS (
+        SELECT 1 FROM subscriber_lists ex
+        INNER JOIN campaign_exclude_lists cel ON (cel.list_id = ex.list_id)
+        WHERE cel.campaign_id = $1 AND ex.subscriber_id = subscriber_lists.subscriber_id
+        AND ex.status != 'unsubscribed'
+    )
+);
+
+-- name: upsert-campaign-dry-run
+INSERT INTO campaign_dry_runs (campaign_id, report) VALUES($1, $2)
+    ON CONFLICT (campaign_id) DO UPDATE SET report=$2, updated_at=NOW();
+
+-- name: get-campaign-dry-run
+SELECT report FROM campaign_dry_runs WHERE campaign_id = $1;
+
+-- name: upsert-push-subscription
+-- Records the web push subscription of a subscriber's browser. A browser's endpoint
+-- is moved to the subscriber who subscribed on it last. Only the last $6 subscriptions
+-- of a subscriber are kept.
+WITH sub AS (
+    SELECT id FROM subscribers WHERE uuid = $1
+),
+ins AS (
+    INSERT INTO push_subscriptions (subscriber_id, endpoint, p256dh, auth, user_agent)
+        VALUES((SELECT id FROM sub), $2, $3, $4, $5)
+        ON CONFLICT (endpoint) DO UPDATE
+        SET subscriber_id=EXCLUDED.subscriber_id, p256dh=$3, auth=$4, user_agent=$5, updated_at=NOW()
+        RETURNING id
+)
+DELETE FROM push_subscriptions WHERE subscriber_id = (SELECT id FROM sub)
+    AND id NOT IN (SELECT id FROM ins)
+    AND id NOT IN (
+        SELECT id FROM push_subscriptions WHERE subscriber_id = (SELECT id FROM sub)
+        ORDER BY updated_at DESC LIMIT $6 - 1
+    );
+
+-- name: get-push-subscriptions
+SELECT endpoint, p256dh, auth FROM push_subscriptions WHERE subscriber_id = $1 ORDER BY id;
+
+-- name: delete-push-subscription
+DELETE FROM push_subscriptions WHERE endpoint = $1;
+
+-- name: reclaim-campaign-lease
+-- Takes over an expired lease of a campaign (of a node that has crashed or stopped renewing it).
+-- The new node resumes from the last processed subscriber ID in the range.
+UPDATE campaign_leases SET node=$2, expires_at=NOW() + $3::FLOAT * INTERVAL '1 second', updated_at=NOW()
+WHERE id = (
+    SELECT campaign_leases.id FROM campaign_leases
+    INNER JOIN campaigns ON (campaigns.id = campaign_leases.campaign_id AND campaigns.status='running')
+    WHERE campaign_id=$1 AND expires_at < NOW()
+    ORDER BY campaign_leases.id LIMIT 1
+    FOR UPDATE OF campaign_leases SKIP LOCKED
+)
+RETURNING id, campaign_id, from_id, to_id, last_id, sent;
+
+-- name: create-campaign-lease
+-- Leases the next range of (at most $4) subscribers of a campaign to a node. The campaign's
+-- last_subscriber_id is the checkpoint upto which ranges have been leased. The campaign row
+-- is locked while a range is being carved out so that concurrent nodes never lease overlapping
+-- ranges. If another node holds the lock, no rows are returned and the node tries again later.
+WITH camp AS (
+    SELECT id, last_subscriber_id, max_subscriber_id FROM campaigns
+    WHERE id=$1 AND status='running' AND last_subscriber_id < max_subscriber_id
+    FOR UPDATE SKIP LOCKED
+),
+next AS (
+    SELECT COALESCE(MAX(subscriber_id), (SELECT max_subscriber_id FROM camp)) AS to_id FROM (
+        SELECT DISTINCT subscriber_id FROM subscriber_lists
+        WHERE list_id = ANY(SELECT list_id FROM campaign_lists WHERE campaign_id=$1)
+            AND subscriber_id > (SELECT last_subscriber_id FROM camp)
+            AND subscriber_id <= (SELECT max_subscriber_id FROM camp)
+        ORDER BY subscriber_id LIMIT $4
+    ) s
+),
+u AS (
+    UPDATE campaigns SET last_subscriber_id=(SELECT to_id FROM next)
+    WHERE id=(SELECT id FROM camp)
+)
+INSERT INTO campaign_leases (campaign_id, from_id, to_id, last_id, node, expires_at)
+    SELECT id, last_subscriber_id, (SELECT to_id FROM next), last_subscriber_id, $2, NOW() + $3::FLOAT * INTERVAL '1 second' FROM camp
+    RETURNING id, campaign_id, from_id, to_id, last_id, sent;
+
+-- name: renew-campaign-lease
+-- Heartbeat that extends a lease held by a node and records its progress.
+UPDATE campaign_leases SET expires_at=NOW() + $3::FLOAT * INTERVAL '1 second', last_id=$4, sent=$5, updated_at=NOW()
+WHERE id=$1 AND node=$2;
+
+-- name: complete-campaign-lease
+-- Deletes a fully processed lease and adds the messages sent in its range to the campaign's sent count.
+WITH l AS (
+    DELETE FROM campaign_leases WHERE id=$1 AND node=$2 RETURNING campaign_id
+)
+UPDATE campaigns SET sent=sent + $3, updated_at=NOW()
+WHERE id=(SELECT campaign_id FROM l);
+
+-- name: add-campaign-sent
+-- Adds deferred messages that have been sent after their leases were completed to the
+-- campaign's sent count.
+UPDATE campaigns SET sent=sent + $2, updated_at=NOW() WHERE id=$1;
+
+-- name: finish-campaign
+-- Marks a running campaign as finished only if all its subscriber ranges have been leased
+-- and processed, ie: there are no pending leases on other nodes, and there are no failed
+-- messages pending retry or deferred messages pending delivery.
+-- An A/B test campaign is only finished after its winner has been sent to the rest.
+UPDATE campaigns SET status='finished', updated_at=NOW()
+WHERE id=$1 AND status='running' AND last_subscriber_id >= max_subscriber_id
+    AND (ab_test_percent = 0 OR ab_winner_id IS NOT NULL)
+    AND NOT EXISTS (SELECT 1 FROM campaign_leases WHERE campaign_id=$1)
+    AND NOT EXISTS (
+        SELECT 1 FROM campaign_deliveries
+        WHERE campaign_id=$1 AND retry_at IS NOT NULL
+    );
+
+-- name: end-campaign-ab-test
+-- Ends the test phase of a running A/B test campaign once its variants have been sent to the
+-- test group, ie: under the same conditions as finish-campaign. The winner is picked after
+-- $2 seconds (the test window) and until then, the campaign is skipped by next-campaigns.
+UPDATE campaigns SET ab_test_ends_at=NOW() + $2::FLOAT * INTERVAL '1 second', updated_at=NOW()
+WHERE id=$1 AND status='running' AND last_subscriber_id >= max_subscriber_id
+    AND ab_test_percent > 0 AND ab_winner_id IS NULL AND ab_test_ends_at IS NULL
+    AND NOT EXISTS (SELECT 1 FROM campaign_leases WHERE campaign_id=$1)
+    AND NOT EXISTS (
+        SELECT 1 FROM campaign_deliveries
+        WHERE campaign_id=$1 AND retry_at IS NOT NULL
+    );
+
+-- name: pick-campaign-ab-winner
+-- Picks the variant of an A/B test campaign whose test window has passed with the highest
+-- rate of unique views or clicks (ab_test_metric) among the subscribers it was sent to as the
+-- winner. The campaign's lease checkpoint is reset so that its subscribers are processed again,
+-- this time, sending the winner to those outside the test group.
+WITH camp AS (
+    SELECT id, ab_test_metric FROM campaigns
+    WHERE id=$1 AND status='running' AND ab_test_percent > 0 AND ab_winner_id IS NULL
+        AND ab_test_ends_at IS NOT NULL AND NOW() >= ab_test_ends_at
+    FOR UPDATE
+),
+sent AS (
+    SELECT variant_id, COUNT(*) AS num FROM campaign_deliveries
+    WHERE campaign_id=$1 AND status='sent' AND variant_id IS NOT NULL
+    GROUP BY variant_id
+),
+metric AS (
+    SELECT d.variant_id, COUNT(DISTINCT m.subscriber_id) AS num FROM (
+        SELECT subscriber_id FROM campaign_views
+            WHERE campaign_id=$1 AND (SELECT ab_test_metric FROM camp) = 'views'
+        UNION ALL
+        SELECT subscriber_id FROM link_clicks
+            WHERE campaign_id=$1 AND (SELECT ab_test_metric FROM camp) = 'clicks'
+    ) m
+    INNER JOIN campaign_deliveries d ON (d.campaign_id=$1 AND d.subscriber_id = m.subscriber_id)
+    WHERE d.variant_id IS NOT NULL
+    GROUP BY d.variant_id
+),
+winner AS (
+    SELECT cv.id FROM campaign_variants cv
+    LEFT JOIN sent s ON (s.variant_id = cv.id)
+    LEFT JOIN metric m ON (m.variant_id = cv.id)
+    WHERE cv.campaign_id = (SELECT id FROM camp)
+    ORDER BY COALESCE(m.num, 0)::FLOAT / GREATEST(COALESCE(s.num, 0), 1) DESC, cv.id
+    LIMIT 1
+)
+UPDATE campaigns SET ab_winner_id=(SELECT id FROM winner), last_subscriber_id=0, updated_at=NOW()
+WHERE id=(SELECT id FROM camp) AND EXISTS (SELECT 1 FROM winner)
+RETURNING ab_winner_id;
+
+-- name: next-campaign-retries
+-- Claims (at most $2) failed messages of a campaign that are due to be retried and deferred
+-- messages that are due to be sent, and returns their subscribers. A claimed message's retry_at is pushed ahead by $3 seconds so that other
+-- nodes don't pick it up while it's being sent. If the node goes down before recording the
+-- outcome, the message becomes due again once that passes. Messages of subscribers who have
+-- since been blocklisted, have unsubscribed from the campaign's lists, are on its exclusion
+-- lists, or have crossed a frequency cap ($4, as in next-campaign-subscribers) are skipped.
+WITH camps AS (
+    SELECT type FROM campaigns WHERE id=$1
+),
+caps AS (
+    SELECT * FROM JSONB_TO_RECORDSET($4::JSONB) AS c(list_id INT, max INT, period FLOAT)
+    WHERE (SELECT type FROM camps) != 'optin'
+),
+due AS (
+    SELECT campaign_deliveries.id, campaign_deliveries.subscriber_id FROM campaign_deliveries
+    INNER JOIN campaigns ON (campaigns.id = campaign_deliveries.campaign_id AND campaigns.status='running')
+    WHERE campaign_id=$1 AND retry_at <= NOW()
+    ORDER BY retry_at LIMIT $2
+    FOR UPDATE OF campaign_deliveries SKIP LOCKED
+),
+eligible AS (
+    SELECT due.id FROM due
+    INNER JOIN subscribers ON (subscribers.id = due.subscriber_id AND subscribers.status != 'blocklisted')
+    WHERE EXISTS (
+        SELECT 1 FROM subscriber_lists sl
+        INNER JOIN campaign_lists cl ON (cl.list_id = sl.list_id)
+        WHERE cl.campaign_id = $1 AND sl.subscriber_id = due.subscriber_id AND sl.status != 'unsubscribed'
+    )
+    AND NOT EXISTS (
+        SELECT 1 FROM subscriber_lists ex
+        INNER JOIN campaign_exclude_lists cel ON (cel.list_id = ex.list_id)
+        WHERE cel.campaign_id = $1 AND ex.subscriber_id = due.subscriber_id AND ex.status != 'unsubscribed'
+    )
+    AND NOT EXISTS (
+        SELECT 1 FROM caps
+        WHERE (caps.list_id = 0 OR EXISTS (
+            SELECT 1 FROM subscriber_lists sl
+            INNER JOIN campaign_lists cl ON (cl.list_id = sl.list_id)
+            WHERE cl.campaign_id = $1 AND sl.subscriber_id = due.subscriber_id
+                AND sl.list_id = caps.list_id AND sl.status != 'unsubscribed'
+        ))
+        AND (
+            SELECT COUNT(*) FROM campaign_deliveries d
+            WHERE d.subscriber_id = due.subscriber_id AND d.campaign_id != $1 AND d.status = 'sent'
+                AND d.updated_at > NOW() - caps.period * INTERVAL '1 second'
+        ) >= caps.max
+    )
+),
+skipped AS (
+    UPDATE campaign_deliveries SET status='skipped', error='subscriber is no longer eligible', retry_at=NULL, updated_at=NOW()
+    WHERE id = ANY(SELECT id FROM due) AND NOT(id = ANY(SELECT id FROM eligible))
+),
+d AS (
+    UPDATE campaign_deliveries SET retry_at=NOW() + $3::FLOAT * INTERVAL '1 second', updated_at=NOW()
+    WHERE id = ANY(SELECT id FROM eligible)
+    RETURNING subscriber_id, attempts
+)
+SELECT subscribers.*, d.attempts FROM d
+    INNER JOIN subscribers ON (subscribers.id = d.subscriber_id)
+    ORDER BY subscribers.id;
+
+-- name: record-campaign-deliveries
+-- Records the delivery attempts of campaign messages in bulk. Every outcome (sent, failed)
+-- of a message is an attempt. Failed messages with a retry delay ($7, seconds) are scheduled
+-- to be retried after it and deferred messages are scheduled to be sent after it.
+INSERT INTO campaign_deliveries (campaign_id, subscriber_id, status, messenger, message_id, error, attempts, retry_at, variant_id)
+    SELECT d.campaign_id, d.subscriber_id, d.status, d.messenger, d.message_id, d.error,
+        (CASE WHEN d.status IN ('sent', 'failed') THEN 1 ELSE 0 END),
+        (CASE WHEN d.status IN ('failed', 'deferred') AND d.retry_after > 0 THEN NOW() + d.retry_after * INTERVAL '1 second' ELSE NULL END),
+        campaign_variants.id
+    FROM UNNEST($1::INT[], $2::INT[], $3::delivery_status[], $4::TEXT[], $5::TEXT[], $6::TEXT[], $7::FLOAT[], $8::INT[])
+        AS d(campaign_id, subscriber_id, status, messenger, message_id, error, retry_after, variant_id)
+    -- Subscribers (and A/B test variants) may have been deleted in the meantime.
+    INNER JOIN subscribers ON (subscribers.id = d.subscriber_id)
+    LEFT JOIN campaign_variants ON (campaign_variants.id = d.variant_id)
+    ON CONFLICT (campaign_id, subscriber_id) DO UPDATE SET
+        status=EXCLUDED.status,
+        messenger=EXCLUDED.messenger,
+        message_id=EXCLUDED.message_id,
+        error=EXCLUDED.error,
+        attempts=campaign_deliveries.attempts + EXCLUDED.attempts,
+        retry_at=EXCLUDED.retry_at,
+        variant_id=COALESCE(EXCLUDED.variant_id, campaign_deliveries.variant_id),
+        updated_at=NOW();
+
+-- name: get-subscriber-send-hours
+-- Returns the hour of the day (UTC) at which each of the given subscribers has historically
+-- engaged (viewed or clicked) the most with campaigns. Subscribers without any engagement
+-- are omitted. last_email_open/clicked default to a time before the subscriber was created.
+WITH engagement AS (
+    SELECT subscriber_id, created_at FROM campaign_views WHERE subscriber_id = ANY($1::INT[])
+    UNION ALL
+    SELECT subscriber_id, created_at FROM link_clicks WHERE subscriber_id = ANY($1::INT[])
+    UNION ALL
+    SELECT id, last_email_open FROM subscribers WHERE id = ANY($1::INT[]) AND last_email_open > created_at
+    UNION ALL
+    SELECT id, last_email_clicked FROM subscribers WHERE id = ANY($1::INT[]) AND last_email_clicked > created_at
 )
-SELECT * FROM subs;
+SELECT DISTINCT ON (subscriber_id) subscriber_id, EXTRACT(HOUR FROM created_at AT TIME ZONE 'UTC')::INT AS hour
+    FROM engagement
+    GROUP BY subscriber_id, hour
+    ORDER BY subscriber_id, COUNT(*) DESC, hour;
+
+-- name: get-campaign-median-send-hour
+-- Returns the median of the hours of the day (UTC) at which the subscribers of a campaign's
+-- lists have historically engaged the most with campaigns, or -1 if there's no engagement.
+WITH subs AS (
+    SELECT DISTINCT subscriber_id AS id FROM subscriber_lists
+    WHERE list_id = ANY(SELECT list_id FROM campaign_lists WHERE campaign_id=$1)
+),
+engagement AS (
+    SELECT v.subscriber_id, v.created_at FROM campaign_views v INNER JOIN subs ON (subs.id = v.subscriber_id)
+    UNION ALL
+    SELECT c.subscriber_id, c.created_at FROM link_clicks c INNER JOIN subs ON (subs.id = c.subscriber_id)
+),
+hours AS (
+    SELECT DISTINCT ON (subscriber_id) subscriber_id, EXTRACT(HOUR FROM created_at AT TIME ZONE 'UTC')::INT AS hour
+        FROM engagement
+        GROUP BY subscriber_id, hour
+        ORDER BY subscriber_id, COUNT(*) DESC, hour
+)
+SELECT COALESCE(PERCENTILE_DISC(0.5) WITHIN GROUP (ORDER BY hour), -1) FROM hours;
+
+-- name: get-subscriber-list-timezones
+-- Returns the default timezone of each of the given subscribers ($2) from the lists of a
+-- campaign ($1) that they're subscribed to. If there are several, the oldest list's is picked.
+SELECT DISTINCT ON (sl.subscriber_id) sl.subscriber_id, lists.timezone
+    FROM subscriber_lists sl
+    INNER JOIN lists ON (lists.id = sl.list_id)
+    WHERE sl.subscriber_id = ANY($2::INT[]) AND sl.status != 'unsubscribed' AND lists.timezone != ''
+    AND sl.list_id = ANY(SELECT list_id FROM campaign_lists WHERE campaign_id = $1)
+    ORDER BY sl.subscriber_id, lists.id;
+
+-- name: get-messenger-sent
+-- Returns the number of campaign messages sent or queued to be sent by a messenger since $2.
+-- It's used to enforce the daily caps of messengers that are warming up.
+SELECT COUNT(*) FROM campaign_deliveries
+    WHERE messenger = $1 AND status IN ('queued', 'sent') AND updated_at >= $2;
 
 -- name: get-one-campaign-subscriber
 SELECT * FROM subscribers
@@ -610,17 +1170,91 @@ WITH camp AS (
         tags=$10::VARCHAR(100)[],
         messenger=$11,
         template_id=$12,
+        ab_test_percent=$14,
+        ab_test_metric=$15::ab_test_metric,
+        ab_test_window=$16,
+        optimize_send_time=$17,
+        local_send_time=$23,
+        recurrence=$19,
+        recurrence_tz=$20,
+        -- Reset the feed's checkpoint if the feed changes.
+        feed_last_item_at=(CASE WHEN feed_url != $21 THEN NULL ELSE feed_last_item_at END),
+        feed_url=$21,
         updated_at=NOW()
     WHERE id = $1 RETURNING id
 ),
 d AS (
     -- Reset list relationships
     DELETE FROM campaign_lists WHERE campaign_id = $1 AND NOT(list_id = ANY($13))
+),
+exd AS (
+    -- Reset exclusion lists if they're given (NULL retains the existing ones).
+    DELETE FROM campaign_exclude_lists WHERE campaign_id = $1 AND $18::INT[] IS NOT NULL AND NOT(list_id = ANY($18::INT[]))
+),
+exLists AS (
+    INSERT INTO campaign_exclude_lists (campaign_id, list_id, list_name)
+        (SELECT $1 as campaign_id, id, name FROM lists WHERE id=ANY($18::INT[]))
+        ON CONFLICT (campaign_id, list_id) DO UPDATE SET list_name = EXCLUDED.list_name
+),
+medd AS (
+    -- Reset attachments if they're given (NULL retains the existing ones).
+    DELETE FROM campaign_media WHERE campaign_id = $1 AND $22::INT[] IS NOT NULL
+        AND (media_id IS NULL OR NOT(media_id = ANY($22::INT[])))
+),
+med AS (
+    INSERT INTO campaign_media (campaign_id, media_id, filename)
+        (SELECT $1 as campaign_id, id, filename FROM media WHERE id=ANY($22::INT[]))
+        ON CONFLICT (campaign_id, media_id) DO UPDATE SET filename = EXCLUDED.filename
 )
 INSERT INTO campaign_lists (campaign_id, list_id, list_name)
     (SELECT $1 as campaign_id, id, name FROM lists WHERE id=ANY($13::INT[]))
     ON CONFLICT (campaign_id, list_id) DO UPDATE SET list_name = EXCLUDED.list_name;
 
+-- name: get-due-recurring-campaigns
+SELECT * FROM campaigns WHERE recurrence != '' AND status='scheduled' AND send_at <= NOW();
+
+-- name: claim-recurring-campaign-run
+-- Claims a run of a recurring campaign by moving its send_at ($2) to the next run ($3).
+-- If another node has already claimed the run, nothing is updated.
+UPDATE campaigns SET send_at=$3, last_run_at=NOW(), updated_at=NOW()
+    WHERE id=$1 AND status='scheduled' AND send_at=$2;
+
+-- name: create-recurring-campaign-run
+-- Clones a recurring campaign ($1) into a child campaign that's scheduled right away
+-- with its lists, exclusion lists, attachments, and A/B test variants. The feed items ($4) that are
+-- rendered into the child are recorded on the parent upto the latest one's date ($5).
+WITH parent AS (
+    UPDATE campaigns SET feed_last_item_at=COALESCE($5, feed_last_item_at)
+    WHERE id=$1 RETURNING *
+),
+camp AS (
+    INSERT INTO campaigns (uuid, type, name, subject, from_email, body, altbody, content_type, send_at, status,
+        tags, messenger, template_id, ab_test_percent, ab_test_metric, ab_test_window, optimize_send_time,
+        local_send_time, feed_items, parent_id)
+        SELECT $2, type, $3, subject, from_email, body, altbody, content_type, NOW(), 'scheduled',
+        tags, messenger, template_id, ab_test_percent, ab_test_metric, ab_test_window, optimize_send_time,
+        local_send_time, $4, id FROM parent
+        RETURNING id
+),
+vars AS (
+    INSERT INTO campaign_variants (campaign_id, name, subject, body, template_id)
+        SELECT (SELECT id FROM camp), name, subject, body, template_id FROM campaign_variants WHERE campaign_id=$1
+),
+exLists AS (
+    INSERT INTO campaign_exclude_lists (campaign_id, list_id, list_name)
+        SELECT (SELECT id FROM camp), list_id, list_name FROM campaign_exclude_lists
+        WHERE campaign_id=$1 AND list_id IS NOT NULL
+),
+med AS (
+    INSERT INTO campaign_media (campaign_id, media_id, filename)
+        SELECT (SELECT id FROM camp), media_id, filename FROM campaign_media
+        WHERE campaign_id=$1 AND media_id IS NOT NULL
+)
+INSERT INTO campaign_lists (campaign_id, list_id, list_name)
+    SELECT (SELECT id FROM camp), list_id, list_name FROM campaign_lists
+    WHERE campaign_id=$1 AND list_id IS NOT NULL
+    RETURNING (SELECT id FROM camp);
+
 -- name: update-campaign-counts
 UPDATE campaigns SET
     to_send=(CASE WHEN $2 != 0 THEN $2 ELSE to_send END),
@@ -629,18 +1263,19 @@ UPDATE campaigns SET
     updated_at=NOW()
 WHERE id=$1;
 
--- name: update-send-campaign-counts
-UPDATE campaigns SET
-    sent = sent + $2,
-    last_subscriber_id= $3,
-    updated_at=NOW()
-WHERE id=$1;
-
--- name: update-setting-campaign-counts
-UPDATE settings set value = (value::bigint + $1)::text::jsonb where key = 'emailsent.total';
+-- name: update-setting-credit-balances
+-- Adds the credits used by sent campaign messages to the totals of the credit balances,
+-- the messages sent on e-mail and other messengers ($1) to emailsent and the
+-- segments of the SMS sent on SMS messengers ($2) to smssent.
+UPDATE settings SET value = (value::BIGINT + (CASE WHEN key = 'smssent.total' THEN $2 ELSE $1 END))::TEXT::JSONB
+WHERE key IN ('emailsent.total', 'smssent.total');
 
 -- name: update-campaign-status
-UPDATE campaigns SET status=$2, updated_at=NOW() WHERE id = $1;
+UPDATE campaigns SET status=$2, pause_reason='', updated_at=NOW() WHERE id = $1;
+
+-- name: pause-campaign
+-- Pauses a campaign automatically (eg: on crossing the error threshold) recording the reason.
+UPDATE campaigns SET status='paused', pause_reason=$2, updated_at=NOW() WHERE id = $1;
 
 -- name: delete-campaign
 DELETE FROM campaigns WHERE id=$1;
@@ -713,6 +1348,120 @@ UPDATE campaigns SET template_id = (SELECT id FROM def) WHERE (SELECT id FROM tp
     RETURNING (SELECT id FROM tpl);
 
 
+-- transactional messages
+-- name: insert-tx-message
+INSERT INTO tx_messages (uuid, subscriber_id, template_id, email, subject, messenger, automation_step_id, status)
+    VALUES($1, $2, NULLIF($3, 0), $4, $5, $6, NULLIF($7, 0), $8::delivery_status);
+
+-- name: get-tx-message
+SELECT * FROM tx_messages WHERE uuid = $1;
+
+-- name: update-tx-message
+-- Records the outcome of the delivery of a transactional message.
+UPDATE tx_messages SET status=$2::delivery_status, message_id=$3, error=$4, updated_at=NOW()
+    WHERE uuid = $1;
+
+
+-- automations
+-- name: query-automations
+SELECT COUNT(*) OVER () AS total, automations.*,
+    (SELECT COUNT(*) FROM automation_subscribers s WHERE s.automation_id = automations.id AND s.status = 'active') AS active,
+    (SELECT COUNT(*) FROM automation_subscribers s WHERE s.automation_id = automations.id AND s.status = 'completed') AS completed,
+    (SELECT COUNT(*) FROM automation_subscribers s WHERE s.automation_id = automations.id AND s.status = 'exited') AS exited
+    FROM automations WHERE ($1 = 0 OR id = $1)
+    ORDER BY created_at DESC OFFSET $2 LIMIT (CASE WHEN $3 = 0 THEN NULL ELSE $3 END);
+
+-- name: get-automation-steps
+SELECT automation_steps.id, automation_id, position, COALESCE(template_id, 0) AS template_id, subject,
+    automation_steps.body, content_type, delay, condition,
+    COALESCE(templates.body, (SELECT body FROM templates WHERE is_default = true LIMIT 1)) AS template_body
+    FROM automation_steps
+    LEFT JOIN templates ON (templates.id = automation_steps.template_id)
+    WHERE automation_id = $1 ORDER BY position;
+
+-- name: get-automation-step-stats
+-- Returns the number of messages of every step of an automation by their delivery status
+-- and the number of subscribers waiting for the step.
+SELECT st.id,
+    COUNT(t.id) FILTER (WHERE t.status = 'queued') AS queued,
+    COUNT(t.id) FILTER (WHERE t.status = 'sent') AS sent,
+    COUNT(t.id) FILTER (WHERE t.status = 'failed') AS failed,
+    COUNT(t.id) FILTER (WHERE t.status = 'skipped') AS skipped,
+    (SELECT COUNT(*) FROM automation_subscribers s
+        WHERE s.automation_id = st.automation_id AND s.status = 'active' AND s.step = st.position) AS waiting
+    FROM automation_steps st
+    LEFT JOIN tx_messages t ON (t.automation_step_id = st.id)
+    WHERE st.automation_id = $1
+    GROUP BY st.id ORDER BY st.position;
+
+-- name: create-automation
+INSERT INTO automations (uuid, name, trigger, list_id, attribute, messenger, from_email, enabled)
+    VALUES($1, $2, $3::automation_trigger, NULLIF($4, 0), $5, $6, $7, $8) RETURNING id;
+
+-- name: update-automation
+UPDATE automations SET name=$2, trigger=$3::automation_trigger, list_id=NULLIF($4, 0), attribute=$5,
+    messenger=$6, from_email=$7, enabled=$8, updated_at=NOW()
+    WHERE id = $1;
+
+-- name: upsert-automation-steps
+-- Replaces the steps of an automation. Steps that already exist ($2 ID != 0) are
+-- updated in place so that their stats are retained. Positions are the array order.
+WITH v AS (
+    SELECT *, (ROW_NUMBER() OVER () - 1) AS position FROM UNNEST($2::INT[], $3::INT[], $4::TEXT[], $5::TEXT[],
+        $6::content_type[], $7::TEXT[], $8::automation_condition[])
+        AS v(id, template_id, subject, body, content_type, delay, condition)
+),
+d AS (
+    DELETE FROM automation_steps WHERE automation_id=$1 AND NOT(id = ANY($2::INT[]))
+),
+u AS (
+    UPDATE automation_steps SET position=v.position, template_id=NULLIF(v.template_id, 0), subject=v.subject,
+        body=v.body, content_type=v.content_type, delay=v.delay, condition=v.condition, updated_at=NOW()
+    FROM v WHERE automation_steps.id = v.id AND automation_steps.automation_id = $1
+)
+INSERT INTO automation_steps (automation_id, position, template_id, subject, body, content_type, delay, condition)
+    SELECT $1, position, NULLIF(template_id, 0), subject, body, content_type, delay, condition FROM v WHERE id = 0;
+
+-- name: delete-automation
+DELETE FROM automations WHERE id = $1;
+
+-- name: exit-automation-subscribers
+-- Exits the active subscribers of automations who have been blocklisted or who are no
+-- longer subscribed to the automation's list (or to any list if it doesn't have one).
+UPDATE automation_subscribers s SET status='exited',
+    exit_reason=(CASE WHEN sub.status = 'blocklisted' THEN 'blocklisted' ELSE 'unsubscribed' END),
+    updated_at=NOW()
+    FROM automations a, subscribers sub
+    WHERE s.status = 'active' AND a.id = s.automation_id AND sub.id = s.subscriber_id
+    AND (sub.status = 'blocklisted' OR NOT EXISTS (
+        SELECT 1 FROM subscriber_lists sl WHERE sl.subscriber_id = sub.id AND sl.status != 'unsubscribed'
+        AND (a.list_id IS NULL OR sl.list_id = a.list_id)
+    ));
+
+-- name: next-automation-subscribers
+-- Claims the subscribers of enabled automations whose next step is due. A claimed subscriber's
+-- next_at is pushed ahead by $2 seconds so that other nodes don't pick it up while it's being
+-- processed. If the node goes down, it becomes due again once that passes.
+WITH due AS (
+    SELECT s.id FROM automation_subscribers s
+    INNER JOIN automations a ON (a.id = s.automation_id AND a.enabled)
+    WHERE s.status = 'active' AND s.next_at <= NOW()
+    ORDER BY s.next_at LIMIT $1
+    FOR UPDATE OF s SKIP LOCKED
+),
+u AS (
+    UPDATE automation_subscribers SET next_at=NOW() + $2::FLOAT * INTERVAL '1 second', updated_at=NOW()
+    WHERE id = ANY(SELECT id FROM due)
+    RETURNING id, automation_id, subscriber_id, step, created_at
+)
+SELECT u.id AS state_id, u.automation_id, u.step, u.created_at AS entered_at, subscribers.*
+    FROM u INNER JOIN subscribers ON (subscribers.id = u.subscriber_id);
+
+-- name: update-automation-subscriber
+UPDATE automation_subscribers SET step=$2, next_at=$3, status=$4::automation_sub_status, updated_at=NOW()
+    WHERE id = $1;
+
+
 -- media
 -- name: insert-media
 INSERT INTO media (uuid, filename, thumb, provider, created_at) VALUES($1, $2, $3, $4, NOW());
@@ -723,6 +1472,15 @@ SELECT * FROM media WHERE provider=$1 ORDER BY created_at DESC;
 -- name: delete-media
 DELETE FROM media WHERE id=$1 RETURNING filename;
 
+-- name: get-media-by-ids
+SELECT * FROM media WHERE id = ANY($1::INT[]);
+
+-- name: get-campaign-media
+-- Returns the media attached to a campaign that still exist.
+SELECT media.* FROM campaign_media
+    INNER JOIN media ON (media.id = campaign_media.media_id)
+    WHERE campaign_media.campaign_id = $1 ORDER BY media.id;
+
 -- links
 -- name: create-link
 INSERT INTO links (uuid, url) VALUES($1, $2) ON CONFLICT (url) DO UPDATE SET url=EXCLUDED.url RETURNING uuid;
@@ -863,6 +1621,11 @@ WITH campLists AS (
     SELECT id AS list_id, campaign_id, optin FROM lists
     INNER JOIN campaign_lists ON (campaign_lists.list_id = lists.id)
     WHERE campaign_lists.campaign_id = $1
+),
+credit AS (
+    -- SMS campaigns are checked against the SMS credit balance.
+    SELECT (CASE WHEN messenger LIKE 'sms\_%' THEN 'smssent' ELSE 'emailsent' END) AS key
+    FROM campaigns WHERE id = $1
 )
 SELECT COALESCE(COUNT(id), 0) as to_send, s.value as total_send, s1.value as email_allowed
 FROM subscribers
@@ -877,7 +1640,7 @@ FROM subscribers
      settings s1
 WHERE subscriber_lists.list_id IN (campLists.list_id)
   AND subscribers.status='enabled'
-  and s.key = 'emailsent.total'  and s1.key = 'emailsent.allowed' group by s.value, s1.value ;
+  and s.key = (SELECT key FROM credit) || '.total'  and s1.key = (SELECT key FROM credit) || '.allowed' group by s.value, s1.value ;
 
 -- name: get-platform-stats
 SELECT JSON_BUILD_OBJECT('subscribers', JSON_BUILD_OBJECT(
@@ -5,6 +5,11 @@ DROP TYPE IF EXISTS subscription_status CASCADE; CREATE TYPE subscription_status
 DROP TYPE IF EXISTS campaign_status CASCADE; CREATE TYPE campaign_status AS ENUM ('draft', 'running', 'scheduled', 'paused', 'cancelled', 'finished');
 DROP TYPE IF EXISTS campaign_type CASCADE; CREATE TYPE campaign_type AS ENUM ('regular', 'optin');
 DROP TYPE IF EXISTS content_type CASCADE; CREATE TYPE content_type AS ENUM ('richtext', 'html', 'plain', 'markdown');
+DROP TYPE IF EXISTS delivery_status CASCADE; CREATE TYPE delivery_status AS ENUM ('queued', 'deferred', 'sent', 'failed', 'skipped');
+DROP TYPE IF EXISTS ab_test_metric CASCADE; CREATE TYPE ab_test_metric AS ENUM ('views', 'clicks');
+DROP TYPE IF EXISTS automation_trigger CASCADE; CREATE TYPE automation_trigger AS ENUM ('subscriber_insert', 'optin_confirm', 'list_add', 'attribute_change');
+DROP TYPE IF EXISTS automation_condition CASCADE; CREATE TYPE automation_condition AS ENUM ('none', 'not_opened', 'not_clicked');
+DROP TYPE IF EXISTS automation_sub_status CASCADE; CREATE TYPE automation_sub_status AS ENUM ('active', 'completed', 'exited');
 
 -- subscribers
 DROP TABLE IF EXISTS subscribers CASCADE;
@@ -36,6 +41,9 @@ CREATE TABLE lists (
     optin           list_optin NOT NULL DEFAULT 'single',
     tags            VARCHAR(100)[],
 
+    -- Default timezone of the list's subscribers who don't have a timezone attribute.
+    timezone        TEXT NOT NULL DEFAULT '',
+
     created_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at      TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
@@ -74,6 +82,20 @@ DROP INDEX IF EXISTS idx_sub_lists_sub_id; CREATE INDEX idx_sub_lists_sub_id ON
 DROP INDEX IF EXISTS idx_sub_lists_list_id; CREATE INDEX idx_sub_lists_list_id ON subscriber_lists(list_id);
 DROP INDEX IF EXISTS idx_sub_lists_status; CREATE INDEX idx_sub_lists_status ON subscriber_lists(status);
 
+-- Web push subscriptions of the browsers of subscribers.
+DROP TABLE IF EXISTS push_subscriptions CASCADE;
+CREATE TABLE push_subscriptions (
+    id               SERIAL PRIMARY KEY,
+    subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    endpoint         TEXT NOT NULL UNIQUE,
+    p256dh           TEXT NOT NULL,
+    auth             TEXT NOT NULL,
+    user_agent       TEXT NOT NULL DEFAULT '',
+    created_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_push_subs_sub_id; CREATE INDEX idx_push_subs_sub_id ON push_subscriptions(subscriber_id);
+
 -- templates
 DROP TABLE IF EXISTS templates CASCADE;
 CREATE TABLE templates (
@@ -117,6 +139,39 @@ CREATE TABLE campaigns (
     max_subscriber_id  INT NOT NULL DEFAULT 0,
     last_subscriber_id INT NOT NULL DEFAULT 0,
 
+    -- Reason for the campaign having been automatically paused, eg: error threshold.
+    pause_reason     TEXT NOT NULL DEFAULT '',
+
+    -- A/B test. ab_test_percent% of the subscribers are sent one of the campaign_variants.
+    -- ab_test_window (duration) after that (ab_test_ends_at), the variant with the highest
+    -- rate of ab_test_metric is picked as the winner and sent to the rest of the subscribers.
+    ab_test_percent  INT NOT NULL DEFAULT 0,
+    ab_test_metric   ab_test_metric NOT NULL DEFAULT 'views',
+    ab_test_window   TEXT NOT NULL DEFAULT '4h',
+    ab_test_ends_at  TIMESTAMP WITH TIME ZONE NULL,
+    ab_winner_id     INTEGER NULL,
+
+    -- Hold the message to every subscriber until the hour of the day at which they've
+    -- historically engaged the most, within 24 hours of the campaign's start.
+    optimize_send_time BOOLEAN NOT NULL DEFAULT false,
+
+    -- Hold the message to every subscriber until a time of the day (HH:MM) in their timezone
+    -- (attribs.timezone or the list's default), within 24 hours of the campaign's start.
+    local_send_time    TEXT NOT NULL DEFAULT '',
+
+    -- Recurring campaigns. A campaign with a cron-like recurrence (in recurrence_tz) isn't
+    -- sent itself. Instead, on every run, it's cloned into a child campaign (parent_id) that's
+    -- sent to the same lists. If it has a feed_url, the RSS/Atom feed items published since
+    -- feed_last_item_at are rendered into the child (feed_items) and the run is skipped if
+    -- there are none.
+    recurrence         TEXT NOT NULL DEFAULT '',
+    recurrence_tz      TEXT NOT NULL DEFAULT 'UTC',
+    feed_url           TEXT NOT NULL DEFAULT '',
+    feed_last_item_at  TIMESTAMP WITH TIME ZONE NULL,
+    feed_items         JSONB NOT NULL DEFAULT '[]',
+    parent_id          INTEGER NULL REFERENCES campaigns(id) ON DELETE SET NULL,
+    last_run_at        TIMESTAMP WITH TIME ZONE NULL,
+
     started_at       TIMESTAMP WITH TIME ZONE,
     created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
     updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
@@ -135,6 +190,167 @@ CREATE UNIQUE INDEX ON campaign_lists (campaign_id, list_id);
 DROP INDEX IF EXISTS idx_camp_lists_camp_id; CREATE INDEX idx_camp_lists_camp_id ON campaign_lists(campaign_id);
 DROP INDEX IF EXISTS idx_camp_lists_list_id; CREATE INDEX idx_camp_lists_list_id ON campaign_lists(list_id);
 
+-- Lists whose subscribers are excluded from a campaign even if they're on its lists.
+DROP TABLE IF EXISTS campaign_exclude_lists CASCADE;
+CREATE TABLE campaign_exclude_lists (
+    campaign_id  INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    list_id      INTEGER NULL REFERENCES lists(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    list_name    TEXT NOT NULL DEFAULT ''
+);
+CREATE UNIQUE INDEX ON campaign_exclude_lists (campaign_id, list_id);
+DROP INDEX IF EXISTS idx_camp_excl_lists_list_id; CREATE INDEX idx_camp_excl_lists_list_id ON campaign_exclude_lists(list_id);
+
+DROP TABLE IF EXISTS campaign_leases CASCADE;
+CREATE TABLE campaign_leases (
+    id               BIGSERIAL PRIMARY KEY,
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+
+    -- The range of subscriber IDs (from_id, to_id] of a campaign leased to a node,
+    -- the last subscriber ID in the range that has been processed and the number
+    -- of messages sent in the range so far. When a node stops renewing a lease
+    -- (heartbeat), it expires and is picked up by another node from last_id.
+    from_id          INT NOT NULL,
+    to_id            INT NOT NULL,
+    last_id          INT NOT NULL,
+    sent             INT NOT NULL DEFAULT 0,
+
+    node             TEXT NOT NULL,
+    expires_at       TIMESTAMP WITH TIME ZONE NOT NULL,
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_camp_leases_camp_id; CREATE INDEX idx_camp_leases_camp_id ON campaign_leases(campaign_id, expires_at);
+
+DROP TABLE IF EXISTS campaign_variants CASCADE;
+CREATE TABLE campaign_variants (
+    id               SERIAL PRIMARY KEY,
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    name             TEXT NOT NULL,
+
+    -- Empty values (and deleted templates) fall back to the campaign's.
+    subject          TEXT NOT NULL DEFAULT '',
+    body             TEXT NOT NULL DEFAULT '',
+    template_id      INTEGER NULL REFERENCES templates(id) ON DELETE SET NULL,
+
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_camp_variants_camp_id; CREATE INDEX idx_camp_variants_camp_id ON campaign_variants(campaign_id);
+
+DROP TABLE IF EXISTS campaign_deliveries CASCADE;
+CREATE TABLE campaign_deliveries (
+    id               BIGSERIAL PRIMARY KEY,
+    campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+
+    -- The status of the last delivery attempt of the campaign to the subscriber
+    -- and the messenger and the provider's message ID or the error of the attempt.
+    status           delivery_status NOT NULL DEFAULT 'queued',
+    messenger        TEXT NOT NULL,
+    message_id       TEXT NOT NULL DEFAULT '',
+    error            TEXT NOT NULL DEFAULT '',
+    attempts         INT NOT NULL DEFAULT 0,
+
+    -- If a failed message is to be retried or a deferred message is to be sent,
+    -- the time after which it's due.
+    retry_at         TIMESTAMP WITH TIME ZONE NULL,
+
+    -- The A/B test variant of the campaign that was sent, if any.
+    variant_id       INTEGER NULL REFERENCES campaign_variants(id) ON DELETE SET NULL,
+
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_camp_deliveries; CREATE UNIQUE INDEX idx_camp_deliveries ON campaign_deliveries(campaign_id, subscriber_id);
+DROP INDEX IF EXISTS idx_camp_deliveries_status; CREATE INDEX idx_camp_deliveries_status ON campaign_deliveries(campaign_id, status);
+DROP INDEX IF EXISTS idx_camp_deliveries_sub_sent; CREATE INDEX idx_camp_deliveries_sub_sent ON campaign_deliveries(subscriber_id, updated_at) WHERE status = 'sent';
+DROP INDEX IF EXISTS idx_camp_deliveries_retry; CREATE INDEX idx_camp_deliveries_retry ON campaign_deliveries(campaign_id, retry_at) WHERE retry_at IS NOT NULL;
+DROP INDEX IF EXISTS idx_camp_deliveries_msgr; CREATE INDEX idx_camp_deliveries_msgr ON campaign_deliveries(messenger, updated_at) WHERE status IN ('queued', 'sent');
+
+-- automations
+DROP TABLE IF EXISTS automations CASCADE;
+CREATE TABLE automations (
+    id               SERIAL PRIMARY KEY,
+    uuid             uuid NOT NULL UNIQUE,
+    name             TEXT NOT NULL,
+    trigger          automation_trigger NOT NULL,
+
+    -- The list the trigger applies to (any list if it's null) and the attribute
+    -- whose change triggers an attribute_change automation (any attribute if it's empty).
+    list_id          INTEGER NULL REFERENCES lists(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    attribute        TEXT NOT NULL DEFAULT '',
+
+    messenger        TEXT NOT NULL,
+    from_email       TEXT NOT NULL DEFAULT '',
+    enabled          BOOLEAN NOT NULL DEFAULT false,
+
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+
+DROP TABLE IF EXISTS automation_steps CASCADE;
+CREATE TABLE automation_steps (
+    id               SERIAL PRIMARY KEY,
+    automation_id    INTEGER NOT NULL REFERENCES automations(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    position         INT NOT NULL,
+    template_id      INTEGER NULL REFERENCES templates(id) ON DELETE SET NULL,
+    subject          TEXT NOT NULL,
+    body             TEXT NOT NULL DEFAULT '',
+    content_type     content_type NOT NULL DEFAULT 'richtext',
+
+    -- Duration (eg: 72h) after the subscriber enters the automation after which the step is sent.
+    delay            TEXT NOT NULL DEFAULT '0s',
+    condition        automation_condition NOT NULL DEFAULT 'none',
+
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_auto_steps_auto_id; CREATE INDEX idx_auto_steps_auto_id ON automation_steps(automation_id, position);
+
+-- The progress of subscribers through automations. A subscriber enters an automation only once.
+DROP TABLE IF EXISTS automation_subscribers CASCADE;
+CREATE TABLE automation_subscribers (
+    id               BIGSERIAL PRIMARY KEY,
+    automation_id    INTEGER NOT NULL REFERENCES automations(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    subscriber_id    INTEGER NOT NULL REFERENCES subscribers(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    status           automation_sub_status NOT NULL DEFAULT 'active',
+
+    -- The position of the next step and the time at which it's due.
+    step             INT NOT NULL DEFAULT 0,
+    next_at          TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    exit_reason      TEXT NOT NULL DEFAULT '',
+
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_auto_subs; CREATE UNIQUE INDEX idx_auto_subs ON automation_subscribers(automation_id, subscriber_id);
+DROP INDEX IF EXISTS idx_auto_subs_next_at; CREATE INDEX idx_auto_subs_next_at ON automation_subscribers(next_at) WHERE status = 'active';
+
+-- transactional messages
+DROP TABLE IF EXISTS tx_messages CASCADE;
+CREATE TABLE tx_messages (
+    id               BIGSERIAL PRIMARY KEY,
+    uuid             uuid NOT NULL UNIQUE,
+    subscriber_id    INTEGER NULL REFERENCES subscribers(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    template_id      INTEGER NULL REFERENCES templates(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    email            TEXT NOT NULL,
+    subject          TEXT NOT NULL,
+
+    -- The status of the delivery and the provider's message ID or the error.
+    status           delivery_status NOT NULL DEFAULT 'queued',
+    messenger        TEXT NOT NULL,
+    message_id       TEXT NOT NULL DEFAULT '',
+    error            TEXT NOT NULL DEFAULT '',
+
+    -- The automation step that sent the message, if any.
+    automation_step_id INTEGER NULL REFERENCES automation_steps(id) ON DELETE SET NULL,
+
+    created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW(),
+    updated_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
+);
+DROP INDEX IF EXISTS idx_tx_messages_step_id; CREATE INDEX idx_tx_messages_step_id ON tx_messages(automation_step_id);
+DROP INDEX IF EXISTS idx_tx_messages_sub_id; CREATE INDEX idx_tx_messages_sub_id ON tx_messages(subscriber_id);
+
 DROP TABLE IF EXISTS campaign_views CASCADE;
 CREATE TABLE campaign_views (
     campaign_id      INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
@@ -157,6 +373,27 @@ CREATE TABLE media (
     created_at       TIMESTAMP WITH TIME ZONE DEFAULT NOW()
 );
 
+-- Media attached to campaigns. Media may be deleted, so media_id is nullable
+-- and a copy of the filename is maintained here.
+DROP TABLE IF EXISTS campaign_media CASCADE;
+CREATE TABLE campaign_media (
+    campaign_id  INTEGER NOT NULL REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    media_id     INTEGER NULL REFERENCES media(id) ON DELETE SET NULL ON UPDATE CASCADE,
+    filename     TEXT NOT NULL DEFAULT ''
+);
+DROP INDEX IF EXISTS idx_camp_media_id; CREATE UNIQUE INDEX idx_camp_media_id ON campaign_media (campaign_id, media_id);
+DROP INDEX IF EXISTS idx_camp_media_camp_id; CREATE INDEX idx_camp_media_camp_id ON campaign_media(campaign_id);
+
+-- The report of the last dry run of a campaign, where its messages are rendered
+-- but not sent.
+DROP TABLE IF EXISTS campaign_dry_runs CASCADE;
+CREATE TABLE campaign_dry_runs (
+    campaign_id  INTEGER NOT NULL UNIQUE REFERENCES campaigns(id) ON DELETE CASCADE ON UPDATE CASCADE,
+    report       JSONB NOT NULL DEFAULT '{}',
+    created_at   TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW(),
+    updated_at   TIMESTAMP WITH TIME ZONE NOT NULL DEFAULT NOW()
+);
+
 -- links
 DROP TABLE IF EXISTS links CASCADE;
 CREATE TABLE links (
@@ -193,9 +430,23 @@ INSERT INTO settings (key, value) VALUES
     ('app.from_email', '"listmonk <noreply@listmonk.yoursite.com>"'),
     ('app.logo_url', '"http://localhost:9000/public/static/logo.png"'),
     ('app.concurrency', '10'),
+    ('app.render_concurrency', '0'),
     ('app.message_rate', '10'),
+    ('app.message_burst', '10'),
+    ('app.messenger_rates', '[]'),
+    ('app.messenger_groups', '[]'),
+    ('app.domain_throttles', '[]'),
+    ('app.warmups', '[]'),
     ('app.batch_size', '1000'),
     ('app.max_send_errors', '1000'),
+    ('app.max_error_rate', '0'),
+    ('app.error_rate_window', '1000'),
+    ('app.error_rate_per_class', 'false'),
+    ('app.requeue_on_error', 'false'),
+    ('app.max_attempts', '3'),
+    ('app.retry_backoff', '{"throttling": "1m", "transient": "30s", "other": "1m", "auth": "0s", "recipient_rejected": "0s"}'),
+    ('app.frequency_caps', '[]'),
+    ('app.attachments_max_size', '10'),
     ('app.message_sliding_window', 'false'),
     ('app.message_sliding_window_duration', '"1h"'),
     ('app.message_sliding_window_rate', '10000'),
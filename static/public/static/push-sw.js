@@ -0,0 +1,26 @@
+/*
+  listmonk web push service worker. It shows the notifications of campaigns
+  and opens their URL on clicking them. See push.js.
+*/
+self.addEventListener('push', function (e) {
+  if (!e.data) {
+    return;
+  }
+
+  var n = e.data.json();
+  e.waitUntil(self.registration.showNotification(n.title, {
+    body: n.body,
+    icon: n.icon,
+    tag: n.tag,
+    data: { url: n.url },
+  }));
+});
+
+self.addEventListener('notificationclick', function (e) {
+  e.notification.close();
+
+  var url = e.notification.data && e.notification.data.url;
+  if (url) {
+    e.waitUntil(clients.openWindow(url));
+  }
+});
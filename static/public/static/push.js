@@ -0,0 +1,110 @@
+/*
+  listmonk web push subscription snippet.
+
+  <script src="https://listmonk.example.com/public/static/push.js"></script>
+  <script>
+    listmonkPush.subscribe('subscriber-uuid').catch(console.error);
+  </script>
+
+  Browsers only register service workers from the page's own origin. On sites
+  other than listmonk's, copy /public/static/push-sw.js to the site and pass
+  its path in the serviceWorker option (default: /listmonk-push-sw.js).
+*/
+(function (window) {
+  'use strict';
+
+  var script = document.currentScript;
+  var defaultRoot = script ? script.src.replace(/\/public\/static\/push\.js.*$/, '') : '';
+
+  function b64ToBytes(s) {
+    var pad = '='.repeat((4 - (s.length % 4)) % 4);
+    var raw = window.atob((s + pad).replace(/-/g, '+').replace(/_/g, '/'));
+    var out = new Uint8Array(raw.length);
+    for (var i = 0; i < raw.length; i++) {
+      out[i] = raw.charCodeAt(i);
+    }
+    return out;
+  }
+
+  function api(url, body) {
+    var opt = body ? {
+      method: 'POST',
+      headers: { 'Content-Type': 'application/json' },
+      body: JSON.stringify(body),
+    } : {};
+
+    return fetch(url, opt).then(function (r) {
+      return r.json().then(function (j) {
+        if (!r.ok) {
+          throw new Error(j.message || r.statusText);
+        }
+        return j.data;
+      });
+    });
+  }
+
+  function options(opt) {
+    opt = opt || {};
+    var root = (opt.rootURL || defaultRoot).replace(/\/$/, '');
+    var sw = opt.serviceWorker;
+    if (!sw) {
+      sw = new URL(root).origin === window.location.origin
+        ? root + '/public/static/push-sw.js' : '/listmonk-push-sw.js';
+    }
+    return { root: root, sw: sw };
+  }
+
+  function supported() {
+    return 'serviceWorker' in navigator && 'PushManager' in window && 'Notification' in window;
+  }
+
+  // subscribe asks for the permission to show notifications, subscribes the
+  // browser to push notifications, and records the subscription against
+  // the subscriber.
+  function subscribe(subUUID, opt) {
+    if (!supported()) {
+      return Promise.reject(new Error('Push notifications are not supported by the browser.'));
+    }
+    var o = options(opt);
+
+    return Promise.all([
+      api(o.root + '/push/key'),
+      navigator.serviceWorker.register(o.sw),
+      Notification.requestPermission(),
+    ]).then(function (res) {
+      if (res[2] !== 'granted') {
+        throw new Error('Notification permission was not granted.');
+      }
+
+      return res[1].pushManager.getSubscription().then(function (sub) {
+        return sub || res[1].pushManager.subscribe({
+          userVisibleOnly: true,
+          applicationServerKey: b64ToBytes(res[0].public_key),
+        });
+      });
+    }).then(function (sub) {
+      return api(o.root + '/push/subscribe/' + encodeURIComponent(subUUID), sub.toJSON());
+    });
+  }
+
+  // unsubscribe unsubscribes the browser from push notifications.
+  function unsubscribe(opt) {
+    if (!supported()) {
+      return Promise.resolve(false);
+    }
+    var o = options(opt);
+
+    return navigator.serviceWorker.getRegistration(o.sw).then(function (reg) {
+      return reg ? reg.pushManager.getSubscription() : null;
+    }).then(function (sub) {
+      if (!sub) {
+        return false;
+      }
+      return api(o.root + '/push/unsubscribe', { endpoint: sub.endpoint }).then(function () {
+        return sub.unsubscribe();
+      });
+    });
+  }
+
+  window.listmonkPush = { subscribe: subscribe, unsubscribe: unsubscribe, supported: supported };
+}(window));